@@ -9,6 +9,8 @@ import (
 	"os"
 
 	"github.com/spf13/cobra"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/version"
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -19,6 +21,7 @@ var rootCmd = &cobra.Command{
 
 sprayproxy server --backend <backend-server> --backend <another-backend>
 `,
+	Version: version.Version + " (" + version.Commit + ")",
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
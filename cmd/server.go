@@ -6,17 +6,20 @@ SPDX-License-Identifier: Apache-2.0
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
 	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
 	"github.com/redhat-appstudio/sprayproxy/pkg/server"
+	"github.com/redhat-appstudio/sprayproxy/pkg/tracing"
 )
 
 // serverCmd represents the server command
@@ -37,12 +40,29 @@ sprayproxy server --backend http://localhost:8081 --backend http://localhost:808
 		insecureSkipTLSVerify := viper.GetBool("insecure-skip-tls-verify")
 		crtFile := viper.GetString("metrics-cert")
 		keyFile := viper.GetString("metrics-key")
+		shutdownTimeout := viper.GetDuration("shutdown-timeout")
+		// metrics set by the proxy on startup, such as the number of backends, need them initialized first
+		metrics.InitMetrics(nil)
 		server, err := server.NewServer(host, port, insecureSkipTLSVerify, backends...)
 		if err != nil {
 			return err
 		}
-
-		metrics.InitMetrics(nil)
+		// installed here rather than by the proxy, which other commands and tests create too
+		metrics.SetOldestForwardAgeFunc(server.OldestForwardAge)
+
+		if tracing.Enabled() {
+			shutdownTracing, err := tracing.Init(context.Background())
+			if err != nil {
+				return err
+			}
+			defer func() {
+				ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+				defer cancel()
+				if err := shutdownTracing(ctx); err != nil {
+					fmt.Printf("error shutting down tracing: %v", err)
+				}
+			}()
+		}
 		stopCh := setupSignalHandler()
 		metricsSrvr, err := metrics.NewServer(host, metricsPort, crtFile, keyFile)
 		if err != nil {
@@ -51,6 +71,15 @@ sprayproxy server --backend http://localhost:8081 --backend http://localhost:808
 		go func() {
 			metricsSrvr.RunServer(stopCh)
 		}()
+		go server.RunHealthChecks(stopCh)
+		go func() {
+			<-stopCh
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				fmt.Printf("error shutting down proxy server: %v", err)
+			}
+		}()
 		err = server.Run()
 		metricsSrvr.StopServer()
 		return err
@@ -79,6 +108,7 @@ func init() {
 	viper.SetDefault("metrics-port", metrics.MetricsPort)
 	viper.SetDefault("metrics-cert", "")
 	viper.SetDefault("metrics-key", "")
+	viper.SetDefault("shutdown-timeout", 30*time.Second)
 
 	viper.SetEnvPrefix("SPRAYPROXY_SERVER")
 	// Replace "-" with underscores "_"
@@ -91,6 +121,7 @@ func init() {
 	serverCmd.Flags().Int("metrics-port", metrics.MetricsPort, fmt.Sprintf("Port for the prometheus metrics endpoint.  Defaults to %d", metrics.MetricsPort))
 	serverCmd.Flags().String("metrics-cert", "", "TLS Certificate file for the prometheus metric endpoint.  Defaults to empty, meaning TLS will not be used")
 	serverCmd.Flags().String("metrics-key", "", "TLS Key file for the prometheus metric endpoint.  Defaults to empty, meaning TLS will not be used")
+	serverCmd.Flags().Duration("shutdown-timeout", 30*time.Second, "Time to wait for in-flight forwards to complete on shutdown. Defaults to 30s")
 
 	viper.BindPFlags(serverCmd.Flags())
 
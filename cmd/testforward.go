@@ -0,0 +1,85 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/proxy"
+)
+
+// testForwardCmd represents the test-forward command
+var testForwardCmd = &cobra.Command{
+	Use:   "test-forward",
+	Short: "Forward a sample payload to a backend",
+	Long: `Forward a sample webhook payload to a backend, as the proxy would, to check it can be reached
+and accepts the requests before registering it. The proxy configuration is read from the environment.
+
+sprayproxy test-forward --backend https://backend.example.com --payload payload.json --event push
+	`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		backend, _ := cmd.Flags().GetString("backend")
+		payloadFile, _ := cmd.Flags().GetString("payload")
+		event, _ := cmd.Flags().GetString("event")
+		headerFlags, _ := cmd.Flags().GetStringArray("header")
+		insecureSkipTLSVerify, _ := cmd.Flags().GetBool("insecure-skip-tls-verify")
+		if backend == "" {
+			return fmt.Errorf("missing --backend")
+		}
+		payload := []byte("{}")
+		if payloadFile != "" {
+			data, err := os.ReadFile(payloadFile)
+			if err != nil {
+				return fmt.Errorf("failed to read payload: %w", err)
+			}
+			payload = data
+		}
+		headers := http.Header{}
+		headers.Set("Content-Type", "application/json")
+		headers.Set("X-GitHub-Event", event)
+		for _, header := range headerFlags {
+			name, value, ok := strings.Cut(header, ":")
+			if !ok || strings.TrimSpace(name) == "" {
+				return fmt.Errorf("invalid header %q, expected Name:Value", header)
+			}
+			headers.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+
+		// only the forwarding configuration matters: the configured backends are neither probed nor loaded
+		// from a file, and no dead letter store is started
+		sprayProxy, err := proxy.NewSprayProxyWithOptions(insecureSkipTLSVerify, zap.NewNop(), nil,
+			proxy.WithStartupCheck(false, false), proxy.WithBackendsFile(""), proxy.WithDeadLetterFile(""))
+		if err != nil {
+			return err
+		}
+		result, err := sprayProxy.TestForward(backend, payload, headers)
+		if result == nil {
+			return err
+		}
+		if err != nil {
+			fmt.Printf("%s: failed after %s: %s\n", result.Host, result.Latency, result.Error)
+			return err
+		}
+		fmt.Printf("%s: %d %s in %s\n", result.Host, result.Status, http.StatusText(result.Status), result.Latency)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(testForwardCmd)
+
+	testForwardCmd.Flags().String("backend", "", "Backend to forward the payload to.")
+	testForwardCmd.Flags().String("payload", "", "File holding the payload to forward. Defaults to an empty JSON object")
+	testForwardCmd.Flags().String("event", "ping", "GitHub event of the payload. Defaults to ping")
+	testForwardCmd.Flags().StringArray("header", []string{}, "Header to send, of the form Name:Value. Use more than once.")
+	testForwardCmd.Flags().Bool("insecure-skip-tls-verify", false, "Skip TLS verification of the backend. INSECURE - do not use in production.")
+}
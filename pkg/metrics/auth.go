@@ -0,0 +1,30 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+)
+
+// BasicAuth protects the handler with HTTP basic auth, using the credentials set by the
+// SPRAYPROXY_METRICS_USERNAME and SPRAYPROXY_METRICS_PASSWORD env vars. Requests without valid
+// credentials are rejected with 401 Unauthorized. The handler is returned as is when no credentials are set.
+func BasicAuth(handler http.Handler) http.Handler {
+	username := os.Getenv("SPRAYPROXY_METRICS_USERNAME")
+	password := os.Getenv("SPRAYPROXY_METRICS_PASSWORD")
+	if username == "" && password == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		// both are compared in constant time, so neither is leaked via timing attacks
+		validUser := subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1
+		validPass := subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+		if !ok || !validUser || !validPass {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBasicAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	request := func(handler http.Handler, username, password string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if username != "" || password != "" {
+			r.SetBasicAuth(username, password)
+		}
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// open when no credentials are configured
+	if code := request(BasicAuth(ok), "", ""); code != http.StatusOK {
+		t.Errorf("expected status code %d without credentials configured, got %d", http.StatusOK, code)
+	}
+
+	t.Setenv("SPRAYPROXY_METRICS_USERNAME", "prometheus")
+	t.Setenv("SPRAYPROXY_METRICS_PASSWORD", "s3cret")
+	handler := BasicAuth(ok)
+	for _, tc := range []struct {
+		username string
+		password string
+		expected int
+	}{
+		{"prometheus", "s3cret", http.StatusOK},
+		{"prometheus", "wrong", http.StatusUnauthorized},
+		{"other", "s3cret", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+	} {
+		if code := request(handler, tc.username, tc.password); code != tc.expected {
+			t.Errorf("%q:%q: expected status code %d, got %d", tc.username, tc.password, tc.expected, code)
+		}
+	}
+}
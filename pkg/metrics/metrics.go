@@ -1,8 +1,16 @@
 package metrics
 
 import (
-	"github.com/prometheus/client_golang/prometheus"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/version"
 )
 
 const (
@@ -16,8 +24,57 @@ const (
 	forwarded                 = "htp" + separator + "forwarded"
 	forwardedRequestsName     = subsystem + separator + forwarded + separator + requestsTotal
 	responseTime              = "http" + separator + "response" + separator + "time"
+	forwardedResponses        = "http" + separator + "forwarded" + separator + "responses"
+	forwardedResponsesName    = subsystem + separator + forwardedResponses + separator + "total"
 	forwardedResponseTimeName = subsystem + separator + responseTime + separator + "duration_seconds"
+	forwardedRetries          = "http" + separator + "forwarded" + separator + "retries"
+	forwardedRetriesName      = subsystem + separator + forwardedRetries + separator + "total"
+	forwardedErrors           = "http" + separator + "forwarded" + separator + "errors"
+	forwardedErrorsName       = subsystem + separator + forwardedErrors + separator + "total"
+	forwardedFailures         = "http" + separator + "forwarded" + separator + "failures"
+	forwardedFailuresName     = subsystem + separator + forwardedFailures + separator + "total"
+	forwardedRedirects        = "http" + separator + "forwarded" + separator + "redirects"
+	forwardedRedirectsName    = subsystem + separator + forwardedRedirects + separator + "total"
+	backendHealthyName        = subsystem + separator + "backend" + separator + "healthy"
+	backendInFlightName       = subsystem + separator + "backend" + separator + "in_flight" + separator + "forwards"
+	asyncFailed               = "http" + separator + "async" + separator + "failed"
+	asyncFailedRequestsName   = subsystem + separator + asyncFailed + separator + requestsTotal
+	circuitOpen               = "http" + separator + "circuit" + separator + "open"
+	circuitOpenName           = subsystem + separator + circuitOpen + separator + requestsTotal
+	failover                  = "http" + separator + "failover"
+	failoverRequestsName      = subsystem + separator + failover + separator + requestsTotal
+	throttled                 = "http" + separator + "throttled"
+	throttledRequestsName     = subsystem + separator + throttled + separator + requestsTotal
+	sampled                   = "http" + separator + "sampled"
+	sampledRequestsName       = subsystem + separator + sampled + separator + requestsTotal
+	deduplicated              = "http" + separator + "deduplicated"
+	deduplicatedRequestsName  = subsystem + separator + deduplicated + separator + requestsTotal
+	coalesced                 = "http" + separator + "coalesced"
+	coalescedRequestsName     = subsystem + separator + coalesced + separator + requestsTotal
+	noBackends                = "http" + separator + "no" + separator + "backends"
+	noBackendsRequestsName    = subsystem + separator + noBackends + separator + requestsTotal
+	notFound                  = "http" + separator + "not" + separator + "found"
+	notFoundRequestsName      = subsystem + separator + notFound + separator + requestsTotal
+	paused                    = "http" + separator + "paused"
+	pausedRequestsName        = subsystem + separator + paused + separator + requestsTotal
+	tooLarge                  = "http" + separator + "too" + separator + "large"
+	tooLargeRequestsName      = subsystem + separator + tooLarge + separator + requestsTotal
+	bodyReadErrors            = "http" + separator + "body" + separator + "read" + separator + "errors"
+	bodyReadErrorsName        = subsystem + separator + bodyReadErrors + separator + "total"
+	inboundRequestSizeName    = subsystem + separator + inbound + separator + "request_size_bytes"
+	rateLimited               = "http" + separator + "rate" + separator + "limited"
+	rateLimitedRequestsName   = subsystem + separator + rateLimited + separator + requestsTotal
+	buildInfoName             = subsystem + separator + "build_info"
+	backendsName              = subsystem + separator + "backends"
+	inFlightRequestsName      = subsystem + separator + "in_flight" + separator + "requests"
+	oldestForwardAgeName      = subsystem + separator + "oldest_in_flight_forward_age_seconds"
+	shuttingDownName          = subsystem + separator + "shutting_down"
+	pausedName                = subsystem + separator + "paused"
+	persistFailuresName       = backendsName + separator + "persist" + separator + "failures" + separator + "total"
 	hostLabel                 = "host"
+	decisionLabel             = "decision"
+	codeLabel                 = "code"
+	classLabel                = "class"
 
 	MetricsPort = 6000
 )
@@ -27,7 +84,41 @@ var (
 	lock              = sync.Mutex{}
 	inboundRequests   prometheus.Counter
 	forwardedRequests *prometheus.CounterVec
-	responseTimes     prometheus.Histogram
+	forwardedResps    *prometheus.CounterVec
+	responseTimes     *prometheus.HistogramVec
+	forwardedRetryReq *prometheus.CounterVec
+	forwardedErrorReq *prometheus.CounterVec
+	forwardedFailReq  *prometheus.CounterVec
+	forwardedRedirReq *prometheus.CounterVec
+	backendHealthy    *prometheus.GaugeVec
+	backendInFlight   *prometheus.GaugeVec
+	asyncFailedReq    prometheus.Counter
+	circuitOpenReq    *prometheus.CounterVec
+	failoverReq       *prometheus.CounterVec
+	throttledReq      *prometheus.CounterVec
+	sampledReq        *prometheus.CounterVec
+	deduplicatedReq   prometheus.Counter
+	coalescedReq      prometheus.Counter
+	noBackendsReq     prometheus.Counter
+	notFoundReq       prometheus.Counter
+	pausedReq         prometheus.Counter
+	tooLargeReq       prometheus.Counter
+	bodyReadErrorsReq prometheus.Counter
+	inboundSizes      prometheus.Histogram
+	rateLimitedReq    prometheus.Counter
+	buildInfo         *prometheus.GaugeVec
+	backends          prometheus.Gauge
+	inFlightRequests  prometheus.Gauge
+	oldestForwardAge  prometheus.GaugeFunc
+	shuttingDown      prometheus.Gauge
+	pausedState       prometheus.Gauge
+	persistFailures   prometheus.Counter
+	// collectors holds everything registered by the last InitMetrics call
+	collectors []prometheus.Collector
+
+	// ageLock guards forwardAge, which computes the age of the oldest forward in flight on scrape
+	ageLock    sync.Mutex
+	forwardAge func() time.Duration
 )
 
 func InitMetrics(registry *prometheus.Registry) {
@@ -54,17 +145,180 @@ func createMetrics() []prometheus.Collector {
 		Help: "Counts forwarded attempts to backend server(s).",
 	},
 		[]string{hostLabel})
-	responseTimes = prometheus.NewHistogram(prometheus.HistogramOpts{
-		Name: forwardedResponseTimeName,
-		Help: "Forwarded request duration in seconds.",
-		// Create buckets of 0.005, 0.05, 0.5, 5, and +Infinity
-		Buckets: prometheus.ExponentialBuckets(0.005, 10, 4),
+	forwardedResps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: forwardedResponsesName,
+		Help: "Counts forwarded attempts to backend server(s) by outcome, either the status code class or error.",
+	},
+		[]string{hostLabel, codeLabel})
+	responseTimes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    forwardedResponseTimeName,
+		Help:    "Forwarded request duration in seconds.",
+		Buckets: latencyBuckets(),
+	},
+		[]string{hostLabel})
+	forwardedRetryReq = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: forwardedRetriesName,
+		Help: "Counts retried forwarding attempts to backend server(s).",
+	},
+		[]string{hostLabel})
+	forwardedErrorReq = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: forwardedErrorsName,
+		Help: "Counts forwarded attempts to backend server(s) failing with a connection error or a 5xx status code.",
+	},
+		[]string{hostLabel})
+	forwardedFailReq = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: forwardedFailuresName,
+		Help: "Counts forwarded attempts to backend server(s) failing without a response, by error class: timeout, connection_refused, dns or other.",
+	},
+		[]string{hostLabel, classLabel})
+	forwardedRedirReq = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: forwardedRedirectsName,
+		Help: "Counts forwarded requests answered with a redirect by backend server(s), a sign of misconfigured backends.",
+	},
+		[]string{hostLabel})
+	backendHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: backendHealthyName,
+		Help: "Health of backend server(s) as determined by health checks, 1 if healthy and 0 otherwise.",
+	},
+		[]string{hostLabel})
+	backendInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: backendInFlightName,
+		Help: "Number of forwards in flight to backend server(s), without those waiting for the concurrency limit of their backend.",
+	},
+		[]string{hostLabel})
+	asyncFailedReq = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: asyncFailedRequestsName,
+		Help: "Counts incoming requests which failed to be forwarded asynchronously to at least one backend.",
+	})
+	circuitOpenReq = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: circuitOpenName,
+		Help: "Counts forwards to backend server(s) short-circuited because their circuit breaker is open.",
+	},
+		[]string{hostLabel})
+	failoverReq = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: failoverRequestsName,
+		Help: "Counts forwards to backup backend server(s) because the forward to the backend before them failed, by failed backend.",
+	},
+		[]string{hostLabel})
+	throttledReq = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: throttledRequestsName,
+		Help: "Counts forwards to backend server(s) dropped because their minimum interval left no turn within the forwarding timeout.",
+	},
+		[]string{hostLabel})
+	sampledReq = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: sampledRequestsName,
+		Help: "Counts sampling decisions for weighted backend server(s), either forwarded or sampled_out.",
+	},
+		[]string{hostLabel, decisionLabel})
+	deduplicatedReq = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: deduplicatedRequestsName,
+		Help: "Counts incoming requests not forwarded because their delivery was recently forwarded already.",
+	})
+	coalescedReq = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: coalescedRequestsName,
+		Help: "Counts incoming requests answered with the results of the forward of the same delivery in progress.",
+	})
+	noBackendsReq = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: noBackendsRequestsName,
+		Help: "Counts incoming requests rejected because no backends were configured.",
+	})
+	notFoundReq = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: notFoundRequestsName,
+		Help: "Counts incoming requests to paths the proxy does not handle.",
+	})
+	pausedReq = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: pausedRequestsName,
+		Help: "Counts incoming requests acknowledged without being forwarded because forwarding was paused.",
+	})
+	tooLargeReq = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: tooLargeRequestsName,
+		Help: "Counts incoming requests rejected before forwarding because their body was too large.",
+	})
+	bodyReadErrorsReq = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: bodyReadErrorsName,
+		Help: "Counts incoming requests whose body could not be read, such as when the client disconnected or was too slow.",
+	})
+	inboundSizes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: inboundRequestSizeName,
+		Help: "Inbound request body size in bytes, including rejected bodies.",
+		// 1KB to 64MB, covering the 25MB GitHub payload limit
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 9),
 	})
-	return []prometheus.Collector{
+	rateLimitedReq = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: rateLimitedRequestsName,
+		Help: "Counts incoming requests rejected because their source exceeded the rate limit.",
+	})
+	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: buildInfoName,
+		Help: "Always 1, labeled with the version, commit and Go version the proxy was built with.",
+	}, []string{"version", "commit", "goversion"})
+	info := version.Get()
+	buildInfo.With(prometheus.Labels{"version": info.Version, "commit": info.Commit, "goversion": info.GoVersion}).Set(1)
+	backends = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: backendsName,
+		Help: "Number of backend server(s) requests are forwarded to, registered or supplied by a provider.",
+	})
+	inFlightRequests = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: inFlightRequestsName,
+		Help: "Number of inbound requests being forwarded, including asynchronous forwards, to observe draining on shutdown.",
+	})
+	oldestForwardAge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: oldestForwardAgeName,
+		Help: "Age of the oldest forward in flight to backend server(s), 0 if there is none, to spot stuck forwards.",
+	}, func() float64 {
+		ageLock.Lock()
+		defer ageLock.Unlock()
+		if forwardAge == nil {
+			return 0
+		}
+		return forwardAge().Seconds()
+	})
+	shuttingDown = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: shuttingDownName,
+		Help: "1 once the proxy is shutting down, waiting for the in-flight requests to complete, 0 otherwise.",
+	})
+	pausedState = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: pausedName,
+		Help: "1 while forwarding is paused, 0 otherwise.",
+	})
+	persistFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: persistFailuresName,
+		Help: "Counts failures to save the backends to the backends file, the backends being kept in memory only.",
+	})
+	collectors = []prometheus.Collector{
 		inboundRequests,
 		forwardedRequests,
+		forwardedResps,
 		responseTimes,
+		forwardedRetryReq,
+		forwardedErrorReq,
+		forwardedFailReq,
+		forwardedRedirReq,
+		backendHealthy,
+		backendInFlight,
+		asyncFailedReq,
+		circuitOpenReq,
+		failoverReq,
+		throttledReq,
+		sampledReq,
+		deduplicatedReq,
+		coalescedReq,
+		noBackendsReq,
+		notFoundReq,
+		pausedReq,
+		tooLargeReq,
+		bodyReadErrorsReq,
+		inboundSizes,
+		rateLimitedReq,
+		buildInfo,
+		backends,
+		inFlightRequests,
+		oldestForwardAge,
+		shuttingDown,
+		pausedState,
+		persistFailures,
 	}
+	return collectors
 }
 
 func IncInboundCount() {
@@ -79,8 +333,230 @@ func IncForwardedCount(hostname string) {
 	}
 }
 
-func AddForwardedResponseTime(seconds float64) {
+// IncForwardedResponseCount counts the outcome of a forwarded attempt by the class of its status code,
+// like 2xx or 5xx, with a status of 0 for attempts failing with an error instead of a response.
+func IncForwardedResponseCount(hostname string, status int) {
+	if forwardedResps != nil {
+		forwardedResps.With(prometheus.Labels{hostLabel: hostname, codeLabel: statusClass(status)}).Inc()
+	}
+}
+
+// statusClass returns the class of the status code, or error for a status of 0.
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "error"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+func AddForwardedResponseTime(hostname string, seconds float64) {
 	if responseTimes != nil {
-		responseTimes.Observe(seconds)
+		responseTimes.With(prometheus.Labels{hostLabel: hostname}).Observe(seconds)
 	}
 }
+
+func ObserveInboundRequestSize(bytes int64) {
+	if inboundSizes != nil {
+		inboundSizes.Observe(float64(bytes))
+	}
+}
+
+// defaultLatencyBuckets cover forwarding durations from 10ms to 30s, above which the forwarding timeout
+// is usually reached
+var defaultLatencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// latencyBuckets returns the buckets of the response time histogram, in seconds, which can be overriden
+// by a comma separated list in SPRAYPROXY_LATENCY_BUCKETS env var.
+func latencyBuckets() []float64 {
+	value := os.Getenv("SPRAYPROXY_LATENCY_BUCKETS")
+	if value == "" {
+		return defaultLatencyBuckets
+	}
+	buckets := []float64{}
+	for _, bucket := range strings.Split(value, ",") {
+		seconds, err := strconv.ParseFloat(strings.TrimSpace(bucket), 64)
+		if err != nil || seconds <= 0 {
+			return defaultLatencyBuckets
+		}
+		buckets = append(buckets, seconds)
+	}
+	sort.Float64s(buckets)
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] == buckets[i-1] {
+			return defaultLatencyBuckets
+		}
+	}
+	return buckets
+}
+
+func IncForwardRetryCount(hostname string) {
+	if forwardedRetryReq != nil {
+		forwardedRetryReq.With(prometheus.Labels{hostLabel: hostname}).Inc()
+	}
+}
+
+func IncForwardErrorCount(hostname string) {
+	if forwardedErrorReq != nil {
+		forwardedErrorReq.With(prometheus.Labels{hostLabel: hostname}).Inc()
+	}
+}
+
+func IncForwardFailureCount(hostname, class string) {
+	if forwardedFailReq != nil {
+		forwardedFailReq.With(prometheus.Labels{hostLabel: hostname, classLabel: class}).Inc()
+	}
+}
+
+func IncForwardRedirectCount(hostname string) {
+	if forwardedRedirReq != nil {
+		forwardedRedirReq.With(prometheus.Labels{hostLabel: hostname}).Inc()
+	}
+}
+
+func SetBackendHealthy(hostname string, healthy bool) {
+	if backendHealthy != nil {
+		value := float64(0)
+		if healthy {
+			value = 1
+		}
+		backendHealthy.With(prometheus.Labels{hostLabel: hostname}).Set(value)
+	}
+}
+
+func IncAsyncFailedCount() {
+	if asyncFailedReq != nil {
+		asyncFailedReq.Inc()
+	}
+}
+
+func IncCircuitOpenCount(hostname string) {
+	if circuitOpenReq != nil {
+		circuitOpenReq.With(prometheus.Labels{hostLabel: hostname}).Inc()
+	}
+}
+
+func IncFailoverCount(hostname string) {
+	if failoverReq != nil {
+		failoverReq.With(prometheus.Labels{hostLabel: hostname}).Inc()
+	}
+}
+
+func IncThrottledCount(hostname string) {
+	if throttledReq != nil {
+		throttledReq.With(prometheus.Labels{hostLabel: hostname}).Inc()
+	}
+}
+
+func IncSampledCount(hostname string, forwarded bool) {
+	if sampledReq != nil {
+		decision := "sampled_out"
+		if forwarded {
+			decision = "forwarded"
+		}
+		sampledReq.With(prometheus.Labels{hostLabel: hostname, decisionLabel: decision}).Inc()
+	}
+}
+
+func IncDeduplicatedCount() {
+	if deduplicatedReq != nil {
+		deduplicatedReq.Inc()
+	}
+}
+
+func IncNoBackendsCount() {
+	if noBackendsReq != nil {
+		noBackendsReq.Inc()
+	}
+}
+
+func IncNotFoundCount() {
+	if notFoundReq != nil {
+		notFoundReq.Inc()
+	}
+}
+
+func IncPausedCount() {
+	if pausedReq != nil {
+		pausedReq.Inc()
+	}
+}
+
+func IncTooLargeCount() {
+	if tooLargeReq != nil {
+		tooLargeReq.Inc()
+	}
+}
+
+func IncBodyReadErrorCount() {
+	if bodyReadErrorsReq != nil {
+		bodyReadErrorsReq.Inc()
+	}
+}
+
+func IncRateLimitedCount() {
+	if rateLimitedReq != nil {
+		rateLimitedReq.Inc()
+	}
+}
+
+func SetBackendCount(count int) {
+	if backends != nil {
+		backends.Set(float64(count))
+	}
+}
+
+func IncPersistFailureCount() {
+	if persistFailures != nil {
+		persistFailures.Inc()
+	}
+}
+
+func IncInFlightCount(hostname string) {
+	if backendInFlight != nil {
+		backendInFlight.With(prometheus.Labels{hostLabel: hostname}).Inc()
+	}
+}
+
+func DecInFlightCount(hostname string) {
+	if backendInFlight != nil {
+		backendInFlight.With(prometheus.Labels{hostLabel: hostname}).Dec()
+	}
+}
+
+func SetInFlightRequestCount(count int) {
+	if inFlightRequests != nil {
+		inFlightRequests.Set(float64(count))
+	}
+}
+
+func SetShuttingDown(down bool) {
+	if shuttingDown != nil {
+		value := float64(0)
+		if down {
+			value = 1
+		}
+		shuttingDown.Set(value)
+	}
+}
+
+func SetPaused(paused bool) {
+	if pausedState != nil {
+		value := float64(0)
+		if paused {
+			value = 1
+		}
+		pausedState.Set(value)
+	}
+}
+
+func IncCoalescedCount() {
+	if coalescedReq != nil {
+		coalescedReq.Inc()
+	}
+}
+
+func SetOldestForwardAgeFunc(age func() time.Duration) {
+	ageLock.Lock()
+	defer ageLock.Unlock()
+	forwardAge = age
+}
@@ -3,6 +3,7 @@ package metrics
 import (
 	"bytes"
 	"net/http"
+	"runtime"
 	"strings"
 	"testing"
 
@@ -30,6 +31,9 @@ func TestMetrics(t *testing.T) {
 		expected     []string
 		githubs      int
 		forwards     int
+		retries      int
+		unhealthy    bool
+		backends     int
 		responseTime float64
 	}{
 		{
@@ -39,13 +43,28 @@ func TestMetrics(t *testing.T) {
 				inboundRequestsName + ` 1`,
 				`# TYPE ` + forwardedRequestsName + ` counter`,
 				forwardedRequestsName + `{host="host1"} 2`,
+				`# TYPE ` + forwardedResponsesName + ` counter`,
+				forwardedResponsesName + `{code="2xx",host="host1"} 2`,
+				forwardedResponsesName + `{code="error",host="host1"} 1`,
 				`# TYPE ` + forwardedResponseTimeName + ` histogram`,
-				forwardedResponseTimeName + `_sum 50`,
-				forwardedResponseTimeName + `_count 1`,
-				forwardedResponseTimeName + `_bucket`,
+				forwardedResponseTimeName + `_sum{host="host1"} 50`,
+				forwardedResponseTimeName + `_count{host="host1"} 1`,
+				forwardedResponseTimeName + `_bucket{host="host1",le="30"} 0`,
+				`# TYPE ` + forwardedRetriesName + ` counter`,
+				forwardedRetriesName + `{host="host1"} 1`,
+				`# TYPE ` + forwardedErrorsName + ` counter`,
+				forwardedErrorsName + `{host="host1"} 1`,
+				`# TYPE ` + forwardedFailuresName + ` counter`,
+				forwardedFailuresName + `{class="timeout",host="host1"} 1`,
+				`# TYPE ` + forwardedRedirectsName + ` counter`,
+				forwardedRedirectsName + `{host="host1"} 1`,
+				`# TYPE ` + backendHealthyName + ` gauge`,
+				backendHealthyName + `{host="host1"} 0`,
 			},
 			githubs:      1,
 			forwards:     2,
+			retries:      1,
+			unhealthy:    true,
 			responseTime: float64(50),
 		},
 		{
@@ -54,11 +73,15 @@ func TestMetrics(t *testing.T) {
 				`# TYPE ` + inboundRequestsName + ` counter`,
 				inboundRequestsName + ` 2`,
 				// no forwarded requests since it is a vector and we will not set any
-				`# TYPE ` + forwardedResponseTimeName + ` histogram`,
-				forwardedResponseTimeName + `_sum 0`,
-				forwardedResponseTimeName + `_count 0`,
-				forwardedResponseTimeName + `_bucket`,
+				`# TYPE ` + asyncFailedRequestsName + ` counter`,
+				asyncFailedRequestsName + ` 0`,
+				// no response time either, the histogram is a vector too
+				`# TYPE ` + buildInfoName + ` gauge`,
+				buildInfoName + `{commit="unknown",goversion="` + runtime.Version() + `",version="dev"} 1`,
+				`# TYPE ` + backendsName + ` gauge`,
+				backendsName + ` 3`,
 			},
+			backends:     3,
 			githubs:      2,
 			forwards:     0,
 			responseTime: float64(0),
@@ -72,9 +95,23 @@ func TestMetrics(t *testing.T) {
 		}
 		for i := 0; i < test.forwards; i += 1 {
 			IncForwardedCount("host1")
+			IncForwardedResponseCount("host1", http.StatusOK)
+		}
+		for i := 0; i < test.retries; i += 1 {
+			IncForwardRetryCount("host1")
+			IncForwardErrorCount("host1")
+			IncForwardedResponseCount("host1", 0)
+			IncForwardFailureCount("host1", "timeout")
+			IncForwardRedirectCount("host1")
+		}
+		if test.unhealthy {
+			SetBackendHealthy("host1", false)
+		}
+		if test.backends > 0 {
+			SetBackendCount(test.backends)
 		}
 		if test.responseTime > 0 {
-			AddForwardedResponseTime(test.responseTime)
+			AddForwardedResponseTime("host1", test.responseTime)
 		}
 
 		h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{ErrorHandling: promhttp.PanicOnError})
@@ -91,3 +128,41 @@ func TestMetrics(t *testing.T) {
 
 	}
 }
+
+func TestStatusClass(t *testing.T) {
+	for status, expected := range map[int]string{
+		0:                              "error",
+		http.StatusOK:                  "2xx",
+		http.StatusFound:               "3xx",
+		http.StatusNotFound:            "4xx",
+		http.StatusInternalServerError: "5xx",
+	} {
+		if got := statusClass(status); got != expected {
+			t.Errorf("status %d: expected class %s, got %s", status, expected, got)
+		}
+	}
+}
+
+func TestLatencyBuckets(t *testing.T) {
+	for value, expected := range map[string][]float64{
+		"":          defaultLatencyBuckets,
+		"0.1, 1,10": {0.1, 1, 10},
+		"5,0.5":     {0.5, 5},
+		"0.1,fast":  defaultLatencyBuckets,
+		"0,1":       defaultLatencyBuckets,
+		"1,1":       defaultLatencyBuckets,
+	} {
+		t.Setenv("SPRAYPROXY_LATENCY_BUCKETS", value)
+		got := latencyBuckets()
+		if len(got) != len(expected) {
+			t.Errorf("%q: expected buckets %v, got %v", value, expected, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != expected[i] {
+				t.Errorf("%q: expected buckets %v, got %v", value, expected, got)
+				break
+			}
+		}
+	}
+}
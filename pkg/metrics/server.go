@@ -26,7 +26,7 @@ func NewServer(host string, port int, crt, key string) (*MetricsServer, error) {
 
 	bindAddr := fmt.Sprintf("%s:%d", host, port)
 	router := http.NewServeMux()
-	router.Handle("/metrics", promhttp.Handler())
+	router.Handle("/metrics", BasicAuth(promhttp.Handler()))
 	ms := &MetricsServer{
 		host:    host,
 		port:    port,
@@ -200,14 +200,8 @@ func TestMetricQueries(t *testing.T) {
 			forwards: 0,
 		},
 	} {
-		if inboundRequests != nil {
-			prometheus.Unregister(inboundRequests)
-		}
-		if forwardedRequests != nil {
-			prometheus.Unregister(forwardedRequests)
-		}
-		if responseTimes != nil {
-			prometheus.Unregister(responseTimes)
+		for _, c := range collectors {
+			prometheus.Unregister(c)
 		}
 		initCalled = false
 		InitMetrics(nil)
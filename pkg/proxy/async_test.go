@@ -0,0 +1,68 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestHandleProxyAsync(t *testing.T) {
+	release := make(chan struct{})
+	received := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+		body, _ := io.ReadAll(req.Body)
+		received <- string(body)
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	t.Setenv("SPRAYPROXY_ASYNC", "true")
+	proxy, err := NewSprayProxy(false, zap.NewNop(), backend.URL, down.URL)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	reqCtx, cancel := context.WithCancel(context.Background())
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello")).WithContext(reqCtx)
+	proxy.HandleProxy(ctx)
+	// the request context is canceled once the handler returns, which must not abort the forwards
+	cancel()
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d even if a backend is down, got %d", http.StatusOK, w.Code)
+	}
+	if w.Body.String() != "accepted" {
+		t.Errorf("expected response %q, got %q", "accepted", w.Body.String())
+	}
+
+	close(release)
+	select {
+	case body := <-received:
+		if body != "hello" {
+			t.Errorf("expected backend to receive %q, got %q", "hello", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected backend to receive the request")
+	}
+	// shutdown waits for asynchronous forwards too
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	if err := proxy.Shutdown(shutdownCtx); err != nil {
+		t.Errorf("unexpected shutdown error: %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// The actions recorded in the audit log.
+const (
+	auditActionRegister   = "register"
+	auditActionUpdate     = "update"
+	auditActionUnregister = "unregister"
+	auditActionReload     = "reload"
+	auditActionSet        = "set"
+)
+
+// The callers recorded in the audit log. Admin tokens are not named, so callers are only told apart by
+// whether they presented one.
+const (
+	auditCallerAdminToken = "admin-token"
+	auditCallerAnonymous  = "anonymous"
+)
+
+// newAuditLogger returns the logger of the audit entries when no audit logger is set, the operational
+// logger with every entry tagged with "audit", so they can be routed to an audit sink.
+func newAuditLogger(logger *zap.Logger) *zap.Logger {
+	return logger.Named("audit").With(zap.Bool("audit", true))
+}
+
+// audit records a change of the backends made by the caller of the request in the audit log, along with
+// the number of backends before and after the change.
+func (p *SprayProxy) audit(c *gin.Context, action, backend string, before, after int) {
+	caller := auditCallerAnonymous
+	if p.adminToken != "" {
+		// only authorized requests change the backends
+		caller = auditCallerAdminToken
+	}
+	p.auditLogger.Info("backends changed",
+		zap.String("action", action),
+		zap.String("backend", backend),
+		zap.String("client-ip", clientIP(c.Request)),
+		zap.String("caller", caller),
+		zap.Time("time", time.Now()),
+		zap.Int("backends-before", before),
+		zap.Int("backends-after", after))
+}
@@ -0,0 +1,107 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestAuditLog(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "backends.json")
+	auditLogger := &recordingLogger{}
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), nil, WithBackendsFile(file), WithAdminToken("s3cr3t"), WithAuditLogger(auditLogger))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	call := func(handler gin.HandlerFunc, method string, query url.Values) {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(method, "http://localhost:8080/backends?"+query.Encode(), nil)
+		ctx.Request.Header.Set("Authorization", "Bearer s3cr3t")
+		handler(ctx)
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status code %d: %s", w.Code, w.Body.String())
+		}
+	}
+	call(proxy.Register, http.MethodPost, url.Values{"server": {"http://backend1"}})
+	call(proxy.Register, http.MethodPost, url.Values{"server": {"http://backend2"}})
+	call(proxy.Register, http.MethodPost, url.Values{"server": {"http://backend2"}, "shadow": {"true"}, "upsert": {"true"}})
+	call(proxy.Unregister, http.MethodDelete, url.Values{"server": {"http://backend1"}})
+	if err := os.WriteFile(file, []byte(`[{"url":"http://backend3"},{"url":"http://backend4"},{"url":"http://backend5"}]`), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	call(proxy.Reload, http.MethodPost, nil)
+
+	// unauthorized requests change nothing, and are not audited
+	w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {"http://backend6"}})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status code %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	expected := []struct {
+		action  string
+		backend string
+		before  int64
+		after   int64
+	}{
+		{action: auditActionRegister, backend: "http://backend1", before: 0, after: 1},
+		{action: auditActionRegister, backend: "http://backend2", before: 1, after: 2},
+		{action: auditActionUpdate, backend: "http://backend2", before: 2, after: 2},
+		{action: auditActionUnregister, backend: "http://backend1", before: 2, after: 1},
+		{action: auditActionReload, backend: file, before: 1, after: 3},
+	}
+	if len(auditLogger.entries) != len(expected) {
+		t.Fatalf("expected %d audit entries, got %+v", len(expected), auditLogger.entries)
+	}
+	for i, e := range expected {
+		got := auditLogger.entries[i]
+		if got.msg != "backends changed" || got.fields["action"] != e.action || got.fields["backend"] != e.backend ||
+			got.fields["backends-before"] != e.before || got.fields["backends-after"] != e.after {
+			t.Errorf("unexpected audit entry %d: %+v", i, got)
+		}
+		if got.fields["client-ip"] != "192.0.2.1" || got.fields["caller"] != auditCallerAdminToken || got.fields["time"] == nil {
+			t.Errorf("expected the caller of audit entry %d to be recorded, got %+v", i, got)
+		}
+	}
+}
+
+func TestAuditLogTagged(t *testing.T) {
+	var buff bytes.Buffer
+	config := zap.NewProductionConfig()
+	core := zapcore.NewCore(
+		zapcore.NewJSONEncoder(config.EncoderConfig),
+		zapcore.AddSync(&buff),
+		config.Level,
+	)
+	proxy, err := NewSprayProxy(false, zap.New(core))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	buff.Reset()
+	callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {"http://backend1"}})
+	var audit string
+	for _, line := range strings.Split(buff.String(), "\n") {
+		if strings.Contains(line, `"msg":"backends changed"`) {
+			audit = line
+		}
+	}
+	for _, expected := range []string{`"logger":"audit"`, `"audit":true`, `"action":"register"`, `"caller":"anonymous"`} {
+		if !strings.Contains(audit, expected) {
+			t.Errorf("expected string %q did not appear in %q", expected, audit)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const bearerPrefix = "Bearer "
+
+// authorized checks the bearer token of a backend management request against the admin token,
+// responding with StatusUnauthorized if it doesn't match. All requests are authorized while no
+// admin token is set.
+func (p *SprayProxy) authorized(c *gin.Context) bool {
+	if p.adminToken == "" {
+		return true
+	}
+	header := c.GetHeader("Authorization")
+	// constant time comparison, to not leak the token via timing attacks
+	if !strings.HasPrefix(header, bearerPrefix) ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, bearerPrefix)), []byte(p.adminToken)) != 1 {
+		c.String(http.StatusUnauthorized, "unauthorized")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestAdminToken(t *testing.T) {
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{"http://backend1"}, WithAdminToken("s3cr3t"))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	for name, tc := range map[string]struct {
+		authorization string
+		expected      int
+	}{
+		"missing":    {"", http.StatusUnauthorized},
+		"wrong":      {"Bearer wrong", http.StatusUnauthorized},
+		"not bearer": {"Basic s3cr3t", http.StatusUnauthorized},
+		"valid":      {"Bearer s3cr3t", http.StatusOK},
+	} {
+		for _, handler := range []gin.HandlerFunc{proxy.List, proxy.Register, proxy.Unregister} {
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080/backends?server=http://backend2", nil)
+			if tc.authorization != "" {
+				ctx.Request.Header.Set("Authorization", tc.authorization)
+			}
+			handler(ctx)
+			if w.Code != tc.expected {
+				t.Errorf("%s: expected status code %d, got %d", name, tc.expected, w.Code)
+			}
+		}
+	}
+}
+
+func TestAdminTokenUnset(t *testing.T) {
+	proxy, err := NewSprayProxy(false, zap.NewNop(), "http://backend1")
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := callBackendsHandler(proxy.List, http.MethodGet, nil)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+}
@@ -0,0 +1,887 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// eventHeader is the header GitHub uses for the type of event that triggered the webhook
+const eventHeader = "X-GitHub-Event"
+
+// Backend is a server the proxy forwards requests to, along with its forwarding settings.
+type Backend struct {
+	URL string `json:"url"`
+	// Events restricts the GitHub events forwarded to the backend. All events are forwarded if empty.
+	Events []string `json:"events,omitempty"`
+	// Methods restricts the HTTP methods of the requests forwarded to the backend. All methods are forwarded if empty.
+	Methods []string `json:"methods,omitempty"`
+	// Weight is the percentage of requests forwarded to the backend. All requests are forwarded if nil.
+	// Within a group, it is instead the share of the requests of the group relative to its other backends.
+	Weight *int `json:"weight,omitempty"`
+	// Group is the group of interchangeable backends the backend belongs to. Each request is forwarded to a
+	// single backend of every group, chosen by weighted round-robin. Backends outside groups all receive it.
+	Group string `json:"group,omitempty"`
+	// Role is "backup" for the backends of a group only forwarded to when the forward to the backend picked
+	// among its primary backends fails, in registration order. Backends are primary if empty.
+	Role string `json:"role,omitempty"`
+	// Priority orders the forwards, backends with a higher priority are forwarded to first. Backends of the
+	// same priority are forwarded to in registration order.
+	Priority int `json:"priority,omitempty"`
+	// MaxConcurrent limits the number of forwards in flight to the backend, further forwards waiting for
+	// one of them to complete, up to the forwarding timeout. Forwards are not limited if zero.
+	MaxConcurrent int `json:"maxConcurrent,omitempty"`
+	// MinInterval is the minimum interval between the forwards to the backend, as a Go duration, further
+	// forwards waiting for it up to the forwarding timeout. Forwards are not paced if empty.
+	MinInterval string `json:"minInterval,omitempty"`
+	// Headers are set on every request forwarded to the backend, overriding the inbound headers.
+	// Their values may be secrets and must not be logged.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Timeout is the forwarding timeout of the backend, as a Go duration. The global timeout applies if empty.
+	Timeout string `json:"timeout,omitempty"`
+	// Shadow backends receive requests, but their failures do not affect the response to the sender.
+	Shadow bool `json:"shadow,omitempty"`
+	// Repo is a glob matched against the full name of the repository of the webhooks forwarded to the
+	// backend, such as "org/*". Webhooks of all repositories are forwarded if empty.
+	Repo string `json:"repo,omitempty"`
+	// PathPrefix is prepended to the path of the requests forwarded to the backend, such as "/hooks".
+	PathPrefix string `json:"pathPrefix,omitempty"`
+	// PathMatch is a regular expression matched against the path of the requests forwarded to the backend,
+	// followed by their query if any, every match being replaced with PathReplace before PathPrefix is
+	// prepended. It adapts requests to backends with another URL scheme, such as "^/([^/]+)/([^/]+)/hook$"
+	// replaced with "/webhooks?repo=$2".
+	PathMatch string `json:"pathMatch,omitempty"`
+	// PathReplace is the replacement of the matches of PathMatch, where $1 stands for the first submatch.
+	PathReplace string `json:"pathReplace,omitempty"`
+	// StripFields are the dot separated paths of the JSON fields removed from the payloads forwarded to the
+	// backend, such as "pull_request.body". Payloads which are not JSON are forwarded unchanged.
+	StripFields []string `json:"stripFields,omitempty"`
+	// Insecure backends are forwarded to without verifying their TLS certificate, such as internal backends
+	// with self-signed certificates. The certificates of all backends are skipped if the proxy is insecure.
+	Insecure bool `json:"insecure,omitempty"`
+	// ServerName is sent in SNI and verified against the TLS certificate of the backend instead of the host of
+	// its URL, for backends reached by IP address but presenting a certificate for a hostname.
+	ServerName string `json:"serverName,omitempty"`
+	// PreserveHost sends the Host header of the inbound request to the backend instead of the host of its URL,
+	// for backends behind name-based virtual hosting.
+	PreserveHost bool `json:"preserveHost,omitempty"`
+	// Pings designates the backend to receive the GitHub ping events, when they are only forwarded to
+	// designated backends.
+	Pings bool `json:"pings,omitempty"`
+}
+
+// forwardTimeout returns the forwarding timeout of the backend, falling back to the given global timeout.
+func (b Backend) forwardTimeout(global time.Duration) time.Duration {
+	if timeout, err := time.ParseDuration(b.Timeout); err == nil && timeout > 0 {
+		return timeout
+	}
+	return global
+}
+
+// maxWeight is the weight of backends receiving all requests
+const maxWeight = 100
+
+// weight returns the percentage of requests forwarded to the backend.
+func (b Backend) weight() int {
+	if b.Weight == nil {
+		return maxWeight
+	}
+	return *b.Weight
+}
+
+// sampled returns true if the request with the given ID is forwarded to the backend, according
+// to its weight. The decision only depends on the request ID, so it is the same for every
+// replay of a delivery.
+func (b Backend) sampled(requestID string) bool {
+	weight := b.weight()
+	if weight >= maxWeight {
+		return true
+	}
+	// hash the backend along with the request ID, so backends sample independently
+	h := fnv.New32a()
+	h.Write([]byte(requestID))
+	h.Write([]byte(b.URL))
+	return int(h.Sum32()%maxWeight) < weight
+}
+
+// acceptsEvent returns true if requests for the given GitHub event are forwarded to the backend.
+func (b Backend) acceptsEvent(event string) bool {
+	if len(b.Events) == 0 {
+		return true
+	}
+	for _, e := range b.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsMethod returns true if requests with the given HTTP method are forwarded to the backend.
+func (b Backend) acceptsMethod(method string) bool {
+	if len(b.Methods) == 0 {
+		return true
+	}
+	for _, m := range b.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// httpMethods are the methods accepted in the methods filter of backends.
+var httpMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// parseMethods parses a comma separated list of HTTP methods, case insensitively.
+func parseMethods(list string) ([]string, error) {
+	methods := splitList(strings.ToUpper(list))
+	for _, method := range methods {
+		if !httpMethods[method] {
+			return nil, fmt.Errorf("invalid method %q", method)
+		}
+	}
+	return methods, nil
+}
+
+// clone returns a deep copy of the backend.
+func (b Backend) clone() Backend {
+	if b.Events != nil {
+		b.Events = append([]string{}, b.Events...)
+	}
+	if b.Methods != nil {
+		b.Methods = append([]string{}, b.Methods...)
+	}
+	if b.StripFields != nil {
+		b.StripFields = append([]string{}, b.StripFields...)
+	}
+	if b.Weight != nil {
+		weight := *b.Weight
+		b.Weight = &weight
+	}
+	if b.Headers != nil {
+		headers := make(map[string]string, len(b.Headers))
+		for name, value := range b.Headers {
+			headers[name] = value
+		}
+		b.Headers = headers
+	}
+	return b
+}
+
+// newBackends returns backends for the given URLs, without any specific settings.
+func newBackends(urls []string) []Backend {
+	backends := make([]Backend, 0, len(urls))
+	for _, url := range urls {
+		backends = append(backends, Backend{URL: url})
+	}
+	return backends
+}
+
+// Register adds the backend given by the "server" query parameter to the backends
+// the proxy forwards to, with the settings given by the optional query parameters
+// documented in the README. With "upsert", the settings of an existing backend are
+// replaced and returned as JSON. Backends cannot be registered while they are supplied
+// by a BackendsFunc.
+func (p *SprayProxy) Register(c *gin.Context) {
+	if !p.authorized(c) || p.managedByProvider(c) {
+		return
+	}
+	if c.Query("server") == "" {
+		c.String(http.StatusBadRequest, "missing server")
+		return
+	}
+	server, err := normalizeBackendURL(c.Query("server"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid server: "+err.Error())
+		return
+	}
+	backend := Backend{
+		URL:    server,
+		Events: splitList(c.Query("events")),
+	}
+	methods, err := parseMethods(c.Query("methods"))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	backend.Methods = methods
+	if value, ok := c.GetQuery("weight"); ok {
+		weight, err := strconv.Atoi(value)
+		if err != nil || weight < 0 || weight > maxWeight {
+			c.String(http.StatusBadRequest, "invalid weight, expected an integer from 0 to 100")
+			return
+		}
+		backend.Weight = &weight
+	}
+	headers, err := parseHeaders(c.QueryArray("header"))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	backend.Headers = headers
+	if value, ok := c.GetQuery("timeout"); ok {
+		if timeout, err := time.ParseDuration(value); err != nil || timeout <= 0 {
+			c.String(http.StatusBadRequest, "invalid timeout, expected a positive duration such as 30s")
+			return
+		}
+		backend.Timeout = value
+	}
+	if value, ok := c.GetQuery("shadow"); ok {
+		shadow, err := strconv.ParseBool(value)
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid shadow, expected true or false")
+			return
+		}
+		backend.Shadow = shadow
+	}
+	if value, ok := c.GetQuery("insecure"); ok {
+		insecure, err := strconv.ParseBool(value)
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid insecure, expected true or false")
+			return
+		}
+		backend.Insecure = insecure
+	}
+	if value, ok := c.GetQuery("preserveHost"); ok {
+		preserveHost, err := strconv.ParseBool(value)
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid preserveHost, expected true or false")
+			return
+		}
+		backend.PreserveHost = preserveHost
+	}
+	if value, ok := c.GetQuery("pings"); ok {
+		pings, err := strconv.ParseBool(value)
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid pings, expected true or false")
+			return
+		}
+		backend.Pings = pings
+	}
+	serverName := c.Query("serverName")
+	if serverName == "" {
+		serverName = c.Query("sni")
+	}
+	if serverName != "" {
+		if !isValidServerName(serverName) {
+			c.String(http.StatusBadRequest, "invalid serverName, expected a hostname")
+			return
+		}
+		backend.ServerName = serverName
+	}
+	if repo := c.Query("repo"); repo != "" {
+		if _, err := path.Match(repo, ""); err != nil {
+			c.String(http.StatusBadRequest, "invalid repo pattern: "+err.Error())
+			return
+		}
+		backend.Repo = repo
+	}
+	if prefix := c.Query("pathPrefix"); prefix != "" {
+		if !strings.HasPrefix(prefix, "/") {
+			c.String(http.StatusBadRequest, "invalid pathPrefix, expected a path starting with /")
+			return
+		}
+		backend.PathPrefix = strings.TrimRight(prefix, "/")
+	}
+	if pattern := c.Query("pathMatch"); pattern != "" {
+		if _, err := compilePathPattern(pattern); err != nil {
+			c.String(http.StatusBadRequest, "invalid pathMatch: "+err.Error())
+			return
+		}
+		backend.PathMatch = pattern
+		backend.PathReplace = c.Query("pathReplace")
+	} else if c.Query("pathReplace") != "" {
+		c.String(http.StatusBadRequest, "invalid pathReplace, expected along with pathMatch")
+		return
+	}
+	stripFields, err := parseStripPaths(c.Query("strip"))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	backend.StripFields = stripFields
+	backend.Group = strings.TrimSpace(c.Query("group"))
+	if value, ok := c.GetQuery("role"); ok {
+		role, ok := parseRole(value)
+		if !ok {
+			c.String(http.StatusBadRequest, "invalid role, expected primary or backup")
+			return
+		}
+		if role == roleBackup && backend.Group == "" {
+			c.String(http.StatusBadRequest, "invalid role, backup backends must belong to a group")
+			return
+		}
+		backend.Role = role
+	}
+	if value, ok := c.GetQuery("priority"); ok {
+		priority, err := strconv.Atoi(value)
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid priority, expected an integer")
+			return
+		}
+		backend.Priority = priority
+	}
+	if value, ok := c.GetQuery("maxConcurrent"); ok {
+		maxConcurrent, err := strconv.Atoi(value)
+		if err != nil || maxConcurrent <= 0 {
+			c.String(http.StatusBadRequest, "invalid maxConcurrent, expected a positive integer")
+			return
+		}
+		backend.MaxConcurrent = maxConcurrent
+	}
+	if value, ok := c.GetQuery("minInterval"); ok {
+		if interval, err := time.ParseDuration(value); err != nil || interval <= 0 {
+			c.String(http.StatusBadRequest, "invalid minInterval, expected a positive duration such as 2s")
+			return
+		}
+		backend.MinInterval = value
+	}
+	upsert := false
+	if value, ok := c.GetQuery("upsert"); ok {
+		if upsert, err = strconv.ParseBool(value); err != nil {
+			c.String(http.StatusBadRequest, "invalid upsert, expected true or false")
+			return
+		}
+	}
+	p.backendsLock.Lock()
+	defer p.backendsLock.Unlock()
+	// never change p.backends in place, snapshots handed out by snapshotBackends may share its array
+	backends := append([]Backend{}, p.backends...)
+	updated := false
+	for i, b := range backends {
+		if b.URL == server {
+			if !upsert {
+				c.String(http.StatusBadRequest, "already there")
+				return
+			}
+			backends[i] = backend
+			updated = true
+		}
+	}
+	if !updated {
+		backends = append(backends, backend)
+	}
+	p.persistBackends(backends)
+	before := len(p.backends)
+	p.backends = backends
+	metrics.SetBackendCount(len(backends))
+	message, action := "registered backend", auditActionRegister
+	if updated {
+		message, action = "updated backend", auditActionUpdate
+	}
+	p.audit(c, action, server, before, len(backends))
+	p.logger.Info(message, backendFields(server, backend)...)
+	if upsert {
+		c.JSON(http.StatusOK, p.backendDetail(backend.clone()))
+		return
+	}
+	c.String(http.StatusOK, "registered")
+}
+
+// Unregister removes the backend given by the "server" query parameter from the backends
+// the proxy forwards to. Backends cannot be unregistered while they are supplied by a BackendsFunc.
+func (p *SprayProxy) Unregister(c *gin.Context) {
+	if !p.authorized(c) || p.managedByProvider(c) {
+		return
+	}
+	server := c.Query("server")
+	if normalized, err := normalizeBackendURL(server); err == nil {
+		server = normalized
+	}
+	p.backendsLock.Lock()
+	defer p.backendsLock.Unlock()
+	backends := []Backend{}
+	for _, backend := range p.backends {
+		if backend.URL != server {
+			backends = append(backends, backend)
+		}
+	}
+	if len(backends) == len(p.backends) {
+		c.String(http.StatusNotFound, "not found")
+		return
+	}
+	p.persistBackends(backends)
+	before := len(p.backends)
+	p.backends = backends
+	metrics.SetBackendCount(len(backends))
+	p.audit(c, auditActionUnregister, server, before, len(backends))
+	p.forgetBackend(server, backends)
+	p.logger.Info("unregistered backend", zap.String("backend", server))
+	c.String(http.StatusOK, "unregistered")
+}
+
+// ErrBackendsProvided is the error of SetBackends when the backends are supplied by a BackendsFunc.
+var ErrBackendsProvided = errors.New("backends are managed by a provider")
+
+// ErrInvalidBackends is wrapped by the error of SetBackends when some of the backends are invalid.
+var ErrInvalidBackends = errors.New("invalid backends")
+
+// SetBackends replaces all the backends the proxy forwards to with the given ones at once, and saves them
+// if a backends file is configured. Backends which were already registered keep their settings, the
+// others are forwarded to with the default ones. If any of the backends is invalid or appears twice, the
+// returned error wraps ErrInvalidBackends and lists all of them, and the backends are left unchanged.
+func (p *SprayProxy) SetBackends(backends []string) error {
+	_, _, err := p.setBackends(backends)
+	return err
+}
+
+// setBackends replaces the backends like SetBackends, and returns the number of backends before and after.
+func (p *SprayProxy) setBackends(urls []string) (int, int, error) {
+	if p.provider != nil {
+		return 0, 0, ErrBackendsProvided
+	}
+	normalized := make([]string, 0, len(urls))
+	invalid := []string{}
+	seen := map[string]bool{}
+	for _, server := range urls {
+		n, err := normalizeBackendURL(server)
+		switch {
+		case err != nil:
+			invalid = append(invalid, fmt.Sprintf("%q: %v", server, err))
+		case seen[n]:
+			invalid = append(invalid, fmt.Sprintf("%q: duplicate backend", server))
+		default:
+			seen[n] = true
+			normalized = append(normalized, n)
+		}
+	}
+	if len(invalid) > 0 {
+		return 0, 0, fmt.Errorf("%w: %s", ErrInvalidBackends, strings.Join(invalid, ", "))
+	}
+	p.backendsLock.Lock()
+	defer p.backendsLock.Unlock()
+	current := make(map[string]Backend, len(p.backends))
+	for _, backend := range p.backends {
+		current[backend.URL] = backend
+	}
+	backends := make([]Backend, 0, len(normalized))
+	for _, server := range normalized {
+		backend, ok := current[server]
+		if !ok {
+			backend = Backend{URL: server}
+		}
+		backends = append(backends, backend)
+	}
+	p.persistBackends(backends)
+	before := len(p.backends)
+	p.backends = backends
+	metrics.SetBackendCount(len(backends))
+	for server := range current {
+		if !seen[server] {
+			p.forgetBackend(server, backends)
+		}
+	}
+	p.logger.Info(fmt.Sprintf("replaced %d backends with %d backends", before, len(backends)))
+	return before, len(backends), nil
+}
+
+// Set replaces all the backends with the ones given by the repeated "server" query parameter, as
+// SetBackends does, and returns them in the format of List. Invalid backends are rejected with
+// 400 Bad Request, listing them all, without changing any backend.
+func (p *SprayProxy) Set(c *gin.Context) {
+	if !p.authorized(c) || p.managedByProvider(c) {
+		return
+	}
+	before, after, err := p.setBackends(c.QueryArray("server"))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	p.audit(c, auditActionSet, "", before, after)
+	p.writeBackends(c)
+}
+
+// redactedHeaderValue replaces the values of backend headers in responses, as they may be secrets
+const redactedHeaderValue = "REDACTED"
+
+// backendDetail is a backend as listed in JSON, along with its health and draining state.
+type backendDetail struct {
+	Backend
+	Healthy  bool `json:"healthy"`
+	Draining bool `json:"draining,omitempty"`
+	InFlight int  `json:"inFlight,omitempty"`
+}
+
+// List returns the backends the proxy forwards to, one per line, with shadow and insecure backends
+// marked as such, along with their group, their role and whether they are draining.
+// If the client accepts JSON, the backends are returned with their settings and health instead,
+// with header values redacted.
+func (p *SprayProxy) List(c *gin.Context) {
+	if !p.authorized(c) {
+		return
+	}
+	p.writeBackends(c)
+}
+
+// writeBackends writes the current backends in the format of List.
+func (p *SprayProxy) writeBackends(c *gin.Context) {
+	if !strings.Contains(c.GetHeader("Accept"), gin.MIMEJSON) {
+		lines := []string{}
+		for _, backend := range p.snapshotBackends() {
+			line := backend.URL
+			if backend.Shadow {
+				line += " (shadow)"
+			}
+			if backend.Insecure {
+				line += " (insecure)"
+			}
+			if backend.Group != "" {
+				line += " (group " + backend.Group + ")"
+			}
+			if backend.Role != "" {
+				line += " (" + backend.Role + ")"
+			}
+			if draining, _ := p.drainState(backend.URL); draining {
+				line += " (draining)"
+			}
+			lines = append(lines, line)
+		}
+		c.String(http.StatusOK, strings.Join(lines, "\n"))
+		return
+	}
+	c.JSON(http.StatusOK, p.backendDetails())
+}
+
+// backendDetails returns the current backends with their health, and the values of their headers redacted.
+func (p *SprayProxy) backendDetails() []backendDetail {
+	backends := p.BackendsDetailed()
+	details := make([]backendDetail, 0, len(backends))
+	for _, backend := range backends {
+		details = append(details, p.backendDetail(backend))
+	}
+	return details
+}
+
+// backendDetail returns the backend with its health, redacting the values of its headers in place.
+func (p *SprayProxy) backendDetail(backend Backend) backendDetail {
+	for name := range backend.Headers {
+		backend.Headers[name] = redactedHeaderValue
+	}
+	draining, inFlight := p.drainState(backend.URL)
+	return backendDetail{Backend: backend, Healthy: p.isHealthy(backend.URL), Draining: draining, InFlight: inFlight}
+}
+
+// Reload replaces the backends with the ones of the backends file, so changes made to the file out of band,
+// such as by updating the ConfigMap it is mounted from, are picked up without a restart. The reloaded
+// backends are returned in the format of List. If the file cannot be read or holds an invalid backend,
+// the current backends are kept. Backends cannot be reloaded while they are supplied by a BackendsFunc.
+func (p *SprayProxy) Reload(c *gin.Context) {
+	if !p.authorized(c) || p.managedByProvider(c) {
+		return
+	}
+	if p.backendsFile == "" {
+		c.String(http.StatusBadRequest, "no backends file configured")
+		return
+	}
+	p.backendsLock.Lock()
+	// read under the lock, so the file is not rewritten by a concurrent registration in the meantime
+	backends, err := loadBackends(p.backendsFile)
+	if err == nil {
+		err = normalizeBackends(backends)
+	}
+	if err != nil {
+		p.backendsLock.Unlock()
+		p.logger.Error("failed to reload backends, keeping the current ones: "+err.Error(), zap.String("file", p.backendsFile))
+		c.String(http.StatusInternalServerError, "failed to reload backends: "+err.Error())
+		return
+	}
+	before := len(p.backends)
+	removed := removedBackends(p.backends, backends)
+	p.backends = backends
+	metrics.SetBackendCount(len(backends))
+	p.backendsLock.Unlock()
+	for _, server := range removed {
+		p.forgetBackend(server, backends)
+	}
+	p.audit(c, auditActionReload, p.backendsFile, before, len(backends))
+	p.logger.Info(fmt.Sprintf("reloaded %d backends from %s", len(backends), p.backendsFile))
+	p.writeBackends(c)
+}
+
+// removedBackends returns the URLs of the current backends which are not in the replacing ones.
+func removedBackends(current, replacing []Backend) []string {
+	kept := make(map[string]bool, len(replacing))
+	for _, backend := range replacing {
+		kept[backend.URL] = true
+	}
+	removed := []string{}
+	for _, backend := range current {
+		if !kept[backend.URL] {
+			removed = append(removed, backend.URL)
+		}
+	}
+	return removed
+}
+
+// forgetBackend drops the state kept about the backend, once it is removed, so it starts afresh if it is
+// added again: its draining, concurrency slots, pacing and health. The state kept by host, its circuit
+// breaker, error history and delivery status, is only dropped if none of the remaining backends shares it.
+func (p *SprayProxy) forgetBackend(server string, remaining []Backend) {
+	p.stopDraining(server)
+	p.forgetSlots(server)
+	p.forgetThrottle(server)
+	p.forgetHealth(server)
+	backendURL, err := parseBackendURL(server)
+	if err != nil {
+		return
+	}
+	for _, backend := range remaining {
+		if other, err := parseBackendURL(backend.URL); err == nil && other.Host == backendURL.Host {
+			return
+		}
+	}
+	p.forgetBreaker(backendURL.Host)
+	p.forgetErrors(server)
+	p.forgetDelivery(backendURL.Host)
+}
+
+// normalizeBackends normalizes the URLs and roles of the backends in place, and returns an error if any is
+// invalid or appears twice.
+func normalizeBackends(backends []Backend) error {
+	seen := map[string]bool{}
+	for i := range backends {
+		server, err := normalizeBackendURL(backends[i].URL)
+		if err != nil {
+			return fmt.Errorf("invalid backend %q: %w", backends[i].URL, err)
+		}
+		if seen[server] {
+			return fmt.Errorf("duplicate backend %q", server)
+		}
+		seen[server] = true
+		backends[i].URL = server
+		if backends[i].Role != "" {
+			role, ok := parseRole(backends[i].Role)
+			if !ok || role == roleBackup && backends[i].Group == "" {
+				return fmt.Errorf("invalid role %q of backend %q", backends[i].Role, server)
+			}
+			backends[i].Role = role
+		}
+	}
+	return nil
+}
+
+// BackendsDetailed returns a snapshot of the backends the proxy currently forwards to, with their settings.
+// The returned backends are copies, which can be modified by the caller.
+func (p *SprayProxy) BackendsDetailed() []Backend {
+	backends := p.snapshotBackends()
+	detailed := make([]Backend, 0, len(backends))
+	for _, backend := range backends {
+		detailed = append(detailed, backend.clone())
+	}
+	return detailed
+}
+
+// Backends returns a snapshot of the URLs of the backends the proxy currently forwards to.
+func (p *SprayProxy) Backends() []string {
+	backends := p.snapshotBackends()
+	urls := make([]string, 0, len(backends))
+	for _, backend := range backends {
+		urls = append(urls, backend.URL)
+	}
+	return urls
+}
+
+// snapshotBackends returns a copy of the backends the proxy currently forwards to.
+func (p *SprayProxy) snapshotBackends() []Backend {
+	if p.provider != nil {
+		return p.provider.get(time.Now())
+	}
+	p.backendsLock.RLock()
+	defer p.backendsLock.RUnlock()
+	return append([]Backend{}, p.backends...)
+}
+
+// persistBackends saves the given backends if a backends file is configured. Failures, such as when the
+// volume of the file turned read-only, are only logged and counted: the backends in memory are the ones
+// forwarded to regardless, so the proxy keeps working even if its changes are lost on restart.
+func (p *SprayProxy) persistBackends(backends []Backend) {
+	if p.backendsFile == "" {
+		return
+	}
+	if err := saveBackends(p.backendsFile, backends); err != nil {
+		metrics.IncPersistFailureCount()
+		p.logger.Warn("failed to persist backends, keeping them in memory only: "+err.Error(), zap.String("file", p.backendsFile))
+	}
+}
+
+// normalizeBackendURL validates that the backend is an absolute http or https URL, and returns it
+// in a canonical form with a lowercase host and no trailing slash, so equivalent URLs compare equal.
+func normalizeBackendURL(server string) (string, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == unixScheme {
+		return normalizeUnixSocketURL(u)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("unsupported scheme %q, expected http, https or unix", u.Scheme)
+	}
+	if u.Host == "" {
+		return "", errors.New("missing host")
+	}
+	u.Host = strings.ToLower(u.Host)
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// parseHeaders parses headers of the form "Name:Value", returning nil if there are none.
+func parseHeaders(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	headers := map[string]string{}
+	for _, value := range values {
+		name, headerValue, ok := strings.Cut(value, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			// the value is not echoed, it may contain a secret
+			return nil, errors.New("invalid header, expected Name:Value")
+		}
+		headers[http.CanonicalHeaderKey(name)] = strings.TrimSpace(headerValue)
+	}
+	return headers, nil
+}
+
+// backendFields returns the log fields of the settings of the given backend that are set.
+func backendFields(server string, backend Backend) []zap.Field {
+	fields := []zap.Field{zap.String("backend", server)}
+	if len(backend.Events) > 0 {
+		fields = append(fields, zap.Strings("events", backend.Events))
+	}
+	if len(backend.Methods) > 0 {
+		fields = append(fields, zap.Strings("methods", backend.Methods))
+	}
+	if backend.Weight != nil {
+		fields = append(fields, zap.Int("weight", backend.weight()))
+	}
+	if len(backend.Headers) > 0 {
+		// only the names, header values may be secrets
+		fields = append(fields, zap.Strings("headers", headerNames(backend.Headers)))
+	}
+	if backend.Timeout != "" {
+		fields = append(fields, zap.String("timeout", backend.Timeout))
+	}
+	if backend.Shadow {
+		fields = append(fields, zap.Bool("shadow", true))
+	}
+	if backend.Repo != "" {
+		fields = append(fields, zap.String("repo", backend.Repo))
+	}
+	if backend.PathPrefix != "" {
+		fields = append(fields, zap.String("path-prefix", backend.PathPrefix))
+	}
+	if backend.PathMatch != "" {
+		fields = append(fields, zap.String("path-match", backend.PathMatch), zap.String("path-replace", backend.PathReplace))
+	}
+	if backend.Insecure {
+		fields = append(fields, zap.Bool("insecure", true))
+	}
+	if backend.ServerName != "" {
+		fields = append(fields, zap.String("server-name", backend.ServerName))
+	}
+	if backend.PreserveHost {
+		fields = append(fields, zap.Bool("preserve-host", true))
+	}
+	if backend.Pings {
+		fields = append(fields, zap.Bool("pings", true))
+	}
+	if backend.Group != "" {
+		fields = append(fields, zap.String("group", backend.Group))
+	}
+	if backend.Role != "" {
+		fields = append(fields, zap.String("role", backend.Role))
+	}
+	if backend.Priority != 0 {
+		fields = append(fields, zap.Int("priority", backend.Priority))
+	}
+	if backend.MaxConcurrent > 0 {
+		fields = append(fields, zap.Int("max-concurrent", backend.MaxConcurrent))
+	}
+	if backend.MinInterval != "" {
+		fields = append(fields, zap.String("min-interval", backend.MinInterval))
+	}
+	if len(backend.StripFields) > 0 {
+		fields = append(fields, zap.Strings("strip-fields", backend.StripFields))
+	}
+	return fields
+}
+
+// headerNames returns the sorted names of the given headers.
+func headerNames(headers map[string]string) []string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mergeBackends returns the given backends followed by the ones of the comma or newline separated list
+// that are not already given. Invalid URLs of the list are logged and skipped.
+func mergeBackends(backends []string, list string, logger *zap.Logger) []string {
+	seen := map[string]bool{}
+	for _, backend := range backends {
+		if normalized, err := normalizeBackendURL(backend); err == nil {
+			seen[normalized] = true
+		}
+		seen[backend] = true
+	}
+	merged := append([]string{}, backends...)
+	for _, backend := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if backend = strings.TrimSpace(backend); backend == "" {
+			continue
+		}
+		normalized, err := normalizeBackendURL(backend)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("skipping invalid backend %q: %v", backend, err))
+			continue
+		}
+		if seen[normalized] {
+			continue
+		}
+		seen[normalized] = true
+		merged = append(merged, normalized)
+	}
+	return merged
+}
+
+// splitList splits a comma separated list, ignoring empty elements.
+func splitList(list string) []string {
+	elements := []string{}
+	for _, element := range strings.Split(list, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			elements = append(elements, element)
+		}
+	}
+	if len(elements) == 0 {
+		return nil
+	}
+	return elements
+}
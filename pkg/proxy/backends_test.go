@@ -0,0 +1,809 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"github.com/redhat-appstudio/sprayproxy/test"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// callBackendsHandler invokes one of the backend management handlers with the given query
+// and returns the recorded response.
+func callBackendsHandler(handler gin.HandlerFunc, method string, query url.Values) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(method, "http://localhost:8080/backends?"+query.Encode(), nil)
+	handler(ctx)
+	return w
+}
+
+func TestRegisterUnregister(t *testing.T) {
+	proxy, err := NewSprayProxy(false, zap.NewNop(), "http://backend1")
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+
+	w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {"http://backend2"}})
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	w = callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {"http://backend2"}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code %d registering a duplicate, got %d", http.StatusBadRequest, w.Code)
+	}
+	w = callBackendsHandler(proxy.Register, http.MethodPost, url.Values{})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code %d registering without server, got %d", http.StatusBadRequest, w.Code)
+	}
+	w = callBackendsHandler(proxy.List, http.MethodGet, url.Values{})
+	expected := "http://backend1\nhttp://backend2"
+	if w.Body.String() != expected {
+		t.Errorf("expected backends %q, got %q", expected, w.Body.String())
+	}
+
+	w = callBackendsHandler(proxy.Unregister, http.MethodDelete, url.Values{"server": {"http://backend1"}})
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	w = callBackendsHandler(proxy.Unregister, http.MethodDelete, url.Values{"server": {"http://backend1"}})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status code %d unregistering an unknown backend, got %d", http.StatusNotFound, w.Code)
+	}
+	backends := proxy.Backends()
+	if len(backends) != 1 || backends[0] != "http://backend2" {
+		t.Errorf("expected backends %v, got %v", []string{"http://backend2"}, backends)
+	}
+}
+
+func TestRegisterUnregisterWhileProxying(t *testing.T) {
+	// meant to be run with -race, which reports concurrent access to the backends
+	backend := test.NewTestServer()
+	defer backend.GetServer().Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop(), backend.GetServer().URL)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	// same backend under another host name, so it isn't rejected as a duplicate
+	server := url.Values{"server": {strings.Replace(backend.GetServer().URL, "127.0.0.1", "localhost", 1)}}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			callBackendsHandler(proxy.Register, http.MethodPost, server)
+			callBackendsHandler(proxy.Unregister, http.MethodDelete, server)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+			proxy.HandleProxy(ctx)
+			if w.Code != http.StatusOK {
+				t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+			}
+		}
+	}()
+	wg.Wait()
+	if backend.GetError() != nil {
+		t.Errorf("backend error: %v", backend.GetError())
+	}
+}
+
+func TestRegisterEvents(t *testing.T) {
+	all := test.NewTestServer()
+	defer all.GetServer().Close()
+	var calls int32
+	filtered := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer filtered.Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop(), all.GetServer().URL)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{
+		"server": {filtered.URL},
+		"events": {"push, pull_request"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	for _, tc := range []struct {
+		event         string
+		expectedCalls int32
+	}{
+		{"push", 1},
+		{"issues", 1},
+		{"pull_request", 2},
+		{"", 2},
+	} {
+		event, expectedCalls := tc.event, tc.expectedCalls
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+		ctx.Request.Header.Set(eventHeader, event)
+		proxy.HandleProxy(ctx)
+		if w.Code != http.StatusOK {
+			t.Errorf("event %q: expected status code %d, got %d", event, http.StatusOK, w.Code)
+		}
+		if got := atomic.LoadInt32(&calls); got != expectedCalls {
+			t.Errorf("event %q: expected %d calls to the filtered backend, got %d", event, expectedCalls, got)
+		}
+	}
+}
+
+func TestRegisterMethods(t *testing.T) {
+	var methods []string
+	var lock sync.Mutex
+	filtered := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		methods = append(methods, req.Method)
+	}))
+	defer filtered.Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {filtered.URL}, "methods": {"post,FETCH"}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code %d for an invalid method, got %d", http.StatusBadRequest, w.Code)
+	}
+	w = callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {filtered.URL}, "methods": {"post, put"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	for _, method := range []string{http.MethodPost, http.MethodGet, http.MethodPut, http.MethodHead} {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(method, "http://localhost:8080", bytes.NewBufferString("hello"))
+		proxy.HandleProxy(ctx)
+		if w.Code != http.StatusOK {
+			t.Errorf("method %s: expected status code %d, got %d", method, http.StatusOK, w.Code)
+		}
+	}
+	if expected := []string{http.MethodPost, http.MethodPut}; !reflect.DeepEqual(methods, expected) {
+		t.Errorf("expected only methods %v to be forwarded, got %v", expected, methods)
+	}
+	if got := proxy.BackendsDetailed()[0].Methods; !reflect.DeepEqual(got, []string{http.MethodPost, http.MethodPut}) {
+		t.Errorf("expected normalized methods, got %v", got)
+	}
+}
+
+func TestNormalizeBackendURL(t *testing.T) {
+	for server, expected := range map[string]string{
+		"http://foo":               "http://foo",
+		"http://foo/":              "http://foo",
+		"https://FOO.example:8443": "https://foo.example:8443",
+		"HTTPS://foo/hooks//":      "https://foo/hooks",
+	} {
+		got, err := normalizeBackendURL(server)
+		if err != nil {
+			t.Errorf("unexpected error normalizing %q: %v", server, err)
+		}
+		if got != expected {
+			t.Errorf("expected %q to be normalized to %q, got %q", server, expected, got)
+		}
+	}
+	for _, server := range []string{"htpp://foo", "foo", "/path", "http://", "ftp://foo", "http://foo bar"} {
+		if _, err := normalizeBackendURL(server); err == nil {
+			t.Errorf("expected error normalizing %q", server)
+		}
+	}
+}
+
+func TestRegisterNormalized(t *testing.T) {
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {"http://Foo/"}})
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	w = callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {"http://foo"}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code %d registering an equivalent backend, got %d", http.StatusBadRequest, w.Code)
+	}
+	w = callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {"htpp://foo"}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code %d registering an invalid backend, got %d", http.StatusBadRequest, w.Code)
+	}
+	expected := `invalid server: unsupported scheme "htpp", expected http, https or unix`
+	if w.Body.String() != expected {
+		t.Errorf("expected response %q, got %q", expected, w.Body.String())
+	}
+	if backends := proxy.Backends(); len(backends) != 1 || backends[0] != "http://foo" {
+		t.Errorf("expected backends %v, got %v", []string{"http://foo"}, backends)
+	}
+	w = callBackendsHandler(proxy.Unregister, http.MethodDelete, url.Values{"server": {"http://foo/"}})
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d unregistering an equivalent backend, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestBackendsEnv(t *testing.T) {
+	t.Setenv("SPRAYPROXY_BACKENDS", "http://backend2, http://Backend1/\nhtpp://backend3\n\nhttp://backend4")
+	logger := &recordingLogger{}
+	proxy, err := NewSprayProxyWithLogger(false, logger, []string{"http://backend1"})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	expected := []string{"http://backend1", "http://backend2", "http://backend4"}
+	if !reflect.DeepEqual(proxy.Backends(), expected) {
+		t.Errorf("expected backends %v, got %v", expected, proxy.Backends())
+	}
+	skipped := logger.find(`skipping invalid backend "htpp://backend3": unsupported scheme "htpp", expected http, https or unix`)
+	if skipped == nil || skipped.level != "warn" {
+		t.Errorf("expected the invalid backend to be logged, got %v", logger.entries)
+	}
+
+	// the backends file takes precedence over both
+	file := filepath.Join(t.TempDir(), "backends.json")
+	if err := os.WriteFile(file, []byte(`[{"url":"http://backend5"}]`), 0o600); err != nil {
+		t.Fatalf("failed to write backends file: %v", err)
+	}
+	t.Setenv("SPRAYPROXY_BACKENDS_FILE", file)
+	proxy, err = NewSprayProxy(false, zap.NewNop(), "http://backend1")
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	if !reflect.DeepEqual(proxy.Backends(), []string{"http://backend5"}) {
+		t.Errorf("expected the persisted backends, got %v", proxy.Backends())
+	}
+}
+
+func TestRegisterWeight(t *testing.T) {
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	for _, weight := range []string{"-1", "101", "ten", ""} {
+		w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {"http://backend1"}, "weight": {weight}})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d registering weight %q, got %d", http.StatusBadRequest, weight, w.Code)
+		}
+	}
+	w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {"http://backend1"}, "weight": {"25"}})
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	w = callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {"http://backend2"}})
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	backends := proxy.snapshotBackends()
+	if backends[0].weight() != 25 || backends[1].weight() != maxWeight {
+		t.Errorf("expected weights %d and %d, got %d and %d", 25, maxWeight, backends[0].weight(), backends[1].weight())
+	}
+}
+
+func TestBackendSampled(t *testing.T) {
+	weight := 25
+	backend := Backend{URL: "http://backend1", Weight: &weight}
+	forwarded := 0
+	for i := 0; i < 10000; i++ {
+		requestID := strconv.Itoa(i)
+		sampled := backend.sampled(requestID)
+		if sampled != backend.sampled(requestID) {
+			t.Fatalf("expected the same decision for request %s", requestID)
+		}
+		if sampled {
+			forwarded++
+		}
+	}
+	if forwarded < 2250 || forwarded > 2750 {
+		t.Errorf("expected about 25%% of requests to be forwarded, got %d out of 10000", forwarded)
+	}
+	none, all := 0, maxWeight
+	if (Backend{Weight: &none}).sampled("request") {
+		t.Error("expected no request to be forwarded with weight 0")
+	}
+	if !(Backend{Weight: &all}).sampled("request") || !(Backend{}).sampled("request") {
+		t.Error("expected all requests to be forwarded without weight")
+	}
+}
+
+func TestHandleProxySampledOut(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics.InitMetrics(registry)
+	backend := test.NewTestServer()
+	defer backend.GetServer().Close()
+	var calls int32
+	sampledOut := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer sampledOut.Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop(), backend.GetServer().URL)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {sampledOut.URL}, "weight": {"0"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if got := atomic.LoadInt32(&calls); got != 0 {
+		t.Errorf("expected the sampled out backend not to be called, got %d calls", got)
+	}
+	if got := sampledMetricValue(t, registry, strings.TrimPrefix(sampledOut.URL, "http://"), "sampled_out"); got != 1 {
+		t.Errorf("expected %v sampled out requests, got %v", 1, got)
+	}
+}
+
+// sampledMetricValue returns the number of sampling decisions for the given host, -1 if there are none.
+func sampledMetricValue(t *testing.T, registry *prometheus.Registry, host, decision string) float64 {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "sprayproxy_http_sampled_requests_total" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range m.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["host"] == host && labels["decision"] == decision {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return -1
+}
+
+func TestRegisterHeaders(t *testing.T) {
+	received := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		received <- req.Header
+	}))
+	defer backend.Close()
+	var logs bytes.Buffer
+	logger := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(&logs), zap.DebugLevel))
+	proxy, err := NewSprayProxy(false, logger)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	for _, header := range []string{"Authorization", ":value"} {
+		w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {backend.URL}, "header": {header}})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d registering header %q, got %d", http.StatusBadRequest, header, w.Code)
+		}
+	}
+	w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{
+		"server": {backend.URL},
+		"header": {"authorization: Bearer s3cr3t", "X-Custom:a:b"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+	ctx.Request.Header.Set("Authorization", "Bearer inbound")
+	proxy.HandleProxy(ctx)
+	header := <-received
+	if got := header.Get("Authorization"); got != "Bearer s3cr3t" {
+		t.Errorf("expected backend header to override the inbound one, got %q", got)
+	}
+	if got := header.Get("X-Custom"); got != "a:b" {
+		t.Errorf("expected header value %q, got %q", "a:b", got)
+	}
+	if strings.Contains(logs.String(), "s3cr3t") {
+		t.Errorf("expected header values to be redacted from logs, got %s", logs.String())
+	}
+}
+
+func TestBackendsDetailed(t *testing.T) {
+	proxy, err := NewSprayProxy(false, zap.NewNop(), "http://backend1")
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{
+		"server": {"http://backend2"},
+		"events": {"push"},
+		"weight": {"50"},
+		"header": {"Authorization:Bearer s3cr3t"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	backends := proxy.BackendsDetailed()
+	if len(backends) != 2 {
+		t.Fatalf("expected %d backends, got %d", 2, len(backends))
+	}
+	backend := backends[1]
+	if backend.URL != "http://backend2" || len(backend.Events) != 1 || backend.weight() != 50 || backend.Headers["Authorization"] != "Bearer s3cr3t" {
+		t.Errorf("unexpected backend %+v", backend)
+	}
+	// modifying the copy must not affect the proxy
+	backend.Headers["Authorization"] = "changed"
+	backend.Events[0] = "changed"
+	if got := proxy.BackendsDetailed()[1]; got.Headers["Authorization"] != "Bearer s3cr3t" || got.Events[0] != "push" {
+		t.Errorf("expected backends to be copies, got %+v", got)
+	}
+}
+
+func TestListJSON(t *testing.T) {
+	proxy, err := NewSprayProxy(false, zap.NewNop(), "http://backend1")
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	callBackendsHandler(proxy.Register, http.MethodPost, url.Values{
+		"server": {"http://backend2"},
+		"events": {"push"},
+		"header": {"Authorization:Bearer s3cr3t"},
+	})
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodGet, "http://localhost:8080/backends", nil)
+	ctx.Request.Header.Set("Accept", "application/json")
+	proxy.List(ctx)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	expected := `[{"url":"http://backend1","healthy":true},` +
+		`{"url":"http://backend2","events":["push"],"headers":{"Authorization":"REDACTED"},"healthy":true}]`
+	if got := w.Body.String(); got != expected {
+		t.Errorf("expected response %s, got %s", expected, got)
+	}
+}
+
+func TestRegisterTimeout(t *testing.T) {
+	t.Setenv("SPRAYPROXY_FORWARDING_REQUEST_TIMEOUT", "100ms")
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	}))
+	defer slow.Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	for _, timeout := range []string{"", "10", "-1s", "0s"} {
+		w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {slow.URL}, "timeout": {timeout}})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d registering timeout %q, got %d", http.StatusBadRequest, timeout, w.Code)
+		}
+	}
+	forward := func() int {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+		proxy.HandleProxy(ctx)
+		return w.Code
+	}
+
+	// the global timeout applies without backend timeout
+	callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {slow.URL}})
+	if code := forward(); code != http.StatusBadGateway {
+		t.Errorf("expected status code %d with the global timeout, got %d", http.StatusBadGateway, code)
+	}
+	callBackendsHandler(proxy.Unregister, http.MethodDelete, url.Values{"server": {slow.URL}})
+	callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {slow.URL}, "timeout": {"5s"}})
+	if code := forward(); code != http.StatusOK {
+		t.Errorf("expected status code %d with the backend timeout, got %d", http.StatusOK, code)
+	}
+}
+
+func TestRegisterShadow(t *testing.T) {
+	backend := test.NewTestServer()
+	defer backend.GetServer().Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop(), backend.GetServer().URL)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {down.URL}, "shadow": {"maybe"}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	w = callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {down.URL}, "shadow": {"true"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	w = callBackendsHandler(proxy.List, http.MethodGet, nil)
+	expected := backend.GetServer().URL + "\n" + down.URL + " (shadow)"
+	if w.Body.String() != expected {
+		t.Errorf("expected list %q, got %q", expected, w.Body.String())
+	}
+
+	// the shadow backend being down does not fail the request
+	w = httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestRegisterPreserveHost(t *testing.T) {
+	hosts := make(chan string, 2)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		hosts <- req.URL.Path + " " + req.Host
+	}))
+	defer backend.Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop(), backend.URL)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {backend.URL + "/preserved"}, "preserveHost": {"maybe"}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	w = callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {backend.URL + "/preserved"}, "preserveHost": {"true"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://hooks.example.com/", bytes.NewBufferString("hello"))
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	got := map[string]bool{<-hosts: true, <-hosts: true}
+	expected := map[string]bool{"/ " + strings.TrimPrefix(backend.URL, "http://"): true, "/ hooks.example.com": true}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected hosts %v, got %v", expected, got)
+	}
+}
+
+func TestRegisterPathPrefix(t *testing.T) {
+	received := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		received <- req.URL.RequestURI()
+	}))
+	defer backend.Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {backend.URL}, "pathPrefix": {"hooks"}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code %d for a prefix without leading slash, got %d", http.StatusBadRequest, w.Code)
+	}
+	forward := func(target string) string {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, target, bytes.NewBufferString("hello"))
+		proxy.HandleProxy(ctx)
+		return <-received
+	}
+
+	// backends without prefix receive the inbound path
+	callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {backend.URL}})
+	if got := forward("http://localhost:8080/payload?x=1"); got != "/payload?x=1" {
+		t.Errorf("expected the inbound path without prefix, got %q", got)
+	}
+	callBackendsHandler(proxy.Unregister, http.MethodDelete, url.Values{"server": {backend.URL}})
+	w = callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {backend.URL}, "pathPrefix": {"/hooks/"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if got := forward("http://localhost:8080/payload?x=1"); got != "/hooks/payload?x=1" {
+		t.Errorf("expected the prefixed path, got %q", got)
+	}
+	if got := forward("http://localhost:8080/a%2Fb"); got != "/hooks/a%2Fb" {
+		t.Errorf("expected the prefixed escaped path, got %q", got)
+	}
+	if prefix := proxy.BackendsDetailed()[0].PathPrefix; prefix != "/hooks" {
+		t.Errorf("expected path prefix /hooks, got %q", prefix)
+	}
+}
+
+func TestRegisterUpsert(t *testing.T) {
+	proxy, err := NewSprayProxy(false, zap.NewNop(), "http://backend1")
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {"http://backend1"}, "upsert": {"maybe"}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code %d for an invalid upsert, got %d", http.StatusBadRequest, w.Code)
+	}
+	w = callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {"http://backend1"}, "weight": {"25"}})
+	if w.Code != http.StatusBadRequest || w.Body.String() != "already there" {
+		t.Errorf("expected existing backends to be rejected without upsert, got %d %q", w.Code, w.Body.String())
+	}
+
+	w = callBackendsHandler(proxy.Register, http.MethodPost, url.Values{
+		"server": {"http://backend1/"},
+		"weight": {"25"},
+		"events": {"push"},
+		"header": {"Authorization:Bearer s3cr3t"},
+		"upsert": {"true"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	detail := backendDetail{}
+	if err := json.Unmarshal(w.Body.Bytes(), &detail); err != nil {
+		t.Fatalf("failed to decode response %q: %v", w.Body.String(), err)
+	}
+	if detail.URL != "http://backend1" || detail.weight() != 25 || !reflect.DeepEqual(detail.Events, []string{"push"}) ||
+		detail.Headers["Authorization"] != redactedHeaderValue || !detail.Healthy {
+		t.Errorf("unexpected updated backend %+v", detail)
+	}
+	backends := proxy.snapshotBackends()
+	if len(backends) != 1 || backends[0].weight() != 25 || backends[0].Headers["Authorization"] != "Bearer s3cr3t" {
+		t.Errorf("expected the backend to be updated in place, got %+v", backends)
+	}
+
+	// upserting a new backend registers it
+	w = callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {"http://backend2"}, "upsert": {"true"}})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"url":"http://backend2"`) {
+		t.Errorf("expected the new backend to be returned, got %d %q", w.Code, w.Body.String())
+	}
+	if backends := proxy.snapshotBackends(); len(backends) != 2 {
+		t.Errorf("expected 2 backends, got %+v", backends)
+	}
+}
+
+func TestRegisterPriority(t *testing.T) {
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {"http://backend1"}, "priority": {"high"}})
+	if w.Code != http.StatusBadRequest || w.Body.String() != "invalid priority, expected an integer" {
+		t.Errorf("expected invalid priority to be rejected, got %d %q", w.Code, w.Body.String())
+	}
+	for _, params := range []url.Values{
+		{"server": {"http://backend1"}},
+		{"server": {"http://backend2"}, "priority": {"-1"}},
+		{"server": {"http://backend3"}, "priority": {"10"}},
+		{"server": {"http://backend4"}},
+		{"server": {"http://backend5"}, "priority": {"10"}},
+	} {
+		if w := callBackendsHandler(proxy.Register, http.MethodPost, params); w.Code != http.StatusOK {
+			t.Fatalf("failed to register backend: %d %s", w.Code, w.Body.String())
+		}
+	}
+	targets := proxy.selectBackends(&inboundRequest{method: http.MethodPost}, nil)
+	got := []string{}
+	for _, target := range targets {
+		got = append(got, target.backend.URL)
+	}
+	// backends of the same priority keep their registration order
+	expected := []string{"http://backend3", "http://backend5", "http://backend1", "http://backend4", "http://backend2"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected forwarding order %v, got %v", expected, got)
+	}
+}
+
+func TestBackendCountMetric(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics.InitMetrics(registry)
+	proxy, err := NewSprayProxy(false, zap.NewNop(), "http://backend1", "http://backend2")
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	if got := metricValue(t, registry, "sprayproxy_backends", ""); got != 2 {
+		t.Errorf("expected 2 backends on startup, got %v", got)
+	}
+	callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {"http://backend3"}})
+	if got := metricValue(t, registry, "sprayproxy_backends", ""); got != 3 {
+		t.Errorf("expected 3 backends once registered, got %v", got)
+	}
+	callBackendsHandler(proxy.Unregister, http.MethodDelete, url.Values{"server": {"http://backend1"}})
+	callBackendsHandler(proxy.Unregister, http.MethodDelete, url.Values{"server": {"http://backend2"}})
+	if got := metricValue(t, registry, "sprayproxy_backends", ""); got != 1 {
+		t.Errorf("expected 1 backend once unregistered, got %v", got)
+	}
+
+	provided := []string{"http://backend4"}
+	proxy, err = NewSprayProxyWithOptions(false, zap.NewNop(), nil, WithBackendsFunc(func() []string { return provided }, 0))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	proxy.Backends()
+	if got := metricValue(t, registry, "sprayproxy_backends", ""); got != 1 {
+		t.Errorf("expected 1 provided backend, got %v", got)
+	}
+	provided = nil
+	proxy.Backends()
+	if got := metricValue(t, registry, "sprayproxy_backends", ""); got != 0 {
+		t.Errorf("expected no provided backends, got %v", got)
+	}
+}
+
+func TestSetBackends(t *testing.T) {
+	proxy, err := NewSprayProxy(false, zap.NewNop(), "http://backend1", "http://backend2")
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {"http://backend2"}, "weight": {"50"}, "upsert": {"true"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	err = proxy.SetBackends([]string{"http://backend3", "ftp://backend4", "http://backend3"})
+	if !errors.Is(err, ErrInvalidBackends) {
+		t.Fatalf("expected invalid backends error, got %v", err)
+	}
+	for _, invalid := range []string{`"ftp://backend4"`, `"http://backend3": duplicate backend`} {
+		if !strings.Contains(err.Error(), invalid) {
+			t.Errorf("expected error %q to list %s", err, invalid)
+		}
+	}
+	w = callBackendsHandler(proxy.List, http.MethodGet, url.Values{})
+	if expected := "http://backend1\nhttp://backend2"; w.Body.String() != expected {
+		t.Errorf("expected backends %q to be left unchanged, got %q", expected, w.Body.String())
+	}
+
+	w = callBackendsHandler(proxy.Set, http.MethodPut, url.Values{"server": {"http://backend2", "http://backend3"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	backends := proxy.backends
+	if len(backends) != 2 || backends[0].URL != "http://backend2" || backends[1].URL != "http://backend3" {
+		t.Fatalf("unexpected backends %v", backends)
+	}
+	if backends[0].Weight == nil || *backends[0].Weight != 50 {
+		t.Errorf("expected the settings of the kept backend to be kept, got %v", backends[0])
+	}
+	if backends[1].Weight != nil {
+		t.Errorf("expected the new backend to get default settings, got %v", backends[1])
+	}
+
+	w = callBackendsHandler(proxy.Set, http.MethodPut, url.Values{"server": {"backend5"}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code %d setting an invalid backend, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestUnregisterSharedHost(t *testing.T) {
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{"http://backend1", "http://backend1/other"}, WithCircuitBreaker(1, time.Minute))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	proxy.recordForward("backend1", false)
+	callBackendsHandler(proxy.Unregister, http.MethodDelete, url.Values{"server": {"http://backend1"}})
+	// the state of the host is still the one of the remaining backend
+	if proxy.allowForward("backend1") {
+		t.Error("expected the circuit breaker of the host to be kept")
+	}
+	callBackendsHandler(proxy.Unregister, http.MethodDelete, url.Values{"server": {"http://backend1/other"}})
+	if !proxy.allowForward("backend1") {
+		t.Error("expected the circuit breaker of the host to be dropped")
+	}
+}
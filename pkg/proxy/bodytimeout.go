@@ -0,0 +1,111 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+)
+
+// defaultBodyReadTimeout bounds the time to read the body of an inbound request by default.
+const defaultBodyReadTimeout = time.Minute
+
+// errBodyReadTimeout is the error of reading the inbound body once the body read timeout expired.
+var errBodyReadTimeout = errors.New("timed out reading request body")
+
+// connContextKey is the context key of the connection an inbound request is received on.
+type connContextKey struct{}
+
+// ConnContext stores the connection in the context of the requests received on it, for the body read
+// timeout to interrupt reads blocked on a slow client. It is meant to be set as the ConnContext of the
+// http.Server the proxy is served by, without which the body read timeout is not enforced.
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
+
+// requestConn returns the connection the request is received on, nil if it was not stored by ConnContext.
+func requestConn(req *http.Request) net.Conn {
+	conn, _ := req.Context().Value(connContextKey{}).(net.Conn)
+	return conn
+}
+
+// timeoutBody is a request body failing reads with errBodyReadTimeout once the whole body could not be
+// read within the timeout, such as when a client trickles its body to hold the proxy. The timeout is the
+// read deadline of the connection, so a read blocked on a slow client is interrupted, and the body is
+// only ever read by the handler. Only the time waiting for the client counts: the deadline is pushed
+// back by the time between reads, such as while the slowest backend consumes a streamed body.
+type timeoutBody struct {
+	io.ReadCloser
+	conn    net.Conn
+	timeout time.Duration
+	// spent is the time spent waiting for the client so far
+	spent time.Duration
+}
+
+// newTimeoutBody returns the body reading the given one, received on conn, within the timeout.
+func newTimeoutBody(body io.ReadCloser, conn net.Conn, timeout time.Duration) *timeoutBody {
+	return &timeoutBody{ReadCloser: body, conn: conn, timeout: timeout}
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	remaining := b.timeout - b.spent
+	if remaining <= 0 {
+		return 0, errBodyReadTimeout
+	}
+	start := time.Now()
+	// the deadline cannot be set once the connection is closed, the read then tells why
+	b.conn.SetReadDeadline(start.Add(remaining))
+	n, err := b.ReadCloser.Read(p)
+	b.spent += time.Since(start)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, errBodyReadTimeout
+	}
+	return n, err
+}
+
+// Close closes the body, clearing the read deadline unless it expired: the rest of the body of a slow
+// client is then not read, and its connection is closed.
+func (b *timeoutBody) Close() error {
+	if b.spent < b.timeout {
+		b.conn.SetReadDeadline(time.Time{})
+	}
+	return b.ReadCloser.Close()
+}
+
+// errMaxBytes is the message of the error of http.MaxBytesReader once the limit is exceeded, which has no
+// dedicated type before Go 1.19.
+const errMaxBytes = "http: request body too large"
+
+// respondBodyError responds to an inbound request whose body could not be read, with 413 Request Entity
+// Too Large when it exceeds the maximum request size, 408 Request Timeout when the client was too slow
+// to send it and 400 Bad Request otherwise, such as when the client disconnects while sending it. The
+// connection of a slow client is closed, rather than reused while its body is still being received.
+// Bodies exceeding the maximum request size are counted apart from the other errors.
+func (p *SprayProxy) respondBodyError(c *gin.Context, err error, zapCommonFields []zap.Field) {
+	switch {
+	case err.Error() == errMaxBytes:
+		metrics.IncTooLargeCount()
+		p.respondError(c, http.StatusRequestEntityTooLarge, errorCodeRequestTooLarge, "request body too large")
+	case errors.Is(err, errBodyReadTimeout):
+		metrics.IncBodyReadErrorCount()
+		c.Header("Connection", "close")
+		p.respondError(c, http.StatusRequestTimeout, errorCodeRequestTimeout, "timed out reading request body")
+	default:
+		metrics.IncBodyReadErrorCount()
+		p.respondError(c, http.StatusBadRequest, errorCodeInvalidBody, "failed to read request body")
+	}
+	p.logger.Error(err.Error(), zapCommonFields...)
+}
@@ -0,0 +1,158 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/test"
+	"go.uber.org/zap"
+)
+
+func TestHandleProxyBodyReadTimeout(t *testing.T) {
+	backend := test.NewTestServer()
+	defer backend.GetServer().Close()
+	for _, tc := range []struct {
+		name           string
+		backends       []string
+		expectedStatus int
+		finishBody     bool
+	}{
+		{
+			name:           "body sent in time",
+			backends:       []string{backend.GetServer().URL, backend.GetServer().URL + "/other"},
+			expectedStatus: http.StatusOK,
+			finishBody:     true,
+		},
+		{
+			name:           "buffered body trickled",
+			backends:       []string{backend.GetServer().URL, backend.GetServer().URL + "/other"},
+			expectedStatus: http.StatusRequestTimeout,
+		},
+		{
+			name:           "streamed body trickled",
+			backends:       []string{backend.GetServer().URL},
+			expectedStatus: http.StatusRequestTimeout,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), tc.backends, WithBodyReadTimeout(200*time.Millisecond))
+			if err != nil {
+				t.Fatalf("failed to set up proxy: %v", err)
+			}
+			r := gin.New()
+			r.POST("/", proxy.HandleProxy)
+			server := httptest.NewUnstartedServer(r)
+			server.Config.ConnContext = ConnContext
+			server.Start()
+			defer server.Close()
+
+			body, writer := io.Pipe()
+			defer writer.Close()
+			go func(finish bool) {
+				writer.Write([]byte("hel"))
+				if finish {
+					writer.Write([]byte("lo"))
+					writer.Close()
+				}
+			}(tc.finishBody)
+			start := time.Now()
+			resp, err := http.Post(server.URL, "text/plain", body)
+			if err != nil {
+				t.Fatalf("failed to send request: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, resp.StatusCode)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("expected the response once the timeout expires, got it after %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestProxyBodyReadTimeoutEnv(t *testing.T) {
+	for _, tc := range []struct {
+		env      string
+		expected time.Duration
+	}{
+		{env: "", expected: defaultBodyReadTimeout},
+		{env: "10s", expected: 10 * time.Second},
+		{env: "0", expected: 0},
+		{env: "-1s", expected: defaultBodyReadTimeout},
+		{env: "invalid", expected: defaultBodyReadTimeout},
+	} {
+		t.Setenv("SPRAYPROXY_BODY_READ_TIMEOUT", tc.env)
+		proxy, err := NewSprayProxy(false, zap.NewNop())
+		if err != nil {
+			t.Fatalf("failed to set up proxy: %v", err)
+		}
+		if proxy.bodyReadTimeout != tc.expected {
+			t.Errorf("expected body read timeout %s for %q, got %s", tc.expected, tc.env, proxy.bodyReadTimeout)
+		}
+	}
+}
+
+func TestTimeoutBodySlowConsumer(t *testing.T) {
+	conn, client := net.Pipe()
+	defer conn.Close()
+	go func() {
+		client.Write([]byte("hel"))
+		client.Write([]byte("lo"))
+		client.Close()
+	}()
+	body := newTimeoutBody(conn, conn, 100*time.Millisecond)
+	defer body.Close()
+	// the body is sent in time, but only consumed after the timeout, as by a slow backend when streaming
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(body, buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	data, err := io.ReadAll(body)
+	if err != nil || string(data) != "lo" {
+		t.Errorf("expected the rest of the body, got %q: %v", data, err)
+	}
+}
+
+func TestTimeoutBodyTrickled(t *testing.T) {
+	conn, client := net.Pipe()
+	defer conn.Close()
+	defer client.Close()
+	go client.Write([]byte("hel"))
+	body := newTimeoutBody(conn, conn, 100*time.Millisecond)
+	defer body.Close()
+	if _, err := io.ReadAll(body); !errors.Is(err, errBodyReadTimeout) {
+		t.Errorf("expected error %v, got %v", errBodyReadTimeout, err)
+	}
+}
+
+func TestHandleProxyBodyReadError(t *testing.T) {
+	backend := test.NewTestServer()
+	defer backend.GetServer().Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop(), backend.GetServer().URL, backend.GetServer().URL+"/other")
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	body := io.MultiReader(strings.NewReader("hel"), iotest.ErrReader(io.ErrUnexpectedEOF))
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", body)
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
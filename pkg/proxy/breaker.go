@@ -0,0 +1,95 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"errors"
+	"time"
+)
+
+// errCircuitOpen is the error of forwards short-circuited by an open circuit breaker.
+var errCircuitOpen = errors.New("circuit open")
+
+// breakerState tracks the circuit breaker of a single backend host.
+type breakerState struct {
+	failures int
+	open     bool
+	openedAt time.Time
+	// trial is set while the single request allowed through a half-open circuit is in flight
+	trial bool
+}
+
+// allowForward returns true if a request can be forwarded to the given backend host.
+// Once the cooldown of an open circuit has elapsed, a single trial request is let through.
+func (p *SprayProxy) allowForward(host string) bool {
+	if p.breakerThreshold <= 0 {
+		return true
+	}
+	p.breakerLock.Lock()
+	defer p.breakerLock.Unlock()
+	state, ok := p.breakers[host]
+	if !ok || !state.open {
+		return true
+	}
+	if state.trial || time.Since(state.openedAt) < p.breakerCooldown {
+		return false
+	}
+	state.trial = true
+	return true
+}
+
+// releaseTrial lets a new trial request through the half-open circuit of the given backend host, once the
+// trial request ended without telling anything about the health of the backend, such as when canceled.
+// Otherwise the circuit would never close, nor open again.
+func (p *SprayProxy) releaseTrial(host string) {
+	if p.breakerThreshold <= 0 {
+		return
+	}
+	p.breakerLock.Lock()
+	defer p.breakerLock.Unlock()
+	if state, ok := p.breakers[host]; ok {
+		state.trial = false
+	}
+}
+
+// forgetBreaker drops the circuit breaker of the given backend host, once no backend of the host is left.
+func (p *SprayProxy) forgetBreaker(host string) {
+	p.breakerLock.Lock()
+	defer p.breakerLock.Unlock()
+	delete(p.breakers, host)
+}
+
+// recordForward updates the circuit breaker of the given backend host with the outcome of a forward.
+// The circuit opens after the configured number of consecutive failures, or if the trial request of a
+// half-open circuit fails, and closes again on the first success.
+func (p *SprayProxy) recordForward(host string, success bool) {
+	if p.breakerThreshold <= 0 {
+		return
+	}
+	p.breakerLock.Lock()
+	defer p.breakerLock.Unlock()
+	if success {
+		if state, ok := p.breakers[host]; ok && state.open {
+			p.logger.Info("closing circuit of backend " + host)
+		}
+		delete(p.breakers, host)
+		return
+	}
+	state, ok := p.breakers[host]
+	if !ok {
+		state = &breakerState{}
+		p.breakers[host] = state
+	}
+	state.failures++
+	if state.open || state.failures >= p.breakerThreshold {
+		if !state.open {
+			p.logger.Info("opening circuit of backend " + host + " for " + p.breakerCooldown.String())
+		}
+		state.open = true
+		state.openedAt = time.Now()
+		state.trial = false
+	}
+}
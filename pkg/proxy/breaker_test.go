@@ -0,0 +1,147 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics.InitMetrics(registry)
+	backend, calls := newFlakyBackend(3, http.StatusInternalServerError)
+	defer backend.Close()
+	cooldown := 100 * time.Millisecond
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL}, WithCircuitBreaker(2, cooldown))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	forward := func() int {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+		proxy.HandleProxy(ctx)
+		return w.Code
+	}
+	host := strings.TrimPrefix(backend.URL, "http://")
+
+	// two failures open the circuit
+	forward()
+	forward()
+	if code := forward(); code != http.StatusBadGateway {
+		t.Errorf("expected status code %d with an open circuit, got %d", http.StatusBadGateway, code)
+	}
+	if got := atomic.LoadInt32(calls); got != 2 {
+		t.Errorf("expected %d calls to the backend, got %d", 2, got)
+	}
+	if got := metricValue(t, registry, "sprayproxy_http_circuit_open_requests_total", host); got != 1 {
+		t.Errorf("expected %v short-circuited requests, got %v", 1, got)
+	}
+
+	// the failing trial request opens the circuit again
+	time.Sleep(cooldown)
+	forward()
+	forward()
+	if got := atomic.LoadInt32(calls); got != 3 {
+		t.Errorf("expected %d calls to the backend, got %d", 3, got)
+	}
+
+	// the succeeding trial request closes the circuit
+	time.Sleep(cooldown)
+	forward()
+	if code := forward(); code != http.StatusOK {
+		t.Errorf("expected status code %d with a closed circuit, got %d", http.StatusOK, code)
+	}
+	if got := atomic.LoadInt32(calls); got != 5 {
+		t.Errorf("expected %d calls to the backend, got %d", 5, got)
+	}
+}
+
+func TestCircuitBreakerSingleTrial(t *testing.T) {
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), nil, WithCircuitBreaker(1, time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	proxy.recordForward("backend", false)
+	if proxy.allowForward("backend") {
+		t.Error("expected forwards to be short-circuited")
+	}
+	time.Sleep(time.Millisecond)
+	if !proxy.allowForward("backend") {
+		t.Error("expected a trial forward once the cooldown elapsed")
+	}
+	if proxy.allowForward("backend") {
+		t.Error("expected a single trial forward")
+	}
+	proxy.recordForward("backend", true)
+	if !proxy.allowForward("backend") {
+		t.Error("expected forwards once the circuit is closed")
+	}
+}
+
+func TestCircuitBreakerCanceledTrial(t *testing.T) {
+	// the backend fails, then holds the trial request until it is canceled, then succeeds
+	var mode int32
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch atomic.LoadInt32(&mode) {
+		case 0:
+			rw.WriteHeader(http.StatusInternalServerError)
+		case 1:
+			<-release
+		}
+	}))
+	defer backend.Close()
+	defer close(release)
+	cooldown := 50 * time.Millisecond
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL}, WithCircuitBreaker(1, cooldown), WithRetryCount(0))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	forward := func(ctx context.Context) int {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello")).WithContext(ctx)
+		proxy.HandleProxy(c)
+		return w.Code
+	}
+
+	forward(context.Background())
+	time.Sleep(cooldown)
+	atomic.StoreInt32(&mode, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	forward(ctx)
+	atomic.StoreInt32(&mode, 2)
+	if code := forward(context.Background()); code != http.StatusOK {
+		t.Errorf("expected a new trial once the canceled one ended, got status %d", code)
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		proxy.recordForward("backend", false)
+	}
+	if !proxy.allowForward("backend") {
+		t.Error("expected forwards with circuit breakers disabled")
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"context"
+	"sync"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// coalescedForward is the forward of a delivery in progress, whose results are shared with the requests
+// of the same delivery received while it is in progress.
+type coalescedForward struct {
+	// done is closed once results are set
+	done    chan struct{}
+	results []BackendResult
+}
+
+// coalescer coalesces the concurrent forwards of the same delivery, in the manner of singleflight: the
+// first request of a delivery forwards it, the requests of the same delivery received until it completes
+// wait for its results instead of forwarding it again.
+type coalescer struct {
+	lock     sync.Mutex
+	inflight map[string]*coalescedForward
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{inflight: map[string]*coalescedForward{}}
+}
+
+// do returns the results of forward, unless a forward of the delivery with the given ID is in progress,
+// in which case it waits for its results, or returns the error of the context once it is done, as the
+// outcome of the delivery is then unknown. shared is true when the results are the ones of another request.
+func (g *coalescer) do(ctx context.Context, id string, forward func() []BackendResult) (results []BackendResult, shared bool, err error) {
+	g.lock.Lock()
+	if inflight, ok := g.inflight[id]; ok {
+		g.lock.Unlock()
+		select {
+		case <-inflight.done:
+			return inflight.results, true, nil
+		case <-ctx.Done():
+			return nil, true, ctx.Err()
+		}
+	}
+	inflight := &coalescedForward{done: make(chan struct{})}
+	g.inflight[id] = inflight
+	g.lock.Unlock()
+
+	defer func() {
+		g.lock.Lock()
+		delete(g.inflight, id)
+		g.lock.Unlock()
+		close(inflight.done)
+	}()
+	inflight.results = forward()
+	return inflight.results, false, nil
+}
+
+// forwardCoalesced forwards the inbound request to the targets, unless coalescing is enabled and a forward
+// of its delivery is already in progress, in which case the results of that forward are returned.
+// If the request is canceled before that forward completes, every target fails with the error of its
+// context. Requests without a delivery ID are always forwarded.
+func (p *SprayProxy) forwardCoalesced(in *inboundRequest, targets []forwardTarget, zapCommonFields []zapcore.Field) []BackendResult {
+	if p.coalescer == nil || in.delivery == "" {
+		return p.forwardAll(in, targets, nil, zapCommonFields)
+	}
+	results, shared, err := p.coalescer.do(in.ctx, in.delivery, func() []BackendResult {
+		return p.forwardAll(in, targets, nil, zapCommonFields)
+	})
+	if err != nil {
+		p.logger.Error("gave up waiting for the forward of the same delivery: "+err.Error(), append(zapCommonFields, zap.String("delivery", in.delivery))...)
+		failed := make([]BackendResult, 0, len(targets))
+		for _, target := range targets {
+			failed = append(failed, BackendResult{URL: target.backend.URL, Host: target.url.Host, Shadow: target.backend.Shadow, Error: err})
+		}
+		return failed
+	}
+	if shared {
+		metrics.IncCoalescedCount()
+		p.logger.Info("delivery already being forwarded, sharing its results", append(zapCommonFields, zap.String("delivery", in.delivery))...)
+	}
+	return results
+}
@@ -0,0 +1,126 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestHandleProxyCoalescing(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		coalesce      bool
+		delivery      string
+		expectedCalls int32
+	}{
+		{
+			name:          "coalescing disabled",
+			delivery:      "72d3162e",
+			expectedCalls: 3,
+		},
+		{
+			name:          "same delivery",
+			coalesce:      true,
+			delivery:      "72d3162e",
+			expectedCalls: 1,
+		},
+		{
+			name:          "no delivery ID",
+			coalesce:      true,
+			expectedCalls: 3,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls int32
+			release := make(chan struct{})
+			backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				rw.WriteHeader(http.StatusAccepted)
+			}))
+			defer backend.Close()
+			proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL}, WithCoalescing(tc.coalesce))
+			if err != nil {
+				t.Fatalf("failed to set up proxy: %v", err)
+			}
+			codes := make(chan int, 3)
+			var wg sync.WaitGroup
+			for i := 0; i < 3; i++ {
+				wg.Add(1)
+				go func(delivery string) {
+					defer wg.Done()
+					w := httptest.NewRecorder()
+					ctx, _ := gin.CreateTestContext(w)
+					ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+					if delivery != "" {
+						ctx.Request.Header.Set(deliveryHeader, delivery)
+					}
+					proxy.HandleProxy(ctx)
+					codes <- w.Code
+				}(tc.delivery)
+			}
+			// let the requests reach the proxy before the forwards complete
+			time.Sleep(100 * time.Millisecond)
+			close(release)
+			wg.Wait()
+			close(codes)
+			for code := range codes {
+				if code != http.StatusOK {
+					t.Errorf("expected status %d, got %d", http.StatusOK, code)
+				}
+			}
+			if got := atomic.LoadInt32(&calls); got != tc.expectedCalls {
+				t.Errorf("expected %d forwards, got %d", tc.expectedCalls, got)
+			}
+		})
+	}
+}
+
+func TestHandleProxyCoalescingCanceled(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+		rw.WriteHeader(http.StatusAccepted)
+	}))
+	defer backend.Close()
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL}, WithCoalescing(true))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	request := func(ctx context.Context) int {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello")).WithContext(ctx)
+		c.Request.Header.Set(deliveryHeader, "72d3162e")
+		proxy.HandleProxy(c)
+		return w.Code
+	}
+	leader := make(chan int, 1)
+	go func() {
+		leader <- request(context.Background())
+	}()
+	// let the first request start the forward
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if code := request(ctx); code == http.StatusOK {
+		t.Errorf("expected a failure, got status %d", code)
+	}
+	close(release)
+	if code := <-leader; code != http.StatusOK {
+		t.Errorf("expected status %d for the first request, got %d", http.StatusOK, code)
+	}
+}
@@ -0,0 +1,55 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"context"
+	"errors"
+)
+
+// errConcurrencyLimit is the error of the forwards which could not start within the forwarding timeout,
+// as their backend had as many forwards in flight as its concurrency limit allows.
+var errConcurrencyLimit = errors.New("timed out waiting for a slot within the concurrency limit of the backend")
+
+// acquireSlot waits until the backend has less forwards in flight than its MaxConcurrent limit, or the
+// context expires, so forwards to a fragile backend queue rather than fail. The returned function
+// releases the slot once the forward is done. Backends without limit never wait.
+func (p *SprayProxy) acquireSlot(ctx context.Context, backend Backend) (func(), error) {
+	if backend.MaxConcurrent <= 0 {
+		return func() {}, nil
+	}
+	slots := p.slots(backend)
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, errConcurrencyLimit
+	}
+}
+
+// slots returns the semaphore bounding the forwards in flight to the backend, a channel with a buffer of
+// its MaxConcurrent size.
+func (p *SprayProxy) slots(backend Backend) chan struct{} {
+	p.slotsLock.Lock()
+	defer p.slotsLock.Unlock()
+	slots, ok := p.concurrencySlots[backend.URL]
+	if !ok || cap(slots) != backend.MaxConcurrent {
+		// a changed limit applies to new forwards, those in flight release the slots of the previous one
+		slots = make(chan struct{}, backend.MaxConcurrent)
+		if p.concurrencySlots == nil {
+			p.concurrencySlots = map[string]chan struct{}{}
+		}
+		p.concurrencySlots[backend.URL] = slots
+	}
+	return slots
+}
+
+// forgetSlots drops the semaphore of the backend, once it is unregistered.
+func (p *SprayProxy) forgetSlots(backend string) {
+	p.slotsLock.Lock()
+	defer p.slotsLock.Unlock()
+	delete(p.concurrencySlots, backend)
+}
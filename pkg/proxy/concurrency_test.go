@@ -0,0 +1,149 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"github.com/redhat-appstudio/sprayproxy/test"
+	"go.uber.org/zap"
+)
+
+func TestRegisterMaxConcurrent(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics.InitMetrics(registry)
+	var inFlight, maxInFlight int32
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			seen := atomic.LoadInt32(&maxInFlight)
+			if current <= seen || atomic.CompareAndSwapInt32(&maxInFlight, seen, current) {
+				break
+			}
+		}
+		<-release
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	for _, invalid := range []string{"0", "-1", "many"} {
+		w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {backend.URL}, "maxConcurrent": {invalid}})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d for maxConcurrent %q, got %d", http.StatusBadRequest, invalid, w.Code)
+		}
+	}
+	w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {backend.URL}, "maxConcurrent": {"2"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	codes := make(chan int, 4)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+			proxy.HandleProxy(ctx)
+			codes <- w.Code
+		}()
+	}
+	// the forwards beyond the limit queue until the first ones complete
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&inFlight) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := metricValue(t, registry, "sprayproxy_backend_in_flight_forwards", hostOf(t, backend.URL)); got != 2 {
+		t.Errorf("expected 2 forwards in flight, got %v", got)
+	}
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("expected queued forwards to succeed, got status %d", code)
+		}
+	}
+	if got := atomic.LoadInt32(&maxInFlight); got != 2 {
+		t.Errorf("expected at most 2 forwards in flight, got %d", got)
+	}
+	if got := metricValue(t, registry, "sprayproxy_backend_in_flight_forwards", hostOf(t, backend.URL)); got != 0 {
+		t.Errorf("expected no forwards in flight once done, got %v", got)
+	}
+}
+
+func TestMaxConcurrentTimeout(t *testing.T) {
+	backend := test.NewTestServer()
+	defer backend.GetServer().Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {backend.GetServer().URL}, "maxConcurrent": {"1"}, "timeout": {"200ms"}})
+	// the only slot is taken, so the forward waits for it until its timeout
+	slot, err := proxy.acquireSlot(context.Background(), proxy.snapshotBackends()[0])
+	if err != nil {
+		t.Fatalf("failed to acquire the only slot: %v", err)
+	}
+	defer slot()
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected status %d once the forwarding timeout expires, got %d", http.StatusBadGateway, w.Code)
+	}
+}
+
+func TestMaxConcurrentTimeoutTrial(t *testing.T) {
+	backend := test.NewTestServer()
+	defer backend.GetServer().Close()
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), nil, WithCircuitBreaker(1, time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {backend.GetServer().URL}, "maxConcurrent": {"1"}, "timeout": {"100ms"}})
+	proxy.recordForward(hostOf(t, backend.GetServer().URL), false)
+	time.Sleep(time.Millisecond)
+	forward := func() int {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+		proxy.HandleProxy(ctx)
+		return w.Code
+	}
+	// the trial of the half-open circuit times out waiting for the only slot
+	slot, err := proxy.acquireSlot(context.Background(), proxy.snapshotBackends()[0])
+	if err != nil {
+		t.Fatalf("failed to acquire the only slot: %v", err)
+	}
+	if code := forward(); code != http.StatusBadGateway {
+		t.Errorf("expected status %d once the forwarding timeout expires, got %d", http.StatusBadGateway, code)
+	}
+	slot()
+	if code := forward(); code != http.StatusOK {
+		t.Errorf("expected a new trial once the previous one timed out waiting for a slot, got %d", code)
+	}
+}
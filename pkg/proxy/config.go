@@ -0,0 +1,197 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// effectiveConfig is the configuration the proxy runs with, as returned by Config. Secrets are only
+// reported as configured or not.
+type effectiveConfig struct {
+	ForwardingTimeout   string                `json:"forwardingTimeout"`
+	DialTimeout         string                `json:"dialTimeout"`
+	TLSHandshakeTimeout string                `json:"tlsHandshakeTimeout"`
+	KeepAlive           string                `json:"keepAlive"`
+	MaxIdleConns        int                   `json:"maxIdleConns"`
+	MaxIdleConnsPerHost int                   `json:"maxIdleConnsPerHost"`
+	IdleConnTimeout     string                `json:"idleConnTimeout"`
+	MaxRequestSize      int64                 `json:"maxRequestSize"`
+	BodyReadTimeout     string                `json:"bodyReadTimeout"`
+	SpillThreshold      int64                 `json:"spillThreshold"`
+	InsecureTLS         bool                  `json:"insecureTLS"`
+	BackendCA           bool                  `json:"backendCA"`
+	ClientCertificate   bool                  `json:"clientCertificate"`
+	UpstreamProxy       string                `json:"upstreamProxy,omitempty"`
+	LocalAddr           string                `json:"localAddr,omitempty"`
+	H2C                 bool                  `json:"h2c"`
+	FollowRedirects     bool                  `json:"followRedirects"`
+	RetryCount          int                   `json:"retryCount"`
+	RetryBaseDelay      string                `json:"retryBaseDelay"`
+	SuccessPolicy       SuccessPolicy         `json:"successPolicy"`
+	FailOn5xx           bool                  `json:"failOn5xx"`
+	SuccessStatus       int                   `json:"successStatus"`
+	SuccessBody         *string               `json:"successBody,omitempty"`
+	SuccessContentType  string                `json:"successContentType,omitempty"`
+	MultiStatus         bool                  `json:"multiStatus"`
+	JSONResponse        bool                  `json:"jsonResponse"`
+	AllowNoBackends     bool                  `json:"allowNoBackends"`
+	PingEvents          PingMode              `json:"pingEvents"`
+	Async               bool                  `json:"async"`
+	Stream              bool                  `json:"stream"`
+	Tracing             bool                  `json:"tracing"`
+	DecodeBodies        bool                  `json:"decodeBodies"`
+	RequestIDHeader     string                `json:"requestIdHeader"`
+	SensitiveHeaders    []string              `json:"sensitiveHeaders"`
+	ForwardHeaders      []string              `json:"forwardHeaders,omitempty"`
+	DropHeaders         []string              `json:"dropHeaders,omitempty"`
+	LogBodyLimit        int                   `json:"logBodyLimit"`
+	LogErrorBodies      bool                  `json:"logErrorBodies"`
+	LogSuccessBodies    bool                  `json:"logSuccessBodies"`
+	ErrorHistorySize    int                   `json:"errorHistorySize"`
+	UserAgentPrefix     string                `json:"userAgentPrefix,omitempty"`
+	ForwardedUserAgent  UserAgentMode         `json:"forwardedUserAgent"`
+	WebhookSecret       bool                  `json:"webhookSecretConfigured"`
+	WebhookSecretFile   string                `json:"webhookSecretFile,omitempty"`
+	AdminToken          bool                  `json:"adminTokenConfigured"`
+	HealthChecks        *healthChecksConfig   `json:"healthChecks,omitempty"`
+	StartupCheck        bool                  `json:"startupCheck"`
+	StrictStartup       bool                  `json:"strictStartup"`
+	CircuitBreaker      *circuitBreakerConfig `json:"circuitBreaker,omitempty"`
+	Deduplication       *deduplicationConfig  `json:"deduplication,omitempty"`
+	CoalesceDeliveries  bool                  `json:"coalesceDeliveries"`
+	Paused              bool                  `json:"paused"`
+	RateLimit           *rateLimitConfig      `json:"rateLimit,omitempty"`
+	DeadLetterFile      string                `json:"deadLetterFile,omitempty"`
+	BackendsFile        string                `json:"backendsFile,omitempty"`
+	BackendsFuncTTL     string                `json:"backendsFuncTTL,omitempty"`
+	Backends            []backendDetail       `json:"backends"`
+}
+
+type healthChecksConfig struct {
+	Interval  string  `json:"interval"`
+	Path      string  `json:"path"`
+	Threshold int     `json:"threshold"`
+	Jitter    float64 `json:"jitter"`
+}
+
+type circuitBreakerConfig struct {
+	Threshold int    `json:"threshold"`
+	Cooldown  string `json:"cooldown"`
+}
+
+type deduplicationConfig struct {
+	Size int    `json:"size"`
+	TTL  string `json:"ttl"`
+}
+
+type rateLimitConfig struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// Config returns the effective configuration of the proxy as JSON, once environment variables and options
+// are applied, along with the backends and their settings. The webhook secrets and the admin token are
+// never returned, values of backend headers are redacted.
+func (p *SprayProxy) Config(c *gin.Context) {
+	if !p.authorized(c) {
+		return
+	}
+	config := effectiveConfig{
+		ForwardingTimeout:   p.fwdReqTmout.String(),
+		DialTimeout:         p.dialTimeout.String(),
+		TLSHandshakeTimeout: p.tlsHandshakeTimeout.String(),
+		KeepAlive:           p.keepAlive.String(),
+		MaxIdleConns:        p.maxIdleConns,
+		MaxIdleConnsPerHost: p.maxIdleConnsPerHost,
+		IdleConnTimeout:     p.idleConnTimeout.String(),
+		MaxRequestSize:      p.maxReqSize,
+		BodyReadTimeout:     p.bodyReadTimeout.String(),
+		SpillThreshold:      p.spillThreshold,
+		InsecureTLS:         p.insecureTLS,
+		BackendCA:           p.rootCAs != nil,
+		ClientCertificate:   len(p.clientCerts) > 0,
+		H2C:                 p.h2c,
+		FollowRedirects:     p.followRedirects,
+		RetryCount:          p.retryCount,
+		RetryBaseDelay:      p.retryBaseDelay.String(),
+		SuccessPolicy:       p.successPolicy,
+		FailOn5xx:           p.failOn5xx,
+		SuccessStatus:       p.successStatus,
+		MultiStatus:         p.multiStatus,
+		JSONResponse:        p.jsonResponse,
+		AllowNoBackends:     p.allowNoBackends,
+		PingEvents:          p.pingMode,
+		Async:               p.async,
+		CoalesceDeliveries:  p.coalescer != nil,
+		Paused:              p.isPaused(),
+		Stream:              p.stream,
+		Tracing:             p.tracing,
+		DecodeBodies:        p.decodeBodies,
+		RequestIDHeader:     p.requestIDHeader,
+		SensitiveHeaders:    []string{},
+		LogBodyLimit:        p.logBodyLimit,
+		LogErrorBodies:      p.logErrorBodies,
+		LogSuccessBodies:    p.logSuccessBodies,
+		ErrorHistorySize:    p.errorHistorySize,
+		UserAgentPrefix:     p.userAgentPrefix,
+		ForwardedUserAgent:  p.userAgentMode,
+		WebhookSecret:       p.verifiesSignatures(),
+		WebhookSecretFile:   p.webhookSecretFile,
+		StartupCheck:        p.startupCheck || p.strictStartup,
+		StrictStartup:       p.strictStartup,
+		AdminToken:          p.adminToken != "",
+		DeadLetterFile:      p.deadLetterFile,
+		BackendsFile:        p.backendsFile,
+		Backends:            p.backendDetails(),
+	}
+	if p.upstreamProxy != nil {
+		// the proxy URL may hold credentials
+		config.UpstreamProxy = p.upstreamProxy.Redacted()
+	}
+	if p.localAddr != nil {
+		config.LocalAddr = p.localAddr.String()
+	}
+	if p.successBody != nil {
+		body := string(p.successBody)
+		config.SuccessBody = &body
+		config.SuccessContentType = p.successContentType
+	}
+	for header := range p.sensitiveHeaders {
+		config.SensitiveHeaders = append(config.SensitiveHeaders, header)
+	}
+	sort.Strings(config.SensitiveHeaders)
+	if p.allowedHeaders != nil {
+		config.ForwardHeaders = headerNamesOf(p.allowedHeaders)
+	}
+	if p.deniedHeaders != nil {
+		config.DropHeaders = headerNamesOf(p.deniedHeaders)
+	}
+	if p.healthCheckInterval > 0 {
+		config.HealthChecks = &healthChecksConfig{
+			Interval:  p.healthCheckInterval.String(),
+			Path:      p.healthCheckPath,
+			Threshold: p.healthCheckThreshold,
+			Jitter:    p.healthCheckJitter,
+		}
+	}
+	if p.breakerThreshold > 0 {
+		config.CircuitBreaker = &circuitBreakerConfig{Threshold: p.breakerThreshold, Cooldown: p.breakerCooldown.String()}
+	}
+	if p.deliveries != nil {
+		config.Deduplication = &deduplicationConfig{Size: p.deliveries.size, TTL: p.deliveries.ttl.String()}
+	}
+	if p.rateLimiter != nil {
+		config.RateLimit = &rateLimitConfig{Rate: p.rateLimiter.rate, Burst: p.rateLimiter.burst}
+	}
+	if p.provider != nil {
+		config.BackendsFuncTTL = p.provider.ttl.String()
+	}
+	c.JSON(http.StatusOK, config)
+}
@@ -0,0 +1,271 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// deadLetterBufferSize is the number of dead letters queued for writing, beyond which they are dropped
+const deadLetterBufferSize = 1000
+
+// deadLetter is a forward that failed, stored so it can be replayed.
+type deadLetter struct {
+	Backend   string      `json:"backend"`
+	Method    string      `json:"method"`
+	URI       string      `json:"uri"`
+	Header    http.Header `json:"header"`
+	Host      string      `json:"host,omitempty"`
+	Body      []byte      `json:"body"`
+	RequestID string      `json:"requestId"`
+	Error     string      `json:"error,omitempty"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+// deadLetterStore appends dead letters to a JSONL file. Dead letters are queued and written in
+// the background, so storing them does not slow down forwarding.
+type deadLetterStore struct {
+	path    string
+	logger  *zap.Logger
+	entries chan deadLetter
+	done    chan struct{}
+	// fileLock guards the file, which is appended to by the writer and drained on replay
+	fileLock sync.Mutex
+	// closeLock guards closed, set once no more dead letters are accepted
+	closeLock sync.Mutex
+	closed    bool
+}
+
+func newDeadLetterStore(path string, logger *zap.Logger) *deadLetterStore {
+	d := &deadLetterStore{
+		path:    path,
+		logger:  logger,
+		entries: make(chan deadLetter, deadLetterBufferSize),
+		done:    make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// add queues a dead letter for writing, and returns false if it was dropped because the queue is full
+// or the store is closed.
+func (d *deadLetterStore) add(entry deadLetter) bool {
+	d.closeLock.Lock()
+	defer d.closeLock.Unlock()
+	if d.closed {
+		return false
+	}
+	select {
+	case d.entries <- entry:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops accepting dead letters, and waits for the queued ones to be written.
+func (d *deadLetterStore) close() {
+	d.closeLock.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.entries)
+	}
+	d.closeLock.Unlock()
+	<-d.done
+}
+
+// run writes the queued dead letters until the store is closed, in batches of what is queued.
+func (d *deadLetterStore) run() {
+	defer close(d.done)
+	for entry := range d.entries {
+		batch := []deadLetter{entry}
+	collect:
+		for {
+			select {
+			case next, ok := <-d.entries:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, next)
+			default:
+				break collect
+			}
+		}
+		if err := d.write(batch); err != nil {
+			d.logger.Error(fmt.Sprintf("failed to write %d dead letters to %s: %v", len(batch), d.path, err))
+		}
+	}
+}
+
+// write appends the given dead letters to the file, one JSON document per line.
+func (d *deadLetterStore) write(batch []deadLetter) error {
+	d.fileLock.Lock()
+	defer d.fileLock.Unlock()
+	file, err := os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range batch {
+		if err := encoder.Encode(entry); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// drain reads and removes all the dead letters from the file.
+func (d *deadLetterStore) drain() ([]deadLetter, error) {
+	d.fileLock.Lock()
+	defer d.fileLock.Unlock()
+	data, err := os.ReadFile(d.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := []deadLetter{}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		entry := deadLetter{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("invalid dead letter in %s: %w", d.path, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, os.Truncate(d.path, 0)
+}
+
+// storeDeadLetter stores the forward of the inbound request to the target backend if it failed.
+// Bodies are never streamed while dead letters are enabled, so they are always available.
+func (p *SprayProxy) storeDeadLetter(in *inboundRequest, target forwardTarget, result BackendResult, zapCommonFields []zapcore.Field) {
+	if p.deadLetters == nil || !result.Failed() {
+		return
+	}
+	reason := fmt.Sprintf("status %d", result.Status)
+	if result.Error != nil {
+		reason = result.Error.Error()
+	}
+	p.addDeadLetter(in, target, reason, zapCommonFields)
+}
+
+// addDeadLetter stores the forward of the inbound request to the target backend, not forwarded for the
+// given reason.
+func (p *SprayProxy) addDeadLetter(in *inboundRequest, target forwardTarget, reason string, zapCommonFields []zapcore.Field) {
+	fields := append(zapCommonFields, zap.String("backend", target.backend.URL))
+	body, err := in.readBody()
+	if err != nil {
+		p.logger.Error("failed to read spilled body of dead letter: "+err.Error(), fields...)
+		return
+	}
+	entry := deadLetter{
+		Backend:   target.backend.URL,
+		Method:    in.method,
+		URI:       in.url.RequestURI(),
+		Header:    in.header,
+		Host:      in.host,
+		Body:      body,
+		RequestID: in.requestID,
+		Error:     reason,
+		Timestamp: time.Now().UTC(),
+	}
+	if !p.deadLetters.add(entry) {
+		p.logger.Error("dropped dead letter, the dead letter queue is full", fields...)
+	}
+}
+
+// ReplayDeadLetters forwards the stored dead letters again to their backend, with its current settings
+// if it is still registered. Dead letters failing again are stored again, as are the invalid ones, which
+// cannot be forwarded. It returns the number of dead letters successfully forwarded.
+func (p *SprayProxy) ReplayDeadLetters() (int, error) {
+	if p.deadLetters == nil {
+		return 0, errors.New("dead letters are not enabled")
+	}
+	entries, err := p.deadLetters.drain()
+	if err != nil {
+		return 0, err
+	}
+	backends := map[string]Backend{}
+	for _, backend := range p.snapshotBackends() {
+		backends[backend.URL] = backend
+	}
+	replayed := 0
+	invalid := []deadLetter{}
+	for _, entry := range entries {
+		backend, ok := backends[entry.Backend]
+		if !ok {
+			backend = Backend{URL: entry.Backend}
+		}
+		target, in, err := entry.toForward(backend)
+		fields := []zapcore.Field{zap.String("request-id", entry.RequestID), zap.Bool("replay", true)}
+		if err != nil {
+			p.logger.Error("keeping invalid dead letter: "+err.Error(), fields...)
+			invalid = append(invalid, entry)
+			continue
+		}
+		results := p.forwardAll(in, []forwardTarget{target}, nil, fields)
+		if len(results) == 1 && !results[0].Failed() {
+			replayed++
+		}
+	}
+	if len(invalid) > 0 {
+		if err := p.deadLetters.write(invalid); err != nil {
+			return replayed, fmt.Errorf("failed to keep %d invalid dead letters: %w", len(invalid), err)
+		}
+	}
+	p.logger.Info(fmt.Sprintf("replayed %d of %d dead letters", replayed, len(entries)))
+	return replayed, nil
+}
+
+// toForward returns what is needed to forward the dead letter again to the given backend.
+func (d deadLetter) toForward(backend Backend) (forwardTarget, *inboundRequest, error) {
+	backendURL, err := parseBackendURL(backend.URL)
+	if err != nil {
+		return forwardTarget{}, nil, err
+	}
+	uri, err := url.ParseRequestURI(d.URI)
+	if err != nil {
+		return forwardTarget{}, nil, err
+	}
+	header := d.Header
+	if header == nil {
+		header = http.Header{}
+	}
+	in := &inboundRequest{
+		method:        d.Method,
+		url:           *uri,
+		header:        header,
+		host:          d.Host,
+		contentLength: int64(len(d.Body)),
+		body:          d.Body,
+		requestID:     d.RequestID,
+		ctx:           context.Background(),
+	}
+	return forwardTarget{backend: backend, url: backendURL}, in, nil
+}
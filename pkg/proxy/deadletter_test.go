@@ -0,0 +1,122 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// waitForDeadLetters waits until the dead letter file holds the expected number of entries.
+func waitForDeadLetters(t *testing.T, path string, expected int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := os.ReadFile(path)
+		lines := strings.Count(string(data), "\n")
+		if lines == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d dead letters, got %d", expected, lines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	var healthy int32
+	received := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		received <- req.URL.RequestURI() + " " + req.Header.Get(eventHeader) + " " + string(body)
+	}))
+	defer backend.Close()
+	path := filepath.Join(t.TempDir(), "deadletters.jsonl")
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL}, WithDeadLetterFile(path))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080/hooks?id=1", bytes.NewBufferString("hello"))
+	ctx.Request.Header.Set(eventHeader, "push")
+	proxy.HandleProxy(ctx)
+	waitForDeadLetters(t, path, 1)
+
+	// failing again, the dead letter is stored again
+	replayed, err := proxy.ReplayDeadLetters()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if replayed != 0 {
+		t.Errorf("expected %d replayed dead letters, got %d", 0, replayed)
+	}
+	waitForDeadLetters(t, path, 1)
+
+	atomic.StoreInt32(&healthy, 1)
+	replayed, err = proxy.ReplayDeadLetters()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if replayed != 1 {
+		t.Errorf("expected %d replayed dead letters, got %d", 1, replayed)
+	}
+	expected := "/hooks?id=1 push hello"
+	if got := <-received; got != expected {
+		t.Errorf("expected backend to receive %q, got %q", expected, got)
+	}
+	if err := proxy.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitForDeadLetters(t, path, 0)
+}
+
+func TestReplayInvalidDeadLetters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deadletters.jsonl")
+	invalid := `{"backend":"http://backend1","method":"POST","uri":"not a uri","body":"aGVsbG8="}` + "\n"
+	if err := os.WriteFile(path, []byte(invalid), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), nil, WithDeadLetterFile(path))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	replayed, err := proxy.ReplayDeadLetters()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if replayed != 0 {
+		t.Errorf("expected %d replayed dead letters, got %d", 0, replayed)
+	}
+	// the invalid dead letter is kept rather than lost
+	waitForDeadLetters(t, path, 1)
+}
+
+func TestDeadLettersDisabled(t *testing.T) {
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	if _, err := proxy.ReplayDeadLetters(); err == nil {
+		t.Error("expected error replaying without dead letter file")
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// deliveryHeader is the header GitHub uses for the unique ID of a webhook delivery, kept on redeliveries
+const deliveryHeader = "X-GitHub-Delivery"
+
+// deliveryCache is an LRU of recently seen delivery IDs, which expire after a TTL.
+type deliveryCache struct {
+	lock    sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	// order holds the deliveryEntry values, most recently seen first
+	order *list.List
+}
+
+type deliveryEntry struct {
+	id     string
+	seenAt time.Time
+}
+
+func newDeliveryCache(size int, ttl time.Duration) *deliveryCache {
+	return &deliveryCache{
+		size:    size,
+		ttl:     ttl,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// seen returns true if the delivery with the given ID was remembered within the TTL.
+func (d *deliveryCache) seen(id string, now time.Time) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	element, ok := d.entries[id]
+	return ok && now.Sub(element.Value.(*deliveryEntry).seenAt) < d.ttl
+}
+
+// remember records the delivery with the given ID, evicting the least recently remembered one when full.
+func (d *deliveryCache) remember(id string, now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if element, ok := d.entries[id]; ok {
+		element.Value.(*deliveryEntry).seenAt = now
+		d.order.MoveToFront(element)
+		return
+	}
+	d.entries[id] = d.order.PushFront(&deliveryEntry{id: id, seenAt: now})
+	if d.order.Len() > d.size {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.entries, oldest.Value.(*deliveryEntry).id)
+	}
+}
+
+// duplicateDelivery returns true if the inbound request is a delivery forwarded recently, after responding
+// to it. Requests without a delivery ID are never duplicates.
+func (p *SprayProxy) duplicateDelivery(c *gin.Context, in *inboundRequest, zapCommonFields []zapcore.Field) bool {
+	if p.deliveries == nil || in.delivery == "" || !p.deliveries.seen(in.delivery, time.Now()) {
+		return false
+	}
+	metrics.IncDeduplicatedCount()
+	p.logger.Info("duplicate delivery, not forwarding", append(zapCommonFields, zap.String("delivery", in.delivery))...)
+	p.respond(c, http.StatusOK, "duplicate", nil)
+	return true
+}
+
+// rememberDelivery remembers the delivery of the inbound request once it is forwarded to every backend,
+// so that its redeliveries are deduplicated. Deliveries that a backend could not be reached with, or
+// answered with a 5xx status, are forwarded again when redelivered.
+func (p *SprayProxy) rememberDelivery(in *inboundRequest, results []BackendResult) {
+	if p.deliveries == nil || in.delivery == "" {
+		return
+	}
+	for _, result := range results {
+		if !result.Shadow && result.Failed() {
+			return
+		}
+	}
+	p.deliveries.remember(in.delivery, time.Now())
+}
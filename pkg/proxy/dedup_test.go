@@ -0,0 +1,136 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+func TestDeliveryCache(t *testing.T) {
+	cache := newDeliveryCache(2, time.Minute)
+	now := time.Now()
+	if cache.seen("a", now) {
+		t.Error("expected first delivery not to be seen")
+	}
+	if cache.seen("a", now) {
+		t.Error("expected delivery not remembered not to be seen")
+	}
+	cache.remember("a", now)
+	if !cache.seen("a", now) {
+		t.Error("expected redelivery to be seen")
+	}
+	if cache.seen("a", now.Add(time.Minute)) {
+		t.Error("expected redelivery after the TTL not to be seen")
+	}
+	// b and c evict a, the least recently remembered
+	cache.remember("b", now)
+	cache.remember("c", now)
+	if cache.seen("a", now) {
+		t.Error("expected evicted delivery not to be seen")
+	}
+}
+
+func TestHandleProxyDeduplication(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics.InitMetrics(registry)
+	backend, calls := newFlakyBackend(1, http.StatusBadGateway)
+	defer backend.Close()
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL}, WithRetryCount(0), WithDeduplication(10, time.Minute))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	deliver := func(delivery string) string {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+		ctx.Request.Header.Set(deliveryHeader, delivery)
+		proxy.HandleProxy(ctx)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+		}
+		return w.Body.String()
+	}
+
+	// the backend fails the first delivery, which must not be deduplicated on redelivery
+	deliver("delivery-1")
+	if got := deliver("delivery-1"); got != "proxied" {
+		t.Errorf("expected redelivery of a failed delivery to be proxied, got %q", got)
+	}
+	if got := deliver("delivery-1"); got != "duplicate" {
+		t.Errorf("expected redelivery to be a duplicate, got %q", got)
+	}
+	if got := deliver("delivery-2"); got != "proxied" {
+		t.Errorf("expected new delivery to be proxied, got %q", got)
+	}
+	if got := atomic.LoadInt32(calls); got != 3 {
+		t.Errorf("expected %d calls to the backend, got %d", 3, got)
+	}
+	if got := metricValue(t, registry, "sprayproxy_http_deduplicated_requests_total", ""); got != 1 {
+		t.Errorf("expected %v deduplicated requests, got %v", 1, got)
+	}
+}
+
+func TestHandleProxyDeduplicationInFlight(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-release
+		}
+		rw.WriteHeader(http.StatusAccepted)
+	}))
+	defer backend.Close()
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL}, WithDeduplication(10, time.Minute))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	deliver := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+		ctx.Request.Header.Set(deliveryHeader, "delivery-1")
+		ctx.Request.Header.Set("Accept", "application/json")
+		proxy.HandleProxy(ctx)
+		return w
+	}
+	first := make(chan int, 1)
+	go func() {
+		first <- deliver().Code
+	}()
+	// let the first delivery reach the backend
+	time.Sleep(100 * time.Millisecond)
+	// its outcome is unknown yet, so the redelivery is forwarded too
+	if w := deliver(); w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	close(release)
+	if code := <-first; code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, code)
+	}
+	w := deliver()
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	var resp proxyResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("expected a JSON response to a duplicate, got %q: %v", w.Body.String(), err)
+	}
+	// the redelivery in flight and the first delivery reached the backend, the last one is a duplicate
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("expected %d calls to the backend, got %d", 2, got)
+	}
+}
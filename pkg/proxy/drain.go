@@ -0,0 +1,118 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// errDraining is the error of the streams of forwards skipped because their backend is draining.
+var errDraining = errors.New("backend draining")
+
+// startForward counts a forward to the backend as in flight, until endForward is called with the
+// returned ID. It returns false, without counting the forward, if the backend is draining and must not
+// receive new forwards.
+func (p *SprayProxy) startForward(backend string) (uint64, bool) {
+	p.drainLock.Lock()
+	defer p.drainLock.Unlock()
+	if p.draining[backend] {
+		return 0, false
+	}
+	if p.forwarding == nil {
+		p.forwarding = map[string]int{}
+		p.forwardStarts = map[uint64]time.Time{}
+	}
+	p.forwarding[backend]++
+	p.lastForwardID++
+	p.forwardStarts[p.lastForwardID] = time.Now()
+	return p.lastForwardID, true
+}
+
+// endForward counts a forward to the backend started with startForward as done.
+func (p *SprayProxy) endForward(backend string, id uint64) {
+	p.drainLock.Lock()
+	defer p.drainLock.Unlock()
+	if p.forwarding[backend]--; p.forwarding[backend] <= 0 {
+		delete(p.forwarding, backend)
+	}
+	delete(p.forwardStarts, id)
+}
+
+// OldestForwardAge returns the time since the oldest forward in flight started, zero if there is none.
+// It is computed when metrics are scraped, to spot forwards stuck on a backend before they time out.
+func (p *SprayProxy) OldestForwardAge() time.Duration {
+	p.drainLock.Lock()
+	defer p.drainLock.Unlock()
+	var oldest time.Duration
+	now := time.Now()
+	for _, start := range p.forwardStarts {
+		if age := now.Sub(start); age > oldest {
+			oldest = age
+		}
+	}
+	return oldest
+}
+
+// drainState returns whether the backend is draining, and the number of its forwards in flight.
+func (p *SprayProxy) drainState(backend string) (bool, int) {
+	p.drainLock.Lock()
+	defer p.drainLock.Unlock()
+	return p.draining[backend], p.forwarding[backend]
+}
+
+// stopDraining forgets the backend was draining, so it receives forwards again if registered again.
+func (p *SprayProxy) stopDraining(backend string) {
+	p.drainLock.Lock()
+	defer p.drainLock.Unlock()
+	delete(p.draining, backend)
+}
+
+// Drain marks the backend given by the "server" query parameter as draining: it receives no new forwards,
+// while the forwards in flight complete. It responds with the number of forwards still in flight, so it
+// can be called again until there are none left, and the backend can be unregistered without cutting
+// a forward short.
+func (p *SprayProxy) Drain(c *gin.Context) {
+	if !p.authorized(c) {
+		return
+	}
+	if c.Query("server") == "" {
+		c.String(http.StatusBadRequest, "missing server")
+		return
+	}
+	server := c.Query("server")
+	if normalized, err := normalizeBackendURL(server); err == nil {
+		server = normalized
+	}
+	found := false
+	for _, backend := range p.snapshotBackends() {
+		if backend.URL == server {
+			found = true
+			break
+		}
+	}
+	if !found {
+		c.String(http.StatusNotFound, "not found")
+		return
+	}
+	p.drainLock.Lock()
+	if p.draining == nil {
+		p.draining = map[string]bool{}
+	}
+	alreadyDraining := p.draining[server]
+	p.draining[server] = true
+	inFlight := p.forwarding[server]
+	p.drainLock.Unlock()
+	if !alreadyDraining {
+		p.logger.Info("draining backend", zap.String("backend", server), zap.Int("in-flight", inFlight))
+	}
+	c.String(http.StatusOK, fmt.Sprintf("draining, %d forwards in flight", inFlight))
+}
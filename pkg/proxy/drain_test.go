@@ -0,0 +1,132 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+func TestDrain(t *testing.T) {
+	var drainedCalls, otherCalls int32
+	received := make(chan struct{}, 1)
+	release := make(chan struct{})
+	drained := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&drainedCalls, 1)
+		received <- struct{}{}
+		<-release
+	}))
+	defer drained.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&otherCalls, 1)
+	}))
+	defer other.Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop(), drained.URL, other.URL)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	send := func() int {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+		proxy.HandleProxy(ctx)
+		return w.Code
+	}
+
+	if w := callBackendsHandler(proxy.Drain, http.MethodPost, url.Values{"server": {"http://unknown"}}); w.Code != http.StatusNotFound {
+		t.Errorf("expected status code %d draining an unknown backend, got %d", http.StatusNotFound, w.Code)
+	}
+
+	// a forward in flight when the backend starts draining completes
+	done := make(chan int)
+	go func() {
+		done <- send()
+	}()
+	<-received
+	w := callBackendsHandler(proxy.Drain, http.MethodPost, url.Values{"server": {drained.URL + "/"}})
+	if w.Code != http.StatusOK || w.Body.String() != "draining, 1 forwards in flight" {
+		t.Errorf("expected the forward in flight to be reported, got %d %q", w.Code, w.Body.String())
+	}
+	w = callBackendsHandler(proxy.List, http.MethodGet, nil)
+	if expected := drained.URL + " (draining)\n" + other.URL; w.Body.String() != expected {
+		t.Errorf("expected list %q, got %q", expected, w.Body.String())
+	}
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("expected the forward in flight to complete with status code %d, got %d", http.StatusOK, code)
+	}
+
+	// new requests skip the draining backend
+	if code := send(); code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, code)
+	}
+	if got := atomic.LoadInt32(&drainedCalls); got != 1 {
+		t.Errorf("expected the draining backend to receive no new requests, got %d", got)
+	}
+	if got := atomic.LoadInt32(&otherCalls); got != 2 {
+		t.Errorf("expected the other backend to receive every request, got %d", got)
+	}
+	w = callBackendsHandler(proxy.Drain, http.MethodPost, url.Values{"server": {drained.URL}})
+	if w.Body.String() != "draining, 0 forwards in flight" {
+		t.Errorf("expected no forwards in flight, got %q", w.Body.String())
+	}
+
+	// registering the backend again once unregistered does not keep it draining
+	callBackendsHandler(proxy.Unregister, http.MethodDelete, url.Values{"server": {drained.URL}})
+	callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {drained.URL}})
+	if draining, _ := proxy.drainState(drained.URL); draining {
+		t.Error("expected the registered backend not to be draining")
+	}
+}
+
+func TestOldestForwardAgeMetric(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics.InitMetrics(registry)
+	received := make(chan struct{})
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		close(received)
+		<-release
+	}))
+	defer backend.Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop(), backend.URL)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	metrics.SetOldestForwardAgeFunc(proxy.OldestForwardAge)
+	defer metrics.SetOldestForwardAgeFunc(nil)
+	if got := metricValue(t, registry, "sprayproxy_oldest_in_flight_forward_age_seconds", ""); got != 0 {
+		t.Errorf("expected no forward in flight, got age %v", got)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+		proxy.HandleProxy(ctx)
+	}()
+	<-received
+	time.Sleep(50 * time.Millisecond)
+	if got := metricValue(t, registry, "sprayproxy_oldest_in_flight_forward_age_seconds", ""); got < 0.05 {
+		t.Errorf("expected the age of the stuck forward, got %v", got)
+	}
+	close(release)
+	<-done
+	if got := metricValue(t, registry, "sprayproxy_oldest_in_flight_forward_age_seconds", ""); got != 0 {
+		t.Errorf("expected no forward in flight once done, got age %v", got)
+	}
+}
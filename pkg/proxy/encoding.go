@@ -0,0 +1,81 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const contentEncodingHeader = "Content-Encoding"
+
+// errDecodedBodyTooLarge is the error of encoded bodies decoding to more than the maximum request size.
+var errDecodedBodyTooLarge = errors.New("decoded body too large")
+
+// decodingReader returns a reader of the body decoded according to the Content-Encoding header of the
+// request. Reading more than limit decoded bytes fails with errDecodedBodyTooLarge, so a small compressed
+// payload cannot expand without bounds. Bodies without encoding, or with the identity one, are read as is.
+func decodingReader(encoding string, body io.Reader, limit int64) (io.Reader, error) {
+	var reader io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		gzipReader, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = gzipReader
+	case "deflate":
+		// deflate is meant to be zlib wrapped, but some clients send raw deflate data
+		buffered := bufio.NewReader(body)
+		if header, err := buffered.Peek(2); err == nil && isZlibHeader(header) {
+			zlibReader, err := zlib.NewReader(buffered)
+			if err != nil {
+				return nil, err
+			}
+			reader = zlibReader
+		} else {
+			reader = flate.NewReader(buffered)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+	return &limitedReader{reader: reader, remaining: limit}, nil
+}
+
+// isZlibHeader returns true if the two bytes are a zlib header, for deflate compressed data.
+func isZlibHeader(header []byte) bool {
+	return header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0
+}
+
+// limitedReader reads up to remaining bytes, and fails with errDecodedBodyTooLarge past them.
+type limitedReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, errDecodedBodyTooLarge
+	}
+	// read one byte past the limit, to tell bodies of exactly the limit from larger ones
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.reader.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, errDecodedBodyTooLarge
+	}
+	return n, err
+}
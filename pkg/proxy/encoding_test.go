@@ -0,0 +1,85 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"testing"
+)
+
+// compress encodes the data with the given writer, such as a gzip one.
+func compress(t *testing.T, data []byte, newWriter func(io.Writer) io.WriteCloser) []byte {
+	var buf bytes.Buffer
+	writer := newWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatalf("failed to compress: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("failed to compress: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	return compress(t, data, func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })
+}
+
+// decode reads the body through a decoding reader.
+func decode(encoding string, body []byte, limit int64) ([]byte, error) {
+	reader, err := decodingReader(encoding, bytes.NewReader(body), limit)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+func TestDecodingReader(t *testing.T) {
+	payload := []byte(`{"action":"opened"}`)
+	zlibbed := compress(t, payload, func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) })
+	deflated := compress(t, payload, func(w io.Writer) io.WriteCloser {
+		writer, _ := flate.NewWriter(w, flate.DefaultCompression)
+		return writer
+	})
+	for _, tc := range []struct {
+		name     string
+		encoding string
+		body     []byte
+	}{
+		{name: "no encoding", body: payload},
+		{name: "identity", encoding: "identity", body: payload},
+		{name: "gzip", encoding: "gzip", body: gzipped(t, payload)},
+		{name: "x-gzip", encoding: "X-Gzip", body: gzipped(t, payload)},
+		{name: "zlib deflate", encoding: "deflate", body: zlibbed},
+		{name: "raw deflate", encoding: "deflate", body: deflated},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			decoded, err := decode(tc.encoding, tc.body, int64(len(payload)))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(decoded, payload) {
+				t.Errorf("expected decoded body %q, got %q", payload, decoded)
+			}
+		})
+	}
+
+	if _, err := decode("br", payload, 1024); err == nil {
+		t.Error("expected an error for an unsupported encoding")
+	}
+	if _, err := decode("gzip", payload, 1024); err == nil {
+		t.Error("expected an error for a corrupt gzip body")
+	}
+	// a small compressed body cannot expand past the limit
+	bomb := gzipped(t, make([]byte, 1<<20))
+	if _, err := decode("gzip", bomb, 1024); !errors.Is(err, errDecodedBodyTooLarge) {
+		t.Errorf("expected errDecodedBodyTooLarge, got %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// ErrorClass is the class of the error of a forward failing without a response from the backend.
+type ErrorClass string
+
+const (
+	// ErrorClassTimeout is a backend not answering in time, such as a slow or overloaded backend.
+	ErrorClassTimeout ErrorClass = "timeout"
+	// ErrorClassConnectionRefused is a backend refusing connections, such as a backend which is down.
+	ErrorClassConnectionRefused ErrorClass = "connection_refused"
+	// ErrorClassDNS is the host of a backend failing to resolve.
+	ErrorClassDNS ErrorClass = "dns"
+	// ErrorClassOther is any other error, such as a TLS or protocol error.
+	ErrorClassOther ErrorClass = "other"
+)
+
+// ClassifyError returns the class of the error returned by an HTTP client sending a request to a backend,
+// telling slow backends from unreachable ones.
+func ClassifyError(err error) ErrorClass {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return ErrorClassDNS
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return ErrorClassConnectionRefused
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return ErrorClassTimeout
+	}
+	return ErrorClassOther
+}
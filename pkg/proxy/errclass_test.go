@@ -0,0 +1,94 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+func TestClassifyError(t *testing.T) {
+	refused := httptest.NewServer(http.NotFoundHandler())
+	refused.Close()
+	_, refusedErr := http.Post(refused.URL, "text/plain", nil)
+
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer slow.Close()
+	_, timeoutErr := (&http.Client{Timeout: 10 * time.Millisecond}).Post(slow.URL, "text/plain", nil)
+
+	for name, tc := range map[string]struct {
+		err      error
+		expected ErrorClass
+	}{
+		"connection refused": {refusedErr, ErrorClassConnectionRefused},
+		"client timeout":     {timeoutErr, ErrorClassTimeout},
+		"wrapped refused": {&url.Error{Op: "Post", URL: "http://backend", Err: &net.OpError{
+			Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}, ErrorClassConnectionRefused},
+		"dns": {&url.Error{Op: "Post", URL: "http://backend", Err: &net.OpError{
+			Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "backend", IsNotFound: true}}}, ErrorClassDNS},
+		"context deadline": {&url.Error{Op: "Post", URL: "http://backend", Err: context.DeadlineExceeded}, ErrorClassTimeout},
+		"other":            {errors.New("tls: bad certificate"), ErrorClassOther},
+	} {
+		if tc.err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+		if got := ClassifyError(tc.err); got != tc.expected {
+			t.Errorf("%s: expected class %s for %v, got %s", name, tc.expected, tc.err, got)
+		}
+	}
+}
+
+func TestHandleProxyErrorClassMetric(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics.InitMetrics(registry)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop(), down.URL)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+	proxy.HandleProxy(ctx)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	class := ""
+	for _, family := range families {
+		if family.GetName() != "sprayproxy_http_forwarded_failures_total" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "class" {
+					class = label.GetValue()
+				}
+			}
+		}
+	}
+	if class != string(ErrorClassConnectionRefused) {
+		t.Errorf("expected the failure to be counted as %s, got %q", ErrorClassConnectionRefused, class)
+	}
+}
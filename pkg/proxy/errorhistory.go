@@ -0,0 +1,106 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultErrorHistorySize is the number of error responses kept per backend by default.
+const defaultErrorHistorySize = 10
+
+// BackendError is an error response of a backend, kept for diagnostics. Response headers are not kept,
+// as they may hold secrets.
+type BackendError struct {
+	Time   time.Time `json:"time"`
+	Status int       `json:"status"`
+	// Body is the start of the response body, truncated to the log body limit
+	Body      string `json:"body,omitempty"`
+	RequestID string `json:"requestId"`
+}
+
+// BackendErrors are the last error responses of a backend, oldest first.
+type BackendErrors struct {
+	Host   string         `json:"host"`
+	Errors []BackendError `json:"errors"`
+}
+
+// errorRing is a fixed size ring buffer of the last error responses of a backend.
+type errorRing struct {
+	entries []BackendError
+	// next is the index the next error is written at, once the ring is full it is the oldest one
+	next int
+	full bool
+}
+
+func (r *errorRing) add(e BackendError) {
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// list returns the errors of the ring, oldest first.
+func (r *errorRing) list() []BackendError {
+	if !r.full {
+		return append([]BackendError{}, r.entries[:r.next]...)
+	}
+	return append(append([]BackendError{}, r.entries[r.next:]...), r.entries[:r.next]...)
+}
+
+// recordError keeps the error response of the backend, dropping its oldest one once errorHistorySize are
+// kept. Memory is bounded by the history size and the log body limit the body is truncated to.
+func (p *SprayProxy) recordError(host string, e BackendError) {
+	if p.errorHistorySize <= 0 {
+		return
+	}
+	p.errorHistoryLock.Lock()
+	defer p.errorHistoryLock.Unlock()
+	ring, ok := p.errorHistory[host]
+	if !ok || len(ring.entries) != p.errorHistorySize {
+		ring = &errorRing{entries: make([]BackendError, p.errorHistorySize)}
+		p.errorHistory[host] = ring
+	}
+	ring.add(e)
+}
+
+// forgetErrors drops the error responses kept for the backend, once it is unregistered.
+func (p *SprayProxy) forgetErrors(backend string) {
+	backendURL, err := parseBackendURL(backend)
+	if err != nil {
+		return
+	}
+	p.errorHistoryLock.Lock()
+	defer p.errorHistoryLock.Unlock()
+	delete(p.errorHistory, backendURL.Host)
+}
+
+// LastErrors returns the last error responses of every backend that answered with one, sorted by host.
+func (p *SprayProxy) LastErrors() []BackendErrors {
+	p.errorHistoryLock.Lock()
+	defer p.errorHistoryLock.Unlock()
+	errors := make([]BackendErrors, 0, len(p.errorHistory))
+	for host, ring := range p.errorHistory {
+		errors = append(errors, BackendErrors{Host: host, Errors: ring.list()})
+	}
+	sort.Slice(errors, func(i, j int) bool {
+		return errors[i].Host < errors[j].Host
+	})
+	return errors
+}
+
+// ListErrors returns the last error responses of every backend as JSON.
+func (p *SprayProxy) ListErrors(c *gin.Context) {
+	if !p.authorized(c) {
+		return
+	}
+	c.JSON(http.StatusOK, p.LastErrors())
+}
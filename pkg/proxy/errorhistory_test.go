@@ -0,0 +1,114 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestLastErrors(t *testing.T) {
+	var count int32
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&count, 1)
+		rw.Header().Set("Set-Cookie", "session=hunter2")
+		if n == 1 {
+			rw.WriteHeader(http.StatusOK)
+			return
+		}
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("failure " + strconv.Itoa(int(n)) + " " + strings.Repeat("x", 100)))
+	}))
+	defer backend.Close()
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL}, WithErrorHistorySize(2), WithLogBodyLimit(10))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+		ctx.Set("requestId", "request-"+strconv.Itoa(i+1))
+		proxy.HandleProxy(ctx)
+	}
+
+	w := callBackendsHandler(proxy.ListErrors, http.MethodGet, nil)
+	if strings.Contains(w.Body.String(), "hunter2") {
+		t.Errorf("expected response headers not to be kept, got %s", w.Body.String())
+	}
+	listed := []BackendErrors{}
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+		t.Fatalf("failed to parse response %q: %v", w.Body.String(), err)
+	}
+	if len(listed) != 1 || listed[0].Host != hostOf(t, backend.URL) {
+		t.Fatalf("expected the errors of a single backend, got %+v", listed)
+	}
+	errors := listed[0].Errors
+	if len(errors) != 2 {
+		t.Fatalf("expected the last 2 errors to be kept, got %+v", errors)
+	}
+	for i, expected := range []struct {
+		requestID string
+		body      string
+	}{
+		{requestID: "request-3", body: "failure 3 ... (100 bytes truncated)"},
+		{requestID: "request-4", body: "failure 4 ... (100 bytes truncated)"},
+	} {
+		got := errors[i]
+		if got.RequestID != expected.requestID || got.Status != http.StatusInternalServerError || got.Body != expected.body || got.Time.IsZero() {
+			t.Errorf("unexpected error %d: %+v", i, got)
+		}
+	}
+
+	// unregistering the backend drops its errors
+	callBackendsHandler(proxy.Unregister, http.MethodDelete, url.Values{"server": {backend.URL}})
+	if got := proxy.LastErrors(); len(got) != 0 {
+		t.Errorf("expected no errors once the backend is unregistered, got %+v", got)
+	}
+}
+
+func TestErrorRing(t *testing.T) {
+	ring := &errorRing{entries: make([]BackendError, 3)}
+	if got := ring.list(); len(got) != 0 {
+		t.Errorf("expected an empty ring, got %+v", got)
+	}
+	for status := 1; status <= 5; status++ {
+		ring.add(BackendError{Status: status})
+	}
+	got := ring.list()
+	if len(got) != 3 || got[0].Status != 3 || got[1].Status != 4 || got[2].Status != 5 {
+		t.Errorf("expected the last 3 errors oldest first, got %+v", got)
+	}
+}
+
+func TestProxyErrorHistorySizeEnv(t *testing.T) {
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	if proxy.errorHistorySize != defaultErrorHistorySize {
+		t.Errorf("expected the default error history size, got %d", proxy.errorHistorySize)
+	}
+	t.Setenv("SPRAYPROXY_ERROR_HISTORY_SIZE", "0")
+	proxy, err = NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	proxy.recordError("localhost", BackendError{Status: http.StatusNotFound})
+	if got := proxy.LastErrors(); len(got) != 0 {
+		t.Errorf("expected no errors to be kept, got %+v", got)
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"strings"
+	"time"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// rolePrimary backends of a group are picked by round-robin, it is the role of backends without one
+	rolePrimary = "primary"
+	// roleBackup backends of a group are only forwarded to when the forward to its picked backend fails
+	roleBackup = "backup"
+)
+
+// parseRole returns the role of the given name, false if it is unknown.
+func parseRole(name string) (string, bool) {
+	switch role := strings.ToLower(strings.TrimSpace(name)); role {
+	case rolePrimary, roleBackup:
+		return role, true
+	}
+	return "", false
+}
+
+// isBackup returns true if the backend is only forwarded to when the other backends of its group fail.
+func (b Backend) isBackup() bool {
+	return b.Role == roleBackup
+}
+
+// hasBackups returns true if any of the targets fails over to backups, which then need the body to be
+// buffered to be replayed.
+func hasBackups(targets []forwardTarget) bool {
+	for _, target := range targets {
+		if len(target.backups) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// splitBackups returns the primary backends of a group and its backups, keeping their registration order.
+func splitBackups(candidates []forwardTarget) ([]forwardTarget, []forwardTarget) {
+	primaries := []forwardTarget{}
+	backups := []forwardTarget{}
+	for _, candidate := range candidates {
+		if candidate.backend.isBackup() {
+			backups = append(backups, candidate)
+		} else {
+			primaries = append(primaries, candidate)
+		}
+	}
+	return primaries, backups
+}
+
+// failOver forwards the inbound request to the backups of the target in order, as long as the forward
+// before failed, and returns the last target forwarded to along with its result. Shadow backends never
+// fail over, their failures not affecting the response.
+func (p *SprayProxy) failOver(in *inboundRequest, target forwardTarget, result BackendResult, zapCommonFields []zapcore.Field) (forwardTarget, BackendResult) {
+	for _, backup := range target.backups {
+		if !result.Failed() || result.Shadow {
+			break
+		}
+		forwardID, ok := p.startForward(backup.backend.URL)
+		if !ok {
+			p.logger.Info("skipping draining backup backend", append(zapCommonFields, zap.String("backend", backup.backend.URL))...)
+			continue
+		}
+		metrics.IncFailoverCount(result.Host)
+		p.logger.Warn("failing over to backup backend", append(zapCommonFields, zap.String("backend", backup.backend.URL), zap.String("failed-backend", target.backend.URL))...)
+		p.recordDelivery(result, time.Now())
+		client := p.backendClient(backup.backend)
+		client.Timeout = 0
+		start := time.Now()
+		backupResult := p.forwardToBackend(client, in, backup, nil, zapCommonFields)
+		backupResult.Latency = time.Since(start)
+		p.endForward(backup.backend.URL, forwardID)
+		target, result = backup, backupResult
+	}
+	return target, result
+}
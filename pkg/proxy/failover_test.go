@@ -0,0 +1,111 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+func TestRegisterRole(t *testing.T) {
+	var primaryStatus, primaryCalls, backupCalls int32
+	primary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&primaryCalls, 1)
+		rw.WriteHeader(int(atomic.LoadInt32(&primaryStatus)))
+	}))
+	defer primary.Close()
+	backup := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&backupCalls, 1)
+	}))
+	defer backup.Close()
+	registry := prometheus.NewRegistry()
+	metrics.InitMetrics(registry)
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+
+	for _, tc := range []struct {
+		query    url.Values
+		expected string
+	}{
+		{query: url.Values{"server": {backup.URL}, "group": {"tekton"}, "role": {"standby"}}, expected: "invalid role, expected primary or backup"},
+		{query: url.Values{"server": {backup.URL}, "role": {"backup"}}, expected: "invalid role, backup backends must belong to a group"},
+	} {
+		w := callBackendsHandler(proxy.Register, http.MethodPost, tc.query)
+		if w.Code != http.StatusBadRequest || w.Body.String() != tc.expected {
+			t.Errorf("expected %q for %v, got %d %q", tc.expected, tc.query, w.Code, w.Body.String())
+		}
+	}
+	for _, query := range []url.Values{
+		{"server": {primary.URL}, "group": {"tekton"}, "role": {"primary"}},
+		{"server": {backup.URL}, "group": {"tekton"}, "role": {"Backup"}},
+	} {
+		if w := callBackendsHandler(proxy.Register, http.MethodPost, query); w.Code != http.StatusOK {
+			t.Fatalf("failed to register %v: %d %q", query, w.Code, w.Body.String())
+		}
+	}
+	w := callBackendsHandler(proxy.List, http.MethodGet, nil)
+	expected := primary.URL + " (group tekton) (primary)\n" + backup.URL + " (group tekton) (backup)"
+	if w.Body.String() != expected {
+		t.Errorf("expected list %q, got %q", expected, w.Body.String())
+	}
+
+	send := func() int {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+		proxy.HandleProxy(ctx)
+		return w.Code
+	}
+	atomic.StoreInt32(&primaryStatus, http.StatusOK)
+	if code := send(); code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", code)
+	}
+	if primary, backup := atomic.LoadInt32(&primaryCalls), atomic.LoadInt32(&backupCalls); primary != 1 || backup != 0 {
+		t.Errorf("expected only the primary to be forwarded to, got %d and %d forwards", primary, backup)
+	}
+
+	atomic.StoreInt32(&primaryStatus, http.StatusInternalServerError)
+	if code := send(); code != http.StatusOK {
+		t.Errorf("expected the backup to take over with status 200, got %d", code)
+	}
+	if backup := atomic.LoadInt32(&backupCalls); backup != 1 {
+		t.Errorf("expected the backup to be forwarded to once the primary failed, got %d forwards", backup)
+	}
+	if value := metricValue(t, registry, "sprayproxy_http_failover_requests_total", strings.TrimPrefix(primary.URL, "http://")); value != 1 {
+		t.Errorf("expected 1 failover, got %v", value)
+	}
+}
+
+func TestSelectBackendsBackupOnly(t *testing.T) {
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	proxy.backends = []Backend{
+		{URL: "http://primary", Group: "tekton", Weight: new(int)},
+		{URL: "http://backup1", Group: "tekton", Role: roleBackup},
+		{URL: "http://backup2", Group: "tekton", Role: roleBackup},
+	}
+	targets := proxy.selectBackends(&inboundRequest{method: http.MethodPost}, nil)
+	if len(targets) != 1 || targets[0].backend.URL != "http://backup1" {
+		t.Fatalf("expected the first backup to take over, got %v", targets)
+	}
+	if len(targets[0].backups) != 1 || targets[0].backups[0].backend.URL != "http://backup2" {
+		t.Errorf("expected the second backup to remain, got %v", targets[0].backups)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// errShuttingDown is the error of forwarding once the proxy is shutting down.
+var errShuttingDown = errors.New("shutting down")
+
+// Forward forwards a request with the given body, headers, method and path, along with its query if any,
+// to the backends it is meant for, as HandleProxy does once it read the inbound request, and returns the
+// result of each forward, none when forwarding is paused. The body is not verified against the webhook
+// secrets, and the forwards are canceled along with the context. An error is returned if the path is
+// invalid or the proxy is shutting down.
+func (p *SprayProxy) Forward(ctx context.Context, body []byte, header http.Header, method, path string) ([]BackendResult, error) {
+	uri, err := url.ParseRequestURI(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path: %w", err)
+	}
+	if !p.beginForward() {
+		return nil, errShuttingDown
+	}
+	defer p.endInflight()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	header = header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	requestID := header.Get(p.requestIDHeader)
+	if requestID == "" {
+		requestID = uuid.New().String()
+	}
+	in := &inboundRequest{
+		method:        method,
+		url:           *uri,
+		header:        header,
+		contentLength: int64(len(body)),
+		body:          body,
+		event:         header.Get(eventHeader),
+		delivery:      header.Get(deliveryHeader),
+		requestID:     requestID,
+		ctx:           ctx,
+	}
+	zapCommonFields := p.commonFields(in)
+	results, _ := p.forward(in, p.selectTargets(in, zapCommonFields), zapCommonFields)
+	return results, nil
+}
+
+// commonFields returns the fields logged along with every entry about the inbound request.
+func (p *SprayProxy) commonFields(in *inboundRequest) []zapcore.Field {
+	return []zapcore.Field{
+		zap.String("method", in.method),
+		zap.String("path", in.url.Path),
+		zap.String("query", in.url.RawQuery),
+		zap.Bool("insecure-tls", p.insecureTLS),
+		zap.String("request-id", in.requestID),
+	}
+}
+
+// selectTargets returns the backends the inbound request is forwarded to, before its body is read.
+func (p *SprayProxy) selectTargets(in *inboundRequest, zapCommonFields []zapcore.Field) []forwardTarget {
+	targets := p.selectBackends(in, zapCommonFields)
+	if in.event == pingEvent {
+		targets = p.pingTargets(targets, zapCommonFields)
+	}
+	return targets
+}
+
+// forward is the forwarding core of HandleProxy and Forward, once the body of the inbound request is read.
+// It forwards the request to the targets matching its repository, sharing the results of a forward of
+// the same delivery in progress, and returns the result of each forward. While forwarding is paused, the
+// request is held instead and true is returned, without results.
+func (p *SprayProxy) forward(in *inboundRequest, targets []forwardTarget, zapCommonFields []zapcore.Field) ([]BackendResult, bool) {
+	targets = p.filterByRepo(in, targets, zapCommonFields)
+	if p.isPaused() {
+		p.holdPaused(in, targets, zapCommonFields)
+		return []BackendResult{}, true
+	}
+	results := p.forwardCoalesced(in, targets, zapCommonFields)
+	p.rememberDelivery(in, results)
+	return results, false
+}
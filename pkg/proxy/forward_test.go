@@ -0,0 +1,79 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestForward(t *testing.T) {
+	received := make(chan string, 1)
+	ok := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		received <- req.Method + " " + req.URL.RequestURI() + " " + req.Header.Get(eventHeader) + " " + string(body)
+	}))
+	defer ok.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{ok.URL, failing.URL, unreachable.URL})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	header := http.Header{}
+	header.Set(eventHeader, "push")
+	results, err := proxy.Forward(context.Background(), []byte("hello"), header, http.MethodPost, "/hook?id=1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %v", results)
+	}
+	if forwarded := <-received; forwarded != "POST /hook?id=1 push hello" {
+		t.Errorf("unexpected forwarded request %q", forwarded)
+	}
+	for _, result := range results {
+		switch result.Host {
+		case strings.TrimPrefix(ok.URL, "http://"):
+			if result.Status != http.StatusOK || result.Error != nil || result.Failed() {
+				t.Errorf("expected the forward to succeed, got %+v", result)
+			}
+		case strings.TrimPrefix(failing.URL, "http://"):
+			if result.Status != http.StatusInternalServerError || !result.Failed() {
+				t.Errorf("expected the forward to fail with 500, got %+v", result)
+			}
+		case strings.TrimPrefix(unreachable.URL, "http://"):
+			if result.Status != 0 || result.Error == nil || !result.Failed() {
+				t.Errorf("expected the forward to fail to connect, got %+v", result)
+			}
+		default:
+			t.Errorf("unexpected result %+v", result)
+		}
+		if result.Latency <= 0 {
+			t.Errorf("expected the latency to be measured, got %+v", result)
+		}
+	}
+
+	if _, err := proxy.Forward(context.Background(), nil, nil, http.MethodPost, "hook"); err == nil {
+		t.Error("expected an invalid path to fail")
+	}
+	proxy.setPaused(true)
+	results, err = proxy.Forward(context.Background(), []byte("hello"), nil, http.MethodPost, "/")
+	if err != nil || len(results) != 0 {
+		t.Errorf("expected no results while paused, got %v, %v", results, err)
+	}
+}
@@ -0,0 +1,42 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	forwardedForHeader   = "X-Forwarded-For"
+	forwardedHostHeader  = "X-Forwarded-Host"
+	forwardedProtoHeader = "X-Forwarded-Proto"
+)
+
+// forwardedHeader returns the headers of the inbound request with the standard reverse proxy headers set,
+// so backends can recover the origin of the request. The client address is appended to any existing
+// X-Forwarded-For chain, while the host and protocol set by a proxy in front of us are kept.
+func forwardedHeader(r *http.Request) http.Header {
+	header := r.Header.Clone()
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := header.Values(forwardedForHeader); len(prior) > 0 {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		header.Set(forwardedForHeader, clientIP)
+	}
+	if header.Get(forwardedHostHeader) == "" && r.Host != "" {
+		header.Set(forwardedHostHeader, r.Host)
+	}
+	if header.Get(forwardedProtoHeader) == "" {
+		proto := "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+		header.Set(forwardedProtoHeader, proto)
+	}
+	return header
+}
@@ -0,0 +1,82 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestForwardedHeader(t *testing.T) {
+	for name, tc := range map[string]struct {
+		header    http.Header
+		tls       bool
+		wantFor   string
+		wantHost  string
+		wantProto string
+	}{
+		"direct":      {http.Header{}, false, "192.0.2.1", "localhost:8080", "http"},
+		"tls":         {http.Header{}, true, "192.0.2.1", "localhost:8080", "https"},
+		"chained":     {http.Header{"X-Forwarded-For": {"203.0.113.7, 198.51.100.2"}}, false, "203.0.113.7, 198.51.100.2, 192.0.2.1", "localhost:8080", "http"},
+		"multi value": {http.Header{"X-Forwarded-For": {"203.0.113.7", "198.51.100.2"}}, false, "203.0.113.7, 198.51.100.2, 192.0.2.1", "localhost:8080", "http"},
+		"behind proxy": {
+			http.Header{"X-Forwarded-Host": {"smee.example.com"}, "X-Forwarded-Proto": {"https"}}, false,
+			"192.0.2.1", "smee.example.com", "https",
+		},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "http://localhost:8080", nil)
+		r.Header = tc.header
+		if tc.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		header := forwardedHeader(r)
+		if got := header.Get("X-Forwarded-For"); got != tc.wantFor {
+			t.Errorf("%s: expected X-Forwarded-For %q, got %q", name, tc.wantFor, got)
+		}
+		if got := header.Get("X-Forwarded-Host"); got != tc.wantHost {
+			t.Errorf("%s: expected X-Forwarded-Host %q, got %q", name, tc.wantHost, got)
+		}
+		if got := header.Get("X-Forwarded-Proto"); got != tc.wantProto {
+			t.Errorf("%s: expected X-Forwarded-Proto %q, got %q", name, tc.wantProto, got)
+		}
+		if r.Header.Get("X-Forwarded-For") == tc.wantFor {
+			t.Errorf("%s: expected the inbound headers to be left untouched", name)
+		}
+	}
+}
+
+func TestHandleProxyForwardedHeaders(t *testing.T) {
+	received := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+	}))
+	defer backend.Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop(), backend.URL)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+	ctx.Request.Header.Set("X-Forwarded-For", "203.0.113.7")
+	proxy.HandleProxy(ctx)
+	header := <-received
+	if got := header.Get("X-Forwarded-For"); got != "203.0.113.7, 192.0.2.1" {
+		t.Errorf("expected client address appended to X-Forwarded-For, got %q", got)
+	}
+	if got := header.Get("X-Forwarded-Host"); got != "localhost:8080" {
+		t.Errorf("expected X-Forwarded-Host localhost:8080, got %q", got)
+	}
+	if got := header.Get("X-Forwarded-Proto"); got != "http" {
+		t.Errorf("expected X-Forwarded-Proto http, got %q", got)
+	}
+}
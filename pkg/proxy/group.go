@@ -0,0 +1,42 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+// pickFromGroup picks the backend of the group the request is forwarded to, among the given candidates,
+// by smooth weighted round-robin: every pick raises the current weight of each candidate by its weight,
+// the candidate with the highest current weight is picked and lowered by the total weight. Backends are
+// then picked in proportion to their weights, without long runs of the same backend. It returns false if
+// no candidate has a positive weight.
+func (p *SprayProxy) pickFromGroup(group string, candidates []forwardTarget) (forwardTarget, bool) {
+	p.groupsLock.Lock()
+	defer p.groupsLock.Unlock()
+	if p.groups == nil {
+		p.groups = map[string]map[string]int{}
+	}
+	// only keep the state of the current candidates, so removed or unhealthy backends do not linger
+	previous := p.groups[group]
+	current := map[string]int{}
+	total := 0
+	picked := -1
+	for i, candidate := range candidates {
+		weight := candidate.backend.weight()
+		if weight <= 0 {
+			continue
+		}
+		url := candidate.backend.URL
+		current[url] = previous[url] + weight
+		total += weight
+		if picked < 0 || current[url] > current[candidates[picked].backend.URL] {
+			picked = i
+		}
+	}
+	p.groups[group] = current
+	if picked < 0 {
+		return forwardTarget{}, false
+	}
+	current[candidates[picked].backend.URL] -= total
+	return candidates[picked], true
+}
@@ -0,0 +1,96 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func weighted(url string, weight int) forwardTarget {
+	return forwardTarget{backend: Backend{URL: url, Weight: &weight, Group: "replicas"}}
+}
+
+func TestPickFromGroup(t *testing.T) {
+	p := &SprayProxy{}
+	candidates := []forwardTarget{weighted("http://a", 75), weighted("http://b", 25), weighted("http://c", 0)}
+	picks := []string{}
+	for i := 0; i < 8; i++ {
+		target, ok := p.pickFromGroup("replicas", candidates)
+		if !ok {
+			t.Fatal("expected a backend to be picked")
+		}
+		picks = append(picks, target.backend.URL)
+	}
+	counts := map[string]int{}
+	for i, pick := range picks {
+		counts[pick]++
+		// smooth round-robin spreads the picks of the lighter backend
+		if i > 0 && pick == "http://b" && picks[i-1] == "http://b" {
+			t.Errorf("expected no consecutive picks of the lighter backend, got %v", picks)
+		}
+	}
+	if counts["http://a"] != 6 || counts["http://b"] != 2 || counts["http://c"] != 0 {
+		t.Errorf("expected picks in proportion to the weights, got %v", picks)
+	}
+
+	if _, ok := p.pickFromGroup("drained", []forwardTarget{weighted("http://c", 0)}); ok {
+		t.Error("expected no backend to be picked without positive weights")
+	}
+}
+
+func TestRegisterGroup(t *testing.T) {
+	newCounting := func(calls *int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(calls, 1)
+		}))
+	}
+	var standaloneCalls, firstCalls, secondCalls int32
+	standalone := newCounting(&standaloneCalls)
+	defer standalone.Close()
+	first := newCounting(&firstCalls)
+	defer first.Close()
+	second := newCounting(&secondCalls)
+	defer second.Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop(), standalone.URL)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	for _, server := range []string{first.URL, second.URL} {
+		w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {server}, "group": {"replicas"}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+		}
+	}
+	w := callBackendsHandler(proxy.List, http.MethodGet, nil)
+	expected := standalone.URL + "\n" + first.URL + " (group replicas)\n" + second.URL + " (group replicas)"
+	if w.Body.String() != expected {
+		t.Errorf("expected list %q, got %q", expected, w.Body.String())
+	}
+
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+		proxy.HandleProxy(ctx)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+		}
+	}
+	if got := atomic.LoadInt32(&standaloneCalls); got != 4 {
+		t.Errorf("expected the backend outside the group to receive every request, got %d", got)
+	}
+	if first, second := atomic.LoadInt32(&firstCalls), atomic.LoadInt32(&secondCalls); first != 2 || second != 2 {
+		t.Errorf("expected the group backends to receive 2 requests each, got %d and %d", first, second)
+	}
+}
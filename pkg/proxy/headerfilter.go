@@ -0,0 +1,71 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// requiredHeaders are always forwarded to backends, regardless of the header allowlist and denylist: the
+// GitHub event, delivery and signature headers, the headers describing the body, and the headers set by
+// the proxy itself.
+var requiredHeaders = newHeaderSet(
+	eventHeader,
+	deliveryHeader,
+	signatureHeader,
+	legacySignatureHeader,
+	"Content-Type",
+	contentEncodingHeader,
+	forwardedForHeader,
+	forwardedHostHeader,
+	forwardedProtoHeader,
+)
+
+// newHeaderSet returns the set of the canonical names of the given headers, nil if there are none.
+func newHeaderSet(headers ...string) map[string]bool {
+	var set map[string]bool
+	for _, header := range headers {
+		if header = strings.TrimSpace(header); header != "" {
+			if set == nil {
+				set = map[string]bool{}
+			}
+			set[http.CanonicalHeaderKey(header)] = true
+		}
+	}
+	return set
+}
+
+// headerNamesOf returns the sorted names of the headers of the set.
+func headerNamesOf(set map[string]bool) []string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// forwardedHeaders returns a copy of the inbound headers to forward to backends. When an allowlist is set
+// only the allowed headers are kept, then the denied headers are removed. The required headers are kept
+// in any case.
+func (p *SprayProxy) forwardedHeaders(header http.Header) http.Header {
+	forwarded := header.Clone()
+	if p.allowedHeaders == nil && p.deniedHeaders == nil {
+		return forwarded
+	}
+	for name := range forwarded {
+		canonical := http.CanonicalHeaderKey(name)
+		if requiredHeaders[canonical] {
+			continue
+		}
+		if (p.allowedHeaders != nil && !p.allowedHeaders[canonical]) || p.deniedHeaders[canonical] {
+			delete(forwarded, name)
+		}
+	}
+	return forwarded
+}
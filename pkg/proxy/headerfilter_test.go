@@ -0,0 +1,101 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestHandleProxyHeaderFilter(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		headers <- req.Header
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	for _, tc := range []struct {
+		name         string
+		allowEnv     string
+		denyEnv      string
+		opts         []Option
+		forwarded    []string
+		notForwarded []string
+	}{
+		{
+			name:      "all headers forwarded by default",
+			forwarded: []string{"Cookie", "X-Internal-Auth", "User-Agent", eventHeader},
+		},
+		{
+			name:         "allowlist",
+			allowEnv:     "user-agent, X-GitHub-Hook-ID",
+			forwarded:    []string{"User-Agent", "X-Github-Hook-Id", eventHeader, deliveryHeader, signatureHeader, "Content-Type", forwardedForHeader},
+			notForwarded: []string{"Cookie", "X-Internal-Auth"},
+		},
+		{
+			name:         "denylist",
+			denyEnv:      "Cookie,X-Internal-Auth,X-GitHub-Event",
+			forwarded:    []string{"User-Agent", "X-Github-Hook-Id", eventHeader},
+			notForwarded: []string{"Cookie", "X-Internal-Auth"},
+		},
+		{
+			name:         "allowlist and denylist options",
+			allowEnv:     "Cookie",
+			opts:         []Option{WithForwardedHeaders("User-Agent", "Cookie"), WithDroppedHeaders("cookie")},
+			forwarded:    []string{"User-Agent", eventHeader},
+			notForwarded: []string{"Cookie", "X-Internal-Auth", "X-Github-Hook-Id"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("SPRAYPROXY_FORWARD_HEADERS", tc.allowEnv)
+			t.Setenv("SPRAYPROXY_DROP_HEADERS", tc.denyEnv)
+			proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL}, tc.opts...)
+			if err != nil {
+				t.Fatalf("failed to set up proxy: %v", err)
+			}
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("{}"))
+			for name, value := range map[string]string{
+				"Cookie":           "session=hunter2",
+				"X-Internal-Auth":  "hunter2",
+				"User-Agent":       "GitHub-Hookshot/1234",
+				"X-GitHub-Hook-ID": "42",
+				eventHeader:        "push",
+				deliveryHeader:     "1234",
+				signatureHeader:    "sha256=abcd",
+				"Content-Type":     "application/json",
+			} {
+				ctx.Request.Header.Set(name, value)
+			}
+			proxy.HandleProxy(ctx)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", w.Code)
+			}
+			got := <-headers
+			for _, name := range tc.forwarded {
+				if got.Get(name) == "" {
+					t.Errorf("expected header %s to be forwarded, got %v", name, got)
+				}
+			}
+			for _, name := range tc.notForwarded {
+				if got.Get(name) != "" {
+					t.Errorf("expected header %s not to be forwarded, got %v", name, got)
+				}
+			}
+			// headers set by the proxy are not filtered
+			if got.Get(proxy.requestIDHeader) == "" {
+				t.Errorf("expected the request ID to be forwarded, got %v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// healthState tracks the outcome of the health checks of a single backend.
+type healthState struct {
+	failures int
+	healthy  bool
+}
+
+// RunHealthChecks periodically checks the health of all backends until stopCh is closed.
+// Backends failing more consecutive checks than the configured threshold are skipped when
+// forwarding requests, until one of their health checks succeeds again.
+// The checks of the backends are staggered, and the interval between them jittered, by the configured
+// jitter fraction of the interval, so backends are not all probed at the same instant.
+// It returns immediately if health checks are disabled.
+func (p *SprayProxy) RunHealthChecks(stopCh <-chan struct{}) {
+	if p.healthCheckInterval <= 0 {
+		return
+	}
+	p.logger.Info(fmt.Sprintf("running backend health checks every %s with %.0f%% jitter",
+		p.healthCheckInterval.String(), p.healthCheckJitter*100))
+	spread := time.Duration(p.healthCheckJitter * float64(p.healthCheckInterval))
+	timer := time.NewTimer(stagger(p.healthCheckInterval, p.healthCheckJitter))
+	defer timer.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-timer.C:
+		}
+		p.checkBackends(spread)
+		timer.Reset(jittered(p.healthCheckInterval, p.healthCheckJitter))
+	}
+}
+
+// BackendHealth returns the health of every backend, true meaning the backend is healthy.
+// Backends that have not been checked yet are considered healthy.
+func (p *SprayProxy) BackendHealth() map[string]bool {
+	backends := p.Backends()
+	p.healthLock.Lock()
+	defer p.healthLock.Unlock()
+	health := make(map[string]bool, len(backends))
+	for _, backend := range backends {
+		health[backend] = p.isHealthyLocked(backend)
+	}
+	return health
+}
+
+// isHealthy returns false if the backend was marked as unhealthy by the health checks.
+func (p *SprayProxy) isHealthy(backend string) bool {
+	p.healthLock.Lock()
+	defer p.healthLock.Unlock()
+	return p.isHealthyLocked(backend)
+}
+
+func (p *SprayProxy) isHealthyLocked(backend string) bool {
+	state, ok := p.health[backend]
+	return !ok || state.healthy
+}
+
+// forgetHealth drops the health state of the backend, once it is unregistered.
+func (p *SprayProxy) forgetHealth(backend string) {
+	p.healthLock.Lock()
+	defer p.healthLock.Unlock()
+	delete(p.health, backend)
+}
+
+// checkBackends runs one health check on all backends concurrently and updates their health state.
+// Each check starts after a random delay up to spread, so the backends are not probed all at once.
+func (p *SprayProxy) checkBackends(spread time.Duration) {
+	snapshot := p.snapshotBackends()
+	// backends are checked with the TLS settings they are forwarded with, such as insecure ones without
+	// verifying their certificate
+	backends := make([]string, len(snapshot))
+	results := make([]bool, len(snapshot))
+	var wg sync.WaitGroup
+	for i, backend := range snapshot {
+		backends[i] = backend.URL
+		wg.Add(1)
+		go func(i int, backend string, client *http.Client) {
+			defer wg.Done()
+			if spread > 0 {
+				time.Sleep(stagger(spread, 1))
+			}
+			results[i] = p.checkBackend(client, backend)
+		}(i, backend.URL, p.backendClient(backend))
+	}
+	wg.Wait()
+
+	p.healthLock.Lock()
+	defer p.healthLock.Unlock()
+	// rebuild the state from the current backends, dropping unregistered ones
+	health := make(map[string]*healthState, len(backends))
+	for i, backend := range backends {
+		state, ok := p.health[backend]
+		if !ok {
+			state = &healthState{healthy: true}
+		}
+		health[backend] = state
+		if results[i] {
+			if !state.healthy {
+				p.logger.Info("backend is healthy again", zap.String("backend", backend))
+			}
+			state.failures = 0
+			state.healthy = true
+		} else {
+			state.failures++
+			if state.healthy && state.failures >= p.healthCheckThreshold {
+				p.logger.Warn("backend is unhealthy, skipping it until it recovers", zap.String("backend", backend), zap.Int("failures", state.failures))
+				state.healthy = false
+			}
+		}
+		if backendURL, err := parseBackendURL(backend); err == nil {
+			metrics.SetBackendHealthy(backendURL.Host, state.healthy)
+		}
+	}
+	p.health = health
+}
+
+// checkBackend sends a GET request to the health path of the backend.
+// Any response below 500 is considered healthy, since it proves the backend is up and serving.
+func (p *SprayProxy) checkBackend(client *http.Client, backend string) bool {
+	checkURL, err := parseBackendURL(backend)
+	if err != nil {
+		p.logger.Error("failed to parse backend "+err.Error(), zap.String("backend", backend))
+		return false
+	}
+	checkURL.Path = strings.TrimSuffix(checkURL.Path, "/") + "/" + strings.TrimPrefix(p.healthCheckPath, "/")
+	ctx, cancel := context.WithTimeout(context.Background(), p.fwdReqTmout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checkURL.String(), nil)
+	if err != nil {
+		p.logger.Error("failed to create health check request: "+err.Error(), zap.String("backend", backend))
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		p.logger.Info("health check failed: "+err.Error(), zap.String("backend", backend))
+		return false
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		p.logger.Info("health check failed", zap.String("backend", backend), zap.Int("status", resp.StatusCode))
+		return false
+	}
+	return true
+}
+
+// Healthz reports that the proxy process is up. It is meant to be used as a liveness probe.
+func (p *SprayProxy) Healthz(c *gin.Context) {
+	healthy, total := p.countHealthy()
+	c.String(http.StatusOK, fmt.Sprintf("healthy, %d/%d backends healthy", healthy, total))
+}
+
+// Readyz reports whether the proxy can deliver webhooks to at least one backend.
+// It is meant to be used as a readiness probe, and fails if there are no backends
+// or all of them are unhealthy.
+func (p *SprayProxy) Readyz(c *gin.Context) {
+	healthy, total := p.countHealthy()
+	if healthy == 0 {
+		c.String(http.StatusServiceUnavailable, fmt.Sprintf("not ready, %d/%d backends healthy", healthy, total))
+		return
+	}
+	c.String(http.StatusOK, fmt.Sprintf("ready, %d/%d backends healthy", healthy, total))
+}
+
+// countHealthy returns the number of healthy backends and the total number of backends.
+func (p *SprayProxy) countHealthy() (int, int) {
+	health := p.BackendHealth()
+	healthy := 0
+	for _, ok := range health {
+		if ok {
+			healthy++
+		}
+	}
+	return healthy, len(health)
+}
@@ -0,0 +1,196 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// newHealthBackend returns a test server whose health endpoint answers with the status
+// stored in health, and which counts the webhooks it receives.
+func newHealthBackend(health *int32) (*httptest.Server, *int32) {
+	var webhooks int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/health" {
+			rw.WriteHeader(int(atomic.LoadInt32(health)))
+			return
+		}
+		atomic.AddInt32(&webhooks, 1)
+		rw.WriteHeader(http.StatusOK)
+	}))
+	return server, &webhooks
+}
+
+func TestHealthChecks(t *testing.T) {
+	health := int32(http.StatusOK)
+	backend, webhooks := newHealthBackend(&health)
+	defer backend.Close()
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL},
+		WithHealthChecks(time.Minute, "/health", 2))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	send := func() int {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+		proxy.HandleProxy(ctx)
+		return w.Code
+	}
+
+	if !proxy.BackendHealth()[backend.URL] {
+		t.Errorf("expected unchecked backend to be healthy")
+	}
+
+	atomic.StoreInt32(&health, http.StatusServiceUnavailable)
+	proxy.checkBackends(0)
+	if !proxy.BackendHealth()[backend.URL] {
+		t.Errorf("expected backend to be healthy below the failure threshold")
+	}
+	proxy.checkBackends(0)
+	if proxy.BackendHealth()[backend.URL] {
+		t.Errorf("expected backend to be unhealthy after reaching the failure threshold")
+	}
+	if code := send(); code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, code)
+	}
+	if got := atomic.LoadInt32(webhooks); got != 0 {
+		t.Errorf("expected unhealthy backend to be skipped, got %d webhooks", got)
+	}
+
+	atomic.StoreInt32(&health, http.StatusOK)
+	proxy.checkBackends(0)
+	if !proxy.BackendHealth()[backend.URL] {
+		t.Errorf("expected backend to be healthy again after a successful check")
+	}
+	send()
+	if got := atomic.LoadInt32(webhooks); got != 1 {
+		t.Errorf("expected healthy backend to receive 1 webhook, got %d", got)
+	}
+}
+
+func TestHealthChecksDisabledByDefault(t *testing.T) {
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		proxy.RunHealthChecks(make(chan struct{}))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("expected RunHealthChecks to return when health checks are disabled")
+	}
+}
+
+func TestHealthChecksEnv(t *testing.T) {
+	t.Setenv("SPRAYPROXY_HEALTH_CHECK_INTERVAL", "30s")
+	t.Setenv("SPRAYPROXY_HEALTH_CHECK_PATH", "/healthz")
+	t.Setenv("SPRAYPROXY_HEALTH_CHECK_THRESHOLD", "5")
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	if proxy.healthCheckInterval != 30*time.Second {
+		t.Errorf("expected interval %s, got %s", 30*time.Second, proxy.healthCheckInterval)
+	}
+	if proxy.healthCheckPath != "/healthz" {
+		t.Errorf("expected path %q, got %q", "/healthz", proxy.healthCheckPath)
+	}
+	if proxy.healthCheckThreshold != 5 {
+		t.Errorf("expected threshold %d, got %d", 5, proxy.healthCheckThreshold)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	health := int32(http.StatusOK)
+	backend1, _ := newHealthBackend(&health)
+	defer backend1.Close()
+	backend2, _ := newHealthBackend(&health)
+	defer backend2.Close()
+
+	probe := func(handler gin.HandlerFunc) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodGet, "http://localhost:8080/readyz", nil)
+		handler(ctx)
+		return w
+	}
+
+	noBackends, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	if w := probe(noBackends.Readyz); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status code %d without backends, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if w := probe(noBackends.Healthz); w.Code != http.StatusOK {
+		t.Errorf("expected liveness status code %d without backends, got %d", http.StatusOK, w.Code)
+	}
+
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend1.URL, backend2.URL},
+		WithHealthChecks(time.Minute, "/health", 1))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := probe(proxy.Readyz)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if expected := "ready, 2/2 backends healthy"; w.Body.String() != expected {
+		t.Errorf("expected response %q, got %q", expected, w.Body.String())
+	}
+
+	atomic.StoreInt32(&health, http.StatusInternalServerError)
+	proxy.checkBackends(0)
+	w = probe(proxy.Readyz)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status code %d with all backends unhealthy, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if expected := "not ready, 0/2 backends healthy"; w.Body.String() != expected {
+		t.Errorf("expected response %q, got %q", expected, w.Body.String())
+	}
+	if w := probe(proxy.Healthz); w.Code != http.StatusOK {
+		t.Errorf("expected liveness status code %d with all backends unhealthy, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestRunHealthChecksJitter(t *testing.T) {
+	var checks int32
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&checks, 1)
+	}))
+	defer backend.Close()
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL},
+		WithHealthChecks(20*time.Millisecond, "/health", 1), WithHealthCheckJitter(0.5))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		proxy.RunHealthChecks(stopCh)
+		close(done)
+	}()
+	// the first check is staggered by up to 10ms, then every 10ms to 30ms
+	time.Sleep(200 * time.Millisecond)
+	close(stopCh)
+	<-done
+	if got := atomic.LoadInt32(&checks); got < 3 {
+		t.Errorf("expected at least 3 health checks, got %d", got)
+	}
+}
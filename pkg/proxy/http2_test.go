@@ -0,0 +1,117 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// protoBackend returns a handler recording the protocol of the requests it receives.
+func protoBackend(protos chan<- string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		protos <- req.Proto
+		rw.WriteHeader(http.StatusOK)
+	})
+}
+
+func TestHandleProxyHTTP2(t *testing.T) {
+	protos := make(chan string, 1)
+	backend := httptest.NewUnstartedServer(protoBackend(protos))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+	caFile := writeCAFile(t, backend)
+
+	for _, tc := range []struct {
+		name        string
+		caFile      string
+		insecureTLS bool
+	}{
+		{
+			name:   "CA configured",
+			caFile: caFile,
+		},
+		{
+			name:        "insecure TLS",
+			insecureTLS: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("SPRAYPROXY_BACKEND_CA_FILE", tc.caFile)
+			proxy, err := NewSprayProxy(tc.insecureTLS, zap.NewNop(), backend.URL)
+			if err != nil {
+				t.Fatalf("failed to set up proxy: %v", err)
+			}
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+			proxy.HandleProxy(ctx)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", w.Code)
+			}
+			if proto := <-protos; proto != "HTTP/2.0" {
+				t.Errorf("expected the backend to be sent HTTP/2, got %s", proto)
+			}
+		})
+	}
+}
+
+func TestHandleProxyH2C(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		h2c           bool
+		expectedProto string
+	}{
+		{
+			name:          "h2c disabled",
+			expectedProto: "HTTP/1.1",
+		},
+		{
+			name:          "h2c enabled",
+			h2c:           true,
+			expectedProto: "HTTP/2.0",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			protos := make(chan string, 1)
+			backend := httptest.NewServer(h2c.NewHandler(protoBackend(protos), &http2.Server{}))
+			defer backend.Close()
+			proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL}, WithH2C(tc.h2c))
+			if err != nil {
+				t.Fatalf("failed to set up proxy: %v", err)
+			}
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+			proxy.HandleProxy(ctx)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", w.Code)
+			}
+			if proto := <-protos; proto != tc.expectedProto {
+				t.Errorf("expected the backend to be sent %s, got %s", tc.expectedProto, proto)
+			}
+		})
+	}
+}
+
+func TestProxyH2CEnv(t *testing.T) {
+	t.Setenv("SPRAYPROXY_H2C", "true")
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	if !proxy.h2c {
+		t.Error("expected h2c to be enabled")
+	}
+}
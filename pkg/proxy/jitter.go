@@ -0,0 +1,45 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// defaultJitter is the fraction of their interval periodic tasks are randomly spread by
+const defaultJitter = 0.1
+
+var (
+	// jitterRand is seeded per process, so replicas of the proxy do not share the same schedule
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterLock sync.Mutex
+)
+
+func randFloat() float64 {
+	jitterLock.Lock()
+	defer jitterLock.Unlock()
+	return jitterRand.Float64()
+}
+
+// jittered returns the interval randomly shortened or lengthened by up to the given fraction of it,
+// so periodic tasks drift apart instead of running at the same instant.
+func jittered(interval time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 || interval <= 0 {
+		return interval
+	}
+	return interval + time.Duration((randFloat()*2-1)*fraction*float64(interval))
+}
+
+// stagger returns a random delay of up to the given fraction of the interval, to spread the runs of
+// periodic tasks started at the same time.
+func stagger(interval time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 || interval <= 0 {
+		return 0
+	}
+	return time.Duration(randFloat() * fraction * float64(interval))
+}
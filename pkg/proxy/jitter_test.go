@@ -0,0 +1,41 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJittered(t *testing.T) {
+	interval := 10 * time.Second
+	if got := jittered(interval, 0); got != interval {
+		t.Errorf("expected no jitter with a fraction of 0, got %s", got)
+	}
+	spread := false
+	for i := 0; i < 100; i++ {
+		got := jittered(interval, 0.2)
+		if got < 8*time.Second || got > 12*time.Second {
+			t.Fatalf("expected %s within 20%% of %s", got, interval)
+		}
+		spread = spread || got != interval
+	}
+	if !spread {
+		t.Error("expected the interval to be jittered")
+	}
+}
+
+func TestStagger(t *testing.T) {
+	interval := 10 * time.Second
+	if got := stagger(interval, 0); got != 0 {
+		t.Errorf("expected no delay with a fraction of 0, got %s", got)
+	}
+	for i := 0; i < 100; i++ {
+		if got := stagger(interval, 0.5); got < 0 || got >= 5*time.Second {
+			t.Fatalf("expected %s within half of %s", got, interval)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DeliveryStatus is the outcome of the most recent forwards to a backend.
+type DeliveryStatus struct {
+	Host string `json:"host"`
+	// LastAttempt is when a request was last forwarded to the backend, successfully or not
+	LastAttempt time.Time `json:"lastAttempt"`
+	// LastSuccess is when the backend last answered with a status below 400, nil if it never did
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	// LastStatus is the status code of the last response, zero if the backend could not be reached
+	LastStatus int    `json:"lastStatus"`
+	LastError  string `json:"lastError,omitempty"`
+}
+
+// forgetDelivery drops the delivery status of the given backend host, once no backend of the host is left.
+func (p *SprayProxy) forgetDelivery(host string) {
+	p.lastDeliveriesLock.Lock()
+	defer p.lastDeliveriesLock.Unlock()
+	delete(p.lastDeliveries, host)
+}
+
+// recordDelivery updates the delivery status of the backend with the result of a forward to it.
+// Forwards skipped by an open circuit breaker are not attempts, and are not recorded.
+func (p *SprayProxy) recordDelivery(result BackendResult, now time.Time) {
+	if errors.Is(result.Error, errCircuitOpen) {
+		return
+	}
+	p.lastDeliveriesLock.Lock()
+	defer p.lastDeliveriesLock.Unlock()
+	status, ok := p.lastDeliveries[result.Host]
+	if !ok {
+		status = &DeliveryStatus{Host: result.Host}
+		p.lastDeliveries[result.Host] = status
+	}
+	status.LastAttempt = now
+	status.LastStatus = result.Status
+	status.LastError = ""
+	if result.Error != nil {
+		status.LastError = result.Error.Error()
+	}
+	if result.Error == nil && result.Status < http.StatusBadRequest {
+		success := now
+		status.LastSuccess = &success
+	}
+}
+
+// LastDeliveries returns the delivery status of every backend requests were forwarded to, sorted by host.
+func (p *SprayProxy) LastDeliveries() []DeliveryStatus {
+	p.lastDeliveriesLock.Lock()
+	defer p.lastDeliveriesLock.Unlock()
+	statuses := make([]DeliveryStatus, 0, len(p.lastDeliveries))
+	for _, status := range p.lastDeliveries {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Host < statuses[j].Host
+	})
+	return statuses
+}
+
+// ListDeliveries returns the delivery status of every backend as JSON.
+func (p *SprayProxy) ListDeliveries(c *gin.Context) {
+	if !p.authorized(c) {
+		return
+	}
+	c.JSON(http.StatusOK, p.LastDeliveries())
+}
@@ -0,0 +1,71 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestLastDeliveries(t *testing.T) {
+	status := int32(http.StatusOK)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer backend.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop(), backend.URL, down.URL)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	if got := proxy.LastDeliveries(); len(got) != 0 {
+		t.Errorf("expected no deliveries before forwarding, got %+v", got)
+	}
+	forward := func() {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+		proxy.HandleProxy(ctx)
+	}
+	before := time.Now()
+	forward()
+	atomic.StoreInt32(&status, http.StatusNotFound)
+	forward()
+
+	deliveries := map[string]DeliveryStatus{}
+	for _, delivery := range proxy.LastDeliveries() {
+		deliveries[delivery.Host] = delivery
+	}
+	got := deliveries[hostOf(t, backend.URL)]
+	if got.LastStatus != http.StatusNotFound || got.LastAttempt.Before(before) {
+		t.Errorf("expected a last attempt with status %d, got %+v", http.StatusNotFound, got)
+	}
+	if got.LastSuccess == nil || !got.LastSuccess.Before(got.LastAttempt) {
+		t.Errorf("expected the last success before the last attempt, got %+v", got)
+	}
+	got = deliveries[hostOf(t, down.URL)]
+	if got.LastStatus != 0 || got.LastError == "" || got.LastSuccess != nil {
+		t.Errorf("expected an unreachable backend without success, got %+v", got)
+	}
+
+	w := callBackendsHandler(proxy.ListDeliveries, http.MethodGet, nil)
+	listed := []DeliveryStatus{}
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+		t.Fatalf("failed to parse response %q: %v", w.Body.String(), err)
+	}
+	if len(listed) != 2 || listed[0].Host > listed[1].Host {
+		t.Errorf("expected 2 deliveries sorted by host, got %+v", listed)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Field is a structured logging field, a key along with its value.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger is the structured logger the proxy logs to. It lets embedders route the logs of the proxy
+// through their own logging library; NewZapLogger adapts a *zap.Logger to it.
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+}
+
+// zapLogger is the Logger backed by a *zap.Logger.
+type zapLogger struct {
+	logger *zap.Logger
+}
+
+// NewZapLogger returns a Logger logging to the given zap logger, or discarding logs if it is nil.
+func NewZapLogger(logger *zap.Logger) Logger {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return zapLogger{logger: logger}
+}
+
+func (l zapLogger) Debug(msg string, fields ...Field) { l.logger.Debug(msg, zapFields(fields)...) }
+func (l zapLogger) Info(msg string, fields ...Field)  { l.logger.Info(msg, zapFields(fields)...) }
+func (l zapLogger) Warn(msg string, fields ...Field)  { l.logger.Warn(msg, zapFields(fields)...) }
+func (l zapLogger) Error(msg string, fields ...Field) { l.logger.Error(msg, zapFields(fields)...) }
+
+func zapFields(fields []Field) []zap.Field {
+	zapFields := make([]zap.Field, len(fields))
+	for i, field := range fields {
+		zapFields[i] = zap.Any(field.Key, field.Value)
+	}
+	return zapFields
+}
+
+// newZapLogger returns the zap logger the proxy logs to internally. Zap backed loggers are used as is,
+// other loggers get the entries of a zap core converting zap fields to plain ones.
+func newZapLogger(logger Logger) *zap.Logger {
+	if logger == nil {
+		return zap.NewNop()
+	}
+	if l, ok := logger.(zapLogger); ok {
+		return l.logger
+	}
+	return zap.New(&loggerCore{logger: logger})
+}
+
+// loggerCore is a zap core writing the entries to a Logger. Fields are encoded to plain values: strings,
+// numbers, durations and nested maps for objects such as the logged headers.
+type loggerCore struct {
+	logger Logger
+	fields []Field
+}
+
+func (c *loggerCore) Enabled(zapcore.Level) bool {
+	// level filtering is left to the logger
+	return true
+}
+
+func (c *loggerCore) With(fields []zapcore.Field) zapcore.Core {
+	return &loggerCore{logger: c.logger, fields: append(append([]Field{}, c.fields...), plainFields(fields)...)}
+}
+
+func (c *loggerCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	return checked.AddCore(entry, c)
+}
+
+func (c *loggerCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	all := append(append([]Field{}, c.fields...), plainFields(fields)...)
+	switch {
+	case entry.Level <= zapcore.DebugLevel:
+		c.logger.Debug(entry.Message, all...)
+	case entry.Level == zapcore.InfoLevel:
+		c.logger.Info(entry.Message, all...)
+	case entry.Level == zapcore.WarnLevel:
+		c.logger.Warn(entry.Message, all...)
+	default:
+		c.logger.Error(entry.Message, all...)
+	}
+	return nil
+}
+
+func (c *loggerCore) Sync() error {
+	return nil
+}
+
+// plainFields encodes zap fields to plain ones, keeping their order.
+func plainFields(fields []zapcore.Field) []Field {
+	plain := make([]Field, 0, len(fields))
+	for _, field := range fields {
+		enc := zapcore.NewMapObjectEncoder()
+		field.AddTo(enc)
+		if value, ok := enc.Fields[field.Key]; ok {
+			plain = append(plain, Field{Key: field.Key, Value: value})
+		}
+	}
+	return plain
+}
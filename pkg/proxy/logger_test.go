@@ -0,0 +1,128 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type loggedEntry struct {
+	level  string
+	msg    string
+	fields map[string]interface{}
+}
+
+// recordingLogger is a Logger keeping the logged entries.
+type recordingLogger struct {
+	lock    sync.Mutex
+	entries []loggedEntry
+}
+
+func (l *recordingLogger) log(level, msg string, fields []Field) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	entry := loggedEntry{level: level, msg: msg, fields: map[string]interface{}{}}
+	for _, field := range fields {
+		entry.fields[field.Key] = field.Value
+	}
+	l.entries = append(l.entries, entry)
+}
+
+func (l *recordingLogger) Debug(msg string, fields ...Field) { l.log("debug", msg, fields) }
+func (l *recordingLogger) Info(msg string, fields ...Field)  { l.log("info", msg, fields) }
+func (l *recordingLogger) Warn(msg string, fields ...Field)  { l.log("warn", msg, fields) }
+func (l *recordingLogger) Error(msg string, fields ...Field) { l.log("error", msg, fields) }
+
+func (l *recordingLogger) find(msg string) *loggedEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i := range l.entries {
+		if l.entries[i].msg == msg {
+			return &l.entries[i]
+		}
+	}
+	return nil
+}
+
+func TestNewSprayProxyWithLogger(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	logger := &recordingLogger{}
+	proxy, err := NewSprayProxyWithLogger(false, logger, []string{backend.URL})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+	ctx.Request.Header.Set("Authorization", "Bearer hunter2")
+	ctx.Request.Header.Set("X-GitHub-Event", "push")
+	proxy.HandleProxy(ctx)
+
+	if logger.find("admin token not set, backend management endpoints are not protected") == nil {
+		t.Errorf("expected the startup warning to be logged, got %v", logger.entries)
+	}
+	received := logger.find("received request")
+	if received == nil {
+		t.Fatalf("expected the received request to be logged, got %v", logger.entries)
+	}
+	if received.level != "debug" {
+		t.Errorf("expected the received request to be logged at debug level, got %s", received.level)
+	}
+	headers, ok := received.fields["headers"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected the headers to be logged as a map, got %#v", received.fields["headers"])
+	}
+	if headers["Authorization"] != redactedHeaderValue || headers["X-Github-Event"] != "push" {
+		t.Errorf("unexpected logged headers %v", headers)
+	}
+	proxied := logger.find("proxied request")
+	if proxied == nil {
+		t.Fatalf("expected the proxied request to be logged, got %v", logger.entries)
+	}
+	if proxied.level != "info" || proxied.fields["backend"] != strings.TrimPrefix(backend.URL, "http://") || proxied.fields["status"] != int64(http.StatusOK) {
+		t.Errorf("unexpected proxied request entry %v", proxied)
+	}
+}
+
+func TestNewZapLogger(t *testing.T) {
+	var buff bytes.Buffer
+	config := zap.NewProductionConfig()
+	core := zapcore.NewCore(
+		zapcore.NewJSONEncoder(config.EncoderConfig),
+		zapcore.AddSync(&buff),
+		zapcore.InfoLevel,
+	)
+	zl := zap.New(core)
+	logger := NewZapLogger(zl)
+	if newZapLogger(logger) != zl {
+		t.Error("expected the zap logger to be used as is")
+	}
+	logger.Debug("filtered")
+	logger.Error("failed", Field{Key: "backend", Value: "http://localhost"}, Field{Key: "attempt", Value: 2})
+	log := buff.String()
+	if strings.Contains(log, "filtered") {
+		t.Errorf("expected debug entries to be filtered, got %q", log)
+	}
+	for _, expected := range []string{`"msg":"failed"`, `"backend":"http://localhost"`, `"attempt":2`} {
+		if !strings.Contains(log, expected) {
+			t.Errorf("expected string %q did not appear in %q", expected, log)
+		}
+	}
+	// a nil zap logger discards the logs
+	NewZapLogger(nil).Info("discarded")
+}
@@ -0,0 +1,29 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+)
+
+// NotFoundHandler answers the requests to paths the proxy does not handle with 404 Not Found, logging them
+// with the fields of proxied requests and counting them in metrics, to be registered with gin's NoRoute.
+func (p *SprayProxy) NotFoundHandler(c *gin.Context) {
+	metrics.IncNotFoundCount()
+	p.logger.Info("no route for request",
+		zap.String("method", c.Request.Method),
+		zap.String("path", c.Request.URL.Path),
+		zap.String("query", c.Request.URL.RawQuery),
+		zap.String("request-id", c.GetString("requestId")),
+		zap.String("client", c.Request.RemoteAddr),
+	)
+	p.respondError(c, http.StatusNotFound, errorCodeNotFound, "not found")
+}
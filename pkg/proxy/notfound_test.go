@@ -0,0 +1,55 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+)
+
+func TestNotFoundHandler(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics.InitMetrics(registry)
+	logger := &recordingLogger{}
+	proxy, err := NewSprayProxyWithLogger(false, logger, nil)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	r := gin.New()
+	r.NoRoute(proxy.NotFoundHandler)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost:8080/wp-login.php?user=admin", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status code %d, got %d", http.StatusNotFound, w.Code)
+	}
+	if w.Body.String() != "not found" {
+		t.Errorf("expected response %q, got %q", "not found", w.Body.String())
+	}
+	entry := logger.find("no route for request")
+	if entry == nil {
+		t.Fatalf("expected the request to be logged, got %v", logger.entries)
+	}
+	if entry.fields["method"] != http.MethodGet || entry.fields["path"] != "/wp-login.php" || entry.fields["query"] != "user=admin" {
+		t.Errorf("unexpected logged fields %v", entry.fields)
+	}
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, "http://localhost:8080/", nil)
+	req.Header.Set("Accept", "application/json")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound || w.Body.String() != `{"error":"not found","code":"not_found","requestId":""}` {
+		t.Errorf("unexpected JSON response %d %q", w.Code, w.Body.String())
+	}
+	if got := metricValue(t, registry, "sprayproxy_http_not_found_requests_total", ""); got != 2 {
+		t.Errorf("expected 2 requests counted, got %v", got)
+	}
+}
@@ -0,0 +1,438 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"net"
+	"net/url"
+	"time"
+)
+
+// Option configures optional behavior of the SprayProxy.
+// Options take precedence over the corresponding SPRAYPROXY_* environment variables.
+type Option func(*SprayProxy)
+
+// WithDialTimeout sets how long connecting to a backend can take, within the forwarding timeout.
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(p *SprayProxy) {
+		p.dialTimeout = timeout
+	}
+}
+
+// WithTLSHandshakeTimeout sets how long the TLS handshake with a backend can take, within the forwarding
+// timeout.
+func WithTLSHandshakeTimeout(timeout time.Duration) Option {
+	return func(p *SprayProxy) {
+		p.tlsHandshakeTimeout = timeout
+	}
+}
+
+// WithKeepAlive sets the period of TCP keep-alives on backend connections. A negative period disables them.
+func WithKeepAlive(period time.Duration) Option {
+	return func(p *SprayProxy) {
+		p.keepAlive = period
+	}
+}
+
+// WithIdleConns sets how many idle connections are kept to the backends, overall and per backend, and
+// how long they are kept. A maximum of 0 keeps any number of idle connections overall.
+func WithIdleConns(max, perHost int, timeout time.Duration) Option {
+	return func(p *SprayProxy) {
+		p.maxIdleConns = max
+		p.maxIdleConnsPerHost = perHost
+		p.idleConnTimeout = timeout
+	}
+}
+
+// WithRetryCount sets how many times a failed forward to a backend is retried before giving up.
+func WithRetryCount(count int) Option {
+	return func(p *SprayProxy) {
+		p.retryCount = count
+	}
+}
+
+// WithRetryBaseDelay sets the delay before the first retry. The delay doubles on every further retry.
+func WithRetryBaseDelay(delay time.Duration) Option {
+	return func(p *SprayProxy) {
+		p.retryBaseDelay = delay
+	}
+}
+
+// WithWebhookSecret sets the secret used to verify the signature of incoming webhooks.
+// An empty secret disables the verification.
+func WithWebhookSecret(secret string) Option {
+	return func(p *SprayProxy) {
+		p.webhookSecretFile = ""
+		p.webhookSecrets = nil
+		if secret != "" {
+			p.webhookSecrets = []string{secret}
+		}
+	}
+}
+
+// WithWebhookSecrets sets the secrets used to verify the signature of incoming webhooks, which are valid
+// if signed with any of them, so secrets can be rotated. No secrets disables the verification.
+func WithWebhookSecrets(secrets ...string) Option {
+	return func(p *SprayProxy) {
+		p.webhookSecretFile = ""
+		p.webhookSecrets = secrets
+	}
+}
+
+// WithWebhookSecretFile sets the file the secrets used to verify the signature of incoming webhooks are read
+// from, one per line, instead of the configured secrets. The file is read again once the reload interval
+// elapsed, so rotated secrets are picked up without a restart, and never if it is zero. An empty path
+// reads the secrets from the configuration.
+func WithWebhookSecretFile(path string, reloadInterval time.Duration) Option {
+	return func(p *SprayProxy) {
+		p.webhookSecretFile = path
+		p.webhookSecretReload = reloadInterval
+	}
+}
+
+// WithAdminToken sets the bearer token required to register, unregister and list backends.
+// An empty token leaves the endpoints unprotected.
+func WithAdminToken(token string) Option {
+	return func(p *SprayProxy) {
+		p.adminToken = token
+	}
+}
+
+// WithAuditLogger sets the logger the changes of the backends are recorded to, such as a logger writing
+// to an audit sink. By default they are logged along with the operational logs, tagged with "audit".
+func WithAuditLogger(logger Logger) Option {
+	return func(p *SprayProxy) {
+		p.auditLogger = newZapLogger(logger)
+	}
+}
+
+// WithRequestIDHeader sets the header the request ID is forwarded to backends in.
+func WithRequestIDHeader(header string) Option {
+	return func(p *SprayProxy) {
+		p.requestIDHeader = header
+	}
+}
+
+// WithUpstreamProxy sets the HTTP proxy requests are forwarded through, instead of the one set by the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY env vars. A nil URL restores the env vars.
+func WithUpstreamProxy(proxyURL *url.URL) Option {
+	return func(p *SprayProxy) {
+		p.upstreamProxy = proxyURL
+	}
+}
+
+// WithLocalAddr sets the source address of the connections to all backends, such as the address of
+// a specific network interface allowlisted by the firewalls of the backends, overriding the
+// SPRAYPROXY_LOCAL_ADDR env var. A nil address lets the system pick it.
+func WithLocalAddr(ip net.IP) Option {
+	return func(p *SprayProxy) {
+		p.localAddr = ip
+	}
+}
+
+// WithSensitiveHeaders redacts the values of the given headers from logs, in addition to the
+// Authorization and GitHub signature headers which are always redacted.
+func WithSensitiveHeaders(headers ...string) Option {
+	return func(p *SprayProxy) {
+		p.sensitiveHeaders = newSensitiveHeaders(headers...)
+	}
+}
+
+// WithForwardedHeaders restricts the inbound headers forwarded to backends to the given ones. The GitHub
+// event, delivery and signature headers, the headers describing the body and the X-Forwarded headers are
+// always forwarded. All headers are forwarded if none are given.
+func WithForwardedHeaders(headers ...string) Option {
+	return func(p *SprayProxy) {
+		p.allowedHeaders = newHeaderSet(headers...)
+	}
+}
+
+// WithDroppedHeaders removes the given inbound headers from the requests forwarded to backends, such as
+// cookies or internal credentials, except for the headers always forwarded.
+func WithDroppedHeaders(headers ...string) Option {
+	return func(p *SprayProxy) {
+		p.deniedHeaders = newHeaderSet(headers...)
+	}
+}
+
+// WithLogBodyLimit sets the number of bytes of backend response bodies read and logged, the rest is discarded.
+func WithLogBodyLimit(limit int) Option {
+	return func(p *SprayProxy) {
+		p.logBodyLimit = limit
+	}
+}
+
+// WithLogErrorBodies enables logging the bodies of backend responses with a 4xx or 5xx status.
+// When disabled, and no error history is kept, the bodies are discarded without being read into memory.
+func WithLogErrorBodies(enabled bool) Option {
+	return func(p *SprayProxy) {
+		p.logErrorBodies = enabled
+	}
+}
+
+// WithLogSuccessBodies enables logging the bodies of the other backend responses at debug level,
+// truncated like the error ones, to catch backends answering a soft failure with a 2xx status.
+// Bodies are only read when the logger has debug entries enabled.
+func WithLogSuccessBodies(enabled bool) Option {
+	return func(p *SprayProxy) {
+		p.logSuccessBodies = enabled
+	}
+}
+
+// WithErrorHistorySize sets the number of error responses kept per backend and listed by ListErrors,
+// zero to keep none.
+func WithErrorHistorySize(size int) Option {
+	return func(p *SprayProxy) {
+		p.errorHistorySize = size
+	}
+}
+
+// WithBackendsFunc sets a provider of the backends to forward to, replacing the configured and registered
+// backends. The provided backends are cached for the given duration, and cannot be registered or
+// unregistered from the API.
+func WithBackendsFunc(fn BackendsFunc, cacheTTL time.Duration) Option {
+	return func(p *SprayProxy) {
+		p.provider = newBackendsProvider(fn, cacheTTL)
+	}
+}
+
+// WithBackendsFile sets the file registered backends are persisted to.
+// An empty path disables the persistence.
+func WithBackendsFile(path string) Option {
+	return func(p *SprayProxy) {
+		p.backendsFile = path
+	}
+}
+
+// WithHealthChecks enables periodic health checks of the backends on the given path.
+// Backends are marked as unhealthy after threshold consecutive failed checks.
+func WithHealthChecks(interval time.Duration, path string, threshold int) Option {
+	return func(p *SprayProxy) {
+		p.healthCheckInterval = interval
+		p.healthCheckPath = path
+		p.healthCheckThreshold = threshold
+	}
+}
+
+// WithHealthCheckJitter sets the fraction, from 0 to 1, of the health check interval by which the checks
+// of the backends are staggered and the interval between checks is randomly shortened or lengthened.
+// A fraction of 0 probes all backends at once, at a fixed interval.
+func WithHealthCheckJitter(fraction float64) Option {
+	return func(p *SprayProxy) {
+		p.healthCheckJitter = fraction
+	}
+}
+
+// WithStartupCheck probes every backend once with a health check on startup, logging the backends failing it.
+// In strict mode, the proxy then fails to start instead.
+func WithStartupCheck(check, strict bool) Option {
+	return func(p *SprayProxy) {
+		p.startupCheck = check
+		p.strictStartup = strict
+	}
+}
+
+// WithCircuitBreaker enables a circuit breaker per backend host, which stops forwarding to a backend
+// for cooldown after threshold consecutive failed forwards. A threshold of 0 disables the breakers.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(p *SprayProxy) {
+		p.breakerThreshold = threshold
+		p.breakerCooldown = cooldown
+	}
+}
+
+// WithDeduplication enables skipping redelivered webhooks, remembering up to size delivery IDs for ttl.
+// A size of 0 disables the deduplication.
+func WithDeduplication(size int, ttl time.Duration) Option {
+	return func(p *SprayProxy) {
+		p.deliveries = nil
+		if size > 0 {
+			p.deliveries = newDeliveryCache(size, ttl)
+		}
+	}
+}
+
+// WithRateLimit limits the requests of each client IP to rate per second, with bursts of up to burst requests.
+// A burst below 1 defaults to the rate, rounded up, and a rate of 0 disables the rate limiting.
+func WithRateLimit(rate float64, burst int) Option {
+	return func(p *SprayProxy) {
+		p.rateLimiter = nil
+		if rate > 0 {
+			p.rateLimiter = newRateLimiter(rate, burst)
+		}
+	}
+}
+
+// WithRequiredUserAgentPrefix rejects the requests whose User-Agent does not start with the prefix,
+// such as "GitHub-Hookshot/". An empty prefix accepts requests from any user agent.
+func WithRequiredUserAgentPrefix(prefix string) Option {
+	return func(p *SprayProxy) {
+		p.userAgentPrefix = prefix
+	}
+}
+
+// WithForwardedUserAgent sets whether the User-Agent of the forwarded requests is kept, identifies the proxy
+// followed by the inbound one, or is replaced with the one of the proxy. Defaults to UserAgentKeep.
+func WithForwardedUserAgent(mode UserAgentMode) Option {
+	return func(p *SprayProxy) {
+		p.userAgentMode = mode
+	}
+}
+
+// WithDeadLetterFile sets the JSONL file failed forwards are stored to, so they can be replayed.
+// An empty path disables storing failed forwards.
+func WithDeadLetterFile(path string) Option {
+	return func(p *SprayProxy) {
+		p.deadLetterFile = path
+	}
+}
+
+// WithSpillThreshold sets the size in bytes above which request bodies are written to a temporary file
+// while they are forwarded, instead of being held in memory. A threshold of 0 keeps all bodies in memory.
+func WithSpillThreshold(threshold int64) Option {
+	return func(p *SprayProxy) {
+		p.spillThreshold = threshold
+	}
+}
+
+// WithMaxRequestSize sets the maximum size in bytes of the requests bodies to forward.
+func WithMaxRequestSize(size int64) Option {
+	return func(p *SprayProxy) {
+		p.maxReqSize = size
+	}
+}
+
+// WithAllowNoBackends enables answering requests as proxied when no backends are configured, instead of
+// rejecting them with 503 Service Unavailable.
+func WithAllowNoBackends(allow bool) Option {
+	return func(p *SprayProxy) {
+		p.allowNoBackends = allow
+	}
+}
+
+// WithDecodeBodies enables verifying the webhook signature of gzip and deflate encoded bodies over their
+// decoded content. The bodies are forwarded to the backends as received, along with their encoding.
+func WithDecodeBodies(decode bool) Option {
+	return func(p *SprayProxy) {
+		p.decodeBodies = decode
+	}
+}
+
+// WithMultiStatus enables responding with 207 Multi-Status and the per backend results as JSON when
+// a request is delivered to some backends but fails for others, instead of 200 or 502.
+func WithMultiStatus(multiStatus bool) Option {
+	return func(p *SprayProxy) {
+		p.multiStatus = multiStatus
+	}
+}
+
+// WithSuccessPolicy sets how many backends must be reached for requests to be answered as proxied,
+// instead of failing with 502 Bad Gateway. Defaults to SuccessPolicyAll.
+func WithSuccessPolicy(policy SuccessPolicy) Option {
+	return func(p *SprayProxy) {
+		p.successPolicy = policy
+	}
+}
+
+// WithFailOn5xx counts the backends answering with a 5xx status as not reached by the success policy,
+// overriding the SPRAYPROXY_FAIL_ON_5XX env var.
+func WithFailOn5xx(fail bool) Option {
+	return func(p *SprayProxy) {
+		p.failOn5xx = fail
+	}
+}
+
+// WithPingMode sets whether GitHub ping events are forwarded to all backends, dropped, or only forwarded to the
+// backends designated to receive them. Defaults to PingForwardAll.
+func WithPingMode(mode PingMode) Option {
+	return func(p *SprayProxy) {
+		p.pingMode = mode
+	}
+}
+
+// WithSuccessStatus sets the status code of the requests answered as proxied, such as 202 Accepted or
+// 204 No Content, instead of 200 OK. Statuses outside of 2xx are ignored.
+func WithSuccessStatus(status int) Option {
+	return func(p *SprayProxy) {
+		if isSuccessStatus(status) {
+			p.successStatus = status
+		}
+	}
+}
+
+// WithSuccessBody sets the body, and its content type, of the requests answered as proxied instead of
+// the "proxied" text. An empty body answers them without any. The per backend results are still
+// returned to clients requesting JSON.
+func WithSuccessBody(contentType string, body []byte) Option {
+	return func(p *SprayProxy) {
+		if body == nil {
+			body = []byte{}
+		}
+		p.successBody = body
+		if contentType != "" {
+			p.successContentType = contentType
+		}
+	}
+}
+
+// WithFollowRedirects enables following the redirects of backends. They are not followed by default,
+// the redirect being the response of the forward, so webhook bodies are not sent to unexpected hosts.
+func WithFollowRedirects(follow bool) Option {
+	return func(p *SprayProxy) {
+		p.followRedirects = follow
+	}
+}
+
+// WithAsync enables responding to requests before they are forwarded to the backends.
+func WithAsync(async bool) Option {
+	return func(p *SprayProxy) {
+		p.async = async
+	}
+}
+
+// WithH2C enables sending HTTP/2 with prior knowledge to cleartext backends, which must then support
+// h2c. Such requests are never sent through an upstream proxy. Backends served over TLS negotiate
+// HTTP/2 regardless.
+func WithH2C(h2c bool) Option {
+	return func(p *SprayProxy) {
+		p.h2c = h2c
+	}
+}
+
+// WithStream enables streaming request bodies to multiple backends. Bodies are always streamed to
+// a single backend, but are buffered by default when forwarding to more backends.
+// Streaming lowers memory usage and latency for large payloads, as forwarding begins before the full
+// body is read and each body is not held in memory, but the slowest backend then throttles the
+// transfer to all of them. Streamed bodies are never retried, and bodies are always buffered when
+// signatures are verified, retries are enabled, requests are forwarded asynchronously, failed
+// forwards are stored or deliveries are coalesced.
+func WithStream(stream bool) Option {
+	return func(p *SprayProxy) {
+		p.stream = stream
+	}
+}
+
+// WithBodyReadTimeout sets the time allowed to read the body of inbound requests, overriding the
+// SPRAYPROXY_BODY_READ_TIMEOUT env var. Clients too slow to send it are answered 408 Request Timeout.
+// A zero timeout disables the limit. It is only enforced on the connections stored by ConnContext.
+func WithBodyReadTimeout(timeout time.Duration) Option {
+	return func(p *SprayProxy) {
+		p.bodyReadTimeout = timeout
+	}
+}
+
+// WithCoalescing enables coalescing the concurrent forwards of the same delivery, overriding the
+// SPRAYPROXY_COALESCE_DELIVERIES env var. Requests received while their X-GitHub-Delivery is being
+// forwarded wait for that forward and are answered with its results, instead of forwarding it again.
+// Bodies are always buffered when coalescing, and asynchronous forwards are never coalesced.
+func WithCoalescing(coalesce bool) Option {
+	return func(p *SprayProxy) {
+		p.coalescer = nil
+		if coalesce {
+			p.coalescer = newCoalescer()
+		}
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+)
+
+// errorPaused is the reason of the dead letters stored while forwarding is paused
+const errorPaused = "forwarding paused"
+
+// Pause pauses forwarding, such as during a maintenance window of the backends: requests are answered
+// as proxied, so GitHub does not retry them, without being forwarded. They are stored as dead letters to
+// be replayed once forwarding is resumed if a dead letter file is set, and dropped otherwise.
+func (p *SprayProxy) Pause(c *gin.Context) {
+	if !p.authorized(c) {
+		return
+	}
+	p.setPaused(true)
+	if p.deadLetters != nil {
+		c.String(http.StatusOK, "paused, requests are stored as dead letters")
+		return
+	}
+	c.String(http.StatusOK, "paused, requests are dropped")
+}
+
+// Resume resumes forwarding paused by Pause. Requests stored as dead letters meanwhile are not forwarded
+// until they are replayed.
+func (p *SprayProxy) Resume(c *gin.Context) {
+	if !p.authorized(c) {
+		return
+	}
+	p.setPaused(false)
+	c.String(http.StatusOK, "resumed")
+}
+
+// Paused returns true while forwarding is paused.
+func (p *SprayProxy) Paused() bool {
+	return p.isPaused()
+}
+
+func (p *SprayProxy) isPaused() bool {
+	p.pauseLock.Lock()
+	defer p.pauseLock.Unlock()
+	return p.paused
+}
+
+func (p *SprayProxy) setPaused(paused bool) {
+	p.pauseLock.Lock()
+	changed := p.paused != paused
+	p.paused = paused
+	p.pauseLock.Unlock()
+	metrics.SetPaused(paused)
+	switch {
+	case changed && paused:
+		p.logger.Warn("forwarding paused, requests are acknowledged without being forwarded")
+	case changed:
+		p.logger.Info("forwarding resumed")
+	}
+}
+
+// holdPaused stores the forwards of the inbound request to the targets as dead letters, if enabled,
+// instead of forwarding them while forwarding is paused.
+func (p *SprayProxy) holdPaused(in *inboundRequest, targets []forwardTarget, zapCommonFields []zapcore.Field) {
+	metrics.IncPausedCount()
+	if p.deadLetters == nil {
+		p.logger.Info("forwarding paused, dropping request", zapCommonFields...)
+		return
+	}
+	for _, target := range targets {
+		p.addDeadLetter(in, target, errorPaused, zapCommonFields)
+	}
+	p.logger.Info("forwarding paused, stored request as dead letters", append(zapCommonFields, zap.Int("backends", len(targets)))...)
+}
@@ -0,0 +1,118 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+func TestPauseResume(t *testing.T) {
+	var received int32
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&received, 1)
+	}))
+	defer backend.Close()
+	for _, tc := range []struct {
+		name          string
+		deadLetters   bool
+		expectedPause string
+	}{
+		{name: "dropped", expectedPause: "paused, requests are dropped"},
+		{name: "dead letters", deadLetters: true, expectedPause: "paused, requests are stored as dead letters"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			atomic.StoreInt32(&received, 0)
+			registry := prometheus.NewRegistry()
+			metrics.InitMetrics(registry)
+			path := filepath.Join(t.TempDir(), "deadletters.jsonl")
+			opts := []Option{}
+			if tc.deadLetters {
+				opts = append(opts, WithDeadLetterFile(path))
+			}
+			proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL, backend.URL + "/other"}, opts...)
+			if err != nil {
+				t.Fatalf("failed to set up proxy: %v", err)
+			}
+			send := func() *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				ctx, _ := gin.CreateTestContext(w)
+				ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+				proxy.HandleProxy(ctx)
+				return w
+			}
+
+			w := callBackendsHandler(proxy.Pause, http.MethodPost, nil)
+			if w.Code != http.StatusOK || w.Body.String() != tc.expectedPause {
+				t.Errorf("unexpected pause response %d %q", w.Code, w.Body.String())
+			}
+			if !proxy.Paused() {
+				t.Error("expected forwarding to be paused")
+			}
+			if got := metricValue(t, registry, "sprayproxy_paused", ""); got != 1 {
+				t.Errorf("expected the paused gauge to be 1, got %v", got)
+			}
+			if w := send(); w.Code != http.StatusOK || w.Body.String() != "paused" {
+				t.Errorf("unexpected response while paused %d %q", w.Code, w.Body.String())
+			}
+			if got := atomic.LoadInt32(&received); got != 0 {
+				t.Errorf("expected no forwards while paused, got %d", got)
+			}
+			if got := metricValue(t, registry, "sprayproxy_http_paused_requests_total", ""); got != 1 {
+				t.Errorf("expected 1 paused request counted, got %v", got)
+			}
+			if tc.deadLetters {
+				// one dead letter per backend
+				waitForDeadLetters(t, path, 2)
+			}
+
+			w = callBackendsHandler(proxy.Resume, http.MethodPost, nil)
+			if w.Code != http.StatusOK || w.Body.String() != "resumed" {
+				t.Errorf("unexpected resume response %d %q", w.Code, w.Body.String())
+			}
+			if proxy.Paused() {
+				t.Error("expected forwarding to be resumed")
+			}
+			if w := send(); w.Code != http.StatusOK {
+				t.Errorf("expected status code %d once resumed, got %d", http.StatusOK, w.Code)
+			}
+			if got := atomic.LoadInt32(&received); got != 2 {
+				t.Errorf("expected 2 forwards once resumed, got %d", got)
+			}
+			if tc.deadLetters {
+				replayed, err := proxy.ReplayDeadLetters()
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if replayed != 2 {
+					t.Errorf("expected 2 replayed dead letters, got %d", replayed)
+				}
+			}
+		})
+	}
+}
+
+func TestPauseUnauthorized(t *testing.T) {
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), nil, WithAdminToken("secret"))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	if w := callBackendsHandler(proxy.Pause, http.MethodPost, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status code %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if proxy.Paused() {
+		t.Error("expected forwarding not to be paused")
+	}
+}
@@ -0,0 +1,59 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// loadBackends reads the backends persisted in the given file.
+// The returned error wraps fs.ErrNotExist if the file does not exist.
+func loadBackends(path string) ([]Backend, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	backends := []Backend{}
+	if err := json.Unmarshal(data, &backends); err != nil {
+		// files written before backends had settings only hold their URLs
+		urls := []string{}
+		if json.Unmarshal(data, &urls) != nil {
+			return nil, err
+		}
+		return newBackends(urls), nil
+	}
+	return backends, nil
+}
+
+// saveBackends persists the backends to the given file.
+// The backends are written to a temporary file in the same directory first, which is then renamed,
+// so a crash while writing never leaves a truncated file behind.
+func saveBackends(path string, backends []Backend) error {
+	data, err := json.Marshal(backends)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	// no-op once the file has been renamed
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,232 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+func TestPersistBackends(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "backends.json")
+	t.Setenv("SPRAYPROXY_BACKENDS_FILE", file)
+
+	// no file yet, the configured backends are used
+	proxy, err := NewSprayProxy(false, zap.NewNop(), "http://backend1")
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	if !reflect.DeepEqual(proxy.Backends(), []string{"http://backend1"}) {
+		t.Errorf("expected configured backends, got %v", proxy.Backends())
+	}
+	callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {"http://backend2"}})
+	callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {"http://backend3"}})
+	callBackendsHandler(proxy.Unregister, http.MethodDelete, url.Values{"server": {"http://backend1"}})
+
+	// a restarted proxy picks up the persisted backends
+	restarted, err := NewSprayProxy(false, zap.NewNop(), "http://backend1")
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	expected := []string{"http://backend2", "http://backend3"}
+	if !reflect.DeepEqual(restarted.Backends(), expected) {
+		t.Errorf("expected persisted backends %v, got %v", expected, restarted.Backends())
+	}
+
+	// only the backends file is left, no temporary files
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read dir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the backends file in %s, got %d entries", dir, len(entries))
+	}
+}
+
+func TestPersistBackendsInvalidFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "backends.json")
+	if err := os.WriteFile(file, []byte("not json"), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if _, err := NewSprayProxyWithOptions(false, zap.NewNop(), nil, WithBackendsFile(file)); err == nil {
+		t.Errorf("expected error loading an invalid backends file")
+	}
+}
+
+func TestPersistBackendsFailure(t *testing.T) {
+	// the parent directory does not exist, so saving fails
+	file := filepath.Join(t.TempDir(), "missing", "backends.json")
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), nil, WithBackendsFile(file))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	registry := prometheus.NewRegistry()
+	metrics.InitMetrics(registry)
+	w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {"http://backend1"}})
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if expected := []string{"http://backend1"}; !reflect.DeepEqual(proxy.Backends(), expected) {
+		t.Errorf("expected backends %v in memory, got %v", expected, proxy.Backends())
+	}
+	w = callBackendsHandler(proxy.Unregister, http.MethodDelete, url.Values{"server": {"http://backend1"}})
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if len(proxy.Backends()) != 0 {
+		t.Errorf("expected no backends, got %v", proxy.Backends())
+	}
+	if got := metricValue(t, registry, "sprayproxy_backends_persist_failures_total", ""); got != 2 {
+		t.Errorf("expected 2 persistence failures, got %v", got)
+	}
+}
+
+func TestPersistBackendsEvents(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "backends.json")
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), nil, WithBackendsFile(file))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {"http://backend1"}, "events": {"push"}})
+	restarted, err := NewSprayProxyWithOptions(false, zap.NewNop(), nil, WithBackendsFile(file))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	expected := []Backend{{URL: "http://backend1", Events: []string{"push"}}}
+	if got := restarted.snapshotBackends(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected persisted backends %v, got %v", expected, got)
+	}
+}
+
+func TestLoadBackendsURLList(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "backends.json")
+	if err := os.WriteFile(file, []byte(`["http://backend1","http://backend2"]`), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	backends, err := loadBackends(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []Backend{{URL: "http://backend1"}, {URL: "http://backend2"}}
+	if !reflect.DeepEqual(backends, expected) {
+		t.Errorf("expected backends %v, got %v", expected, backends)
+	}
+}
+
+func TestReloadBackends(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "backends.json")
+	if err := os.WriteFile(file, []byte(`[{"url":"http://backend1"}]`), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), nil, WithBackendsFile(file), WithAdminToken("s3cr3t"))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	reload := func(authorization string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080/backends/reload", nil)
+		ctx.Request.Header.Set("Authorization", authorization)
+		proxy.Reload(ctx)
+		return w
+	}
+
+	// the file is edited out of band
+	if err := os.WriteFile(file, []byte(`[{"url":"http://Backend2/"},{"url":"http://backend3","shadow":true}]`), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if w := reload("Bearer wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status code %d without the admin token, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if !reflect.DeepEqual(proxy.Backends(), []string{"http://backend1"}) {
+		t.Errorf("expected unauthorized reload to keep the backends, got %v", proxy.Backends())
+	}
+	w := reload("Bearer s3cr3t")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if expected := "http://backend2\nhttp://backend3 (shadow)"; w.Body.String() != expected {
+		t.Errorf("expected reloaded list %q, got %q", expected, w.Body.String())
+	}
+
+	// invalid files keep the current backends
+	for _, content := range []string{"not json", `[{"url":"ftp://backend4"}]`, `[{"url":"http://backend4"},{"url":"http://backend4/"}]`} {
+		if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+		if w := reload("Bearer s3cr3t"); w.Code != http.StatusInternalServerError {
+			t.Errorf("%s: expected status code %d, got %d", content, http.StatusInternalServerError, w.Code)
+		}
+		if expected := []string{"http://backend2", "http://backend3"}; !reflect.DeepEqual(proxy.Backends(), expected) {
+			t.Errorf("%s: expected backends %v to be kept, got %v", content, expected, proxy.Backends())
+		}
+	}
+}
+
+func TestReloadForgetsRemovedBackends(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "backends.json")
+	if err := os.WriteFile(file, []byte(`[{"url":"http://backend1","maxConcurrent":1,"minInterval":"1s"},{"url":"http://backend2"}]`), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), nil, WithBackendsFile(file), WithCircuitBreaker(1, time.Minute))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	removed := proxy.snapshotBackends()[0]
+	proxy.slots(removed)
+	proxy.nextForwards = map[string]time.Time{removed.URL: time.Now().Add(time.Second)}
+	proxy.recordError("backend1", BackendError{Status: http.StatusInternalServerError})
+	proxy.health[removed.URL] = &healthState{failures: 3}
+	proxy.recordForward("backend1", false)
+	proxy.recordDelivery(BackendResult{URL: removed.URL, Host: "backend1", Status: http.StatusInternalServerError}, time.Now())
+
+	if err := os.WriteFile(file, []byte(`[{"url":"http://backend2"}]`), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if w := callBackendsHandler(proxy.Reload, http.MethodPost, nil); w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if _, ok := proxy.concurrencySlots[removed.URL]; ok {
+		t.Error("expected the concurrency slots of the removed backend to be dropped")
+	}
+	if _, ok := proxy.nextForwards[removed.URL]; ok {
+		t.Error("expected the pacing of the removed backend to be dropped")
+	}
+	if errors := proxy.LastErrors(); len(errors) != 0 {
+		t.Errorf("expected the error history of the removed backend to be dropped, got %v", errors)
+	}
+	if !proxy.isHealthy(removed.URL) {
+		t.Error("expected the health of the removed backend to be dropped")
+	}
+	if !proxy.allowForward("backend1") {
+		t.Error("expected the circuit breaker of the removed backend to be dropped")
+	}
+	if _, ok := proxy.lastDeliveries["backend1"]; ok {
+		t.Error("expected the delivery status of the removed backend to be dropped")
+	}
+}
+
+func TestReloadBackendsWithoutFile(t *testing.T) {
+	proxy, err := NewSprayProxy(false, zap.NewNop(), "http://backend1")
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	if w := callBackendsHandler(proxy.Reload, http.MethodPost, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
@@ -0,0 +1,57 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// pingEvent is the GitHub event sent once a webhook is created, to check it is delivered
+const pingEvent = "ping"
+
+// PingMode decides the backends GitHub ping events are forwarded to.
+type PingMode string
+
+const (
+	// PingForwardAll forwards ping events like any other event.
+	PingForwardAll PingMode = "forward-all"
+	// PingDrop answers ping events as proxied without forwarding them.
+	PingDrop PingMode = "drop"
+	// PingForwardDesignated only forwards ping events to the backends registered to receive them, which
+	// use them as health checks of their webhook.
+	PingForwardDesignated PingMode = "forward-to-health-backends"
+)
+
+// parsePingMode parses the name of a ping mode, case insensitively.
+func parsePingMode(name string) (PingMode, bool) {
+	switch mode := PingMode(strings.ToLower(strings.TrimSpace(name))); mode {
+	case PingForwardAll, PingDrop, PingForwardDesignated:
+		return mode, true
+	}
+	return "", false
+}
+
+// pingTargets returns the targets a ping event is forwarded to according to the ping mode, none when
+// pings are dropped, so the ping is answered as proxied.
+func (p *SprayProxy) pingTargets(targets []forwardTarget, zapCommonFields []zapcore.Field) []forwardTarget {
+	switch p.pingMode {
+	case PingDrop:
+		p.logger.Debug("dropping ping event", zapCommonFields...)
+		return nil
+	case PingForwardDesignated:
+		designated := []forwardTarget{}
+		for _, target := range targets {
+			if target.backend.Pings {
+				designated = append(designated, target)
+			}
+		}
+		return designated
+	default:
+		return targets
+	}
+}
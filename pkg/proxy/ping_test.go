@@ -0,0 +1,71 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestPingEvents(t *testing.T) {
+	var lock sync.Mutex
+	received := []string{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		received = append(received, r.URL.Path+" "+r.Header.Get(eventHeader))
+	}))
+	defer backend.Close()
+	for _, tc := range []struct {
+		env      string
+		expected []string
+	}{
+		{env: "", expected: []string{"/ ping", "/ ping", "/ push", "/ push"}},
+		{env: "forward-all", expected: []string{"/ ping", "/ ping", "/ push", "/ push"}},
+		{env: "invalid", expected: []string{"/ ping", "/ ping", "/ push", "/ push"}},
+		{env: "Drop", expected: []string{"/ push", "/ push"}},
+		{env: "forward-to-health-backends", expected: []string{"/ ping", "/ push", "/ push"}},
+	} {
+		t.Setenv("SPRAYPROXY_PING_EVENTS", tc.env)
+		proxy, err := NewSprayProxy(false, zap.NewNop(), backend.URL)
+		if err != nil {
+			t.Fatalf("failed to set up proxy: %v", err)
+		}
+		w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {backend.URL + "/pings"}, "pings": {"maybe"}})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, w.Code)
+		}
+		callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {backend.URL + "/pings"}, "pings": {"true"}})
+		lock.Lock()
+		received = []string{}
+		lock.Unlock()
+		for _, event := range []string{"ping", "push"} {
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString(`{"zen":"Keep it logically awesome."}`))
+			ctx.Request.Header.Set(eventHeader, event)
+			proxy.HandleProxy(ctx)
+			if w.Code != http.StatusOK {
+				t.Errorf("mode %q: expected status code %d for %s, got %d", tc.env, http.StatusOK, event, w.Code)
+			}
+		}
+		lock.Lock()
+		sort.Strings(received)
+		if !reflect.DeepEqual(received, tc.expected) {
+			t.Errorf("mode %q: expected forwards %v, got %v", tc.env, tc.expected, received)
+		}
+		lock.Unlock()
+	}
+}
@@ -0,0 +1,57 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import "strings"
+
+// SuccessPolicy decides whether a request is answered as proxied, depending on how many of its
+// backends could be reached. Shadow backends never count.
+type SuccessPolicy string
+
+const (
+	// SuccessPolicyAll answers requests as proxied only if every backend could be reached.
+	SuccessPolicyAll SuccessPolicy = "all"
+	// SuccessPolicyAny answers requests as proxied if at least one backend could be reached.
+	SuccessPolicyAny SuccessPolicy = "any"
+	// SuccessPolicyQuorum answers requests as proxied if a majority of the backends could be reached.
+	SuccessPolicyQuorum SuccessPolicy = "quorum"
+)
+
+// parseSuccessPolicy parses the name of a success policy, case insensitively.
+func parseSuccessPolicy(name string) (SuccessPolicy, bool) {
+	switch policy := SuccessPolicy(strings.ToLower(strings.TrimSpace(name))); policy {
+	case SuccessPolicyAll, SuccessPolicyAny, SuccessPolicyQuorum:
+		return policy, true
+	}
+	return "", false
+}
+
+// succeeded returns true if the results of the forwards satisfy the policy. Backends answering with a
+// 5xx status are reached, unless failOn5xx is set. Requests without any backend to forward to succeed,
+// as nothing failed.
+func (policy SuccessPolicy) succeeded(results []BackendResult, failOn5xx bool) bool {
+	reached, total := 0, 0
+	for _, result := range results {
+		if result.Shadow {
+			continue
+		}
+		total++
+		if result.Error == nil && !(failOn5xx && result.Failed()) {
+			reached++
+		}
+	}
+	if total == 0 {
+		return true
+	}
+	switch policy {
+	case SuccessPolicyAny:
+		return reached > 0
+	case SuccessPolicyQuorum:
+		return reached*2 > total
+	default:
+		return reached == total
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestSuccessPolicySucceeded(t *testing.T) {
+	ok := BackendResult{Status: http.StatusOK}
+	down := BackendResult{Error: errors.New("connection refused")}
+	failing := BackendResult{Status: http.StatusInternalServerError}
+	shadowDown := BackendResult{Error: errors.New("connection refused"), Shadow: true}
+	for _, tc := range []struct {
+		name      string
+		results   []BackendResult
+		failOn5xx bool
+		expected  map[SuccessPolicy]bool
+	}{
+		{
+			name:     "no backends",
+			expected: map[SuccessPolicy]bool{SuccessPolicyAll: true, SuccessPolicyAny: true, SuccessPolicyQuorum: true},
+		},
+		{
+			name:     "all reached",
+			results:  []BackendResult{ok, ok, shadowDown},
+			expected: map[SuccessPolicy]bool{SuccessPolicyAll: true, SuccessPolicyAny: true, SuccessPolicyQuorum: true},
+		},
+		{
+			name:     "majority reached",
+			results:  []BackendResult{ok, ok, down},
+			expected: map[SuccessPolicy]bool{SuccessPolicyAll: false, SuccessPolicyAny: true, SuccessPolicyQuorum: true},
+		},
+		{
+			name:     "half reached",
+			results:  []BackendResult{ok, down},
+			expected: map[SuccessPolicy]bool{SuccessPolicyAll: false, SuccessPolicyAny: true, SuccessPolicyQuorum: false},
+		},
+		{
+			name:     "errors answered",
+			results:  []BackendResult{failing, failing},
+			expected: map[SuccessPolicy]bool{SuccessPolicyAll: true, SuccessPolicyAny: true, SuccessPolicyQuorum: true},
+		},
+		{
+			name:      "errors answered failing on 5xx",
+			results:   []BackendResult{ok, failing, failing},
+			failOn5xx: true,
+			expected:  map[SuccessPolicy]bool{SuccessPolicyAll: false, SuccessPolicyAny: true, SuccessPolicyQuorum: false},
+		},
+		{
+			name:     "none reached",
+			results:  []BackendResult{down, down},
+			expected: map[SuccessPolicy]bool{SuccessPolicyAll: false, SuccessPolicyAny: false, SuccessPolicyQuorum: false},
+		},
+		{
+			name:     "only shadow backends",
+			results:  []BackendResult{shadowDown},
+			expected: map[SuccessPolicy]bool{SuccessPolicyAll: true, SuccessPolicyAny: true, SuccessPolicyQuorum: true},
+		},
+	} {
+		for policy, expected := range tc.expected {
+			if got := policy.succeeded(tc.results, tc.failOn5xx); got != expected {
+				t.Errorf("%s with policy %s: expected %v, got %v", tc.name, policy, expected, got)
+			}
+		}
+	}
+}
+
+func TestParseSuccessPolicy(t *testing.T) {
+	for name, expected := range map[string]SuccessPolicy{"all": SuccessPolicyAll, " Any": SuccessPolicyAny, "QUORUM": SuccessPolicyQuorum} {
+		if policy, ok := parseSuccessPolicy(name); !ok || policy != expected {
+			t.Errorf("%q: expected policy %s, got %s", name, expected, policy)
+		}
+	}
+	if _, ok := parseSuccessPolicy("most"); ok {
+		t.Error("expected an unknown policy to be rejected")
+	}
+}
+
+func TestHandleProxySuccessPolicy(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	for policy, expected := range map[string]int{
+		"":       http.StatusBadGateway,
+		"bogus":  http.StatusBadGateway,
+		"all":    http.StatusBadGateway,
+		"any":    http.StatusOK,
+		"quorum": http.StatusOK,
+	} {
+		t.Setenv("SPRAYPROXY_SUCCESS_POLICY", policy)
+		proxy, err := NewSprayProxy(false, zap.NewNop(), up.URL, up.URL+"/other", down.URL)
+		if err != nil {
+			t.Fatalf("failed to set up proxy: %v", err)
+		}
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+		proxy.HandleProxy(ctx)
+		if w.Code != expected {
+			t.Errorf("policy %q: expected status code %d, got %d", policy, expected, w.Code)
+		}
+	}
+
+	// a backend answering with 500 is reached, unless it fails the delivery as much as an unreachable one
+	for _, policy := range []string{"all", "any", "quorum"} {
+		t.Setenv("SPRAYPROXY_SUCCESS_POLICY", policy)
+		for failOn5xx, expected := range map[bool]int{false: http.StatusOK, true: http.StatusBadGateway} {
+			proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{failing.URL}, WithRetryCount(0), WithFailOn5xx(failOn5xx))
+			if err != nil {
+				t.Fatalf("failed to set up proxy: %v", err)
+			}
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+			proxy.HandleProxy(ctx)
+			if w.Code != expected {
+				t.Errorf("policy %q failing on 5xx %v: expected status code %d with a 500 backend, got %d", policy, failOn5xx, expected, w.Code)
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+)
+
+// backendsProvider caches the backends returned by a BackendsFunc, so it is not called on every request.
+type backendsProvider struct {
+	fn  BackendsFunc
+	ttl time.Duration
+	// lock guards backends and fetched, and is held while calling fn so concurrent requests share a call
+	lock     sync.Mutex
+	backends []Backend
+	fetched  time.Time
+}
+
+func newBackendsProvider(fn BackendsFunc, ttl time.Duration) *backendsProvider {
+	return &backendsProvider{fn: fn, ttl: ttl}
+}
+
+// get returns a copy of the current backends, calling the provider if the cached ones expired.
+func (b *backendsProvider) get(now time.Time) []Backend {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.backends == nil || now.Sub(b.fetched) >= b.ttl {
+		b.backends = newBackends(b.fn())
+		b.fetched = now
+		metrics.SetBackendCount(len(b.backends))
+	}
+	return append([]Backend{}, b.backends...)
+}
+
+// managedByProvider rejects the request with 409 Conflict if backends are provided by a BackendsFunc,
+// and cannot be changed from the API. It returns true if the request was rejected.
+func (p *SprayProxy) managedByProvider(c *gin.Context) bool {
+	if p.provider == nil {
+		return false
+	}
+	c.String(http.StatusConflict, "backends are managed by a provider")
+	return true
+}
@@ -0,0 +1,92 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestBackendsProviderCache(t *testing.T) {
+	calls := 0
+	urls := []string{"http://a"}
+	provider := newBackendsProvider(func() []string {
+		calls++
+		return urls
+	}, time.Minute)
+	now := time.Now()
+	if got := provider.get(now); len(got) != 1 || got[0].URL != "http://a" {
+		t.Errorf("unexpected backends %+v", got)
+	}
+	urls = []string{"http://a", "http://b"}
+	if got := provider.get(now.Add(30 * time.Second)); len(got) != 1 {
+		t.Errorf("expected cached backends, got %+v", got)
+	}
+	if got := provider.get(now.Add(time.Minute)); len(got) != 2 {
+		t.Errorf("expected refreshed backends, got %+v", got)
+	}
+	if calls != 2 {
+		t.Errorf("expected the provider to be called twice, got %d", calls)
+	}
+}
+
+func TestHandleProxyBackendsFunc(t *testing.T) {
+	var received int32
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&received, 1)
+	}))
+	defer backend.Close()
+	var calls int32
+	provider := func() []string {
+		atomic.AddInt32(&calls, 1)
+		return []string{backend.URL}
+	}
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{"http://static.invalid"}, WithBackendsFunc(provider, time.Minute))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+		proxy.HandleProxy(ctx)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+		}
+	}
+	if got := atomic.LoadInt32(&received); got != 3 {
+		t.Errorf("expected the provided backend to receive 3 requests, got %d", got)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("expected the provider to be called once, got %d", got)
+	}
+	w := callBackendsHandler(proxy.List, http.MethodGet, nil)
+	if w.Body.String() != backend.URL {
+		t.Errorf("expected list %q, got %q", backend.URL, w.Body.String())
+	}
+
+	// backends are managed by the provider
+	w = callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {"http://other"}})
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status code %d registering, got %d", http.StatusConflict, w.Code)
+	}
+	w = callBackendsHandler(proxy.Unregister, http.MethodDelete, url.Values{"server": {backend.URL}})
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status code %d unregistering, got %d", http.StatusConflict, w.Code)
+	}
+	w = callBackendsHandler(proxy.Reload, http.MethodPost, nil)
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status code %d reloading, got %d", http.StatusConflict, w.Code)
+	}
+}
@@ -7,164 +7,1433 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"github.com/redhat-appstudio/sprayproxy/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"golang.org/x/net/http2"
 )
 
 // GitHub webhook request max size is 25MB
-const maxReqSize = 1024 * 1024 * 25
+const defaultMaxReqSize = 1024 * 1024 * 25
 
+// BackendsFunc returns the URLs of the backends to forward to, for backends discovered dynamically.
 type BackendsFunc func() []string
 
 type SprayProxy struct {
-	backends    BackendsFunc
-	insecureTLS bool
-	logger      *zap.Logger
-	fwdReqTmout time.Duration
+	// backendsLock guards backends, which can be changed at runtime while requests are proxied
+	backendsLock   sync.RWMutex
+	backends       []Backend
+	backendsFile   string
+	insecureTLS    bool
+	rootCAs        *x509.CertPool
+	clientCerts    []tls.Certificate
+	logger         *zap.Logger
+	fwdReqTmout    time.Duration
+	maxReqSize     int64
+	spillThreshold int64
+	retryCount     int
+	retryBaseDelay time.Duration
+	webhookSecrets []string
+	adminToken     string
+	jsonResponse   bool
+	multiStatus    bool
+	// successPolicy decides how many backends must be reached for a request to be answered as proxied
+	successPolicy SuccessPolicy
+	// failOn5xx counts the backends answering with a 5xx status as not reached by the success policy
+	failOn5xx bool
+	// successStatus is the status code of the requests answered as proxied
+	successStatus int
+	// successBody replaces the text of the requests answered as proxied when set, along with its content type
+	successBody        []byte
+	successContentType string
+	// decodeBodies verifies the signature of gzip and deflate encoded bodies over their decoded content
+	decodeBodies bool
+	// allowNoBackends answers requests as proxied when no backends are configured
+	allowNoBackends bool
+	async           bool
+	stream          bool
+	tracing         bool
+	h2c             bool
+	// followRedirects follows the redirects of backends, instead of answering with them
+	followRedirects bool
+	// pingMode decides the backends GitHub ping events are forwarded to
+	pingMode PingMode
+	// upstreamProxy is the HTTP proxy forwards are sent through, overriding the proxy env vars when set
+	upstreamProxy *url.URL
+	// localAddr is the source address of the connections to all backends, chosen by the system when nil
+	localAddr net.IP
+	// requestIDHeader is the header the request ID is forwarded to backends in
+	requestIDHeader string
+	// allowedHeaders are the canonical names of the inbound headers forwarded to backends, nil to forward all
+	allowedHeaders map[string]bool
+	// deniedHeaders are the canonical names of the inbound headers never forwarded to backends
+	deniedHeaders map[string]bool
+	// sensitiveHeaders are the canonical names of the headers redacted from logs
+	sensitiveHeaders map[string]bool
+	// logBodyLimit is the number of bytes of backend response bodies logged
+	logBodyLimit int
+	// logErrorBodies enables logging the bodies of backend responses with a 4xx or 5xx status
+	logErrorBodies bool
+	// logSuccessBodies enables logging the bodies of the other backend responses, at debug level
+	logSuccessBodies bool
+
+	// bodyReadTimeout bounds the time to read the body of inbound requests, 0 meaning no limit
+	bodyReadTimeout time.Duration
+	// dialTimeout and tlsHandshakeTimeout bound connecting to the backends, within the forwarding timeout
+	dialTimeout         time.Duration
+	tlsHandshakeTimeout time.Duration
+	// keepAlive is the period of TCP keep-alives on backend connections, disabled if negative
+	keepAlive time.Duration
+	// maxIdleConns, maxIdleConnsPerHost and idleConnTimeout bound the idle connections kept to the backends
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+	// transportLock guards transports, the transports of the backend clients keyed by their TLS settings
+	transportLock sync.Mutex
+	transports    map[transportKey]*http.Transport
+
+	healthCheckInterval  time.Duration
+	healthCheckPath      string
+	healthCheckThreshold int
+	// healthCheckJitter is the fraction of the interval health checks are randomly spread by
+	healthCheckJitter float64
+	// healthLock guards health, the state of the backends as determined by health checks
+	healthLock sync.Mutex
+	health     map[string]*healthState
+	// startupCheck probes the backends once on startup, which fails if any of them fails with strictStartup
+	startupCheck  bool
+	strictStartup bool
+
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	// breakerLock guards breakers, the circuit breakers keyed by backend host
+	breakerLock sync.Mutex
+	breakers    map[string]*breakerState
+
+	// drainLock guards draining, the backends not receiving new forwards, forwarding, the number of
+	// forwards in flight keyed by backend URL, and forwardStarts, their start times keyed by forward ID
+	drainLock     sync.Mutex
+	draining      map[string]bool
+	forwarding    map[string]int
+	forwardStarts map[uint64]time.Time
+	lastForwardID uint64
+
+	// slotsLock guards concurrencySlots, the semaphores of the backends with a concurrency limit keyed by URL
+	slotsLock        sync.Mutex
+	concurrencySlots map[string]chan struct{}
+
+	// throttleLock guards nextForwards, the earliest start of the next forward to the paced backends keyed by URL
+	throttleLock sync.Mutex
+	nextForwards map[string]time.Time
+
+	// groupsLock guards groups, the current round-robin weights of the backends keyed by group and URL
+	groupsLock sync.Mutex
+	groups     map[string]map[string]int
+
+	// deliveries holds the recently seen delivery IDs, nil if deduplication is disabled
+	deliveries *deliveryCache
+	// coalescer coalesces the concurrent forwards of the same delivery, nil if coalescing is disabled
+	coalescer *coalescer
+
+	// rateLimiter limits the rate of requests per client IP, nil if rate limiting is disabled
+	rateLimiter *rateLimiter
+	// userAgentPrefix is the prefix the User-Agent of requests must start with, if set
+	userAgentPrefix string
+	// userAgentMode decides whether the User-Agent of forwarded requests identifies the proxy
+	userAgentMode UserAgentMode
+	// auditLogger records the changes of the backends, separately from the operational logs
+	auditLogger *zap.Logger
+
+	deadLetterFile string
+	// deadLetters stores the failed forwards, nil if no dead letter file is set
+	deadLetters *deadLetterStore
+
+	// lastDeliveriesLock guards lastDeliveries, the outcome of the last forwards keyed by backend host
+	lastDeliveriesLock sync.Mutex
+	lastDeliveries     map[string]*DeliveryStatus
+
+	// errorHistorySize is the number of error responses kept per backend, zero if they are not kept
+	errorHistorySize int
+	// errorHistoryLock guards errorHistory, the last error responses keyed by backend host
+	errorHistoryLock sync.Mutex
+	errorHistory     map[string]*errorRing
+
+	// webhookSecretFile is the file the webhook secrets are read from instead of webhookSecrets if set, read
+	// again every webhookSecretReload
+	webhookSecretFile   string
+	webhookSecretReload time.Duration
+	// secretFile caches the secrets of webhookSecretFile, nil if it is not set
+	secretFile *secretFile
+
+	// provider supplies the backends instead of the registered ones, nil if backends are not provided
+	provider *backendsProvider
+
+	// pauseLock guards paused, set while requests are acknowledged without being forwarded
+	pauseLock sync.Mutex
+	paused    bool
+
+	// inflight tracks the requests being forwarded, shutdownLock guards shuttingDown and inflightCount,
+	// the number of requests inflight tracks
+	inflight      sync.WaitGroup
+	shutdownLock  sync.Mutex
+	shuttingDown  bool
+	inflightCount int
 }
 
 func NewSprayProxy(insecureTLS bool, logger *zap.Logger, backends ...string) (*SprayProxy, error) {
-	backendFn := func() []string {
-		return backends
-	}
+	return NewSprayProxyWithOptions(insecureTLS, logger, backends)
+}
+
+// NewSprayProxyWithOptions creates a SprayProxy like NewSprayProxy, applying the given options
+// on top of the configuration read from the environment.
+func NewSprayProxyWithOptions(insecureTLS bool, logger *zap.Logger, backends []string, opts ...Option) (*SprayProxy, error) {
+	return NewSprayProxyWithLogger(insecureTLS, NewZapLogger(logger), backends, opts...)
+}
+
+// NewSprayProxyWithLogger creates a SprayProxy like NewSprayProxyWithOptions, logging to the given
+// Logger instead of a zap logger.
+func NewSprayProxyWithLogger(insecureTLS bool, log Logger, backends []string, opts ...Option) (*SprayProxy, error) {
+	logger := newZapLogger(log)
 
 	// forwarding request timeout of 15s, can be overriden by SPRAYPROXY_FORWARDING_REQUEST_TIMEOUT env var
 	fwdReqTmout := 15 * time.Second
 	if duration, err := time.ParseDuration(os.Getenv("SPRAYPROXY_FORWARDING_REQUEST_TIMEOUT")); err == nil {
 		fwdReqTmout = duration
 	}
-	logger.Info(fmt.Sprintf("proxy forwarding request timeout set to %s", fwdReqTmout.String()))
 
-	return &SprayProxy{
-		backends:    backendFn,
-		insecureTLS: insecureTLS,
-		logger:      logger,
-		fwdReqTmout: fwdReqTmout,
-	}, nil
+	// backend connection timeout of 5s, can be overriden by SPRAYPROXY_DIAL_TIMEOUT env var
+	dialTimeout := 5 * time.Second
+	if duration, err := time.ParseDuration(os.Getenv("SPRAYPROXY_DIAL_TIMEOUT")); err == nil && duration > 0 {
+		dialTimeout = duration
+	}
+
+	// backend TLS handshake timeout of 5s, can be overriden by SPRAYPROXY_TLS_HANDSHAKE_TIMEOUT env var
+	tlsHandshakeTimeout := 5 * time.Second
+	if duration, err := time.ParseDuration(os.Getenv("SPRAYPROXY_TLS_HANDSHAKE_TIMEOUT")); err == nil && duration > 0 {
+		tlsHandshakeTimeout = duration
+	}
+
+	// TCP keep-alives every 30s, can be overriden by SPRAYPROXY_KEEP_ALIVE env var, a negative duration disabling them
+	keepAlive := 30 * time.Second
+	if duration, err := time.ParseDuration(os.Getenv("SPRAYPROXY_KEEP_ALIVE")); err == nil && duration != 0 {
+		keepAlive = duration
+	}
+
+	// up to 100 idle connections, can be overriden by SPRAYPROXY_MAX_IDLE_CONNS env var, 0 meaning no limit
+	maxIdleConns := 100
+	if count, err := strconv.Atoi(os.Getenv("SPRAYPROXY_MAX_IDLE_CONNS")); err == nil && count >= 0 {
+		maxIdleConns = count
+	}
+
+	// up to 10 idle connections per backend, can be overriden by SPRAYPROXY_MAX_IDLE_CONNS_PER_HOST env var
+	maxIdleConnsPerHost := 10
+	if count, err := strconv.Atoi(os.Getenv("SPRAYPROXY_MAX_IDLE_CONNS_PER_HOST")); err == nil && count > 0 {
+		maxIdleConnsPerHost = count
+	}
+
+	// idle connections closed after 90s, can be overriden by SPRAYPROXY_IDLE_CONN_TIMEOUT env var
+	idleConnTimeout := 90 * time.Second
+	if duration, err := time.ParseDuration(os.Getenv("SPRAYPROXY_IDLE_CONN_TIMEOUT")); err == nil && duration > 0 {
+		idleConnTimeout = duration
+	}
+
+	// request body max size of 25MB, can be overriden by SPRAYPROXY_MAX_REQUEST_SIZE env var
+	maxReqSize := int64(defaultMaxReqSize)
+	if size, err := parseSize(os.Getenv("SPRAYPROXY_MAX_REQUEST_SIZE")); err == nil {
+		maxReqSize = size
+	}
+
+	// inbound request bodies read within 1m, can be overriden by SPRAYPROXY_BODY_READ_TIMEOUT env var, 0 meaning no limit
+	bodyReadTimeout := defaultBodyReadTimeout
+	if duration, err := time.ParseDuration(os.Getenv("SPRAYPROXY_BODY_READ_TIMEOUT")); err == nil && duration >= 0 {
+		bodyReadTimeout = duration
+	}
+
+	// failed forwards are not retried by default, can be overriden by SPRAYPROXY_RETRY_COUNT env var
+	retryCount := 0
+	if count, err := strconv.Atoi(os.Getenv("SPRAYPROXY_RETRY_COUNT")); err == nil && count >= 0 {
+		retryCount = count
+	}
+	// first retry delay of 100ms, can be overriden by SPRAYPROXY_RETRY_BASE_DELAY env var
+	retryBaseDelay := 100 * time.Millisecond
+	if duration, err := time.ParseDuration(os.Getenv("SPRAYPROXY_RETRY_BASE_DELAY")); err == nil && duration >= 0 {
+		retryBaseDelay = duration
+	}
+
+	// backends given by SPRAYPROXY_BACKENDS env var, a comma or newline separated list, are added to the given ones
+	backends = mergeBackends(backends, os.Getenv("SPRAYPROXY_BACKENDS"), logger)
+
+	// registered backends are only persisted when a file is set by SPRAYPROXY_BACKENDS_FILE env var
+	backendsFile := os.Getenv("SPRAYPROXY_BACKENDS_FILE")
+
+	// webhook signatures are only verified when secrets are set by SPRAYPROXY_WEBHOOK_SECRETS env var,
+	// a comma separated list to rotate them, or a single one by SPRAYPROXY_WEBHOOK_SECRET env var
+	webhookSecrets := splitList(os.Getenv("SPRAYPROXY_WEBHOOK_SECRETS"))
+	if len(webhookSecrets) == 0 && os.Getenv("SPRAYPROXY_WEBHOOK_SECRET") != "" {
+		webhookSecrets = []string{os.Getenv("SPRAYPROXY_WEBHOOK_SECRET")}
+	}
+	// webhook secrets are instead read from a file when set by SPRAYPROXY_WEBHOOK_SECRET_FILE env var, read again
+	// every minute unless SPRAYPROXY_WEBHOOK_SECRET_RELOAD_INTERVAL env var is set, 0 disabling the reloads
+	webhookSecretFile := os.Getenv("SPRAYPROXY_WEBHOOK_SECRET_FILE")
+	webhookSecretReload := defaultSecretReloadInterval
+	if duration, err := time.ParseDuration(os.Getenv("SPRAYPROXY_WEBHOOK_SECRET_RELOAD_INTERVAL")); err == nil && duration >= 0 {
+		webhookSecretReload = duration
+	}
+
+	// backend management endpoints are only protected when a token is set by SPRAYPROXY_ADMIN_TOKEN env var
+	adminToken := os.Getenv("SPRAYPROXY_ADMIN_TOKEN")
+
+	// backend certificates are verified with the system pool, extended by SPRAYPROXY_BACKEND_CA_FILE env var
+	var rootCAs *x509.CertPool
+	if caFile := os.Getenv("SPRAYPROXY_BACKEND_CA_FILE"); caFile != "" {
+		pool, err := loadCAFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load backend CA file: %w", err)
+		}
+		rootCAs = pool
+	}
+
+	// no client certificate is presented to backends, unless set by SPRAYPROXY_CLIENT_CERT_FILE and
+	// SPRAYPROXY_CLIENT_KEY_FILE env vars
+	clientCerts, err := loadClientCert(os.Getenv("SPRAYPROXY_CLIENT_CERT_FILE"), os.Getenv("SPRAYPROXY_CLIENT_KEY_FILE"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client certificate: %w", err)
+	}
+
+	// forwards honor the HTTP_PROXY, HTTPS_PROXY and NO_PROXY env vars, unless overriden by SPRAYPROXY_UPSTREAM_PROXY env var
+	var upstreamProxy *url.URL
+	if proxy := os.Getenv("SPRAYPROXY_UPSTREAM_PROXY"); proxy != "" {
+		proxyURL, err := parseUpstreamProxy(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream proxy: %w", err)
+		}
+		upstreamProxy = proxyURL
+	}
+
+	// the system picks the source address of the forwards, unless set by SPRAYPROXY_LOCAL_ADDR env var
+	var localAddr net.IP
+	if addr := os.Getenv("SPRAYPROXY_LOCAL_ADDR"); addr != "" {
+		ip, err := parseLocalAddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid local address: %w", err)
+		}
+		localAddr = ip
+	}
+
+	// signatures are verified over the body as received, unless SPRAYPROXY_DECODE_BODIES env var is set
+	decodeBodies, _ := strconv.ParseBool(os.Getenv("SPRAYPROXY_DECODE_BODIES"))
+
+	// per backend results are only returned as JSON on request, unless SPRAYPROXY_JSON_RESPONSE env var is set
+	jsonResponse, _ := strconv.ParseBool(os.Getenv("SPRAYPROXY_JSON_RESPONSE"))
+
+	// requests are rejected when no backends are configured, unless SPRAYPROXY_ALLOW_NO_BACKENDS env var is set
+	allowNoBackends, _ := strconv.ParseBool(os.Getenv("SPRAYPROXY_ALLOW_NO_BACKENDS"))
+
+	// requests fail unless all backends are reached, can be overriden by SPRAYPROXY_SUCCESS_POLICY env var
+	successPolicy := SuccessPolicyAll
+	if policy, ok := parseSuccessPolicy(os.Getenv("SPRAYPROXY_SUCCESS_POLICY")); ok {
+		successPolicy = policy
+	}
+
+	// backends answering with a 5xx status are reached, unless SPRAYPROXY_FAIL_ON_5XX env var is set
+	failOn5xx, _ := strconv.ParseBool(os.Getenv("SPRAYPROXY_FAIL_ON_5XX"))
+
+	// ping events are forwarded like other events, can be overriden by SPRAYPROXY_PING_EVENTS env var
+	pingMode := PingForwardAll
+	if mode, ok := parsePingMode(os.Getenv("SPRAYPROXY_PING_EVENTS")); ok {
+		pingMode = mode
+	}
+
+	// proxied requests are answered with 200 OK, can be overriden by SPRAYPROXY_SUCCESS_STATUS env var
+	successStatus := http.StatusOK
+	if status, err := strconv.Atoi(os.Getenv("SPRAYPROXY_SUCCESS_STATUS")); err == nil && isSuccessStatus(status) {
+		successStatus = status
+	}
+
+	// proxied requests are answered with "proxied", unless a body is set by SPRAYPROXY_SUCCESS_BODY env var,
+	// with the content type set by SPRAYPROXY_SUCCESS_CONTENT_TYPE env var
+	var successBody []byte
+	if body, ok := os.LookupEnv("SPRAYPROXY_SUCCESS_BODY"); ok {
+		successBody = []byte(body)
+	}
+	successContentType := defaultSuccessContentType
+	if contentType := os.Getenv("SPRAYPROXY_SUCCESS_CONTENT_TYPE"); contentType != "" {
+		successContentType = contentType
+	}
+
+	// partial deliveries are answered like full ones, unless SPRAYPROXY_MULTI_STATUS env var is set
+	multiStatus, _ := strconv.ParseBool(os.Getenv("SPRAYPROXY_MULTI_STATUS"))
+
+	// requests are forwarded before responding, unless SPRAYPROXY_ASYNC env var is set
+	async, _ := strconv.ParseBool(os.Getenv("SPRAYPROXY_ASYNC"))
+
+	// bodies are only streamed to a single backend, unless SPRAYPROXY_STREAM env var is set
+	stream, _ := strconv.ParseBool(os.Getenv("SPRAYPROXY_STREAM"))
+
+	// cleartext backends are sent HTTP/1.1, unless SPRAYPROXY_H2C env var is set
+	h2c, _ := strconv.ParseBool(os.Getenv("SPRAYPROXY_H2C"))
+
+	// redirects of backends are not followed, unless SPRAYPROXY_FOLLOW_REDIRECTS env var is set
+	followRedirects, _ := strconv.ParseBool(os.Getenv("SPRAYPROXY_FOLLOW_REDIRECTS"))
+
+	// request IDs are forwarded in the X-Request-ID header, can be overriden by SPRAYPROXY_REQUEST_ID_HEADER env var
+	requestIDHeader := "X-Request-ID"
+	if header := os.Getenv("SPRAYPROXY_REQUEST_ID_HEADER"); header != "" {
+		requestIDHeader = header
+	}
+
+	// signature and authorization headers are redacted from logs, extended by SPRAYPROXY_SENSITIVE_HEADERS env var
+	sensitiveHeaders := newSensitiveHeaders(strings.Split(os.Getenv("SPRAYPROXY_SENSITIVE_HEADERS"), ",")...)
+
+	// all inbound headers are forwarded to backends, unless restricted by SPRAYPROXY_FORWARD_HEADERS env var,
+	// or some are dropped by SPRAYPROXY_DROP_HEADERS env var
+	allowedHeaders := newHeaderSet(strings.Split(os.Getenv("SPRAYPROXY_FORWARD_HEADERS"), ",")...)
+	deniedHeaders := newHeaderSet(strings.Split(os.Getenv("SPRAYPROXY_DROP_HEADERS"), ",")...)
+
+	// bodies are buffered in memory, unless a size above which they are spilled to disk is set by
+	// SPRAYPROXY_SPILL_THRESHOLD env var
+	var spillThreshold int64
+	if size, err := parseSize(os.Getenv("SPRAYPROXY_SPILL_THRESHOLD")); err == nil && size > 0 {
+		spillThreshold = size
+	}
+
+	// backend response bodies are logged up to 4KB, can be overriden by SPRAYPROXY_LOG_BODY_LIMIT env var
+	logBodyLimit := defaultLogBodyLimit
+	if limit, err := parseSize(os.Getenv("SPRAYPROXY_LOG_BODY_LIMIT")); err == nil {
+		logBodyLimit = int(limit)
+	}
+
+	// backend error response bodies are logged, unless disabled by SPRAYPROXY_LOG_ERROR_BODIES env var
+	logErrorBodies := true
+	if enabled, err := strconv.ParseBool(os.Getenv("SPRAYPROXY_LOG_ERROR_BODIES")); err == nil {
+		logErrorBodies = enabled
+	}
+
+	// successful backend response bodies are not logged, unless enabled by SPRAYPROXY_LOG_SUCCESS_BODIES env var
+	logSuccessBodies, _ := strconv.ParseBool(os.Getenv("SPRAYPROXY_LOG_SUCCESS_BODIES"))
+
+	// the last 10 error responses of each backend are kept, can be overriden by SPRAYPROXY_ERROR_HISTORY_SIZE env var
+	errorHistorySize := defaultErrorHistorySize
+	if size, err := strconv.Atoi(os.Getenv("SPRAYPROXY_ERROR_HISTORY_SIZE")); err == nil && size >= 0 {
+		errorHistorySize = size
+	}
+
+	// spans are only recorded and propagated to backends when SPRAYPROXY_TRACING env var is set
+	tracingEnabled := tracing.Enabled()
+
+	// health checks are disabled unless an interval is set by SPRAYPROXY_HEALTH_CHECK_INTERVAL env var
+	healthCheckInterval := time.Duration(0)
+	if duration, err := time.ParseDuration(os.Getenv("SPRAYPROXY_HEALTH_CHECK_INTERVAL")); err == nil && duration > 0 {
+		healthCheckInterval = duration
+	}
+	// health checks are sent to the backend root, can be overriden by SPRAYPROXY_HEALTH_CHECK_PATH env var
+	healthCheckPath := "/"
+	if path := os.Getenv("SPRAYPROXY_HEALTH_CHECK_PATH"); path != "" {
+		healthCheckPath = path
+	}
+	// backends are unhealthy after 3 failed checks in a row, can be overriden by SPRAYPROXY_HEALTH_CHECK_THRESHOLD env var
+	healthCheckThreshold := 3
+	if threshold, err := strconv.Atoi(os.Getenv("SPRAYPROXY_HEALTH_CHECK_THRESHOLD")); err == nil && threshold > 0 {
+		healthCheckThreshold = threshold
+	}
+
+	// health checks are spread by 10% of their interval, can be overriden by SPRAYPROXY_HEALTH_CHECK_JITTER env var
+	healthCheckJitter := defaultJitter
+	if jitter, err := strconv.ParseFloat(os.Getenv("SPRAYPROXY_HEALTH_CHECK_JITTER"), 64); err == nil && jitter >= 0 && jitter <= 1 {
+		healthCheckJitter = jitter
+	}
+
+	// backends are not probed on startup unless SPRAYPROXY_STARTUP_CHECK env var is set, nor is startup failed
+	// by backends failing the probe unless SPRAYPROXY_STRICT_STARTUP env var is set, which implies the probe
+	strictStartup, _ := strconv.ParseBool(os.Getenv("SPRAYPROXY_STRICT_STARTUP"))
+	startupCheck, _ := strconv.ParseBool(os.Getenv("SPRAYPROXY_STARTUP_CHECK"))
+
+	// circuit breakers are disabled unless a threshold is set by SPRAYPROXY_CIRCUIT_BREAKER_THRESHOLD env var
+	breakerThreshold := 0
+	if threshold, err := strconv.Atoi(os.Getenv("SPRAYPROXY_CIRCUIT_BREAKER_THRESHOLD")); err == nil && threshold > 0 {
+		breakerThreshold = threshold
+	}
+	// open circuits are retried after 30 seconds, can be overriden by SPRAYPROXY_CIRCUIT_BREAKER_COOLDOWN env var
+	breakerCooldown := 30 * time.Second
+	if duration, err := time.ParseDuration(os.Getenv("SPRAYPROXY_CIRCUIT_BREAKER_COOLDOWN")); err == nil && duration > 0 {
+		breakerCooldown = duration
+	}
+
+	// deliveries are only deduplicated when a cache size is set by SPRAYPROXY_DEDUP_CACHE_SIZE env var
+	var deliveries *deliveryCache
+	if size, err := strconv.Atoi(os.Getenv("SPRAYPROXY_DEDUP_CACHE_SIZE")); err == nil && size > 0 {
+		// deliveries are remembered for an hour, can be overriden by SPRAYPROXY_DEDUP_TTL env var
+		ttl := time.Hour
+		if duration, err := time.ParseDuration(os.Getenv("SPRAYPROXY_DEDUP_TTL")); err == nil && duration > 0 {
+			ttl = duration
+		}
+		deliveries = newDeliveryCache(size, ttl)
+	}
+
+	// concurrent forwards of the same delivery are only coalesced when SPRAYPROXY_COALESCE_DELIVERIES env var is set
+	var deliveryCoalescer *coalescer
+	if coalesce, _ := strconv.ParseBool(os.Getenv("SPRAYPROXY_COALESCE_DELIVERIES")); coalesce {
+		deliveryCoalescer = newCoalescer()
+	}
+
+	// requests are only rate limited when a rate per second is set by SPRAYPROXY_RATE_LIMIT env var
+	var limiter *rateLimiter
+	if rate, err := strconv.ParseFloat(os.Getenv("SPRAYPROXY_RATE_LIMIT"), 64); err == nil && rate > 0 {
+		// bursts default to the rate, can be overriden by SPRAYPROXY_RATE_LIMIT_BURST env var
+		burst, _ := strconv.Atoi(os.Getenv("SPRAYPROXY_RATE_LIMIT_BURST"))
+		limiter = newRateLimiter(rate, burst)
+	}
+
+	// requests are accepted from any user agent, unless a prefix is required by SPRAYPROXY_REQUIRE_UA_PREFIX env var
+	userAgentPrefix := os.Getenv("SPRAYPROXY_REQUIRE_UA_PREFIX")
+
+	// the user agent of requests is forwarded unchanged, can be overriden by SPRAYPROXY_FORWARDED_USER_AGENT env var
+	userAgentMode := UserAgentKeep
+	if mode, ok := parseUserAgentMode(os.Getenv("SPRAYPROXY_FORWARDED_USER_AGENT")); ok {
+		userAgentMode = mode
+	}
+
+	// failed forwards are only stored when a file is set by SPRAYPROXY_DEADLETTER_FILE env var
+	deadLetterFile := os.Getenv("SPRAYPROXY_DEADLETTER_FILE")
+
+	p := &SprayProxy{
+		backends:       newBackends(backends),
+		backendsFile:   backendsFile,
+		insecureTLS:    insecureTLS,
+		rootCAs:        rootCAs,
+		clientCerts:    clientCerts,
+		logger:         logger,
+		fwdReqTmout:    fwdReqTmout,
+		maxReqSize:     maxReqSize,
+		spillThreshold: spillThreshold,
+		retryCount:     retryCount,
+		retryBaseDelay: retryBaseDelay,
+		webhookSecrets: webhookSecrets,
+		decodeBodies:   decodeBodies,
+		adminToken:     adminToken,
+		jsonResponse:   jsonResponse,
+		multiStatus:    multiStatus,
+		successPolicy:  successPolicy,
+		failOn5xx:      failOn5xx,
+
+		successStatus:      successStatus,
+		successBody:        successBody,
+		successContentType: successContentType,
+
+		allowNoBackends: allowNoBackends,
+		pingMode:        pingMode,
+		async:           async,
+		stream:          stream,
+		h2c:             h2c,
+		followRedirects: followRedirects,
+		tracing:         tracingEnabled,
+		upstreamProxy:   upstreamProxy,
+		localAddr:       localAddr,
+
+		requestIDHeader:  requestIDHeader,
+		allowedHeaders:   allowedHeaders,
+		deniedHeaders:    deniedHeaders,
+		sensitiveHeaders: sensitiveHeaders,
+		logBodyLimit:     logBodyLimit,
+		logErrorBodies:   logErrorBodies,
+		logSuccessBodies: logSuccessBodies,
+
+		bodyReadTimeout:     bodyReadTimeout,
+		dialTimeout:         dialTimeout,
+		tlsHandshakeTimeout: tlsHandshakeTimeout,
+		keepAlive:           keepAlive,
+		maxIdleConns:        maxIdleConns,
+		maxIdleConnsPerHost: maxIdleConnsPerHost,
+		idleConnTimeout:     idleConnTimeout,
+
+		healthCheckInterval:  healthCheckInterval,
+		healthCheckPath:      healthCheckPath,
+		healthCheckThreshold: healthCheckThreshold,
+		healthCheckJitter:    healthCheckJitter,
+		health:               map[string]*healthState{},
+		startupCheck:         startupCheck || strictStartup,
+		strictStartup:        strictStartup,
+
+		breakerThreshold: breakerThreshold,
+		breakerCooldown:  breakerCooldown,
+		breakers:         map[string]*breakerState{},
+
+		deliveries: deliveries,
+		coalescer:  deliveryCoalescer,
+
+		rateLimiter:     limiter,
+		userAgentPrefix: userAgentPrefix,
+		userAgentMode:   userAgentMode,
+
+		auditLogger: newAuditLogger(logger),
+
+		deadLetterFile: deadLetterFile,
+
+		webhookSecretFile:   webhookSecretFile,
+		webhookSecretReload: webhookSecretReload,
+
+		lastDeliveries: map[string]*DeliveryStatus{},
+
+		errorHistorySize: errorHistorySize,
+		errorHistory:     map[string]*errorRing{},
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.backendsFile != "" {
+		persisted, err := loadBackends(p.backendsFile)
+		switch {
+		case err == nil:
+			p.backends = persisted
+			logger.Info(fmt.Sprintf("loaded %d backends from %s", len(persisted), p.backendsFile))
+		case errors.Is(err, fs.ErrNotExist):
+			logger.Info(fmt.Sprintf("backends file %s not found, using configured backends", p.backendsFile))
+		default:
+			return nil, fmt.Errorf("failed to load backends from %s: %w", p.backendsFile, err)
+		}
+	}
+	if p.webhookSecretFile != "" {
+		secrets, err := newSecretFile(p.webhookSecretFile, p.webhookSecretReload, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read webhook secrets from %s: %w", p.webhookSecretFile, err)
+		}
+		p.secretFile = secrets
+		logger.Info(fmt.Sprintf("verifying webhook signatures with the secrets of %s, reloaded every %s", p.webhookSecretFile, p.webhookSecretReload.String()))
+	}
+	if p.provider != nil {
+		logger.Info(fmt.Sprintf("backends supplied by a provider, cached for %s", p.provider.ttl.String()))
+	} else {
+		// provided backends are only counted once fetched
+		metrics.SetBackendCount(len(p.backends))
+	}
+	if p.deadLetterFile != "" {
+		p.deadLetters = newDeadLetterStore(p.deadLetterFile, logger)
+		logger.Info("storing failed forwards to " + p.deadLetterFile)
+	}
+	logger.Info(fmt.Sprintf("proxy forwarding request timeout set to %s", p.fwdReqTmout.String()))
+	if p.bodyReadTimeout > 0 {
+		logger.Info(fmt.Sprintf("proxy request body read timeout set to %s", p.bodyReadTimeout.String()))
+	}
+	logger.Info(fmt.Sprintf("proxy dial timeout set to %s and TLS handshake timeout set to %s", p.dialTimeout.String(), p.tlsHandshakeTimeout.String()))
+	logger.Info(fmt.Sprintf("proxy keeping up to %d idle connections, %d per backend, for %s", p.maxIdleConns, p.maxIdleConnsPerHost, p.idleConnTimeout.String()))
+	logger.Info(fmt.Sprintf("proxy request max size set to %d bytes", p.maxReqSize))
+	if p.spillThreshold > 0 {
+		logger.Info(fmt.Sprintf("spilling request bodies larger than %d bytes to %s", p.spillThreshold, os.TempDir()))
+	}
+	logger.Info(fmt.Sprintf("proxy forwarding retries set to %d with base delay %s", p.retryCount, p.retryBaseDelay.String()))
+	if p.upstreamProxy != nil {
+		logger.Info("forwarding requests through upstream proxy " + p.upstreamProxy.Redacted())
+	}
+	if p.localAddr != nil {
+		logger.Info("forwarding requests to all backends from local address " + p.localAddr.String())
+	}
+	if p.async {
+		logger.Info("forwarding requests asynchronously")
+	}
+	if p.stream {
+		logger.Info("streaming request bodies to all backends")
+	}
+	if p.tracing {
+		logger.Info("tracing enabled")
+	}
+	if p.h2c {
+		logger.Info("sending HTTP/2 with prior knowledge to cleartext backends")
+	}
+	if p.followRedirects {
+		logger.Warn("following backend redirects, request bodies may be sent to the redirect targets")
+	}
+	if p.successStatus != http.StatusOK || p.successBody != nil {
+		logger.Info(fmt.Sprintf("answering proxied requests with status %d", p.successStatus))
+	}
+	if p.deliveries != nil {
+		logger.Info(fmt.Sprintf("deduplicating up to %d deliveries seen in the last %s", p.deliveries.size, p.deliveries.ttl.String()))
+	}
+	if p.coalescer != nil {
+		logger.Info("coalescing concurrent forwards of the same delivery")
+	}
+	if p.rateLimiter != nil {
+		logger.Info(fmt.Sprintf("rate limiting requests to %g per second per client, with bursts of %d", p.rateLimiter.rate, p.rateLimiter.burst))
+	}
+	if p.userAgentPrefix != "" {
+		logger.Info(fmt.Sprintf("rejecting requests with a user agent not starting with %q", p.userAgentPrefix))
+	}
+	if p.userAgentMode != UserAgentKeep {
+		logger.Info(fmt.Sprintf("forwarding requests with the %q user agent mode", string(p.userAgentMode)))
+	}
+	if p.pingMode != PingForwardAll {
+		logger.Info(fmt.Sprintf("handling ping events with the %q ping mode", string(p.pingMode)))
+	}
+	if p.successPolicy != SuccessPolicyAll {
+		logger.Info(fmt.Sprintf("answering requests as proxied with the %q success policy", string(p.successPolicy)))
+	}
+	if p.failOn5xx {
+		logger.Info("failing requests forwarded to backends answering with a 5xx status")
+	}
+	if p.breakerThreshold > 0 {
+		logger.Info(fmt.Sprintf("circuit breakers open after %d failures for %s", p.breakerThreshold, p.breakerCooldown.String()))
+	}
+	if p.secretFile == nil && len(p.webhookSecrets) > 1 {
+		logger.Info(fmt.Sprintf("verifying webhook signatures with %d secrets", len(p.webhookSecrets)))
+	}
+	if !p.verifiesSignatures() {
+		logger.Info("webhook secret not set, skipping signature verification")
+	}
+	if p.adminToken == "" {
+		logger.Warn("admin token not set, backend management endpoints are not protected")
+	}
+	if p.startupCheck || p.strictStartup {
+		if err := p.checkStartup(); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
 }
 
 func (p *SprayProxy) HandleProxy(c *gin.Context) {
 	// currently not distinguishing between requests we can parse and those we cannot parse
 	metrics.IncInboundCount()
-	errors := []error{}
-	zapCommonFields := []zapcore.Field{
-		zap.String("method", c.Request.Method),
-		zap.String("path", c.Request.URL.Path),
-		zap.String("query", c.Request.URL.RawQuery),
-		zap.Bool("insecure-tls", p.insecureTLS),
-		zap.String("request-id", c.GetString("requestId")),
-	}
-	// Read in body from incoming request
-	buf := &bytes.Buffer{}
-	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxReqSize)
+	if !p.beginForward() {
+		p.respondError(c, http.StatusServiceUnavailable, errorCodeShuttingDown, "shutting down")
+		return
+	}
+	defer p.endInflight()
+	requestID := p.ensureRequestID(c)
+	in := &inboundRequest{
+		method:        c.Request.Method,
+		url:           *c.Request.URL,
+		header:        forwardedHeader(c.Request),
+		host:          c.Request.Host,
+		contentLength: c.Request.ContentLength,
+		event:         c.GetHeader(eventHeader),
+		delivery:      c.GetHeader(deliveryHeader),
+		requestID:     requestID,
+		ctx:           c.Request.Context(),
+	}
+	zapCommonFields := p.commonFields(in)
+	// a client disconnect cancels the forwards, which are then pointless, unless they are
+	// asynchronous and outlive the request on purpose
+	if p.async {
+		in.ctx = context.Background()
+	}
+	if p.tracing {
+		span := p.startInboundSpan(c)
+		defer span.End()
+		in.ctx = trace.ContextWithSpan(in.ctx, span)
+	}
+	p.logger.Debug("received request", append(zapCommonFields, zap.Object("headers", p.redactHeaders(in.header)))...)
+	if !p.allowNoBackends && len(p.snapshotBackends()) == 0 {
+		metrics.IncNoBackendsCount()
+		p.respondError(c, http.StatusServiceUnavailable, errorCodeNoBackends, "no backends configured")
+		p.logger.Error("no backends configured", zapCommonFields...)
+		return
+	}
+	inbound := c.Request.Body
+	if conn := requestConn(c.Request); p.bodyReadTimeout > 0 && conn != nil {
+		inbound = newTimeoutBody(inbound, conn, p.bodyReadTimeout)
+	}
+	body := &countingReader{ReadCloser: inbound}
+	c.Request.Body = http.MaxBytesReader(c.Writer, body, p.maxReqSize)
 	defer c.Request.Body.Close()
-	_, err := buf.ReadFrom(c.Request.Body)
-	if err != nil {
-		c.String(http.StatusRequestEntityTooLarge, "request body too large")
-		p.logger.Error(err.Error(), zapCommonFields...)
+	targets := p.selectTargets(in, zapCommonFields)
+
+	// repository filters are matched against the body and transforms change it, which must then be buffered
+	// as do backups, the body being replayed to them
+	if p.canStream(len(targets)) && !hasRepoFilter(targets) && !hasTransform(targets) && !hasBackups(targets) {
+		if in.contentLength > p.maxReqSize {
+			observeBodySize(in, body.read)
+			metrics.IncTooLargeCount()
+			p.respondError(c, http.StatusRequestEntityTooLarge, errorCodeRequestTooLarge, "request body too large")
+			p.logger.Error("request body too large", zapCommonFields...)
+			return
+		}
+		if p.duplicateDelivery(c, in, zapCommonFields) {
+			return
+		}
+		streams, done := teeBody(c.Request.Body, len(targets))
+		results := p.forwardAll(in, targets, streams, zapCommonFields)
+		err := <-done
+		// the body is fully read once done, as it is only read by the tee
+		observeBodySize(in, body.read)
+		if err != nil {
+			p.respondBodyError(c, err, zapCommonFields)
+			return
+		}
+		p.rememberDelivery(in, results)
+		p.respondResults(c, results)
 		return
 	}
-	body := buf.Bytes()
 
-	client := &http.Client{
-		// set forwarding request timeout
-		Timeout: p.fwdReqTmout,
+	// Read in body from incoming request, large bodies being spilled to disk if enabled
+	err := p.bufferBody(in, c.Request.Body)
+	observeBodySize(in, body.read)
+	if err != nil {
+		p.respondBodyError(c, err, zapCommonFields)
+		return
 	}
-	if p.insecureTLS {
-		client.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
+	// spilled bodies are removed once forwarded, by the asynchronous forwards when they take over
+	removeBody := true
+	defer func() {
+		if removeBody {
+			p.removeBody(in)
+		}
+	}()
+
+	if p.verifiesSignatures() {
+		// the secrets may be reloaded meanwhile, the index refers to these ones
+		secrets := p.currentWebhookSecrets()
+		index, err := p.verifySignature(in, secrets, c.GetHeader(signatureHeader), c.GetHeader(contentEncodingHeader))
+		switch {
+		case err == nil:
+		case invalidSignature(err):
+			p.respondError(c, http.StatusUnauthorized, errorCodeInvalidSignature, "invalid webhook signature")
+			p.logger.Error("invalid webhook signature: "+err.Error(), zapCommonFields...)
+			return
+		case errors.Is(err, errDecodedBodyTooLarge):
+			metrics.IncTooLargeCount()
+			p.respondError(c, http.StatusRequestEntityTooLarge, errorCodeRequestTooLarge, "request body too large")
+			p.logger.Error(err.Error(), zapCommonFields...)
+			return
+		case p.decodeBodies:
+			p.respondError(c, http.StatusBadRequest, errorCodeInvalidEncoding, "invalid content encoding")
+			p.logger.Error("failed to decode request body: "+err.Error(), zapCommonFields...)
+			return
+		default:
+			c.String(http.StatusInternalServerError, "failed to read request body")
+			p.logger.Error("failed to read request body: "+err.Error(), zapCommonFields...)
+			return
 		}
+		// only the index is logged with the forwards, to tell when a rotated secret is no longer used
+		zapCommonFields = append(zapCommonFields, zap.Int("secret-index", index))
+		in.secret = secrets[index]
+	}
+
+	if p.duplicateDelivery(c, in, zapCommonFields) {
+		return
+	}
+	if p.async && !p.isPaused() {
+		// the request context is canceled once the handler returns, so forwarding must not depend on it.
+		// The forward is still tracked as in-flight, this request holding it until the goroutine takes over.
+		p.addInflight()
+		removeBody = false
+		go func() {
+			defer p.endInflight()
+			defer p.removeBody(in)
+			results, _ := p.forward(in, targets, zapCommonFields)
+			for _, result := range results {
+				if result.Error != nil && !result.Shadow {
+					metrics.IncAsyncFailedCount()
+					p.logger.Error("failed to proxy asynchronously", zapCommonFields...)
+					return
+				}
+			}
+		}()
+		p.respond(c, http.StatusOK, "accepted", nil)
+		return
+	}
+
+	results, paused := p.forward(in, targets, zapCommonFields)
+	if paused {
+		p.respond(c, http.StatusOK, "paused", nil)
+		return
+	}
+	p.respondResults(c, results)
+}
+
+// ensureRequestID returns the ID of the inbound request, generating one if no middleware set it.
+func (p *SprayProxy) ensureRequestID(c *gin.Context) string {
+	requestID := c.GetString("requestId")
+	if requestID == "" {
+		requestID = uuid.New().String()
+		c.Set("requestId", requestID)
+	}
+	return requestID
+}
+
+// respondResults responds to the inbound request according to the results of its forwards.
+func (p *SprayProxy) respondResults(c *gin.Context, results []BackendResult) {
+	if p.multiStatus && partialDelivery(results) {
+		// the body is what tells the outcomes apart, so it is always rendered
+		p.respondJSON(c, http.StatusMultiStatus, results)
+		return
+	}
+	if !p.successPolicy.succeeded(results, p.failOn5xx) {
+		// we have a bad gateway/connection somewhere
+		p.respond(c, http.StatusBadGateway, "failed to proxy", results)
+		return
 	}
+	p.respondSuccess(c, results)
+}
+
+// inboundRequest holds what is needed from an incoming request to forward it, so forwarding
+// does not depend on the gin context, which is reused once the handler returns.
+type inboundRequest struct {
+	method string
+	url    url.URL
+	header http.Header
+	// host is the Host header of the inbound request, sent to the backends preserving it
+	host string
+	// contentLength is the length of the inbound body, -1 if unknown
+	contentLength int64
+	// body is shared by all forwarding goroutines and must only be read from.
+	// It is nil when the body is streamed, or spilled to bodyFile.
+	body []byte
+	// bodyFile is the temporary file the body is spilled to, when larger than the spill threshold
+	bodyFile string
+	event    string
+	delivery string
+	// requestID correlates the forwards with the logs of the inbound request
+	requestID string
+	// secret is the webhook secret the signature was verified with, empty if not verified.
+	// It must never be logged.
+	secret string
+	// ctx is the parent of the forwards, canceled when the client disconnects unless forwarding
+	// asynchronously. It holds the span of the inbound request, the parent of the forwarding spans.
+	ctx context.Context
+	// test is set for test forwards, sent as the others but leaving the state of the proxy untouched:
+	// its metrics, circuit breakers, pacing, concurrency slots, draining, error history, delivery status
+	// and dead letters. They never fail over to backups.
+	test bool
+}
+
+// forwardTarget is a backend an inbound request is forwarded to, along with its parsed URL.
+type forwardTarget struct {
+	backend Backend
+	url     *url.URL
+	// backups are forwarded to in order when the forward to the backend fails
+	backups []forwardTarget
+}
 
-	for _, backend := range p.backends() {
-		backendURL, err := url.Parse(backend)
+// selectBackends returns the backends the inbound request is meant for, with a single backend of each group,
+// sorted by decreasing priority.
+func (p *SprayProxy) selectBackends(in *inboundRequest, zapCommonFields []zapcore.Field) []forwardTarget {
+	targets := []forwardTarget{}
+	// the backends of each group, in order of their first backend, to forward to one of them per group
+	groups := []string{}
+	grouped := map[string][]forwardTarget{}
+	// work on a snapshot, so concurrent registration changes do not affect this request
+	for _, backend := range p.snapshotBackends() {
+		if !backend.acceptsEvent(in.event) {
+			p.logger.Debug("skipping backend not subscribed to event "+in.event, append(zapCommonFields, zap.String("backend", backend.URL))...)
+			continue
+		}
+		if !backend.acceptsMethod(in.method) {
+			p.logger.Debug("skipping backend not accepting method "+in.method, append(zapCommonFields, zap.String("backend", backend.URL))...)
+			continue
+		}
+		if !p.isHealthy(backend.URL) {
+			p.logger.Info("skipping unhealthy backend", append(zapCommonFields, zap.String("backend", backend.URL))...)
+			continue
+		}
+		if draining, _ := p.drainState(backend.URL); draining {
+			p.logger.Info("skipping draining backend", append(zapCommonFields, zap.String("backend", backend.URL))...)
+			continue
+		}
+		backendURL, err := parseBackendURL(backend.URL)
 		if err != nil {
 			p.logger.Error("failed to parse backend "+err.Error(), zapCommonFields...)
 			continue
 		}
-		copy := c.Copy()
-		newURL := copy.Request.URL
-		newURL.Host = backendURL.Host
-		newURL.Scheme = backendURL.Scheme
-		// zap always append and does not override field entries, so we create
-		// per backend list of fields
-		zapBackendFields := append(zapCommonFields, zap.String("backend", newURL.Host))
-		newRequest, err := http.NewRequest(copy.Request.Method, newURL.String(), bytes.NewReader(body))
-		if err != nil {
-			p.logger.Error("failed to create request: "+err.Error(), zapBackendFields...)
-			errors = append(errors, err)
+		if backend.Group != "" {
+			if _, ok := grouped[backend.Group]; !ok {
+				groups = append(groups, backend.Group)
+			}
+			grouped[backend.Group] = append(grouped[backend.Group], forwardTarget{backend: backend, url: backendURL})
+			continue
+		}
+		if backend.weight() < maxWeight {
+			sampled := backend.sampled(in.requestID)
+			metrics.IncSampledCount(backendURL.Host, sampled)
+			if !sampled {
+				p.logger.Debug("skipping backend sampling out the request", append(zapCommonFields, zap.String("backend", backend.URL))...)
+				continue
+			}
+		}
+		targets = append(targets, forwardTarget{backend: backend, url: backendURL})
+	}
+	for _, group := range groups {
+		primaries, backups := splitBackups(grouped[group])
+		target, ok := p.pickFromGroup(group, primaries)
+		if !ok && len(backups) > 0 {
+			// the primaries are all unhealthy or weighted out, so the backups take over right away
+			target, backups, ok = backups[0], backups[1:], true
+		}
+		if !ok {
+			p.logger.Debug("skipping group without weighted backends", append(zapCommonFields, zap.String("group", group))...)
+			continue
+		}
+		target.backups = backups
+		targets = append(targets, target)
+	}
+	// higher priority backends are forwarded to first, the others keep their registration order
+	sort.SliceStable(targets, func(i, j int) bool {
+		return targets[i].backend.Priority > targets[j].backend.Priority
+	})
+	return targets
+}
+
+// forwardAll forwards the inbound request to the given backends, and returns the result of every forward
+// in the order of the backends.
+// When streams is set, the body of the forward to each backend is read from the stream at the same index,
+// otherwise the buffered body of the inbound request is used.
+func (p *SprayProxy) forwardAll(in *inboundRequest, targets []forwardTarget, streams []*io.PipeReader, zapCommonFields []zapcore.Field) []BackendResult {
+	// forwards are bound by the timeout of their context instead, which can be set per backend,
+	// backends with the same TLS settings share their client
+	clients := map[transportKey]*http.Client{}
+
+	// forward to all backends in parallel, so the overall latency is bound by
+	// the slowest backend rather than the sum of all of them
+	var wg sync.WaitGroup
+	// each forward writes the result at the index of its backend, skipped ones stay unset
+	results := make([]*BackendResult, len(targets))
+	for i, target := range targets {
+		var stream *io.PipeReader
+		if streams != nil {
+			stream = streams[i]
+		}
+		// checked again along with counting the forward, in case the backend started draining since it was selected
+		forwardID, ok := uint64(0), true
+		if !in.test {
+			forwardID, ok = p.startForward(target.backend.URL)
+		}
+		if !ok {
+			p.logger.Info("skipping draining backend", append(zapCommonFields, zap.String("backend", target.backend.URL))...)
+			if stream != nil {
+				// unblock the tee, which otherwise waits for this backend to read
+				stream.CloseWithError(errDraining)
+			}
 			continue
 		}
-		newRequest.Header = copy.Request.Header
-		// currently not distinguishing between requests we send and requests that return without error
-		metrics.IncForwardedCount(backendURL.Host)
+		key := transportKey{insecure: target.backend.Insecure, serverName: target.backend.ServerName}
+		targetClient, ok := clients[key]
+		if !ok {
+			targetClient = p.backendClient(target.backend)
+			targetClient.Timeout = 0
+			clients[key] = targetClient
+		}
+		wg.Add(1)
+		go func(i int, client *http.Client, target forwardTarget, stream *io.PipeReader, forwardID uint64) {
+			defer wg.Done()
+			start := time.Now()
+			if in.test {
+				result := p.forwardToBackend(client, in, target, stream, zapCommonFields)
+				result.Latency = time.Since(start)
+				results[i] = &result
+				return
+			}
+			defer p.endForward(target.backend.URL, forwardID)
+			result := p.forwardToBackend(client, in, target, stream, zapCommonFields)
+			result.Latency = time.Since(start)
+			target, result = p.failOver(in, target, result, zapCommonFields)
+			p.storeDeadLetter(in, target, result, zapCommonFields)
+			p.recordDelivery(result, time.Now())
+			results[i] = &result
+		}(i, targetClient, target, stream, forwardID)
+	}
+	wg.Wait()
+	forwarded := []BackendResult{}
+	for _, result := range results {
+		if result != nil {
+			forwarded = append(forwarded, *result)
+		}
+	}
+	return forwarded
+}
 
+// forwardToBackend sends a copy of the inbound request to a single backend, with the body read
+// from stream if set, otherwise from the buffered body. Streamed bodies cannot be replayed, so they
+// are never retried.
+// It is safe to call concurrently for different backends of the same inbound request.
+// The result has no error if the backend could be reached and its response fully read, regardless of
+// its response status.
+func (p *SprayProxy) forwardToBackend(client *http.Client, in *inboundRequest, target forwardTarget, stream *io.PipeReader, zapCommonFields []zapcore.Field) BackendResult {
+	backendURL := target.url
+	result := BackendResult{URL: target.backend.URL, Host: backendURL.Host, Shadow: target.backend.Shadow}
+	// copy the URL by value, the inbound request is shared between goroutines
+	newURL := in.url
+	newURL.Host = backendURL.Host
+	newURL.Scheme = backendURL.Scheme
+	rewriteErr := target.backend.rewritePath(&newURL)
+	newURL.Path = target.backend.PathPrefix + newURL.Path
+	if newURL.RawPath != "" {
+		newURL.RawPath = target.backend.PathPrefix + newURL.RawPath
+	}
+	// zap always append and does not override field entries, so we create
+	// per backend list of fields
+	zapBackendFields := make([]zapcore.Field, len(zapCommonFields), len(zapCommonFields)+2)
+	copy(zapBackendFields, zapCommonFields)
+	zapBackendFields = append(zapBackendFields, zap.String("backend", newURL.Host), zap.Bool("shadow", target.backend.Shadow))
+	if rewriteErr != nil {
+		p.logger.Error("failed to rewrite path: "+rewriteErr.Error(), zapBackendFields...)
+		if stream != nil {
+			// unblock the tee, which otherwise waits for this backend to read
+			stream.CloseWithError(rewriteErr)
+		}
+		result.Error = rewriteErr
+		return result
+	}
+	if !in.test && !p.allowForward(backendURL.Host) {
+		metrics.IncCircuitOpenCount(backendURL.Host)
+		p.logger.Info("skipping backend with open circuit", zapBackendFields...)
+		if stream != nil {
+			// unblock the tee, which otherwise waits for this backend to read
+			stream.CloseWithError(errCircuitOpen)
+		}
+		result.Error = errCircuitOpen
+		return result
+	}
+	defer func() {
+		if in.test {
+			return
+		}
+		if in.ctx.Err() != nil {
+			// canceled by the client, which says nothing about the health of the backend
+			p.releaseTrial(backendURL.Host)
+			return
+		}
+		if errors.Is(result.Error, errConcurrencyLimit) || errors.Is(result.Error, errThrottled) {
+			// never sent, which says nothing about the health of the backend either
+			p.releaseTrial(backendURL.Host)
+			return
+		}
+		p.recordForward(backendURL.Host, result.Error == nil && result.Status < http.StatusInternalServerError)
+	}()
+	forwardCtx := in.ctx
+	if p.tracing {
+		var span trace.Span
+		forwardCtx, span = p.startForwardSpan(forwardCtx, backendURL.Host)
+		start := time.Now()
+		defer func() {
+			endForwardSpan(span, result, time.Since(start))
+		}()
+	}
+	// the overall forwarding timeout applies to all attempts, including the backoff in between
+	ctx, cancel := context.WithTimeout(forwardCtx, target.backend.forwardTimeout(p.fwdReqTmout))
+	defer cancel()
+	// paced before taking a slot, so waiting for its turn does not hold back the other forwards
+	var err error
+	release := func() {}
+	if !in.test {
+		err = p.throttle(ctx, target.backend, backendURL.Host)
+		if err == nil {
+			release, err = p.acquireSlot(ctx, target.backend)
+		}
+	}
+	if err != nil {
+		p.logger.Error("failed to forward: "+err.Error(), zapBackendFields...)
+		if stream != nil {
+			// unblock the tee, which otherwise waits for this backend to read
+			stream.CloseWithError(err)
+		}
+		result.Error = err
+		return result
+	}
+	defer release()
+	if !in.test {
+		metrics.IncInFlightCount(backendURL.Host)
+		defer metrics.DecInFlightCount(backendURL.Host)
+	}
+	var transformed []byte
+	if stream == nil {
+		transformed = p.transformBody(in, target.backend, zapBackendFields)
+	}
+	var resp *http.Response
+	for retry := 0; ; retry++ {
+		var body io.Reader
+		if stream != nil {
+			body = stream
+		} else if transformed != nil {
+			body = bytes.NewReader(transformed)
+		} else {
+			opened, err := in.openBody()
+			if err != nil {
+				p.logger.Error("failed to read request body: "+err.Error(), zapBackendFields...)
+				result.Error = err
+				return result
+			}
+			body = opened
+		}
+		newRequest, err := http.NewRequestWithContext(ctx, in.method, newURL.String(), body)
+		if err != nil {
+			p.logger.Error("failed to create request: "+err.Error(), zapBackendFields...)
+			if stream != nil {
+				// unblock the tee, which otherwise waits for this backend to read
+				stream.CloseWithError(err)
+			} else if file, ok := body.(io.Closer); ok {
+				file.Close()
+			}
+			result.Error = err
+			return result
+		}
+		newRequest.Header = p.forwardedHeaders(in.header)
+		newRequest.Header.Set(p.requestIDHeader, in.requestID)
+		if p.userAgentMode != UserAgentKeep {
+			newRequest.Header.Set("User-Agent", p.userAgentMode.forwardedUserAgent(in.header.Get("User-Agent")))
+		}
+		if transformed != nil {
+			signTransformed(newRequest.Header, in, transformed)
+		}
+		// backend specific headers override the inbound ones
+		for name, value := range target.backend.Headers {
+			newRequest.Header.Set(name, value)
+		}
+		if target.backend.PreserveHost && in.host != "" {
+			newRequest.Host = in.host
+		}
+		// the length of streamed and spilled bodies is not known from their reader, unlike in memory ones
+		if (stream != nil || in.bodyFile != "") && transformed == nil {
+			newRequest.ContentLength = in.contentLength
+		}
+		if p.tracing {
+			otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(newRequest.Header))
+		}
 		// for response time, we are making it "simpler" and including everything in the client.Do call
 		start := time.Now()
-		resp, err := client.Do(newRequest)
+		resp, err = client.Do(newRequest)
 		responseTime := time.Now().Sub(start)
-		metrics.AddForwardedResponseTime(responseTime.Seconds())
+		if !in.test {
+			countAttempt(backendURL.Host, resp, err, responseTime)
+		}
 		// standartize on what ginzap logs
-		zapBackendFields = append(zapBackendFields, zap.Duration("latency", responseTime))
+		attemptFields := append(zapBackendFields, zap.Duration("latency", responseTime), zap.Int("retry", retry))
 		if err != nil {
-			p.logger.Error("proxy error: "+err.Error(), zapBackendFields...)
-			errors = append(errors, err)
-			continue
+			attemptFields = append(attemptFields, zap.String("error-class", string(ClassifyError(err))))
+		} else if isRedirect(resp) {
+			p.logger.Warn("backend answered with a redirect, check its URL", append(attemptFields, zap.Int("status", resp.StatusCode), zap.String("location", resp.Header.Get("Location")))...)
 		}
-		defer resp.Body.Close()
-		zapBackendFields = append(zapBackendFields, zap.Int("status", resp.StatusCode))
-		p.logger.Info("proxied request", zapBackendFields...)
-		if resp.StatusCode >= 400 {
-			respBody, err := io.ReadAll(resp.Body)
+		if stream != nil || retry >= p.retryCount || !isRetryable(resp, err) || !p.canRetry(ctx, retry+1) {
 			if err != nil {
-				p.logger.Info("failed to read response: "+err.Error(), zapBackendFields...)
-			} else {
-				p.logger.Info("response body: "+string(respBody), zapBackendFields...)
+				p.logger.Error("proxy error: "+err.Error(), attemptFields...)
+				result.Error = err
+				return result
 			}
+			zapBackendFields = attemptFields
+			break
+		}
+		if err != nil {
+			p.logger.Info("retrying after proxy error: "+err.Error(), attemptFields...)
+		} else {
+			p.logger.Info("retrying after status "+strconv.Itoa(resp.StatusCode), attemptFields...)
+			// drain the body so the connection can be reused
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if !in.test {
+			metrics.IncForwardRetryCount(backendURL.Host)
+		}
+		select {
+		case <-ctx.Done():
+			p.logger.Error("proxy error: "+ctx.Err().Error(), attemptFields...)
+			result.Error = ctx.Err()
+			return result
+		case <-time.After(backoff(p.retryBaseDelay, retry+1)):
 		}
+	}
+	defer resp.Body.Close()
+	result.Status = resp.StatusCode
+	zapBackendFields = append(zapBackendFields, zap.Int("status", resp.StatusCode))
+	// the response, along with its trailers, is only complete once the body is read to the end,
+	// which also lets the connection be reused
+	logBody := resp.StatusCode >= 400 && p.logErrorBodies
+	keepError := resp.StatusCode >= 400 && p.errorHistorySize > 0
+	// successful bodies are only read when debug entries are logged, so they cost nothing in production
+	logSuccessBody := resp.StatusCode < 400 && p.logSuccessBodies && p.logger.Core().Enabled(zapcore.DebugLevel)
+	var respBody string
+	var readErr error
+	if logBody || keepError || logSuccessBody {
+		respBody, readErr = p.readLoggedBody(resp.Body)
+	} else {
+		_, readErr = io.Copy(io.Discard, resp.Body)
+	}
+	if readErr != nil {
+		// a truncated body or malformed chunks or trailers, the backend did not complete the response
+		p.logger.Error("failed to read response: "+readErr.Error(), zapBackendFields...)
+		result.Error = readErr
+		return result
+	}
+	if len(resp.Trailer) > 0 {
+		zapBackendFields = append(zapBackendFields, zap.Object("trailers", p.redactHeaders(resp.Trailer)))
+	}
+	p.logger.Info("proxied request", zapBackendFields...)
+	if keepError && !in.test {
+		p.recordError(backendURL.Host, BackendError{Time: time.Now(), Status: resp.StatusCode, Body: respBody, RequestID: in.requestID})
+	}
+	if logBody {
+		p.logger.Info("response body: "+respBody,
+			append(zapBackendFields, zap.Object("response-headers", p.redactHeaders(resp.Header)))...)
+	}
+	if logSuccessBody {
+		// backends may report soft failures with a successful status, such as {"ok":false}
+		p.logger.Debug("response body: "+respBody, zapBackendFields...)
+	}
+	return result
+}
 
-		// // Create a new request with a disconnected context
-		// newRequest := copy.Request.Clone(context.Background())
-		// // Deep copy the request body since this needs to be read multiple times
-		// newRequest.Body = io.NopCloser(bytes.NewReader(body))
-
-		// proxy := httputil.NewSingleHostReverseProxy(backendURL)
-		// proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
-		// 	errors = append(errors, err)
-		// 	rw.WriteHeader(http.StatusBadGateway)
-		// }
-		// if p.insecureTLS {
-		// 	proxy.Transport = &http.Transport{
-		// 		TLSClientConfig: &tls.Config{
-		// 			InsecureSkipVerify: true,
-		// 		},
-		// 	}
-		// }
-		// doProxy(backend, proxy, newRequest)
-	}
-	if len(errors) > 0 {
-		// we have a bad gateway/connection somewhere
-		c.String(http.StatusBadGateway, "failed to proxy")
+// countAttempt records the metrics of an attempt to forward a request to the backend host, which took the
+// response time to answer with the response or fail with the error.
+func countAttempt(host string, resp *http.Response, err error, responseTime time.Duration) {
+	// currently not distinguishing between requests we send and requests that return without error
+	metrics.IncForwardedCount(host)
+	metrics.AddForwardedResponseTime(host, responseTime.Seconds())
+	if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+		metrics.IncForwardErrorCount(host)
+	}
+	if err != nil {
+		metrics.IncForwardedResponseCount(host, 0)
+		metrics.IncForwardFailureCount(host, string(ClassifyError(err)))
 		return
 	}
-	c.String(http.StatusOK, "proxied")
+	metrics.IncForwardedResponseCount(host, resp.StatusCode)
+	if isRedirect(resp) {
+		metrics.IncForwardRedirectCount(host)
+	}
+}
+
+// transportKey identifies the transports of the backend clients by the TLS settings they differ in.
+type transportKey struct {
+	insecure   bool
+	serverName string
+}
+
+// httpClient returns the client used to send requests to the backends, skipping the verification
+// of their TLS certificates if insecure is set or the proxy is insecure.
+func (p *SprayProxy) httpClient(insecure bool) *http.Client {
+	return p.backendClient(Backend{Insecure: insecure})
+}
+
+// backendClient returns the client used to send requests to the backend, according to its TLS settings.
+func (p *SprayProxy) backendClient(backend Backend) *http.Client {
+	client := &http.Client{
+		// set forwarding request timeout
+		Timeout:   p.fwdReqTmout,
+		Transport: p.transport(transportKey{insecure: backend.Insecure || p.insecureTLS, serverName: backend.ServerName}),
+	}
+	if !p.followRedirects {
+		// the redirect is returned as the response, so the body is not sent to an unexpected host
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	return client
+}
+
+// transport returns the transport of the clients sending requests to the backends, creating it on first
+// use. Transports are shared by the clients, so connections to the backends are reused across requests.
+func (p *SprayProxy) transport(key transportKey) *http.Transport {
+	p.transportLock.Lock()
+	defer p.transportLock.Unlock()
+	if transport, ok := p.transports[key]; ok {
+		return transport
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// custom transports must keep honoring the proxy env vars, like the default one does
+	proxy := http.ProxyFromEnvironment
+	if p.upstreamProxy != nil {
+		proxy = http.ProxyURL(p.upstreamProxy)
+	}
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		// Unix sockets are local, never reached through a proxy
+		if _, ok := unixSocket(req.URL.Hostname()); ok {
+			return nil, nil
+		}
+		return proxy(req)
+	}
+	// fail fast on unreachable or stalled backends, instead of waiting for the forwarding timeout
+	dialer := &net.Dialer{Timeout: p.dialTimeout, KeepAlive: p.keepAlive}
+	if p.localAddr != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: p.localAddr}
+	}
+	transport.DialContext = dialBackend(dialer)
+	transport.TLSHandshakeTimeout = p.tlsHandshakeTimeout
+	transport.MaxIdleConns = p.maxIdleConns
+	transport.MaxIdleConnsPerHost = p.maxIdleConnsPerHost
+	transport.IdleConnTimeout = p.idleConnTimeout
+	// HTTP/2 is only negotiated with a custom TLS config when forced
+	transport.ForceAttemptHTTP2 = true
+	transport.TLSClientConfig = &tls.Config{
+		// insecure TLS overrides the CA bundle, since nothing is verified at all
+		InsecureSkipVerify: key.insecure,
+		RootCAs:            p.rootCAs,
+		Certificates:       p.clientCerts,
+		// the host of the backend URL is used when empty
+		ServerName: key.serverName,
+	}
+	if p.h2c {
+		// cleartext backends are sent HTTP/2 directly, without going through the upstream proxy
+		transport.RegisterProtocol("http", newH2CTransport(dialer))
+	}
+	if p.transports == nil {
+		p.transports = map[transportKey]*http.Transport{}
+	}
+	p.transports[key] = transport
+	return transport
+}
+
+// isRedirect returns true if the response is a redirect which was not followed.
+func isRedirect(resp *http.Response) bool {
+	return resp.StatusCode >= http.StatusMultipleChoices && resp.StatusCode < http.StatusBadRequest && resp.Header.Get("Location") != ""
+}
+
+// newH2CTransport returns a transport sending HTTP/2 requests over cleartext connections, for backends
+// known to speak HTTP/2 without TLS.
+func newH2CTransport(dialer *net.Dialer) *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dialBackend(dialer)(ctx, network, addr)
+		},
+	}
+}
+
+// parseUpstreamProxy parses the URL of an upstream HTTP proxy, like "http://proxy.example.com:3128".
+func parseUpstreamProxy(proxy string) (*url.URL, error) {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if (proxyURL.Scheme != "http" && proxyURL.Scheme != "https") || proxyURL.Host == "" {
+		return nil, fmt.Errorf("%q is not an http or https URL", proxy)
+	}
+	return proxyURL, nil
+}
+
+// parseLocalAddr parses the source address of the forwards, an IPv4 or IPv6 address like "10.0.0.5".
+// No port can be set, as each connection needs its own.
+func parseLocalAddr(addr string) (net.IP, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP address", addr)
+	}
+	return ip, nil
 }
 
-func (p *SprayProxy) Backends() []string {
-	return p.backends()
+// canRetry returns true if the given retry can happen before the forwarding deadline expires.
+func (p *SprayProxy) canRetry(ctx context.Context, retry int) bool {
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Until(deadline) > backoff(p.retryBaseDelay, retry)
 }
 
 // InsecureSkipTLSVerify indicates if the proxy is skipping TLS verification.
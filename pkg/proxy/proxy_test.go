@@ -7,12 +7,20 @@ package proxy
 
 import (
 	"bytes"
+	"context"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
 	"github.com/redhat-appstudio/sprayproxy/test"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -58,6 +66,7 @@ func TestProxyCustomTimeout(t *testing.T) {
 }
 
 func TestHandleProxy(t *testing.T) {
+	t.Setenv("SPRAYPROXY_ALLOW_NO_BACKENDS", "true")
 	proxy, err := NewSprayProxy(false, zap.NewNop())
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
@@ -106,13 +115,14 @@ func TestHandleProxyMultiBackend(t *testing.T) {
 }
 
 func TestLargePayloadOnLimit(t *testing.T) {
+	t.Setenv("SPRAYPROXY_ALLOW_NO_BACKENDS", "true")
 	proxy, err := NewSprayProxy(false, zap.NewNop())
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 	w := httptest.NewRecorder()
 	ctx, _ := gin.CreateTestContext(w)
-	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBuffer(make([]byte, maxReqSize)))
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBuffer(make([]byte, defaultMaxReqSize)))
 	proxy.HandleProxy(ctx)
 	if w.Code != http.StatusOK {
 		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
@@ -124,13 +134,14 @@ func TestLargePayloadOnLimit(t *testing.T) {
 }
 
 func TestLargePayloadAboveLimit(t *testing.T) {
+	t.Setenv("SPRAYPROXY_ALLOW_NO_BACKENDS", "true")
 	proxy, err := NewSprayProxy(false, zap.NewNop())
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 	w := httptest.NewRecorder()
 	ctx, _ := gin.CreateTestContext(w)
-	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBuffer(make([]byte, maxReqSize+1)))
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBuffer(make([]byte, defaultMaxReqSize+1)))
 	proxy.HandleProxy(ctx)
 	if w.Code != http.StatusRequestEntityTooLarge {
 		t.Errorf("expected status code %d, got %d", http.StatusRequestEntityTooLarge, w.Code)
@@ -167,3 +178,470 @@ func TestProxyLog(t *testing.T) {
 		t.Errorf("expected string %q did not appear in %q", expected, log)
 	}
 }
+
+func TestHandleProxyConcurrentBackends(t *testing.T) {
+	// each backend blocks until all backends have received the request,
+	// which can only happen if the proxy forwards to them concurrently
+	const numBackends = 3
+	var arrived sync.WaitGroup
+	arrived.Add(numBackends)
+	allArrived := make(chan struct{})
+	go func() {
+		arrived.Wait()
+		close(allArrived)
+	}()
+	backends := []string{}
+	for i := 0; i < numBackends; i++ {
+		backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			arrived.Done()
+			select {
+			case <-allArrived:
+				rw.WriteHeader(http.StatusOK)
+			case <-time.After(5 * time.Second):
+				rw.WriteHeader(http.StatusGatewayTimeout)
+			}
+		}))
+		defer backend.Close()
+		backends = append(backends, backend.URL)
+	}
+
+	proxy, err := NewSprayProxy(false, zap.NewNop(), backends...)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	select {
+	case <-allArrived:
+	default:
+		t.Errorf("expected all backends to be called concurrently")
+	}
+}
+
+func TestHandleProxyOneBackendDown(t *testing.T) {
+	backend := test.NewTestServer()
+	defer backend.GetServer().Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	downURL := down.URL
+	down.Close()
+
+	proxy, err := NewSprayProxy(false, zap.NewNop(), backend.GetServer().URL, downURL)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected status code %d, got %d", http.StatusBadGateway, w.Code)
+	}
+	if backend.GetError() != nil {
+		t.Errorf("backend error: %v", backend.GetError())
+	}
+}
+
+// metricValue returns the value of the counter or gauge with the given name and host label
+// from the registry, or -1 if it is not found.
+func metricValue(t *testing.T, registry *prometheus.Registry, name, host string) float64 {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			// metrics without host label are looked up with an empty host
+			if host == "" && len(m.GetLabel()) == 0 {
+				if m.GetCounter() != nil {
+					return m.GetCounter().GetValue()
+				}
+				return m.GetGauge().GetValue()
+			}
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "host" && label.GetValue() == host {
+					if m.GetCounter() != nil {
+						return m.GetCounter().GetValue()
+					}
+					return m.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	return -1
+}
+
+func TestHandleProxyErrorMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics.InitMetrics(registry)
+	failing, _ := newFlakyBackend(5, http.StatusInternalServerError)
+	defer failing.Close()
+	rejecting, _ := newFlakyBackend(5, http.StatusNotFound)
+	defer rejecting.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	proxy, err := NewSprayProxy(false, zap.NewNop(), failing.URL, rejecting.URL, down.URL)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+	proxy.HandleProxy(ctx)
+
+	for backend, expected := range map[string]float64{
+		failing.URL: 1,
+		// 4xx are not counted as errors, and counters without any increment are not reported
+		rejecting.URL: -1,
+		down.URL:      1,
+	} {
+		host := strings.TrimPrefix(backend, "http://")
+		if got := metricValue(t, registry, "sprayproxy_http_forwarded_errors_total", host); got != expected {
+			t.Errorf("backend %s: expected %v errors, got %v", host, expected, got)
+		}
+	}
+
+	codes := map[string]string{}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "sprayproxy_http_forwarded_responses_total" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range m.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			codes[labels["host"]] = labels["code"]
+		}
+	}
+	for backend, expected := range map[string]string{
+		failing.URL:   "5xx",
+		rejecting.URL: "4xx",
+		down.URL:      "error",
+	} {
+		host := strings.TrimPrefix(backend, "http://")
+		if codes[host] != expected {
+			t.Errorf("backend %s: expected responses counted as %s, got %q", host, expected, codes[host])
+		}
+	}
+}
+
+func TestHandleProxyRequestID(t *testing.T) {
+	received := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		received <- req.Header
+	}))
+	defer backend.Close()
+
+	for name, tc := range map[string]struct {
+		requestID string
+		opts      []Option
+		header    string
+	}{
+		"generated":     {"", nil, "X-Request-ID"},
+		"from context":  {"abc-123", nil, "X-Request-ID"},
+		"custom header": {"abc-123", []Option{WithRequestIDHeader("X-Correlation-ID")}, "X-Correlation-ID"},
+	} {
+		proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL}, tc.opts...)
+		if err != nil {
+			t.Fatalf("failed to set up proxy: %v", err)
+		}
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+		if tc.requestID != "" {
+			ctx.Set("requestId", tc.requestID)
+		}
+		proxy.HandleProxy(ctx)
+
+		requestID := ctx.GetString("requestId")
+		if requestID == "" || (tc.requestID != "" && requestID != tc.requestID) {
+			t.Errorf("%s: unexpected request ID %q", name, requestID)
+		}
+		if got := (<-received).Get(tc.header); got != requestID {
+			t.Errorf("%s: expected backend to receive request ID %q in %s, got %q", name, requestID, tc.header, got)
+		}
+	}
+}
+
+func TestHandleProxyUpstreamProxy(t *testing.T) {
+	received := make(chan string, 1)
+	// a stub HTTP proxy, receiving the absolute URL of the backend instead of a path
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.URL.String()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("failed to parse upstream proxy URL: %v", err)
+	}
+	// the backend is only reachable through the upstream proxy
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{"http://backend.invalid"}, WithUpstreamProxy(upstreamURL))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080/hook", bytes.NewBufferString("hello"))
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+	select {
+	case got := <-received:
+		if got != "http://backend.invalid/hook" {
+			t.Errorf("expected upstream proxy to receive the backend URL, got %q", got)
+		}
+	default:
+		t.Error("expected request to transit the upstream proxy")
+	}
+}
+
+func TestHTTPClientProxyFromEnvironment(t *testing.T) {
+	proxy, err := NewSprayProxy(true, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	transport, ok := proxy.httpClient(false).Transport.(*http.Transport)
+	if !ok {
+		t.Fatal("expected insecure TLS to set a custom transport")
+	}
+	if transport.Proxy == nil {
+		t.Error("expected the insecure TLS transport to honor the proxy env vars")
+	}
+}
+
+func TestHTTPClientTransportReused(t *testing.T) {
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	if proxy.httpClient(false).Transport != proxy.httpClient(false).Transport {
+		t.Error("expected the transport to be shared by the clients")
+	}
+	if proxy.httpClient(false).Transport == proxy.httpClient(true).Transport {
+		t.Error("expected insecure clients to have their own transport")
+	}
+	if proxy.httpClient(false).Transport == proxy.backendClient(Backend{ServerName: "example.com"}).Transport {
+		t.Error("expected clients overriding the server name to have their own transport")
+	}
+}
+
+func TestProxyTransportTimeoutsEnv(t *testing.T) {
+	t.Setenv("SPRAYPROXY_DIAL_TIMEOUT", "2s")
+	t.Setenv("SPRAYPROXY_TLS_HANDSHAKE_TIMEOUT", "bad")
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	if proxy.dialTimeout != 2*time.Second {
+		t.Errorf("expected dial timeout of 2s, got %s", proxy.dialTimeout)
+	}
+	if proxy.tlsHandshakeTimeout != 5*time.Second {
+		t.Errorf("expected default TLS handshake timeout, got %s", proxy.tlsHandshakeTimeout)
+	}
+	if got := proxy.httpClient(false).Transport.(*http.Transport).TLSHandshakeTimeout; got != 5*time.Second {
+		t.Errorf("expected the transport TLS handshake timeout to be set, got %s", got)
+	}
+}
+
+func TestProxyIdleConnsEnv(t *testing.T) {
+	t.Setenv("SPRAYPROXY_MAX_IDLE_CONNS", "0")
+	t.Setenv("SPRAYPROXY_MAX_IDLE_CONNS_PER_HOST", "50")
+	t.Setenv("SPRAYPROXY_IDLE_CONN_TIMEOUT", "-1s")
+	t.Setenv("SPRAYPROXY_KEEP_ALIVE", "-1s")
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	transport := proxy.httpClient(false).Transport.(*http.Transport)
+	if transport.MaxIdleConns != 0 || transport.MaxIdleConnsPerHost != 50 {
+		t.Errorf("expected 0 and 50 idle connections, got %d and %d", transport.MaxIdleConns, transport.MaxIdleConnsPerHost)
+	}
+	if transport.IdleConnTimeout != 90*time.Second {
+		t.Errorf("expected the default idle connection timeout, got %s", transport.IdleConnTimeout)
+	}
+	if proxy.keepAlive != -time.Second {
+		t.Errorf("expected keep-alives to be disabled, got %s", proxy.keepAlive)
+	}
+
+	proxy, err = NewSprayProxyWithOptions(false, zap.NewNop(), nil, WithIdleConns(20, 5, time.Minute))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	transport = proxy.httpClient(true).Transport.(*http.Transport)
+	if transport.MaxIdleConns != 20 || transport.MaxIdleConnsPerHost != 5 || transport.IdleConnTimeout != time.Minute {
+		t.Errorf("unexpected idle connection settings %d, %d and %s", transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+}
+
+func TestHandleProxyTLSHandshakeTimeout(t *testing.T) {
+	// a backend accepting connections but never completing the TLS handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		<-done
+		conn.Close()
+	}()
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{"https://" + listener.Addr().String()},
+		WithTLSHandshakeTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+	start := time.Now()
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected status 502, got %d", w.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the handshake to time out early, took %s", elapsed)
+	}
+}
+
+func TestProxyUpstreamProxyEnv(t *testing.T) {
+	t.Setenv("SPRAYPROXY_UPSTREAM_PROXY", "http://proxy.example.com:3128")
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	if proxy.upstreamProxy == nil || proxy.upstreamProxy.Host != "proxy.example.com:3128" {
+		t.Errorf("unexpected upstream proxy %v", proxy.upstreamProxy)
+	}
+	t.Setenv("SPRAYPROXY_UPSTREAM_PROXY", "proxy.example.com")
+	if _, err := NewSprayProxy(false, zap.NewNop()); err == nil {
+		t.Error("expected an error for an upstream proxy without scheme")
+	}
+}
+
+func TestProxyLocalAddr(t *testing.T) {
+	remotes := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		host, _, _ := net.SplitHostPort(req.RemoteAddr)
+		remotes <- host
+	}))
+	defer backend.Close()
+	// any loopback address can be the source of connections to the backend on 127.0.0.1
+	t.Setenv("SPRAYPROXY_LOCAL_ADDR", "127.0.0.2")
+	proxy, err := NewSprayProxy(false, zap.NewNop(), backend.URL)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+	proxy.HandleProxy(ctx)
+	if remote := <-remotes; remote != "127.0.0.2" {
+		t.Errorf("expected the forward to come from 127.0.0.2, got %s", remote)
+	}
+	for _, invalid := range []string{"10.0.0.5:8080", "eth0"} {
+		t.Setenv("SPRAYPROXY_LOCAL_ADDR", invalid)
+		if _, err := NewSprayProxy(false, zap.NewNop()); err == nil {
+			t.Errorf("expected an error for local address %q", invalid)
+		}
+	}
+}
+
+func TestHandleProxyNoBackends(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics.InitMetrics(registry)
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status code %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if w.Body.String() != "no backends configured" {
+		t.Errorf("expected response %q, got %q", "no backends configured", w.Body.String())
+	}
+	if got := metricValue(t, registry, "sprayproxy_http_no_backends_requests_total", ""); got != 1 {
+		t.Errorf("expected 1 request without backends, got %v", got)
+	}
+
+	// allowed explicitly, requests are answered as proxied
+	proxy, err = NewSprayProxyWithOptions(false, zap.NewNop(), nil, WithAllowNoBackends(true))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w = httptest.NewRecorder()
+	ctx, _ = gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestHandleProxyClientDisconnect(t *testing.T) {
+	received := make(chan struct{})
+	aborted := make(chan bool, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the server only notices the connection closing once the body is read
+		io.ReadAll(r.Body)
+		close(received)
+		select {
+		case <-r.Context().Done():
+			aborted <- true
+		case <-time.After(5 * time.Second):
+			aborted <- false
+		}
+	}))
+	defer backend.Close()
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL}, WithCircuitBreaker(1, time.Minute))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	reqCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello")).WithContext(reqCtx)
+	done := make(chan struct{})
+	go func() {
+		proxy.HandleProxy(ctx)
+		close(done)
+	}()
+	<-received
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the client disconnect to abort the forward")
+	}
+	if !<-aborted {
+		t.Error("expected the backend to see the forward canceled")
+	}
+	// the cancellation is not a failure of the backend
+	if !proxy.allowForward(hostOf(t, backend.URL)) {
+		t.Error("expected the circuit breaker to remain closed")
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+)
+
+// rateLimitPruneInterval is how often the buckets of idle clients are dropped, so they do not pile up.
+const rateLimitPruneInterval = time.Minute
+
+// tokenBucket holds the tokens left to a single client, as of the last time it was refilled.
+type tokenBucket struct {
+	tokens   float64
+	refilled time.Time
+}
+
+// rateLimiter limits the rate of requests of each client IP with a token bucket: every client can
+// send up to burst requests at once, then rate requests per second on average.
+type rateLimiter struct {
+	rate  float64
+	burst int
+
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+}
+
+// newRateLimiter returns a rate limiter allowing each client IP rate requests per second, with bursts
+// of up to burst requests. A burst below 1 defaults to the rate, rounded up.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: burst, buckets: map[string]*tokenBucket{}}
+}
+
+// allow returns true if the client can send a request at the given time, consuming one of its tokens.
+func (l *rateLimiter) allow(client string, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if now.Sub(l.pruned) >= rateLimitPruneInterval {
+		l.prune(now)
+	}
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(l.burst), refilled: now}
+		l.buckets[client] = bucket
+	}
+	if elapsed := now.Sub(bucket.refilled); elapsed > 0 {
+		bucket.tokens = math.Min(float64(l.burst), bucket.tokens+elapsed.Seconds()*l.rate)
+		bucket.refilled = now
+	}
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// prune drops the buckets refilled up to the burst, which are the same as the bucket of a new client.
+// It must be called with the lock held.
+func (l *rateLimiter) prune(now time.Time) {
+	full := time.Duration(float64(l.burst) / l.rate * float64(time.Second))
+	for client, bucket := range l.buckets {
+		if now.Sub(bucket.refilled) >= full {
+			delete(l.buckets, client)
+		}
+	}
+	l.pruned = now
+}
+
+// RateLimit is a gin middleware rejecting the requests of clients over the rate limit of the proxy, if
+// enabled, with 429 Too Many Requests. It is meant to run before HandleProxy, so rejected requests are
+// neither read nor forwarded. Clients are identified by the IP address of the connection, so forwarded
+// headers cannot be spoofed to get around the limit.
+func (p *SprayProxy) RateLimit(c *gin.Context) {
+	if p.rateLimiter == nil {
+		return
+	}
+	client := clientIP(c.Request)
+	if p.rateLimiter.allow(client, time.Now()) {
+		return
+	}
+	metrics.IncRateLimitedCount()
+	p.logger.Info("rate limit exceeded", zap.String("request-id", c.GetString("requestId")), zap.String("client", client))
+	c.Header("Retry-After", "1")
+	p.respondError(c, http.StatusTooManyRequests, errorCodeRateLimited, "rate limit exceeded")
+	c.Abort()
+}
+
+// clientIP returns the IP address of the connection of the request, ignoring X-Forwarded-For which the
+// client could set to anything.
+func clientIP(req *http.Request) string {
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return client
+}
@@ -0,0 +1,122 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter := newRateLimiter(2, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !limiter.allow("10.0.0.1", now) {
+			t.Fatalf("expected request %d within the burst to be allowed", i+1)
+		}
+	}
+	if limiter.allow("10.0.0.1", now) {
+		t.Error("expected request over the burst to be rejected")
+	}
+	if !limiter.allow("10.0.0.2", now) {
+		t.Error("expected other clients not to be limited")
+	}
+	// the bucket refills by the rate
+	if !limiter.allow("10.0.0.1", now.Add(500*time.Millisecond)) {
+		t.Error("expected a request to be allowed once a token is refilled")
+	}
+	if limiter.allow("10.0.0.1", now.Add(500*time.Millisecond)) {
+		t.Error("expected a single token to be refilled after half a second")
+	}
+
+	// full buckets are pruned
+	limiter.allow("10.0.0.1", now.Add(rateLimitPruneInterval))
+	if len(limiter.buckets) != 1 {
+		t.Errorf("expected the idle client to be pruned, got %d buckets", len(limiter.buckets))
+	}
+}
+
+func TestNewRateLimiterDefaultBurst(t *testing.T) {
+	for rate, expected := range map[float64]int{0.5: 1, 1: 1, 2.5: 3, 10: 10} {
+		if burst := newRateLimiter(rate, 0).burst; burst != expected {
+			t.Errorf("rate %v: expected default burst %d, got %d", rate, expected, burst)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics.InitMetrics(registry)
+	var calls int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer backend.Close()
+	t.Setenv("SPRAYPROXY_RATE_LIMIT", "0.1")
+	t.Setenv("SPRAYPROXY_RATE_LIMIT_BURST", "2")
+	proxy, err := NewSprayProxy(false, zap.NewNop(), backend.URL)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	router := gin.New()
+	router.POST("/", proxy.RateLimit, proxy.HandleProxy)
+	send := func(remoteAddr string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/", bytes.NewBufferString("hello"))
+		req.RemoteAddr = remoteAddr
+		// forwarded headers do not get around the limit
+		req.Header.Set("X-Forwarded-For", remoteAddr)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := send("10.0.0.1:1234"); w.Code != http.StatusOK {
+			t.Errorf("expected status code %d within the burst, got %d", http.StatusOK, w.Code)
+		}
+	}
+	w := send("10.0.0.1:5678")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status code %d over the limit, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+	if w := send("10.0.0.2:1234"); w.Code != http.StatusOK {
+		t.Errorf("expected status code %d for another client, got %d", http.StatusOK, w.Code)
+	}
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Errorf("expected %d forwarded requests, got %d", 3, got)
+	}
+	if got := metricValue(t, registry, "sprayproxy_http_rate_limited_requests_total", ""); got != 1 {
+		t.Errorf("expected %v rate limited requests, got %v", 1, got)
+	}
+}
+
+func TestRateLimitDisabled(t *testing.T) {
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{}, WithAllowNoBackends(true), WithRateLimit(0, 0))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	router := gin.New()
+	router.POST("/", proxy.RateLimit, proxy.HandleProxy)
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://localhost:8080/", bytes.NewBufferString("hello")))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d without rate limit, got %d", http.StatusOK, w.Code)
+		}
+	}
+}
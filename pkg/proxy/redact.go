@@ -0,0 +1,77 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// defaultLogBodyLimit is the number of bytes of backend response bodies logged by default.
+const defaultLogBodyLimit = 4 * 1024
+
+// defaultSensitiveHeaders are the headers whose values are always redacted from logs.
+var defaultSensitiveHeaders = []string{"Authorization", "X-Hub-Signature", "X-Hub-Signature-256"}
+
+// newSensitiveHeaders returns the canonical set of the default sensitive headers and the given ones.
+func newSensitiveHeaders(headers ...string) map[string]bool {
+	sensitive := map[string]bool{}
+	for _, header := range append(defaultSensitiveHeaders, headers...) {
+		if header = strings.TrimSpace(header); header != "" {
+			sensitive[http.CanonicalHeaderKey(header)] = true
+		}
+	}
+	return sensitive
+}
+
+// redactedHeaders logs headers as an object, masking the values of the sensitive ones.
+type redactedHeaders struct {
+	header    http.Header
+	sensitive map[string]bool
+}
+
+func (r redactedHeaders) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	names := make([]string, 0, len(r.header))
+	for name := range r.header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if r.sensitive[http.CanonicalHeaderKey(name)] {
+			enc.AddString(name, redactedHeaderValue)
+			continue
+		}
+		enc.AddString(name, strings.Join(r.header[name], ", "))
+	}
+	return nil
+}
+
+// redactHeaders returns the headers in a form safe to log, without the values of sensitive headers.
+func (p *SprayProxy) redactHeaders(header http.Header) zapcore.ObjectMarshaler {
+	return redactedHeaders{header: header, sensitive: p.sensitiveHeaders}
+}
+
+// readLoggedBody reads the body in a form safe to log, up to the configured limit. The rest of the
+// body is drained and discarded, so it is not held in memory and the connection can be reused.
+func (p *SprayProxy) readLoggedBody(body io.Reader) (string, error) {
+	logged, err := io.ReadAll(io.LimitReader(body, int64(p.logBodyLimit)))
+	if err != nil {
+		return "", err
+	}
+	truncated, err := io.Copy(io.Discard, body)
+	if err != nil {
+		return "", err
+	}
+	if truncated > 0 {
+		return fmt.Sprintf("%s... (%d bytes truncated)", logged, truncated), nil
+	}
+	return string(logged), nil
+}
@@ -0,0 +1,181 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestProxyLogRedactsSensitiveHeaders(t *testing.T) {
+	var buff bytes.Buffer
+	config := zap.NewProductionConfig()
+	core := zapcore.NewCore(
+		zapcore.NewJSONEncoder(config.EncoderConfig),
+		zapcore.AddSync(&buff),
+		zapcore.DebugLevel,
+	)
+	logger := zap.New(core)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend-Token", "backend-secret")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(strings.Repeat("a", 64)))
+	}))
+	defer backend.Close()
+	proxy, err := NewSprayProxyWithOptions(false, logger, []string{backend.URL},
+		WithSensitiveHeaders("X-Custom-Token", "X-Backend-Token"), WithLogBodyLimit(16))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+	ctx.Request.Header.Set("Authorization", "Bearer hunter2")
+	ctx.Request.Header.Set("X-Hub-Signature-256", "sha256=deadbeef")
+	ctx.Request.Header.Set("X-Custom-Token", "custom-secret")
+	ctx.Request.Header.Set("X-GitHub-Event", "push")
+	proxy.HandleProxy(ctx)
+	log := buff.String()
+	for _, secret := range []string{"hunter2", "deadbeef", "custom-secret", "backend-secret"} {
+		if strings.Contains(log, secret) {
+			t.Errorf("secret %q appeared in %q", secret, log)
+		}
+	}
+	for _, expected := range []string{
+		`"X-Github-Event":"push"`,
+		`"Authorization":"REDACTED"`,
+		`"X-Backend-Token":"REDACTED"`,
+		`response body: ` + strings.Repeat("a", 16) + `... (48 bytes truncated)`,
+	} {
+		if !strings.Contains(log, expected) {
+			t.Errorf("expected string %q did not appear in %q", expected, log)
+		}
+	}
+}
+
+func TestNewSensitiveHeaders(t *testing.T) {
+	sensitive := newSensitiveHeaders("x-api-key", " ", "")
+	for _, header := range []string{"Authorization", "X-Hub-Signature", "X-Hub-Signature-256", "X-Api-Key"} {
+		if !sensitive[header] {
+			t.Errorf("expected %s to be sensitive", header)
+		}
+	}
+	if len(sensitive) != 4 {
+		t.Errorf("expected 4 sensitive headers, got %v", sensitive)
+	}
+}
+
+func TestReadLoggedBody(t *testing.T) {
+	p := &SprayProxy{logBodyLimit: 5}
+	if got, err := p.readLoggedBody(strings.NewReader("hello")); err != nil || got != "hello" {
+		t.Errorf("expected body under the limit to be kept, got %q, %v", got, err)
+	}
+	body := strings.NewReader("hello world")
+	got, err := p.readLoggedBody(body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "hello... (6 bytes truncated)" {
+		t.Errorf("unexpected truncated body %q", got)
+	}
+	if body.Len() != 0 {
+		t.Errorf("expected the rest of the body to be drained, %d bytes left", body.Len())
+	}
+}
+
+func TestProxyLogBodyLimitEnv(t *testing.T) {
+	t.Setenv("SPRAYPROXY_LOG_BODY_LIMIT", "1KB")
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if proxy.logBodyLimit != 1024 {
+		t.Errorf("expected log body limit of 1024, got %d", proxy.logBodyLimit)
+	}
+	t.Setenv("SPRAYPROXY_LOG_BODY_LIMIT", "bad")
+	proxy, err = NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if proxy.logBodyLimit != defaultLogBodyLimit {
+		t.Errorf("expected default log body limit, got %d", proxy.logBodyLimit)
+	}
+}
+
+func TestProxyLogErrorBodiesDisabled(t *testing.T) {
+	var buff bytes.Buffer
+	config := zap.NewProductionConfig()
+	core := zapcore.NewCore(
+		zapcore.NewJSONEncoder(config.EncoderConfig),
+		zapcore.AddSync(&buff),
+		config.Level,
+	)
+	logger := zap.New(core)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("no such repository"))
+	}))
+	defer backend.Close()
+	t.Setenv("SPRAYPROXY_LOG_ERROR_BODIES", "false")
+	proxy, err := NewSprayProxy(false, logger, backend.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+	proxy.HandleProxy(ctx)
+	log := buff.String()
+	if !strings.Contains(log, `"status":404`) {
+		t.Errorf("expected the response status to be logged, got %q", log)
+	}
+	if strings.Contains(log, "no such repository") {
+		t.Errorf("expected the response body not to be logged, got %q", log)
+	}
+}
+
+func TestProxyLogSuccessBodies(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":false,"error":"unknown installation"}`))
+	}))
+	defer backend.Close()
+	for _, tc := range []struct {
+		name     string
+		enabled  bool
+		level    zapcore.Level
+		expected bool
+	}{
+		{name: "disabled", level: zapcore.DebugLevel},
+		{name: "enabled", enabled: true, level: zapcore.DebugLevel, expected: true},
+		{name: "enabled without debug logs", enabled: true, level: zapcore.InfoLevel},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buff bytes.Buffer
+			core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionConfig().EncoderConfig), zapcore.AddSync(&buff), tc.level)
+			proxy, err := NewSprayProxyWithOptions(false, zap.New(core), []string{backend.URL},
+				WithLogSuccessBodies(tc.enabled), WithLogBodyLimit(11))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+			proxy.HandleProxy(ctx)
+			log := buff.String()
+			expected := `"msg":"response body: {\"ok\":false... (32 bytes truncated)"`
+			if logged := strings.Contains(log, expected); logged != tc.expected {
+				t.Errorf("expected the body to be logged %v, got log %q", tc.expected, log)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+func TestHandleProxyRedirect(t *testing.T) {
+	var redirected int32
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&redirected, 1)
+	}))
+	defer target.Close()
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.Redirect(rw, req, target.URL, http.StatusFound)
+	}))
+	defer backend.Close()
+
+	for _, tc := range []struct {
+		name               string
+		env                string
+		opts               []Option
+		expectedRedirected int32
+		expectedCount      float64
+	}{
+		{
+			name:          "not followed by default",
+			expectedCount: 1,
+		},
+		{
+			name:               "followed with env var",
+			env:                "true",
+			expectedRedirected: 1,
+		},
+		{
+			name:          "option overrides env var",
+			env:           "true",
+			opts:          []Option{WithFollowRedirects(false)},
+			expectedCount: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			atomic.StoreInt32(&redirected, 0)
+			registry := prometheus.NewRegistry()
+			metrics.InitMetrics(registry)
+			t.Setenv("SPRAYPROXY_FOLLOW_REDIRECTS", tc.env)
+			proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL}, tc.opts...)
+			if err != nil {
+				t.Fatalf("failed to set up proxy: %v", err)
+			}
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("secret payload"))
+			proxy.HandleProxy(ctx)
+			if w.Code != http.StatusOK {
+				t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+			}
+			if got := atomic.LoadInt32(&redirected); got != tc.expectedRedirected {
+				t.Errorf("expected %d requests to the redirect target, got %d", tc.expectedRedirected, got)
+			}
+			got := metricValue(t, registry, "sprayproxy_http_forwarded_redirects_total", hostOf(t, backend.URL))
+			if got < 0 {
+				got = 0
+			}
+			if got != tc.expectedCount {
+				t.Errorf("expected %v redirects to be counted, got %v", tc.expectedCount, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"encoding/json"
+	"mime"
+	"net/url"
+	"path"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// repositoryPayload is the part of a webhook payload identifying its repository.
+type repositoryPayload struct {
+	Repository *struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+// acceptsRepo returns true if requests for the repository with the given full name are forwarded to the backend.
+func (b Backend) acceptsRepo(fullName string) bool {
+	if b.Repo == "" {
+		return true
+	}
+	matched, err := path.Match(b.Repo, fullName)
+	return err == nil && matched
+}
+
+// hasRepoFilter returns true if any of the targets filters requests by repository.
+func hasRepoFilter(targets []forwardTarget) bool {
+	for _, target := range targets {
+		if target.backend.Repo != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// filterByRepo returns the targets accepting the repository of the inbound request. All targets are
+// returned if the request has no repository, such as webhooks of organization events.
+func (p *SprayProxy) filterByRepo(in *inboundRequest, targets []forwardTarget, zapCommonFields []zapcore.Field) []forwardTarget {
+	if !hasRepoFilter(targets) {
+		return targets
+	}
+	fullName, ok := repositoryFullName(in)
+	if !ok {
+		return targets
+	}
+	filtered := make([]forwardTarget, 0, len(targets))
+	for _, target := range targets {
+		if !target.backend.acceptsRepo(fullName) {
+			p.logger.Debug("skipping backend not subscribed to repository "+fullName, append(zapCommonFields, zap.String("backend", target.backend.URL))...)
+			continue
+		}
+		filtered = append(filtered, target)
+	}
+	return filtered
+}
+
+// repositoryFullName returns the full name of the repository of the webhook, parsed from its JSON payload,
+// sent either as is or in the "payload" field of a form. It returns false if the payload has no repository.
+// Spilled bodies are read back from disk to be parsed.
+func repositoryFullName(in *inboundRequest) (string, bool) {
+	payload, err := in.readBody()
+	if err != nil {
+		return "", false
+	}
+	if mediaType, _, _ := mime.ParseMediaType(in.header.Get("Content-Type")); mediaType == "application/x-www-form-urlencoded" {
+		form, err := url.ParseQuery(string(payload))
+		if err != nil {
+			return "", false
+		}
+		payload = []byte(form.Get("payload"))
+	}
+	parsed := repositoryPayload{}
+	if err := json.Unmarshal(payload, &parsed); err != nil || parsed.Repository == nil || parsed.Repository.FullName == "" {
+		return "", false
+	}
+	return parsed.Repository.FullName, true
+}
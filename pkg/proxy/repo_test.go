@@ -0,0 +1,82 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestRepositoryFullName(t *testing.T) {
+	for name, tc := range map[string]struct {
+		contentType string
+		body        string
+		expected    string
+		ok          bool
+	}{
+		"json":          {"application/json", `{"action":"opened","repository":{"full_name":"org/repo"}}`, "org/repo", true},
+		"form":          {"application/x-www-form-urlencoded", "payload=" + url.QueryEscape(`{"repository":{"full_name":"org/repo"}}`), "org/repo", true},
+		"no repository": {"application/json", `{"organization":{"login":"org"}}`, "", false},
+		"not json":      {"text/plain", "hello", "", false},
+	} {
+		in := &inboundRequest{header: http.Header{"Content-Type": {tc.contentType}}, body: []byte(tc.body)}
+		got, ok := repositoryFullName(in)
+		if got != tc.expected || ok != tc.ok {
+			t.Errorf("%s: expected %q, %v, got %q, %v", name, tc.expected, tc.ok, got, ok)
+		}
+	}
+}
+
+func TestRegisterRepo(t *testing.T) {
+	var orgCalls, otherCalls int32
+	org := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&orgCalls, 1)
+	}))
+	defer org.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&otherCalls, 1)
+	}))
+	defer other.Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {org.URL}, "repo": {"org/["}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code %d registering an invalid pattern, got %d", http.StatusBadRequest, w.Code)
+	}
+	callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {org.URL}, "repo": {"org/*"}})
+	callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {other.URL}, "repo": {"other/*"}})
+
+	for _, body := range []string{
+		`{"repository":{"full_name":"org/repo"}}`,
+		`{"repository":{"full_name":"org/another"}}`,
+		// events without repository are forwarded to all backends
+		`{"zen":"Keep it logically awesome."}`,
+	} {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", strings.NewReader(body))
+		ctx.Request.Header.Set("Content-Type", "application/json")
+		proxy.HandleProxy(ctx)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+		}
+	}
+	if got := atomic.LoadInt32(&orgCalls); got != 3 {
+		t.Errorf("expected %d calls to the org backend, got %d", 3, got)
+	}
+	if got := atomic.LoadInt32(&otherCalls); got != 1 {
+		t.Errorf("expected %d calls to the other backend, got %d", 1, got)
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BackendResult is the outcome of forwarding a request to a single backend.
+type BackendResult struct {
+	// URL is the URL the backend is registered with, telling apart the backends of the same host
+	URL  string
+	Host string
+	// Status is the response status code, zero if the backend could not be reached
+	Status int
+	// Latency is the time the forward took, including its retries
+	Latency time.Duration
+	// Error is set if the backend could not be reached or its response could not be read
+	Error error
+	// Shadow is set for shadow backends, whose results do not affect the response status
+	Shadow bool
+}
+
+// Failed returns true if the backend could not be reached or responded with a 5xx status.
+func (r BackendResult) Failed() bool {
+	return r.Error != nil || r.Status >= http.StatusInternalServerError
+}
+
+// proxyResponse is the JSON representation of the outcome of a proxied request.
+// Error and Code are only set if the request could not be proxied.
+type proxyResponse struct {
+	Error     string `json:"error,omitempty"`
+	Code      string `json:"code,omitempty"`
+	RequestID string `json:"requestId"`
+	// Backends holds the results keyed by backend URL
+	Backends map[string]backendStatus `json:"backends"`
+}
+
+// Stable codes of the errors returned by HandleProxy, for clients to tell errors apart.
+const (
+	errorCodeShuttingDown     = "shutting_down"
+	errorCodeNoBackends       = "no_backends"
+	errorCodeRequestTooLarge  = "request_too_large"
+	errorCodeRequestTimeout   = "request_timeout"
+	errorCodeInvalidBody      = "invalid_body"
+	errorCodeInvalidSignature = "invalid_signature"
+	errorCodeBadGateway       = "bad_gateway"
+	errorCodeRateLimited      = "rate_limited"
+	errorCodeInvalidEncoding  = "invalid_encoding"
+	errorCodeInvalidUserAgent = "invalid_user_agent"
+	errorCodeNotFound         = "not_found"
+)
+
+// errorResponse is the JSON representation of an error returned by HandleProxy.
+type errorResponse struct {
+	Error     string `json:"error"`
+	Code      string `json:"code"`
+	RequestID string `json:"requestId"`
+}
+
+type backendStatus struct {
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Shadow bool   `json:"shadow,omitempty"`
+}
+
+// respond writes the response of a proxied request. The per backend results are rendered
+// as JSON if the client accepts it or JSON responses are enabled, otherwise the plain text
+// message is returned. A bad gateway status is rendered with the error envelope fields.
+func (p *SprayProxy) respond(c *gin.Context, status int, message string, results []BackendResult) {
+	if !p.wantsJSON(c) {
+		c.String(status, message)
+		return
+	}
+	resp := resultsResponse(c, results)
+	if status == http.StatusBadGateway {
+		resp.Error = message
+		resp.Code = errorCodeBadGateway
+	}
+	c.JSON(status, resp)
+}
+
+// defaultSuccessContentType is the content type of the custom body of requests answered as proxied, unless set
+const defaultSuccessContentType = "text/plain; charset=utf-8"
+
+// isSuccessStatus returns true if the status can answer a proxied request.
+func isSuccessStatus(status int) bool {
+	return status >= http.StatusOK && status < http.StatusMultipleChoices
+}
+
+// respondSuccess writes the response of a request proxied according to the success policy, with the
+// configured status. The custom body replaces the plain text message, while the per backend results are
+// still rendered as JSON when requested. No Content responses have no body at all.
+func (p *SprayProxy) respondSuccess(c *gin.Context, results []BackendResult) {
+	switch {
+	case p.successStatus == http.StatusNoContent:
+		c.Status(http.StatusNoContent)
+		c.Writer.WriteHeaderNow()
+	case p.successBody != nil && !p.wantsJSON(c):
+		c.Data(p.successStatus, p.successContentType, p.successBody)
+	default:
+		p.respond(c, p.successStatus, "proxied", results)
+	}
+}
+
+// respondError writes an error response of HandleProxy. The error is rendered as JSON, along with its
+// code, if the client accepts it or JSON responses are enabled, otherwise the plain text message is returned.
+func (p *SprayProxy) respondError(c *gin.Context, status int, code, message string) {
+	if !p.wantsJSON(c) {
+		c.String(status, message)
+		return
+	}
+	c.JSON(status, errorResponse{Error: message, Code: code, RequestID: c.GetString("requestId")})
+}
+
+// wantsJSON returns true if responses to the request are rendered as JSON.
+func (p *SprayProxy) wantsJSON(c *gin.Context) bool {
+	return p.jsonResponse || strings.Contains(c.GetHeader("Accept"), gin.MIMEJSON)
+}
+
+// respondJSON writes the per backend results of a proxied request as JSON.
+func (p *SprayProxy) respondJSON(c *gin.Context, status int, results []BackendResult) {
+	c.JSON(status, resultsResponse(c, results))
+}
+
+// resultsResponse returns the JSON representation of the per backend results of a proxied request.
+func resultsResponse(c *gin.Context, results []BackendResult) proxyResponse {
+	resp := proxyResponse{
+		RequestID: c.GetString("requestId"),
+		Backends:  make(map[string]backendStatus, len(results)),
+	}
+	for _, result := range results {
+		backend := backendStatus{Status: result.Status, Shadow: result.Shadow}
+		if result.Error != nil {
+			backend.Error = result.Error.Error()
+		}
+		resp.Backends[result.URL] = backend
+	}
+	return resp
+}
+
+// partialDelivery returns true if the request was delivered to some backends but failed for others.
+// Shadow backends are ignored.
+func partialDelivery(results []BackendResult) bool {
+	delivered, failed := false, false
+	for _, result := range results {
+		if result.Shadow {
+			continue
+		}
+		if result.Failed() {
+			failed = true
+		} else {
+			delivered = true
+		}
+	}
+	return delivered && failed
+}
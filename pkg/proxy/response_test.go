@@ -0,0 +1,389 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestHandleProxyJSONResponse(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer ok.Close()
+	rejecting := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusNotFound)
+	}))
+	defer rejecting.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	for _, tc := range []struct {
+		name   string
+		accept string
+		env    string
+	}{
+		{
+			name:   "requested with accept header",
+			accept: "application/json",
+		},
+		{
+			name: "enabled with env var",
+			env:  "true",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("SPRAYPROXY_JSON_RESPONSE", tc.env)
+			proxy, err := NewSprayProxy(false, zap.NewNop(), ok.URL, ok.URL+"/other", rejecting.URL, down.URL)
+			if err != nil {
+				t.Fatalf("failed to set up proxy: %v", err)
+			}
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Set("requestId", "1234")
+			ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+			if tc.accept != "" {
+				ctx.Request.Header.Set("Accept", tc.accept)
+			}
+			proxy.HandleProxy(ctx)
+			if w.Code != http.StatusBadGateway {
+				t.Errorf("expected status code %d, got %d", http.StatusBadGateway, w.Code)
+			}
+			resp := proxyResponse{}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to parse response %q: %v", w.Body.String(), err)
+			}
+			if resp.RequestID != "1234" {
+				t.Errorf("expected request id %q, got %q", "1234", resp.RequestID)
+			}
+			if resp.Code != errorCodeBadGateway || resp.Error != "failed to proxy" {
+				t.Errorf("expected error %q with code %q, got %q with code %q", "failed to proxy", errorCodeBadGateway, resp.Error, resp.Code)
+			}
+			if got := resp.Backends[ok.URL]; got.Status != http.StatusOK || got.Error != "" {
+				t.Errorf("expected status %d without error, got %+v", http.StatusOK, got)
+			}
+			if got := resp.Backends[rejecting.URL]; got.Status != http.StatusNotFound || got.Error != "" {
+				t.Errorf("expected status %d without error, got %+v", http.StatusNotFound, got)
+			}
+			if got := resp.Backends[down.URL]; got.Status != 0 || got.Error == "" {
+				t.Errorf("expected an error, got %+v", got)
+			}
+			// backends of the same host are told apart
+			if got := resp.Backends[ok.URL+"/other"]; got.Status != http.StatusOK || len(resp.Backends) != 4 {
+				t.Errorf("expected the results of %d backends, got %+v", 4, resp.Backends)
+			}
+		})
+	}
+}
+
+func TestHandleProxyTextResponseByDefault(t *testing.T) {
+	t.Setenv("SPRAYPROXY_ALLOW_NO_BACKENDS", "true")
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+	ctx.Request.Header.Set("Accept", "text/plain")
+	proxy.HandleProxy(ctx)
+	if w.Body.String() != "proxied" {
+		t.Errorf("expected response %q, got %q", "proxied", w.Body.String())
+	}
+}
+
+func TestHandleProxyJSONErrors(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer backend.Close()
+	for _, tc := range []struct {
+		name     string
+		backends []string
+		opts     []Option
+		status   int
+		code     string
+	}{
+		{name: "no backends", status: http.StatusServiceUnavailable, code: errorCodeNoBackends},
+		{
+			name:     "too large",
+			backends: []string{backend.URL},
+			opts:     []Option{WithMaxRequestSize(2)},
+			status:   http.StatusRequestEntityTooLarge,
+			code:     errorCodeRequestTooLarge,
+		},
+		{
+			name:     "invalid signature",
+			backends: []string{backend.URL},
+			opts:     []Option{WithWebhookSecret("secret")},
+			status:   http.StatusUnauthorized,
+			code:     errorCodeInvalidSignature,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), tc.backends, tc.opts...)
+			if err != nil {
+				t.Fatalf("failed to set up proxy: %v", err)
+			}
+			request := func(accept string) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				ctx, _ := gin.CreateTestContext(w)
+				ctx.Set("requestId", "1234")
+				ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+				ctx.Request.Header.Set("Accept", accept)
+				proxy.HandleProxy(ctx)
+				return w
+			}
+
+			w := request("application/json")
+			if w.Code != tc.status {
+				t.Errorf("expected status code %d, got %d", tc.status, w.Code)
+			}
+			resp := errorResponse{}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to parse response %q: %v", w.Body.String(), err)
+			}
+			if resp.Code != tc.code || resp.Error == "" || resp.RequestID != "1234" {
+				t.Errorf("unexpected error response %+v", resp)
+			}
+
+			// plain text remains the default
+			w = request("text/plain")
+			if w.Code != tc.status || w.Body.String() != resp.Error {
+				t.Errorf("expected status code %d with %q, got %d with %q", tc.status, resp.Error, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandleProxyMultiStatus(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer ok.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	for _, tc := range []struct {
+		name     string
+		backends []string
+		env      string
+		expected int
+	}{
+		{name: "disabled", backends: []string{ok.URL, down.URL}, expected: http.StatusBadGateway},
+		{name: "unreachable backend", backends: []string{ok.URL, down.URL}, env: "true", expected: http.StatusMultiStatus},
+		{name: "failing backend", backends: []string{ok.URL, failing.URL}, env: "true", expected: http.StatusMultiStatus},
+		{name: "all delivered", backends: []string{ok.URL}, env: "true", expected: http.StatusOK},
+		{name: "none delivered", backends: []string{down.URL}, env: "true", expected: http.StatusBadGateway},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("SPRAYPROXY_MULTI_STATUS", tc.env)
+			proxy, err := NewSprayProxy(false, zap.NewNop(), tc.backends...)
+			if err != nil {
+				t.Fatalf("failed to set up proxy: %v", err)
+			}
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Set("requestId", "1234")
+			ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+			proxy.HandleProxy(ctx)
+			if w.Code != tc.expected {
+				t.Fatalf("expected status code %d, got %d", tc.expected, w.Code)
+			}
+			if w.Code != http.StatusMultiStatus {
+				return
+			}
+			resp := proxyResponse{}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to parse response %q: %v", w.Body.String(), err)
+			}
+			if resp.RequestID != "1234" {
+				t.Errorf("expected request id %q, got %q", "1234", resp.RequestID)
+			}
+			if got := resp.Backends[ok.URL]; got.Status != http.StatusOK {
+				t.Errorf("expected status %d, got %+v", http.StatusOK, got)
+			}
+			if len(resp.Backends) != len(tc.backends) {
+				t.Errorf("expected %d backends, got %+v", len(tc.backends), resp.Backends)
+			}
+		})
+	}
+}
+
+func hostOf(t *testing.T, rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("failed to parse url %q: %v", rawURL, err)
+	}
+	return u.Host
+}
+
+func TestHandleProxyChunkedResponses(t *testing.T) {
+	chunked := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Trailer", "X-Checksum")
+		rw.WriteHeader(http.StatusOK)
+		for i := 0; i < 3; i++ {
+			rw.Write([]byte("chunk"))
+			// flushing before the end of the handler forces the chunked encoding
+			rw.(http.Flusher).Flush()
+		}
+		rw.Header().Set("X-Checksum", "abc123")
+	}))
+	defer chunked.Close()
+	truncated := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, buf, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("failed to hijack connection: %v", err)
+			return
+		}
+		defer conn.Close()
+		// a chunk announced as 16 bytes, cut short by the connection closing
+		buf.WriteString("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n10\r\nshort")
+		buf.Flush()
+	}))
+	defer truncated.Close()
+
+	for _, tc := range []struct {
+		name     string
+		backend  string
+		expected int
+		log      string
+	}{
+		{name: "chunked with trailers", backend: chunked.URL, expected: http.StatusOK, log: `"trailers":{"X-Checksum":"abc123"}`},
+		{name: "truncated chunked", backend: truncated.URL, expected: http.StatusBadGateway, log: "failed to read response"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buff bytes.Buffer
+			config := zap.NewProductionConfig()
+			logger := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(config.EncoderConfig), zapcore.AddSync(&buff), config.Level))
+			proxy, err := NewSprayProxy(false, logger, tc.backend)
+			if err != nil {
+				t.Fatalf("failed to set up proxy: %v", err)
+			}
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+			proxy.HandleProxy(ctx)
+			if w.Code != tc.expected {
+				t.Errorf("expected status code %d, got %d", tc.expected, w.Code)
+			}
+			if log := buff.String(); !strings.Contains(log, tc.log) {
+				t.Errorf("expected string %q did not appear in %q", tc.log, log)
+			}
+		})
+	}
+}
+
+func TestHandleProxySuccessResponse(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	for _, tc := range []struct {
+		name                string
+		env                 map[string]string
+		opts                []Option
+		accept              string
+		expectedStatus      int
+		expectedBody        string
+		expectedContentType string
+	}{
+		{
+			name:                "default",
+			expectedStatus:      http.StatusOK,
+			expectedBody:        "proxied",
+			expectedContentType: "text/plain; charset=utf-8",
+		},
+		{
+			name:                "custom status",
+			env:                 map[string]string{"SPRAYPROXY_SUCCESS_STATUS": "202"},
+			expectedStatus:      http.StatusAccepted,
+			expectedBody:        "proxied",
+			expectedContentType: "text/plain; charset=utf-8",
+		},
+		{
+			name:           "no content",
+			env:            map[string]string{"SPRAYPROXY_SUCCESS_STATUS": "204", "SPRAYPROXY_SUCCESS_BODY": "ignored"},
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:                "invalid status ignored",
+			env:                 map[string]string{"SPRAYPROXY_SUCCESS_STATUS": "302"},
+			expectedStatus:      http.StatusOK,
+			expectedBody:        "proxied",
+			expectedContentType: "text/plain; charset=utf-8",
+		},
+		{
+			name:                "custom body",
+			env:                 map[string]string{"SPRAYPROXY_SUCCESS_BODY": `{"ok":true}`, "SPRAYPROXY_SUCCESS_CONTENT_TYPE": "application/json"},
+			expectedStatus:      http.StatusOK,
+			expectedBody:        `{"ok":true}`,
+			expectedContentType: "application/json",
+		},
+		{
+			name:                "empty body",
+			env:                 map[string]string{"SPRAYPROXY_SUCCESS_BODY": ""},
+			expectedStatus:      http.StatusOK,
+			expectedContentType: "text/plain; charset=utf-8",
+		},
+		{
+			name:                "options override env vars",
+			env:                 map[string]string{"SPRAYPROXY_SUCCESS_STATUS": "204"},
+			opts:                []Option{WithSuccessStatus(http.StatusAccepted), WithSuccessBody("application/xml", []byte("<ok/>"))},
+			expectedStatus:      http.StatusAccepted,
+			expectedBody:        "<ok/>",
+			expectedContentType: "application/xml",
+		},
+		{
+			name:                "results still returned as JSON",
+			env:                 map[string]string{"SPRAYPROXY_SUCCESS_STATUS": "202", "SPRAYPROXY_SUCCESS_BODY": "ok"},
+			accept:              "application/json",
+			expectedStatus:      http.StatusAccepted,
+			expectedBody:        `{"requestId":"1234","backends":{"` + backend.URL + `":{"status":200}}}`,
+			expectedContentType: "application/json; charset=utf-8",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for name, value := range tc.env {
+				t.Setenv(name, value)
+			}
+			proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL}, tc.opts...)
+			if err != nil {
+				t.Fatalf("failed to set up proxy: %v", err)
+			}
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Set("requestId", "1234")
+			ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+			if tc.accept != "" {
+				ctx.Request.Header.Set("Accept", tc.accept)
+			}
+			proxy.HandleProxy(ctx)
+			if w.Code != tc.expectedStatus {
+				t.Errorf("expected status code %d, got %d", tc.expectedStatus, w.Code)
+			}
+			if w.Body.String() != tc.expectedBody {
+				t.Errorf("expected body %q, got %q", tc.expectedBody, w.Body.String())
+			}
+			if got := w.Header().Get("Content-Type"); got != tc.expectedContentType {
+				t.Errorf("expected content type %q, got %q", tc.expectedContentType, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// maxBackoffShift caps the exponent used to compute the backoff delay, to avoid overflows.
+const maxBackoffShift = 16
+
+// isRetryable returns true if a forwarding attempt failed in a way that is worth retrying:
+// the backend could not be reached or it answered with a 5xx status code.
+// 4xx responses are not retried since sending the same request again will not change the outcome.
+func isRetryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode >= http.StatusInternalServerError
+}
+
+// backoff returns the delay to wait before the given retry, starting at 1 for the first retry.
+func backoff(base time.Duration, retry int) time.Duration {
+	shift := retry - 1
+	if shift > maxBackoffShift {
+		shift = maxBackoffShift
+	}
+	return base << shift
+}
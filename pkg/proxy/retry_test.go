@@ -0,0 +1,174 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// newFlakyBackend returns a test server answering with the given status code
+// for the first failures requests, then with 200.
+func newFlakyBackend(failures int32, status int) (*httptest.Server, *int32) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= failures {
+			rw.WriteHeader(status)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	return server, &calls
+}
+
+func TestProxyRetryEnv(t *testing.T) {
+	t.Setenv("SPRAYPROXY_RETRY_COUNT", "3")
+	t.Setenv("SPRAYPROXY_RETRY_BASE_DELAY", "1s")
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if proxy.retryCount != 3 {
+		t.Errorf("expected retry count %d, got %d", 3, proxy.retryCount)
+	}
+	if proxy.retryBaseDelay != time.Second {
+		t.Errorf("expected retry base delay %s, got %s", time.Second, proxy.retryBaseDelay)
+	}
+}
+
+func TestProxyRetryOptionsOverrideEnv(t *testing.T) {
+	t.Setenv("SPRAYPROXY_RETRY_COUNT", "3")
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), nil, WithRetryCount(5), WithRetryBaseDelay(time.Millisecond))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if proxy.retryCount != 5 {
+		t.Errorf("expected retry count %d, got %d", 5, proxy.retryCount)
+	}
+	if proxy.retryBaseDelay != time.Millisecond {
+		t.Errorf("expected retry base delay %s, got %s", time.Millisecond, proxy.retryBaseDelay)
+	}
+}
+
+func TestHandleProxyRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		failures      int32
+		status        int
+		retries       int
+		expectedCalls int32
+	}{
+		{
+			name:          "5xx is retried until success",
+			failures:      2,
+			status:        http.StatusServiceUnavailable,
+			retries:       3,
+			expectedCalls: 3,
+		},
+		{
+			name:          "5xx is retried until retries are exhausted",
+			failures:      5,
+			status:        http.StatusInternalServerError,
+			retries:       2,
+			expectedCalls: 3,
+		},
+		{
+			name:          "4xx is not retried",
+			failures:      1,
+			status:        http.StatusNotFound,
+			retries:       3,
+			expectedCalls: 1,
+		},
+		{
+			name:          "no retries by default",
+			failures:      1,
+			status:        http.StatusServiceUnavailable,
+			retries:       0,
+			expectedCalls: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			backend, calls := newFlakyBackend(tc.failures, tc.status)
+			defer backend.Close()
+			proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL},
+				WithRetryCount(tc.retries), WithRetryBaseDelay(time.Millisecond))
+			if err != nil {
+				t.Fatalf("failed to set up proxy: %v", err)
+			}
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+			proxy.HandleProxy(ctx)
+			if w.Code != http.StatusOK {
+				t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+			}
+			if got := atomic.LoadInt32(calls); got != tc.expectedCalls {
+				t.Errorf("expected %d calls to the backend, got %d", tc.expectedCalls, got)
+			}
+		})
+	}
+}
+
+func TestHandleProxyRetryConnectionError(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	downURL := down.URL
+	down.Close()
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{downURL},
+		WithRetryCount(2), WithRetryBaseDelay(time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected status code %d, got %d", http.StatusBadGateway, w.Code)
+	}
+}
+
+func TestRetryBackoffRespectsTimeout(t *testing.T) {
+	backend, calls := newFlakyBackend(5, http.StatusServiceUnavailable)
+	defer backend.Close()
+	t.Setenv("SPRAYPROXY_FORWARDING_REQUEST_TIMEOUT", "200ms")
+	// the first backoff is already longer than the forwarding timeout
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL},
+		WithRetryCount(3), WithRetryBaseDelay(time.Second))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+	start := time.Now()
+	proxy.HandleProxy(ctx)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected forwarding to stop before the timeout, took %s", elapsed)
+	}
+	if got := atomic.LoadInt32(calls); got != 1 {
+		t.Errorf("expected %d calls to the backend, got %d", 1, got)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	base := 10 * time.Millisecond
+	for retry, expected := range map[int]time.Duration{
+		1: 10 * time.Millisecond,
+		2: 20 * time.Millisecond,
+		3: 40 * time.Millisecond,
+	} {
+		if got := backoff(base, retry); got != expected {
+			t.Errorf("retry %d: expected backoff %s, got %s", retry, expected, got)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// pathRegexps caches the compiled path rewrite patterns of the backends, so they are not compiled on
+// every forward. Patterns are validated on registration, the cache only grows with distinct patterns.
+var pathRegexps sync.Map
+
+// compilePathPattern returns the compiled path rewrite pattern.
+func compilePathPattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := pathRegexps.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	pathRegexps.Store(pattern, re)
+	return re, nil
+}
+
+// rewritePath rewrites the path and query of the URL forwarded to the backend, replacing every match of
+// its PathMatch pattern in the escaped path, followed by the query if any, with its PathReplace template.
+// URLs not matching the pattern, and all URLs of backends without a pattern, are left unchanged.
+func (b Backend) rewritePath(u *url.URL) error {
+	if b.PathMatch == "" {
+		return nil
+	}
+	re, err := compilePathPattern(b.PathMatch)
+	if err != nil {
+		return err
+	}
+	target := u.EscapedPath()
+	if u.RawQuery != "" {
+		target += "?" + u.RawQuery
+	}
+	if !re.MatchString(target) {
+		return nil
+	}
+	rewritten := re.ReplaceAllString(target, b.PathReplace)
+	if !strings.HasPrefix(rewritten, "/") {
+		rewritten = "/" + rewritten
+	}
+	parsed, err := url.ParseRequestURI(rewritten)
+	if err != nil {
+		return fmt.Errorf("invalid rewritten path %q: %w", rewritten, err)
+	}
+	u.Path, u.RawPath, u.RawQuery = parsed.Path, parsed.RawPath, parsed.RawQuery
+	return nil
+}
@@ -0,0 +1,66 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestRegisterPathRewrite(t *testing.T) {
+	received := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		received <- req.URL.RequestURI()
+	}))
+	defer backend.Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	for _, invalid := range []url.Values{
+		{"server": {backend.URL}, "pathMatch": {"^/(unclosed$"}, "pathReplace": {"/$1"}},
+		{"server": {backend.URL}, "pathReplace": {"/webhooks"}},
+	} {
+		if w := callBackendsHandler(proxy.Register, http.MethodPost, invalid); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d registering %v, got %d", http.StatusBadRequest, invalid, w.Code)
+		}
+	}
+	w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{
+		"server":      {backend.URL},
+		"pathMatch":   {"^/([^/]+)/([^/]+)/hook$"},
+		"pathReplace": {"/webhooks?repo=$2"},
+		"pathPrefix":  {"/api"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	for _, tc := range []struct {
+		target   string
+		expected string
+	}{
+		{target: "/org/repo/hook", expected: "/api/webhooks?repo=repo"},
+		// the query is matched along with the path, so it keeps the URL from matching here
+		{target: "/org/repo/hook?x=1", expected: "/api/org/repo/hook?x=1"},
+		{target: "/payload", expected: "/api/payload"},
+	} {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080"+tc.target, bytes.NewBufferString("hello"))
+		proxy.HandleProxy(ctx)
+		if got := <-received; got != tc.expected {
+			t.Errorf("expected %s to be forwarded to %s, got %s", tc.target, tc.expected, got)
+		}
+	}
+	if backend := proxy.BackendsDetailed()[0]; backend.PathMatch != "^/([^/]+)/([^/]+)/hook$" || backend.PathReplace != "/webhooks?repo=$2" {
+		t.Errorf("unexpected path rewrite %q to %q", backend.PathMatch, backend.PathReplace)
+	}
+}
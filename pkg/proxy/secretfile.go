@@ -0,0 +1,94 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultSecretReloadInterval is the interval the webhook secret file is read again at by default.
+const defaultSecretReloadInterval = time.Minute
+
+// secretFile caches the webhook secrets read from a file, such as a mounted Kubernetes secret or a file
+// written by a Vault agent, reading it again once the reload interval elapsed so rotated secrets are
+// picked up without a restart.
+type secretFile struct {
+	path     string
+	interval time.Duration
+	logger   *zap.Logger
+	// lock guards secrets and read, and is held while reading the file so concurrent requests share a read
+	lock    sync.Mutex
+	secrets []string
+	read    time.Time
+}
+
+// newSecretFile returns the secrets of the file, which must hold at least one.
+func newSecretFile(path string, interval time.Duration, logger *zap.Logger) (*secretFile, error) {
+	secrets, err := readSecrets(path)
+	if err != nil {
+		return nil, err
+	}
+	return &secretFile{path: path, interval: interval, logger: logger, secrets: secrets, read: time.Now()}, nil
+}
+
+// readSecrets reads the secrets of the file, one per line, to rotate them. Surrounding whitespace, such as
+// a trailing newline, is not part of the secrets.
+func readSecrets(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secrets := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			secrets = append(secrets, line)
+		}
+	}
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("no secrets in %s", path)
+	}
+	return secrets, nil
+}
+
+// get returns the current secrets, reading the file again if the reload interval elapsed. The current
+// secrets are kept if the file cannot be read, or is empty, such as while it is being rewritten.
+func (f *secretFile) get(now time.Time) []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.interval > 0 && now.Sub(f.read) >= f.interval {
+		f.read = now
+		secrets, err := readSecrets(f.path)
+		switch {
+		case err != nil:
+			f.logger.Warn("failed to reload webhook secrets, keeping the current ones: "+err.Error(), zap.String("file", f.path))
+		case !reflect.DeepEqual(secrets, f.secrets):
+			f.secrets = secrets
+			f.logger.Info(fmt.Sprintf("reloaded %d webhook secrets from %s", len(secrets), f.path))
+		}
+	}
+	return f.secrets
+}
+
+// verifiesSignatures returns true if webhook signatures are verified, with secrets set or read from a file.
+func (p *SprayProxy) verifiesSignatures() bool {
+	return p.secretFile != nil || len(p.webhookSecrets) > 0
+}
+
+// currentWebhookSecrets returns the secrets webhook signatures are verified with, the ones of the secret
+// file if set.
+func (p *SprayProxy) currentWebhookSecrets() []string {
+	if p.secretFile != nil {
+		return p.secretFile.get(time.Now())
+	}
+	return p.webhookSecrets
+}
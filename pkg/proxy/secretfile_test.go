@@ -0,0 +1,110 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestWebhookSecretFile(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	path := filepath.Join(t.TempDir(), "secret")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("failed to write secret file: %v", err)
+		}
+	}
+	write("old\n")
+	// reloaded on every request
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL}, WithWebhookSecret("env"),
+		WithWebhookSecretFile(path, time.Nanosecond))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	send := func(secret string) int {
+		body := []byte(`{"action":"opened"}`)
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBuffer(body))
+		ctx.Request.Header.Set(signatureHeader, sign(secret, body))
+		proxy.HandleProxy(ctx)
+		return w.Code
+	}
+	for _, tc := range []struct {
+		name     string
+		rewrite  bool
+		content  string
+		secret   string
+		expected int
+	}{
+		{name: "secret of the file", secret: "old", expected: http.StatusOK},
+		{name: "file takes precedence over the configured secret", secret: "env", expected: http.StatusUnauthorized},
+		{name: "rotated secret", rewrite: true, content: "new\nold\n", secret: "new", expected: http.StatusOK},
+		{name: "previous secret during rotation", secret: "old", expected: http.StatusOK},
+		{name: "previous secret removed", rewrite: true, content: "new", secret: "old", expected: http.StatusUnauthorized},
+		{name: "empty file keeps the secrets", rewrite: true, content: "", secret: "new", expected: http.StatusOK},
+	} {
+		if tc.rewrite {
+			write(tc.content)
+		}
+		if got := send(tc.secret); got != tc.expected {
+			t.Errorf("%s: expected status code %d, got %d", tc.name, tc.expected, got)
+		}
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("failed to remove secret file: %v", err)
+	}
+	if got := send("new"); got != http.StatusOK {
+		t.Errorf("expected the secrets to be kept once the file is removed, got status code %d", got)
+	}
+}
+
+func TestWebhookSecretFileEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	t.Setenv("SPRAYPROXY_WEBHOOK_SECRET_FILE", path)
+	if _, err := NewSprayProxy(false, zap.NewNop()); err == nil {
+		t.Error("expected error with a missing secret file")
+	}
+	if err := os.WriteFile(path, []byte("\n"), 0o600); err != nil {
+		t.Fatalf("failed to write secret file: %v", err)
+	}
+	if _, err := NewSprayProxy(false, zap.NewNop()); err == nil {
+		t.Error("expected error with an empty secret file")
+	}
+	if err := os.WriteFile(path, []byte("secret\n"), 0o600); err != nil {
+		t.Fatalf("failed to write secret file: %v", err)
+	}
+	for env, expected := range map[string]time.Duration{
+		"":        defaultSecretReloadInterval,
+		"10s":     10 * time.Second,
+		"0":       0,
+		"-1s":     defaultSecretReloadInterval,
+		"invalid": defaultSecretReloadInterval,
+	} {
+		t.Setenv("SPRAYPROXY_WEBHOOK_SECRET_RELOAD_INTERVAL", env)
+		proxy, err := NewSprayProxy(false, zap.NewNop())
+		if err != nil {
+			t.Fatalf("failed to set up proxy: %v", err)
+		}
+		if !reflect.DeepEqual(proxy.currentWebhookSecrets(), []string{"secret"}) {
+			t.Errorf("expected the secret of the file, got %d secrets", len(proxy.currentWebhookSecrets()))
+		}
+		if proxy.secretFile.interval != expected {
+			t.Errorf("expected reload interval %s for %q, got %s", expected, env, proxy.secretFile.interval)
+		}
+	}
+}
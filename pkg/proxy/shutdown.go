@@ -0,0 +1,100 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+)
+
+// ShutdownState is the progress of the graceful shutdown of the proxy.
+type ShutdownState struct {
+	// ShuttingDown is set once Shutdown is called
+	ShuttingDown bool `json:"shuttingDown"`
+	// InFlight is the number of requests still being forwarded, including asynchronous forwards
+	InFlight int `json:"inFlight"`
+}
+
+// Shutdown stops the proxy from accepting new requests and waits for the requests
+// being forwarded to complete, or for the context to expire.
+// Requests received after Shutdown is called are answered with 503 Service Unavailable.
+// Dead letters stored by the completed forwards are written before it returns.
+func (p *SprayProxy) Shutdown(ctx context.Context) error {
+	p.shutdownLock.Lock()
+	p.shuttingDown = true
+	p.shutdownLock.Unlock()
+	metrics.SetShuttingDown(true)
+	p.logger.Info("shutting down, waiting for in-flight forwards to complete")
+
+	done := make(chan struct{})
+	go func() {
+		p.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		p.logger.Info("all in-flight forwards completed")
+		if p.deadLetters != nil {
+			// flush the dead letters of the completed forwards
+			p.deadLetters.close()
+		}
+		return nil
+	case <-ctx.Done():
+		p.logger.Warn("in-flight forwards did not complete before shutdown: " + ctx.Err().Error())
+		return ctx.Err()
+	}
+}
+
+// beginForward registers a new in-flight forward, unless the proxy is shutting down.
+// Callers must call p.endInflight() once the forward completes if true is returned.
+func (p *SprayProxy) beginForward() bool {
+	p.shutdownLock.Lock()
+	defer p.shutdownLock.Unlock()
+	if p.shuttingDown {
+		return false
+	}
+	// adding under the lock guarantees Wait in Shutdown never races with Add
+	p.inflight.Add(1)
+	p.inflightCount++
+	metrics.SetInFlightRequestCount(p.inflightCount)
+	return true
+}
+
+// addInflight registers another in-flight forward for a request registered by beginForward, such as
+// an asynchronous forward taking over from the request. Callers must call p.endInflight() once it completes.
+func (p *SprayProxy) addInflight() {
+	p.shutdownLock.Lock()
+	defer p.shutdownLock.Unlock()
+	p.inflight.Add(1)
+	p.inflightCount++
+	metrics.SetInFlightRequestCount(p.inflightCount)
+}
+
+// endInflight marks an in-flight forward registered by beginForward or addInflight as complete.
+func (p *SprayProxy) endInflight() {
+	p.shutdownLock.Lock()
+	p.inflightCount--
+	metrics.SetInFlightRequestCount(p.inflightCount)
+	p.shutdownLock.Unlock()
+	p.inflight.Done()
+}
+
+// ShutdownProgress returns whether the proxy is shutting down, and the number of requests still being forwarded.
+func (p *SprayProxy) ShutdownProgress() ShutdownState {
+	p.shutdownLock.Lock()
+	defer p.shutdownLock.Unlock()
+	return ShutdownState{ShuttingDown: p.shuttingDown, InFlight: p.inflightCount}
+}
+
+// ShutdownStatus returns the progress of the graceful shutdown as JSON, so deployment tooling can wait
+// for the in-flight forwards to complete before killing the proxy. It is not protected by the admin
+// token, as it only reports operational status.
+func (p *SprayProxy) ShutdownStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, p.ShutdownProgress())
+}
@@ -0,0 +1,122 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+func TestShutdownDrainsInflightForwards(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics.InitMetrics(registry)
+	received := make(chan struct{})
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		close(received)
+		<-release
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop(), backend.URL)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	send := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+		proxy.HandleProxy(ctx)
+		return w
+	}
+
+	inflight := make(chan *httptest.ResponseRecorder)
+	go func() {
+		inflight <- send()
+	}()
+	<-received
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- proxy.Shutdown(context.Background())
+	}()
+	// wait for the shutdown to begin
+	for {
+		proxy.shutdownLock.Lock()
+		shuttingDown := proxy.shuttingDown
+		proxy.shutdownLock.Unlock()
+		if shuttingDown {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if w := send(); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status code %d after shutdown, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	select {
+	case <-shutdown:
+		t.Fatalf("expected shutdown to wait for the in-flight forward")
+	case <-time.After(50 * time.Millisecond):
+	}
+	status := func() string {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodGet, "http://localhost:8080/shutdown", nil)
+		proxy.ShutdownStatus(ctx)
+		return w.Body.String()
+	}
+	if got, expected := status(), `{"shuttingDown":true,"inFlight":1}`; got != expected {
+		t.Errorf("expected shutdown status %s, got %s", expected, got)
+	}
+	if got := metricValue(t, registry, "sprayproxy_in_flight_requests", ""); got != 1 {
+		t.Errorf("expected 1 request in flight, got %v", got)
+	}
+	if got := metricValue(t, registry, "sprayproxy_shutting_down", ""); got != 1 {
+		t.Errorf("expected the shutdown to be exposed, got %v", got)
+	}
+
+	close(release)
+	if w := <-inflight; w.Code != http.StatusOK {
+		t.Errorf("expected in-flight request status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("unexpected shutdown error: %v", err)
+	}
+	if got, expected := status(), `{"shuttingDown":true,"inFlight":0}`; got != expected {
+		t.Errorf("expected shutdown status %s, got %s", expected, got)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop(), backend.URL)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	if !proxy.beginForward() {
+		t.Fatalf("expected forward to begin before shutdown")
+	}
+	defer proxy.endInflight()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := proxy.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected error %v, got %v", context.DeadlineExceeded, err)
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"strings"
+)
+
+const (
+	// signatureHeader is the header GitHub uses for the HMAC-SHA256 signature of the payload
+	signatureHeader = "X-Hub-Signature-256"
+	signaturePrefix = "sha256="
+)
+
+var (
+	// ErrMissingSignature is returned by ValidateSignature when the webhook is not signed.
+	ErrMissingSignature = errors.New("missing signature")
+	// ErrMalformedSignature is returned by ValidateSignature when the signature is not a hex encoded
+	// HMAC-SHA256 prefixed with "sha256=".
+	ErrMalformedSignature = errors.New("malformed signature")
+	// ErrSignatureMismatch is returned by ValidateSignature when the signature does not match the body.
+	ErrSignatureMismatch = errors.New("signature mismatch")
+)
+
+// ValidateSignature checks the X-Hub-Signature-256 header value of a webhook against the HMAC-SHA256
+// of its raw body, computed with the given secret. It returns nil if the signature is valid, otherwise
+// ErrMissingSignature, ErrMalformedSignature or ErrSignatureMismatch.
+func ValidateSignature(secret string, body []byte, header string) error {
+	// the inbound webhooks are validated by matchingSecret as well, which never fails reading a byte slice
+	_, err := matchingSecret([]string{secret}, bytes.NewReader(body), header)
+	return err
+}
+
+// parseSignature returns the HMAC-SHA256 held by an X-Hub-Signature-256 header value.
+func parseSignature(header string) ([]byte, error) {
+	if header == "" {
+		return nil, ErrMissingSignature
+	}
+	if !strings.HasPrefix(header, signaturePrefix) {
+		return nil, ErrMalformedSignature
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(header, signaturePrefix))
+	if err != nil || len(got) != sha256.Size {
+		return nil, ErrMalformedSignature
+	}
+	return got, nil
+}
+
+// signBody returns the HMAC-SHA256 of the body, computed with the given secret.
+func signBody(secret string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// matchingSecret validates the signature against each of the secrets, so secrets can be rotated without
+// rejecting the webhooks signed with the previous one. It returns the index of the first secret the
+// signature is valid for, or the error of the validation. The body is read once whatever the number
+// of secrets, so it can be streamed, and its read errors are returned as is.
+func matchingSecret(secrets []string, body io.Reader, header string) (int, error) {
+	// missing and malformed signatures are invalid for any secret, no need to read the body
+	got, err := parseSignature(header)
+	if err != nil {
+		return -1, err
+	}
+	macs := make([]hash.Hash, 0, len(secrets))
+	writers := make([]io.Writer, 0, len(secrets))
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, []byte(secret))
+		macs = append(macs, mac)
+		writers = append(writers, mac)
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), body); err != nil {
+		return -1, err
+	}
+	for i, mac := range macs {
+		// constant time comparison, to not leak the expected signature via timing attacks
+		if hmac.Equal(got, mac.Sum(nil)) {
+			return i, nil
+		}
+	}
+	return -1, ErrSignatureMismatch
+}
+
+// invalidSignature returns true if the error is one of the signature validation errors, rather than
+// an error reading the body.
+func invalidSignature(err error) bool {
+	return errors.Is(err, ErrMissingSignature) || errors.Is(err, ErrMalformedSignature) || errors.Is(err, ErrSignatureMismatch)
+}
+
+// verifySignature returns the index of the webhook secret the buffered body of the inbound request is signed
+// with, among the given ones. If enabled, encoded bodies are decoded while reading them, but still forwarded
+// as received.
+func (p *SprayProxy) verifySignature(in *inboundRequest, secrets []string, header, encoding string) (int, error) {
+	body, err := in.openBody()
+	if err != nil {
+		return -1, err
+	}
+	if file, ok := body.(io.Closer); ok {
+		defer file.Close()
+	}
+	if p.decodeBodies {
+		if body, err = decodingReader(encoding, body, p.maxReqSize); err != nil {
+			return -1, err
+		}
+	}
+	return matchingSecret(secrets, body, header)
+}
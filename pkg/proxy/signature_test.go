@@ -0,0 +1,249 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/test"
+	"go.uber.org/zap"
+)
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestValidateSignature(t *testing.T) {
+	body := []byte(`{"action":"opened"}`)
+	for _, tc := range []struct {
+		name      string
+		signature string
+		expected  error
+	}{
+		{
+			name:      "valid signature",
+			signature: sign("secret", body),
+			expected:  nil,
+		},
+		{
+			name:      "signed with another secret",
+			signature: sign("other", body),
+			expected:  ErrSignatureMismatch,
+		},
+		{
+			name:      "missing signature",
+			signature: "",
+			expected:  ErrMissingSignature,
+		},
+		{
+			name:      "missing prefix",
+			signature: sign("secret", body)[len(signaturePrefix):],
+			expected:  ErrMalformedSignature,
+		},
+		{
+			name:      "not hex encoded",
+			signature: signaturePrefix + "not-hex",
+			expected:  ErrMalformedSignature,
+		},
+		{
+			name:      "truncated",
+			signature: sign("secret", body)[:len(signaturePrefix)+10],
+			expected:  ErrMalformedSignature,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := ValidateSignature("secret", body, tc.signature); !errors.Is(err, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestHandleProxySignature(t *testing.T) {
+	body := []byte("hello")
+	for _, tc := range []struct {
+		name           string
+		secret         string
+		signature      string
+		expectedStatus int
+	}{
+		{
+			name:           "no secret configured",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "valid signature",
+			secret:         "secret",
+			signature:      sign("secret", body),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "invalid signature",
+			secret:         "secret",
+			signature:      sign("other", body),
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "missing signature",
+			secret:         "secret",
+			expectedStatus: http.StatusUnauthorized,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("SPRAYPROXY_WEBHOOK_SECRET", tc.secret)
+			backend := test.NewTestServer()
+			defer backend.GetServer().Close()
+			proxy, err := NewSprayProxy(false, zap.NewNop(), backend.GetServer().URL)
+			if err != nil {
+				t.Fatalf("failed to set up proxy: %v", err)
+			}
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBuffer(body))
+			if tc.signature != "" {
+				ctx.Request.Header.Set(signatureHeader, tc.signature)
+			}
+			proxy.HandleProxy(ctx)
+			if w.Code != tc.expectedStatus {
+				t.Errorf("expected status code %d, got %d", tc.expectedStatus, w.Code)
+			}
+		})
+	}
+}
+
+func TestMatchingSecret(t *testing.T) {
+	body := []byte(`{"action":"opened"}`)
+	secrets := []string{"new", "old"}
+	if index, err := matchingSecret(secrets, bytes.NewReader(body), sign("old", body)); err != nil || index != 1 {
+		t.Errorf("expected the old secret to match, got %d, %v", index, err)
+	}
+	if index, err := matchingSecret(secrets, bytes.NewReader(body), sign("new", body)); err != nil || index != 0 {
+		t.Errorf("expected the new secret to match, got %d, %v", index, err)
+	}
+	if _, err := matchingSecret(secrets, bytes.NewReader(body), sign("other", body)); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("expected %v, got %v", ErrSignatureMismatch, err)
+	}
+	if _, err := matchingSecret(secrets, bytes.NewReader(body), ""); !errors.Is(err, ErrMissingSignature) {
+		t.Errorf("expected %v, got %v", ErrMissingSignature, err)
+	}
+}
+
+func TestHandleProxySignatureRotation(t *testing.T) {
+	body := []byte("hello")
+	t.Setenv("SPRAYPROXY_WEBHOOK_SECRET", "ignored")
+	t.Setenv("SPRAYPROXY_WEBHOOK_SECRETS", "new, old")
+	backend := test.NewTestServer()
+	defer backend.GetServer().Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop(), backend.GetServer().URL)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	for secret, expected := range map[string]int{
+		"new":     http.StatusOK,
+		"old":     http.StatusOK,
+		"ignored": http.StatusUnauthorized,
+	} {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBuffer(body))
+		ctx.Request.Header.Set(signatureHeader, sign(secret, body))
+		proxy.HandleProxy(ctx)
+		if w.Code != expected {
+			t.Errorf("signed with %q: expected status code %d, got %d", secret, expected, w.Code)
+		}
+	}
+}
+
+func TestHandleProxySignatureGzip(t *testing.T) {
+	payload := []byte(`{"action":"opened"}`)
+	encoded := gzipped(t, payload)
+	for _, tc := range []struct {
+		name           string
+		decode         bool
+		encoding       string
+		body           []byte
+		expectedStatus int
+	}{
+		{
+			name:           "decoded",
+			decode:         true,
+			encoding:       "gzip",
+			body:           encoded,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "not decoded",
+			encoding:       "gzip",
+			body:           encoded,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "not encoded",
+			decode:         true,
+			body:           payload,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "corrupt",
+			decode:         true,
+			encoding:       "gzip",
+			body:           payload,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "unsupported encoding",
+			decode:         true,
+			encoding:       "br",
+			body:           encoded,
+			expectedStatus: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var received []byte
+			var receivedEncoding string
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received, _ = io.ReadAll(r.Body)
+				receivedEncoding = r.Header.Get(contentEncodingHeader)
+			}))
+			defer backend.Close()
+			proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL},
+				WithWebhookSecret("secret"), WithDecodeBodies(tc.decode))
+			if err != nil {
+				t.Fatalf("failed to set up proxy: %v", err)
+			}
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBuffer(tc.body))
+			if tc.encoding != "" {
+				ctx.Request.Header.Set(contentEncodingHeader, tc.encoding)
+			}
+			// GitHub signs the payload before encoding it
+			ctx.Request.Header.Set(signatureHeader, sign("secret", payload))
+			proxy.HandleProxy(ctx)
+			if w.Code != tc.expectedStatus {
+				t.Fatalf("expected status code %d, got %d", tc.expectedStatus, w.Code)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			// the body is forwarded with its original encoding
+			if !bytes.Equal(received, tc.body) || receivedEncoding != tc.encoding {
+				t.Errorf("expected the body to be forwarded as received with encoding %q, got %q with encoding %q", tc.encoding, received, receivedEncoding)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+)
+
+// sizeUnits are the supported size suffixes, using binary multiples like maxReqSize does.
+// Longer suffixes come first so "MB" is not mistaken for "B".
+var sizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"GB", 1024 * 1024 * 1024},
+	{"MB", 1024 * 1024},
+	{"KB", 1024},
+	{"B", 1},
+}
+
+// parseSize parses a size in bytes with an optional unit, for example "512", "64KB" or "10MB".
+func parseSize(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return size * multiplier, nil
+}
+
+// countingReader counts the bytes read from a request body, so the size of rejected bodies can be reported.
+type countingReader struct {
+	io.ReadCloser
+	read int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.read += int64(n)
+	return n, err
+}
+
+// observeBodySize records the size of the inbound body, given the bytes read from it. Bodies rejected
+// for being too large are only partially read, their declared length is then used if it is known.
+func observeBodySize(in *inboundRequest, read int64) {
+	size := read
+	if in.contentLength > size {
+		size = in.contentLength
+	}
+	metrics.ObserveInboundRequestSize(size)
+}
@@ -0,0 +1,184 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/iotest"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+func TestParseSize(t *testing.T) {
+	for value, expected := range map[string]int64{
+		"512":   512,
+		"512B":  512,
+		"64KB":  64 * 1024,
+		"10MB":  10 * 1024 * 1024,
+		"10mb":  10 * 1024 * 1024,
+		" 1 GB": 1024 * 1024 * 1024,
+	} {
+		got, err := parseSize(value)
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %v", value, err)
+		}
+		if got != expected {
+			t.Errorf("expected %q to be %d bytes, got %d", value, expected, got)
+		}
+	}
+	for _, value := range []string{"", "MB", "ten MB", "-1MB", "0", "10TB"} {
+		if _, err := parseSize(value); err == nil {
+			t.Errorf("expected error parsing %q", value)
+		}
+	}
+}
+
+func TestMaxRequestSize(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		env      string
+		opts     []Option
+		expected int64
+	}{
+		{
+			name:     "default",
+			expected: defaultMaxReqSize,
+		},
+		{
+			name:     "invalid env var is ignored",
+			env:      "a lot",
+			expected: defaultMaxReqSize,
+		},
+		{
+			name:     "env var",
+			env:      "1MB",
+			expected: 1024 * 1024,
+		},
+		{
+			name:     "option overrides env var",
+			env:      "1MB",
+			opts:     []Option{WithMaxRequestSize(2048)},
+			expected: 2048,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("SPRAYPROXY_MAX_REQUEST_SIZE", tc.env)
+			proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), nil, tc.opts...)
+			if err != nil {
+				t.Fatalf("failed to set up proxy: %v", err)
+			}
+			if proxy.maxReqSize != tc.expected {
+				t.Errorf("expected max request size %d, got %d", tc.expected, proxy.maxReqSize)
+			}
+		})
+	}
+}
+
+func TestCustomMaxRequestSize(t *testing.T) {
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), nil, WithMaxRequestSize(1024), WithAllowNoBackends(true))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	for size, expected := range map[int]int{
+		1024: http.StatusOK,
+		1025: http.StatusRequestEntityTooLarge,
+	} {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBuffer(make([]byte, size)))
+		proxy.HandleProxy(ctx)
+		if w.Code != expected {
+			t.Errorf("payload of %d bytes: expected status code %d, got %d", size, expected, w.Code)
+		}
+	}
+}
+
+func TestInboundRequestSizeMetric(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics.InitMetrics(registry)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	for _, stream := range []bool{false, true} {
+		proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL}, WithMaxRequestSize(1024), WithStream(stream))
+		if err != nil {
+			t.Fatalf("failed to set up proxy: %v", err)
+		}
+		for _, size := range []int{100, 2048} {
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBuffer(make([]byte, size)))
+			// the length is unknown, so rejected bodies are measured while read
+			ctx.Request.ContentLength = -1
+			proxy.HandleProxy(ctx)
+		}
+	}
+
+	histogram := inboundSizeHistogram(t, registry)
+	if histogram.GetSampleCount() != 4 {
+		t.Errorf("expected 4 observed bodies, got %d", histogram.GetSampleCount())
+	}
+	// rejected bodies are read up to one byte past the limit
+	if expected := float64(2 * (100 + 1025)); histogram.GetSampleSum() != expected {
+		t.Errorf("expected observed sizes to sum to %v, got %v", expected, histogram.GetSampleSum())
+	}
+}
+
+func TestBodyErrorMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics.InitMetrics(registry)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	for _, stream := range []bool{false, true} {
+		proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL}, WithMaxRequestSize(1024), WithStream(stream))
+		if err != nil {
+			t.Fatalf("failed to set up proxy: %v", err)
+		}
+		for _, body := range []io.Reader{
+			// rejected on its length
+			bytes.NewBuffer(make([]byte, 2048)),
+			// rejected while read
+			io.MultiReader(bytes.NewBuffer(make([]byte, 2048))),
+			// the client hangs up while sending its body
+			io.MultiReader(bytes.NewBufferString("hel"), iotest.ErrReader(io.ErrUnexpectedEOF)),
+		} {
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", body)
+			proxy.HandleProxy(ctx)
+		}
+	}
+	if got := metricValue(t, registry, "sprayproxy_http_too_large_requests_total", ""); got != 4 {
+		t.Errorf("expected 4 requests too large, got %v", got)
+	}
+	if got := metricValue(t, registry, "sprayproxy_http_body_read_errors_total", ""); got != 2 {
+		t.Errorf("expected 2 body read errors, got %v", got)
+	}
+	if got := metricValue(t, registry, "sprayproxy_http_inbound_requests_total", ""); got != 6 {
+		t.Errorf("expected 6 inbound requests, got %v", got)
+	}
+}
+
+func inboundSizeHistogram(t *testing.T, registry *prometheus.Registry) *dto.Histogram {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() == "sprayproxy_http_inbound_request_size_bytes" {
+			return family.GetMetric()[0].GetHistogram()
+		}
+	}
+	t.Fatal("inbound request size histogram not found")
+	return nil
+}
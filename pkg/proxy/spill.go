@@ -0,0 +1,82 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+// spillFilePattern is the name pattern of the temporary files large bodies are spilled to.
+const spillFilePattern = "sprayproxy-body-*"
+
+// bufferBody reads the whole body of the inbound request, so it can be forwarded to every backend.
+// Bodies up to the spill threshold are held in memory, larger ones are written to a temporary file
+// instead, to bound the memory used by concurrent large payloads. The file must be removed with
+// removeBody once the body is no longer needed.
+func (p *SprayProxy) bufferBody(in *inboundRequest, body io.Reader) error {
+	buf := &bytes.Buffer{}
+	if p.spillThreshold <= 0 {
+		_, err := buf.ReadFrom(body)
+		in.body = buf.Bytes()
+		in.contentLength = int64(buf.Len())
+		return err
+	}
+	if _, err := buf.ReadFrom(io.LimitReader(body, p.spillThreshold+1)); err != nil {
+		return err
+	}
+	if int64(buf.Len()) <= p.spillThreshold {
+		in.body = buf.Bytes()
+		in.contentLength = int64(buf.Len())
+		return nil
+	}
+	file, err := os.CreateTemp("", spillFilePattern)
+	if err != nil {
+		return err
+	}
+	in.bodyFile = file.Name()
+	read, err := io.Copy(file, io.MultiReader(buf, body))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		p.removeBody(in)
+		return err
+	}
+	in.contentLength = read
+	return nil
+}
+
+// openBody returns a new reader of the buffered body of the inbound request. Spilled bodies are read
+// from their file, which the caller must close.
+func (in *inboundRequest) openBody() (io.Reader, error) {
+	if in.bodyFile == "" {
+		return bytes.NewReader(in.body), nil
+	}
+	return os.Open(in.bodyFile)
+}
+
+// readBody returns the buffered body of the inbound request, reading it back from disk if it was spilled.
+func (in *inboundRequest) readBody() ([]byte, error) {
+	if in.bodyFile == "" {
+		return in.body, nil
+	}
+	return os.ReadFile(in.bodyFile)
+}
+
+// removeBody removes the file the body of the inbound request was spilled to, if any.
+func (p *SprayProxy) removeBody(in *inboundRequest) {
+	if in.bodyFile == "" {
+		return
+	}
+	if err := os.Remove(in.bodyFile); err != nil {
+		p.logger.Error("failed to remove spilled body: "+err.Error(), zap.String("file", in.bodyFile), zap.String("request-id", in.requestID))
+	}
+	in.bodyFile = ""
+}
@@ -0,0 +1,170 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// spillDir redirects the temporary files to a directory of the test, and returns it.
+func spillDir(t *testing.T) string {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	return dir
+}
+
+func countFiles(t *testing.T, dir string) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read dir: %v", err)
+	}
+	return len(entries)
+}
+
+// spillBackend records the bodies it receives, along with the number of spilled files while receiving them.
+type spillBackend struct {
+	*httptest.Server
+	lock     sync.Mutex
+	failures int
+	bodies   [][]byte
+	spilled  []int
+}
+
+func newSpillBackend(t *testing.T, dir string, failures int) *spillBackend {
+	backend := &spillBackend{failures: failures}
+	backend.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		backend.lock.Lock()
+		defer backend.lock.Unlock()
+		if r.ContentLength != int64(len(body)) {
+			t.Errorf("expected Content-Length %d, got %d", len(body), r.ContentLength)
+		}
+		backend.bodies = append(backend.bodies, body)
+		backend.spilled = append(backend.spilled, countFiles(t, dir))
+		if backend.failures > 0 {
+			backend.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	return backend
+}
+
+func TestSpillLargeBodies(t *testing.T) {
+	dir := spillDir(t)
+	backend := newSpillBackend(t, dir, 1)
+	defer backend.Close()
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL},
+		WithSpillThreshold(1024), WithRetryCount(1), WithRetryBaseDelay(time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	for _, size := range []int{1024, 4096} {
+		backend.bodies, backend.spilled, backend.failures = nil, nil, 1
+		payload := bytes.Repeat([]byte("a"), size)
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBuffer(payload))
+		// the length is unknown, as with chunked requests
+		ctx.Request.ContentLength = -1
+		proxy.HandleProxy(ctx)
+		if w.Code != http.StatusOK {
+			t.Fatalf("size %d: expected status code %d, got %d", size, http.StatusOK, w.Code)
+		}
+		// the retry reads the body again
+		if len(backend.bodies) != 2 {
+			t.Fatalf("size %d: expected 2 attempts, got %d", size, len(backend.bodies))
+		}
+		expectedSpilled := 0
+		if size > 1024 {
+			expectedSpilled = 1
+		}
+		for i, body := range backend.bodies {
+			if !bytes.Equal(body, payload) {
+				t.Errorf("size %d: attempt %d received %d bytes", size, i, len(body))
+			}
+			if backend.spilled[i] != expectedSpilled {
+				t.Errorf("size %d: expected %d spilled files while forwarding, got %d", size, expectedSpilled, backend.spilled[i])
+			}
+		}
+		if n := countFiles(t, dir); n != 0 {
+			t.Errorf("size %d: expected the spilled body to be removed, got %d files", size, n)
+		}
+	}
+}
+
+func TestSpillSignedBodies(t *testing.T) {
+	dir := spillDir(t)
+	backend := newSpillBackend(t, dir, 0)
+	defer backend.Close()
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL},
+		WithSpillThreshold(16), WithWebhookSecret("secret"))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	payload := bytes.Repeat([]byte("a"), 64)
+	for signature, expected := range map[string]int{sign("secret", payload): http.StatusOK, sign("other", payload): http.StatusUnauthorized} {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBuffer(payload))
+		ctx.Request.Header.Set(signatureHeader, signature)
+		proxy.HandleProxy(ctx)
+		if w.Code != expected {
+			t.Errorf("expected status code %d, got %d", expected, w.Code)
+		}
+		if n := countFiles(t, dir); n != 0 {
+			t.Errorf("expected the spilled body to be removed, got %d files", n)
+		}
+	}
+}
+
+func TestSpillAsync(t *testing.T) {
+	dir := spillDir(t)
+	backend := newSpillBackend(t, dir, 0)
+	defer backend.Close()
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend.URL}, WithSpillThreshold(16), WithAsync(true))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBuffer(make([]byte, 64)))
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	// shutting down waits for the asynchronous forward
+	if err := proxy.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(backend.spilled) != 1 || backend.spilled[0] != 1 {
+		t.Errorf("expected the body to be forwarded from its spilled file, got %v", backend.spilled)
+	}
+	if n := countFiles(t, dir); n != 0 {
+		t.Errorf("expected the spilled body to be removed, got %d files", n)
+	}
+}
+
+func TestSpillThresholdEnv(t *testing.T) {
+	t.Setenv("SPRAYPROXY_SPILL_THRESHOLD", "1MB")
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if proxy.spillThreshold != 1024*1024 {
+		t.Errorf("expected spill threshold of 1MB, got %d", proxy.spillThreshold)
+	}
+}
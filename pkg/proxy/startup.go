@@ -0,0 +1,47 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// checkStartup probes every backend once with a health check, so misconfigured backends, such as typos in
+// their URL or firewalls dropping the connections, are reported on startup rather than on the first webhook.
+// Failed backends are logged, and returned as an error in strict mode only.
+func (p *SprayProxy) checkStartup() error {
+	backends := p.snapshotBackends()
+	results := make([]bool, len(backends))
+	var wg sync.WaitGroup
+	for i, backend := range backends {
+		wg.Add(1)
+		go func(i int, backend string, client *http.Client) {
+			defer wg.Done()
+			results[i] = p.checkBackend(client, backend)
+		}(i, backend.URL, p.backendClient(backend))
+	}
+	wg.Wait()
+	failed := []string{}
+	for i, backend := range backends {
+		if !results[i] {
+			failed = append(failed, backend.URL)
+			p.logger.Warn("backend failed the startup check", zap.String("backend", backend.URL))
+		}
+	}
+	if len(failed) == 0 {
+		p.logger.Info(fmt.Sprintf("all %d backends passed the startup check", len(backends)))
+		return nil
+	}
+	if p.strictStartup {
+		return fmt.Errorf("backends failed the startup check: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
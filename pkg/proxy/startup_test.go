@@ -0,0 +1,66 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestStartupCheck(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	logger := &recordingLogger{}
+	if _, err := NewSprayProxyWithLogger(false, logger, []string{up.URL, down.URL}, WithStartupCheck(true, false)); err != nil {
+		t.Fatalf("expected the failed backend not to fail startup, got %v", err)
+	}
+	failed := logger.find("backend failed the startup check")
+	if failed == nil || failed.level != "warn" || failed.fields["backend"] != down.URL {
+		t.Errorf("expected the failed backend to be logged, got %v", logger.entries)
+	}
+
+	_, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{up.URL, down.URL}, WithStartupCheck(false, true))
+	if err == nil || !strings.Contains(err.Error(), down.URL) || strings.Contains(err.Error(), up.URL) {
+		t.Errorf("expected the failed backend to fail startup in strict mode, got %v", err)
+	}
+	logger = &recordingLogger{}
+	if _, err := NewSprayProxyWithLogger(false, logger, []string{up.URL}, WithStartupCheck(true, true)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if logger.find("all 1 backends passed the startup check") == nil {
+		t.Errorf("expected the passed check to be logged, got %v", logger.entries)
+	}
+}
+
+func TestStartupCheckEnv(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	for _, tc := range []struct {
+		check       string
+		strict      string
+		expectError bool
+	}{
+		{},
+		{check: "true"},
+		{strict: "true", expectError: true},
+		{check: "false", strict: "true", expectError: true},
+		{strict: "invalid"},
+	} {
+		t.Setenv("SPRAYPROXY_STARTUP_CHECK", tc.check)
+		t.Setenv("SPRAYPROXY_STRICT_STARTUP", tc.strict)
+		_, err := NewSprayProxy(false, zap.NewNop(), down.URL)
+		if (err != nil) != tc.expectError {
+			t.Errorf("check %q and strict %q: expected error %v, got %v", tc.check, tc.strict, tc.expectError, err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import "io"
+
+// streamChunkSize is the size of the chunks the inbound body is copied to the backends in
+const streamChunkSize = 32 * 1024
+
+// canStream returns true if the body of a request forwarded to the given number of backends can be
+// streamed. Streaming needs no signature verification, retries, asynchronous forwarding or dead letters,
+// which all require the full body, nor coalescing, whose waiting requests do not forward their body, nor
+// paused forwarding, which does not forward it at all.
+func (p *SprayProxy) canStream(backends int) bool {
+	if backends == 0 || p.verifiesSignatures() || p.retryCount > 0 || p.async || p.deadLetters != nil || p.coalescer != nil {
+		return false
+	}
+	if p.isPaused() {
+		return false
+	}
+	return backends == 1 || p.stream
+}
+
+// teeBody copies src to n pipes, one per backend, so the body is forwarded while it is read.
+// Pipes closed by their reader are dropped, the others keep receiving the body.
+// The returned channel yields the error reading src, if any, once it has been fully copied.
+func teeBody(src io.Reader, n int) ([]*io.PipeReader, <-chan error) {
+	readers := make([]*io.PipeReader, n)
+	writers := make([]*io.PipeWriter, n)
+	for i := range readers {
+		readers[i], writers[i] = io.Pipe()
+	}
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		buf := make([]byte, streamChunkSize)
+		for {
+			read, readErr := src.Read(buf)
+			if read > 0 {
+				for i, w := range writers {
+					if w == nil {
+						continue
+					}
+					// the slowest backend sets the pace, as each chunk is written to all of them
+					if _, writeErr := w.Write(buf[:read]); writeErr != nil {
+						writers[i] = nil
+					}
+				}
+			}
+			if readErr != nil {
+				if readErr != io.EOF {
+					err = readErr
+				}
+				break
+			}
+		}
+		for _, w := range writers {
+			if w != nil {
+				// a nil error closes the pipe with io.EOF
+				w.CloseWithError(err)
+			}
+		}
+		done <- err
+	}()
+	return readers, done
+}
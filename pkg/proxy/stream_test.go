@@ -0,0 +1,138 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestHandleProxyStreamsToSingleBackend(t *testing.T) {
+	started := make(chan struct{})
+	received := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		head := make([]byte, len("hello"))
+		io.ReadFull(req.Body, head)
+		close(started)
+		rest, _ := io.ReadAll(req.Body)
+		received <- string(head) + string(rest)
+	}))
+	defer backend.Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop(), backend.URL)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	body, bodyWriter := io.Pipe()
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", body)
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		proxy.HandleProxy(ctx)
+	}()
+
+	bodyWriter.Write([]byte("hello"))
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the backend to receive the body before it is fully read")
+	}
+	bodyWriter.Write([]byte(" world"))
+	bodyWriter.Close()
+	<-handled
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if got := <-received; got != "hello world" {
+		t.Errorf("expected backend to receive %q, got %q", "hello world", got)
+	}
+}
+
+func TestHandleProxyStreamsToMultipleBackends(t *testing.T) {
+	var mu sync.Mutex
+	received := []string{}
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		mu.Lock()
+		received = append(received, string(body))
+		mu.Unlock()
+	})
+	backend1 := httptest.NewServer(handler)
+	defer backend1.Close()
+	backend2 := httptest.NewServer(handler)
+	defer backend2.Close()
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{backend1.URL, backend2.URL}, WithStream(true))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	payload := strings.Repeat("a", 3*streamChunkSize+1)
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", strings.NewReader(payload))
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if len(received) != 2 {
+		t.Fatalf("expected 2 backends to receive the body, got %d", len(received))
+	}
+	for _, body := range received {
+		if body != payload {
+			t.Errorf("expected backends to receive %d bytes, got %d", len(payload), len(body))
+		}
+	}
+}
+
+func TestCanStream(t *testing.T) {
+	for name, tc := range map[string]struct {
+		opts     []Option
+		backends int
+		expected bool
+	}{
+		"no backend":                {nil, 0, false},
+		"single backend":            {nil, 1, true},
+		"multiple backends":         {nil, 2, false},
+		"multiple backends, stream": {[]Option{WithStream(true)}, 2, true},
+		"signature verification":    {[]Option{WithWebhookSecret("secret")}, 1, false},
+		"retries":                   {[]Option{WithStream(true), WithRetryCount(1)}, 2, false},
+		"async":                     {[]Option{WithAsync(true)}, 1, false},
+		"dead letters":              {[]Option{WithDeadLetterFile(filepath.Join(t.TempDir(), "deadletters.jsonl"))}, 1, false},
+	} {
+		proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), nil, tc.opts...)
+		if err != nil {
+			t.Fatalf("failed to set up proxy: %v", err)
+		}
+		if got := proxy.canStream(tc.backends); got != tc.expected {
+			t.Errorf("%s: expected %v, got %v", name, tc.expected, got)
+		}
+	}
+}
+
+func TestTeeBodyDropsClosedReader(t *testing.T) {
+	payload := strings.Repeat("a", 2*streamChunkSize)
+	readers, done := teeBody(strings.NewReader(payload), 2)
+	readers[0].Close()
+	got, err := io.ReadAll(readers[1])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(got) != payload {
+		t.Errorf("expected %d bytes, got %d", len(payload), len(got))
+	}
+	if err := <-done; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
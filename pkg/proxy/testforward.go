@@ -0,0 +1,61 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// TestForward sends the payload with the given headers to the backend, along the forwarding path of the
+// webhooks, to validate the backend can be reached and accepts the proxy requests before registering it.
+// The payload is posted to the URL of the backend, signed with the first webhook secret unless the headers
+// already hold a signature. Neither the metrics nor the state of the proxy, such as its backends, are
+// affected. The returned error is set if the backend could not be reached, in which case the result holds
+// the error too.
+func (p *SprayProxy) TestForward(backend string, payload []byte, headers http.Header) (*BackendResult, error) {
+	server, err := normalizeBackendURL(backend)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend: %w", err)
+	}
+	target, err := parseBackendURL(server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend: %w", err)
+	}
+	header := headers.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if p.verifiesSignatures() && header.Get(signatureHeader) == "" {
+		header.Set(signatureHeader, signaturePrefix+hex.EncodeToString(signBody(p.currentWebhookSecrets()[0], payload)))
+	}
+	in := &inboundRequest{
+		method:        http.MethodPost,
+		url:           url.URL{Path: target.Path, RawPath: target.RawPath, RawQuery: target.RawQuery},
+		header:        header,
+		contentLength: int64(len(payload)),
+		body:          payload,
+		event:         header.Get(eventHeader),
+		delivery:      header.Get(deliveryHeader),
+		requestID:     uuid.New().String(),
+		ctx:           context.Background(),
+		test:          true,
+	}
+	results := p.forwardAll(in, []forwardTarget{{backend: Backend{URL: server}, url: target}}, nil, p.commonFields(in))
+	result := &results[0]
+	if result.Error != nil {
+		p.logger.Info("test forward failed: "+result.Error.Error(), zap.String("backend", server))
+		return result, result.Error
+	}
+	p.logger.Info("test forward", zap.String("backend", server), zap.Int("status", result.Status), zap.Duration("latency", result.Latency))
+	return result, nil
+}
@@ -0,0 +1,97 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+func TestTestForward(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics.InitMetrics(registry)
+	payload := []byte(`{"zen":"Keep it logically awesome."}`)
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != string(payload) {
+			t.Errorf("expected payload %q, got %q", payload, body)
+		}
+		received = r.Header
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer backend.Close()
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{}, WithWebhookSecret("secret"))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+
+	result, err := proxy.TestForward(backend.URL, payload, http.Header{"X-Github-Event": {"ping"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Host != hostOf(t, backend.URL) || result.Status != http.StatusAccepted || result.Latency <= 0 || result.Error != nil {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if received.Get("X-GitHub-Event") != "ping" {
+		t.Errorf("expected the event header to be forwarded, got %v", received)
+	}
+	if received.Get(signatureHeader) != sign("secret", payload) {
+		t.Errorf("expected the payload to be signed, got %q", received.Get(signatureHeader))
+	}
+
+	// a signature sent by the caller is kept
+	if _, err := proxy.TestForward(backend.URL, payload, http.Header{signatureHeader: {"sha256=custom"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if received.Get(signatureHeader) != "sha256=custom" {
+		t.Errorf("expected the given signature to be kept, got %q", received.Get(signatureHeader))
+	}
+
+	if len(proxy.Backends()) != 0 {
+		t.Errorf("expected the backends to be unchanged, got %v", proxy.Backends())
+	}
+	if len(proxy.LastDeliveries()) != 0 {
+		t.Errorf("expected no delivery to be recorded, got %v", proxy.LastDeliveries())
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			if metric.GetCounter().GetValue() != 0 || metric.GetHistogram().GetSampleCount() != 0 {
+				t.Errorf("expected no metric to be recorded, got %s %v", family.GetName(), metric)
+			}
+		}
+	}
+}
+
+func TestTestForwardUnreachable(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backend.Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	result, err := proxy.TestForward(backend.URL, []byte("{}"), nil)
+	if err == nil {
+		t.Fatal("expected an error forwarding to a closed backend")
+	}
+	if result == nil || result.Status != 0 || result.Error == nil {
+		t.Errorf("expected the result to hold the error, got %+v", result)
+	}
+
+	if _, err := proxy.TestForward("not a url", []byte("{}"), nil); err == nil {
+		t.Error("expected an error for an invalid backend")
+	}
+}
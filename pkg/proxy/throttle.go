@@ -0,0 +1,72 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+)
+
+// errThrottled is the error of the forwards dropped as they could not start within the forwarding timeout,
+// given the minimum interval between the forwards to their backend.
+var errThrottled = errors.New("timed out waiting for the minimum interval between forwards to the backend")
+
+// minInterval returns the minimum interval between the forwards to the backend, zero if they are not paced.
+func (b Backend) minInterval() time.Duration {
+	if interval, err := time.ParseDuration(b.MinInterval); err == nil && interval > 0 {
+		return interval
+	}
+	return 0
+}
+
+// throttle waits until the MinInterval of the backend elapsed since the start of its previous forward, so
+// bursts of webhooks to a fragile backend are paced. Forwards queue in the order they reserve their start,
+// and are dropped if it would come after the context expires, the forwarding timeout. Backends without
+// minimum interval never wait.
+func (p *SprayProxy) throttle(ctx context.Context, backend Backend, host string) error {
+	interval := backend.minInterval()
+	if interval <= 0 {
+		return nil
+	}
+	now := time.Now()
+	p.throttleLock.Lock()
+	start := p.nextForwards[backend.URL]
+	if start.Before(now) {
+		start = now
+	}
+	if deadline, ok := ctx.Deadline(); ok && start.After(deadline) {
+		p.throttleLock.Unlock()
+		metrics.IncThrottledCount(host)
+		return errThrottled
+	}
+	if p.nextForwards == nil {
+		p.nextForwards = map[string]time.Time{}
+	}
+	p.nextForwards[backend.URL] = start.Add(interval)
+	p.throttleLock.Unlock()
+
+	if wait := start.Sub(now); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			metrics.IncThrottledCount(host)
+			return errThrottled
+		}
+	}
+	return nil
+}
+
+// forgetThrottle drops the pacing of the backend, once it is unregistered.
+func (p *SprayProxy) forgetThrottle(backend string) {
+	p.throttleLock.Lock()
+	defer p.throttleLock.Unlock()
+	delete(p.nextForwards, backend)
+}
@@ -0,0 +1,119 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"github.com/redhat-appstudio/sprayproxy/test"
+	"go.uber.org/zap"
+)
+
+func TestRegisterMinInterval(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics.InitMetrics(registry)
+	var lock sync.Mutex
+	received := []time.Time{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		received = append(received, time.Now())
+	}))
+	defer backend.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer other.Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop(), other.URL)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	for _, invalid := range []string{"0", "-1s", "often"} {
+		w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {backend.URL}, "minInterval": {invalid}})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d for minInterval %q, got %d", http.StatusBadRequest, invalid, w.Code)
+		}
+	}
+	// three forwards fit within the timeout, the fourth one is dropped
+	w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {backend.URL}, "minInterval": {"200ms"}, "timeout": {"500ms"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	codes := make(chan int, 4)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+			proxy.HandleProxy(ctx)
+			codes <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+	if counts[http.StatusOK] != 3 || counts[http.StatusBadGateway] != 1 {
+		t.Errorf("expected 3 paced forwards and 1 dropped, got %v", counts)
+	}
+	if got := metricValue(t, registry, "sprayproxy_http_throttled_requests_total", hostOf(t, backend.URL)); got != 1 {
+		t.Errorf("expected 1 throttled forward, got %v", got)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	sort.Slice(received, func(i, j int) bool { return received[i].Before(received[j]) })
+	for i := 1; i < len(received); i++ {
+		// allow for the scheduling of the goroutines
+		if gap := received[i].Sub(received[i-1]); gap < 150*time.Millisecond {
+			t.Errorf("expected the forwards to be paced, got %s between forwards", gap)
+		}
+	}
+}
+
+func TestMinIntervalTrial(t *testing.T) {
+	backend := test.NewTestServer()
+	defer backend.GetServer().Close()
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), nil, WithCircuitBreaker(1, time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	server := backend.GetServer().URL
+	callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {server}, "minInterval": {"1s"}, "timeout": {"100ms"}})
+	proxy.recordForward(hostOf(t, server), false)
+	time.Sleep(time.Millisecond)
+	forward := func() int {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+		proxy.HandleProxy(ctx)
+		return w.Code
+	}
+	// the trial of the half-open circuit is dropped, its turn coming after its timeout
+	proxy.throttleLock.Lock()
+	proxy.nextForwards = map[string]time.Time{server: time.Now().Add(time.Second)}
+	proxy.throttleLock.Unlock()
+	if code := forward(); code != http.StatusBadGateway {
+		t.Errorf("expected status %d for the throttled trial, got %d", http.StatusBadGateway, code)
+	}
+	proxy.forgetThrottle(server)
+	if code := forward(); code != http.StatusOK {
+		t.Errorf("expected a new trial once the previous one was throttled, got %d", code)
+	}
+}
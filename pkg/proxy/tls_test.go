@@ -0,0 +1,332 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// writeCAFile writes the certificate of the TLS test server to a PEM file.
+func writeCAFile(t *testing.T, server *httptest.Server) string {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("failed to write CA file: %v", err)
+	}
+	return path
+}
+
+func TestHandleProxyBackendCA(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	caFile := writeCAFile(t, backend)
+
+	for _, tc := range []struct {
+		name           string
+		caFile         string
+		insecureTLS    bool
+		expectedStatus int
+	}{
+		{
+			name:           "no CA configured",
+			expectedStatus: http.StatusBadGateway,
+		},
+		{
+			name:           "CA configured",
+			caFile:         caFile,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "insecure TLS without CA",
+			insecureTLS:    true,
+			expectedStatus: http.StatusOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("SPRAYPROXY_BACKEND_CA_FILE", tc.caFile)
+			proxy, err := NewSprayProxy(tc.insecureTLS, zap.NewNop(), backend.URL)
+			if err != nil {
+				t.Fatalf("failed to set up proxy: %v", err)
+			}
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+			proxy.HandleProxy(ctx)
+			if w.Code != tc.expectedStatus {
+				t.Errorf("expected status code %d, got %d", tc.expectedStatus, w.Code)
+			}
+		})
+	}
+}
+
+func TestBackendCAInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("failed to write CA file: %v", err)
+	}
+	t.Setenv("SPRAYPROXY_BACKEND_CA_FILE", path)
+	if _, err := NewSprayProxy(false, zap.NewNop()); err == nil {
+		t.Errorf("expected error loading an invalid CA file")
+	}
+}
+
+// writeClientCert generates a self-signed client certificate, writes it and its key to PEM files,
+// and returns their paths along with a pool trusting the certificate.
+func writeClientCert(t *testing.T) (string, string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sprayproxy"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed to write certificate file: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestHandleProxyClientCert(t *testing.T) {
+	certFile, keyFile, clientCAs := writeClientCert(t)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	backend.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	// the test server logs failed handshakes
+	backend.Config.ErrorLog = log.New(io.Discard, "", 0)
+	backend.StartTLS()
+	defer backend.Close()
+	t.Setenv("SPRAYPROXY_BACKEND_CA_FILE", writeCAFile(t, backend))
+
+	for _, tc := range []struct {
+		name           string
+		certFile       string
+		keyFile        string
+		expectedStatus int
+	}{
+		{
+			name:           "no client certificate",
+			expectedStatus: http.StatusBadGateway,
+		},
+		{
+			name:           "client certificate",
+			certFile:       certFile,
+			keyFile:        keyFile,
+			expectedStatus: http.StatusOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("SPRAYPROXY_CLIENT_CERT_FILE", tc.certFile)
+			t.Setenv("SPRAYPROXY_CLIENT_KEY_FILE", tc.keyFile)
+			proxy, err := NewSprayProxy(false, zap.NewNop(), backend.URL)
+			if err != nil {
+				t.Fatalf("failed to set up proxy: %v", err)
+			}
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+			proxy.HandleProxy(ctx)
+			if w.Code != tc.expectedStatus {
+				t.Errorf("expected status code %d, got %d", tc.expectedStatus, w.Code)
+			}
+		})
+	}
+}
+
+func TestClientCertMissingKey(t *testing.T) {
+	certFile, _, _ := writeClientCert(t)
+	t.Setenv("SPRAYPROXY_CLIENT_CERT_FILE", certFile)
+	if _, err := NewSprayProxy(false, zap.NewNop()); err == nil {
+		t.Error("expected error without client key file")
+	}
+}
+
+func TestHandleProxyInsecureBackend(t *testing.T) {
+	newBackend := func(received *int32) *httptest.Server {
+		backend := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(received, 1)
+		}))
+		// the test server logs failed handshakes
+		backend.Config.ErrorLog = log.New(io.Discard, "", 0)
+		backend.StartTLS()
+		return backend
+	}
+	var internalRequests, externalRequests int32
+	internal, external := newBackend(&internalRequests), newBackend(&externalRequests)
+	defer internal.Close()
+	defer external.Close()
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{}, WithHealthChecks(time.Minute, "/health", 1))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {internal.URL}, "insecure": {"maybe"}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {internal.URL}, "insecure": {"true"}})
+	callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {external.URL}})
+	w = callBackendsHandler(proxy.List, http.MethodGet, nil)
+	if expected := internal.URL + " (insecure)\n" + external.URL; w.Body.String() != expected {
+		t.Errorf("expected list %q, got %q", expected, w.Body.String())
+	}
+
+	// the certificate of the external backend is still verified
+	w = httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected status code %d, got %d", http.StatusBadGateway, w.Code)
+	}
+	if got := atomic.LoadInt32(&internalRequests); got != 1 {
+		t.Errorf("expected the insecure backend to receive the request, got %d requests", got)
+	}
+	if got := atomic.LoadInt32(&externalRequests); got != 0 {
+		t.Errorf("expected the verified backend not to receive the request, got %d requests", got)
+	}
+
+	proxy.checkBackends(0)
+	health := proxy.BackendHealth()
+	if !health[internal.URL] || health[external.URL] {
+		t.Errorf("expected only the insecure backend to pass health checks, got %v", health)
+	}
+}
+
+func TestHandleProxyServerName(t *testing.T) {
+	serverNames := make(chan string, 1)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	backend.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverNames <- hello.ServerName
+			return nil, nil
+		},
+	}
+	backend.Config.ErrorLog = log.New(io.Discard, "", 0)
+	backend.StartTLS()
+	defer backend.Close()
+	t.Setenv("SPRAYPROXY_BACKEND_CA_FILE", writeCAFile(t, backend))
+
+	for _, tc := range []struct {
+		name               string
+		params             url.Values
+		expectedStatus     int
+		expectedServerName string
+	}{
+		{
+			// the certificate of the test server is valid for example.com
+			name:               "matching server name",
+			params:             url.Values{"serverName": {"example.com"}},
+			expectedStatus:     http.StatusOK,
+			expectedServerName: "example.com",
+		},
+		{
+			name:               "sni alias",
+			params:             url.Values{"sni": {"example.com"}},
+			expectedStatus:     http.StatusOK,
+			expectedServerName: "example.com",
+		},
+		{
+			name:               "mismatched server name",
+			params:             url.Values{"serverName": {"backend.example.org"}},
+			expectedStatus:     http.StatusBadGateway,
+			expectedServerName: "backend.example.org",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			proxy, err := NewSprayProxy(false, zap.NewNop())
+			if err != nil {
+				t.Fatalf("failed to set up proxy: %v", err)
+			}
+			tc.params.Set("server", backend.URL)
+			if w := callBackendsHandler(proxy.Register, http.MethodPost, tc.params); w.Code != http.StatusOK {
+				t.Fatalf("failed to register backend: %d %s", w.Code, w.Body.String())
+			}
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+			proxy.HandleProxy(ctx)
+			if w.Code != tc.expectedStatus {
+				t.Errorf("expected status code %d, got %d", tc.expectedStatus, w.Code)
+			}
+			if got := <-serverNames; got != tc.expectedServerName {
+				t.Errorf("expected server name %q to be sent, got %q", tc.expectedServerName, got)
+			}
+		})
+	}
+}
+
+func TestRegisterInvalidServerName(t *testing.T) {
+	proxy, err := NewSprayProxy(false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	for _, serverName := range []string{"bad_name", "10.0.0.1", "-example.com", "example..com", "example.com."} {
+		w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {"https://10.0.0.1"}, "serverName": {serverName}})
+		if w.Code != http.StatusBadRequest || w.Body.String() != "invalid serverName, expected a hostname" {
+			t.Errorf("expected server name %q to be rejected, got %d %q", serverName, w.Code, w.Body.String())
+		}
+	}
+	if got := proxy.Backends(); len(got) != 0 {
+		t.Errorf("expected no backends to be registered, got %v", got)
+	}
+}
@@ -0,0 +1,54 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// latencyKey records the time spent forwarding to a backend, including retries
+const latencyKey = attribute.Key("sprayproxy.forward.latency_ms")
+
+// startInboundSpan starts the span of an inbound request, continuing the trace of the sender if any.
+func (p *SprayProxy) startInboundSpan(c *gin.Context) trace.Span {
+	ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+	_, span := tracing.Tracer().Start(ctx, "proxy "+c.Request.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("github.event", c.GetHeader(eventHeader))))
+	return span
+}
+
+// startForwardSpan starts the span of the forward to a backend, child of the inbound request span.
+func (p *SprayProxy) startForwardSpan(ctx context.Context, host string) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, "forward "+host,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.NetPeerNameKey.String(host)))
+}
+
+// endForwardSpan records the result of the forward to a backend and ends its span.
+func endForwardSpan(span trace.Span, result BackendResult, latency time.Duration) {
+	span.SetAttributes(latencyKey.Int64(latency.Milliseconds()))
+	if result.Error != nil {
+		span.RecordError(result.Error)
+		span.SetStatus(codes.Error, result.Error.Error())
+	} else {
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(result.Status))
+		if result.Status >= 500 {
+			span.SetStatus(codes.Error, "")
+		}
+	}
+	span.End()
+}
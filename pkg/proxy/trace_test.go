@@ -0,0 +1,114 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// recordSpans sets up a global tracer provider recording all spans, until the test ends.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	})
+	return recorder
+}
+
+func TestHandleProxyTracing(t *testing.T) {
+	recorder := recordSpans(t)
+	t.Setenv("SPRAYPROXY_TRACING", "true")
+	traceparents := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		traceparents <- req.Header.Get("traceparent")
+		rw.WriteHeader(http.StatusAccepted)
+	}))
+	defer backend.Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop(), backend.URL)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+	inboundTraceparent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	ctx.Request.Header.Set("traceparent", inboundTraceparent)
+	proxy.HandleProxy(ctx)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected %d spans, got %d", 2, len(spans))
+	}
+	// the forward span ends first
+	forward, inbound := spans[0], spans[1]
+	if inbound.SpanKind() != trace.SpanKindServer || forward.SpanKind() != trace.SpanKindClient {
+		t.Errorf("unexpected span kinds %v and %v", inbound.SpanKind(), forward.SpanKind())
+	}
+	if got := inbound.Parent().SpanID().String(); got != "b7ad6b7169203331" {
+		t.Errorf("expected the inbound span to continue the sender trace, got parent %s", got)
+	}
+	if forward.Parent().SpanID() != inbound.SpanContext().SpanID() {
+		t.Error("expected the forward span to be a child of the inbound span")
+	}
+	host := strings.TrimPrefix(backend.URL, "http://")
+	attributes := map[string]bool{}
+	for _, attr := range forward.Attributes() {
+		switch attr.Key {
+		case semconv.NetPeerNameKey:
+			attributes[string(attr.Key)] = attr.Value.AsString() == host
+		case semconv.HTTPStatusCodeKey:
+			attributes[string(attr.Key)] = attr.Value.AsInt64() == http.StatusAccepted
+		case latencyKey:
+			attributes[string(attr.Key)] = true
+		}
+	}
+	if len(attributes) != 3 {
+		t.Errorf("expected host, status and latency attributes, got %v", forward.Attributes())
+	}
+	for key, ok := range attributes {
+		if !ok {
+			t.Errorf("unexpected value of attribute %s", key)
+		}
+	}
+	expected := "00-" + forward.SpanContext().TraceID().String() + "-" + forward.SpanContext().SpanID().String() + "-01"
+	if got := <-traceparents; got != expected {
+		t.Errorf("expected traceparent %q, got %q", expected, got)
+	}
+}
+
+func TestHandleProxyTracingDisabled(t *testing.T) {
+	recorder := recordSpans(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer backend.Close()
+	proxy, err := NewSprayProxy(false, zap.NewNop(), backend.URL)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+	proxy.HandleProxy(ctx)
+	if spans := recorder.Ended(); len(spans) != 0 {
+		t.Errorf("expected no spans with tracing disabled, got %d", len(spans))
+	}
+}
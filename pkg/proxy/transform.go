@@ -0,0 +1,132 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// legacySignatureHeader is the header GitHub uses for the HMAC-SHA1 signature of the payload
+const legacySignatureHeader = "X-Hub-Signature"
+
+// parseStripPaths parses a comma separated list of the dot separated paths of JSON fields, such as
+// "pull_request.body".
+func parseStripPaths(list string) ([]string, error) {
+	paths := splitList(list)
+	for _, path := range paths {
+		for _, key := range strings.Split(path, ".") {
+			if key == "" {
+				return nil, fmt.Errorf("invalid strip path %q", path)
+			}
+		}
+	}
+	return paths, nil
+}
+
+// hasTransform returns true if any of the targets transforms the body of the requests.
+func hasTransform(targets []forwardTarget) bool {
+	for _, target := range targets {
+		if len(target.backend.StripFields) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// transformBody returns the body of the inbound request as forwarded to the backend, without the fields
+// the backend strips. It returns nil if the body is forwarded unchanged, such as when it is not JSON or
+// has none of the fields.
+func (p *SprayProxy) transformBody(in *inboundRequest, backend Backend, zapBackendFields []zapcore.Field) []byte {
+	if len(backend.StripFields) == 0 {
+		return nil
+	}
+	body, err := in.readBody()
+	if err != nil {
+		p.logger.Error("failed to read request body, forwarding it unchanged: "+err.Error(), zapBackendFields...)
+		return nil
+	}
+	transformed, ok := stripJSONFields(body, backend.StripFields)
+	if !ok {
+		return nil
+	}
+	p.logger.Debug("stripped fields from request body", append(zapBackendFields, zap.Strings("fields", backend.StripFields))...)
+	return transformed
+}
+
+// stripJSONFields returns the JSON body without the fields at the given paths. Paths going through arrays
+// strip the field from each of their elements. It returns false if the body is not JSON or none of the
+// fields were found.
+func stripJSONFields(body []byte, paths []string) ([]byte, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	// keep numbers as is, instead of converting them to floats
+	decoder.UseNumber()
+	var payload interface{}
+	if err := decoder.Decode(&payload); err != nil || decoder.More() {
+		return nil, false
+	}
+	stripped := false
+	for _, path := range paths {
+		if stripField(payload, strings.Split(path, ".")) {
+			stripped = true
+		}
+	}
+	if !stripped {
+		return nil, false
+	}
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	// the payload is not meant for HTML, keep it as close to the original as possible
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(payload); err != nil {
+		return nil, false
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), true
+}
+
+// stripField removes the field at the path from the value, returning true if it was found.
+func stripField(value interface{}, path []string) bool {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		field, ok := value[path[0]]
+		if !ok {
+			return false
+		}
+		if len(path) == 1 {
+			delete(value, path[0])
+			return true
+		}
+		return stripField(field, path[1:])
+	case []interface{}:
+		stripped := false
+		for _, element := range value {
+			if stripField(element, path) {
+				stripped = true
+			}
+		}
+		return stripped
+	}
+	return false
+}
+
+// signTransformed replaces the signatures of the inbound request, which no longer match the transformed
+// body, with one signed by the secret the inbound signature was verified with. The signatures are removed
+// if the proxy did not verify it.
+func signTransformed(header http.Header, in *inboundRequest, body []byte) {
+	header.Del(legacySignatureHeader)
+	if in.secret == "" {
+		header.Del(signatureHeader)
+		return
+	}
+	header.Set(signatureHeader, signaturePrefix+hex.EncodeToString(signBody(in.secret, body)))
+}
@@ -0,0 +1,133 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestStripJSONFields(t *testing.T) {
+	for name, tc := range map[string]struct {
+		body     string
+		paths    []string
+		expected string
+		stripped bool
+	}{
+		"nested field": {
+			body:     `{"action":"opened","pull_request":{"number":1,"body":"secret <b>notes</b>"}}`,
+			paths:    []string{"pull_request.body"},
+			expected: `{"action":"opened","pull_request":{"number":1}}`,
+			stripped: true,
+		},
+		"field of array elements": {
+			body:     `{"commits":[{"id":"a","message":"one"},{"id":"b"},{"id":"c","message":"three"}]}`,
+			paths:    []string{"commits.message"},
+			expected: `{"commits":[{"id":"a"},{"id":"b"},{"id":"c"}]}`,
+			stripped: true,
+		},
+		"large numbers are kept": {
+			body:     `{"id":12345678901234567890,"body":"x"}`,
+			paths:    []string{"body", "missing"},
+			expected: `{"id":12345678901234567890}`,
+			stripped: true,
+		},
+		"missing field": {
+			body:  `{"action":"opened"}`,
+			paths: []string{"pull_request.body"},
+		},
+		"not JSON": {
+			body:  `payload=%7B%7D`,
+			paths: []string{"payload"},
+		},
+		"trailing data": {
+			body:  `{"body":"x"} {"body":"y"}`,
+			paths: []string{"body"},
+		},
+	} {
+		got, ok := stripJSONFields([]byte(tc.body), tc.paths)
+		if ok != tc.stripped {
+			t.Errorf("%s: expected stripped to be %v, got %v", name, tc.stripped, ok)
+			continue
+		}
+		if ok && string(got) != tc.expected {
+			t.Errorf("%s: expected body %s, got %s", name, tc.expected, got)
+		}
+	}
+}
+
+func TestParseStripPaths(t *testing.T) {
+	paths, err := parseStripPaths("pull_request.body, commits.message")
+	if err != nil || len(paths) != 2 || paths[1] != "commits.message" {
+		t.Errorf("unexpected paths %v, %v", paths, err)
+	}
+	for _, list := range []string{"pull_request.", ".body", "a..b"} {
+		if _, err := parseStripPaths(list); err == nil {
+			t.Errorf("expected %q to be invalid", list)
+		}
+	}
+}
+
+func TestHandleProxyStripFields(t *testing.T) {
+	type received struct {
+		body      string
+		signature string
+	}
+	newBackend := func(requests chan<- received) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			body, _ := io.ReadAll(req.Body)
+			requests <- received{body: string(body), signature: req.Header.Get(signatureHeader)}
+		}))
+	}
+	strippedRequests := make(chan received, 1)
+	stripped := newBackend(strippedRequests)
+	defer stripped.Close()
+	intactRequests := make(chan received, 1)
+	intact := newBackend(intactRequests)
+	defer intact.Close()
+	secret := "s3cr3t"
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{intact.URL}, WithWebhookSecret(secret))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {stripped.URL}, "strip": {"pull_request..body"}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code %d for an invalid path, got %d", http.StatusBadRequest, w.Code)
+	}
+	w = callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {stripped.URL}, "strip": {"pull_request.body"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	body := `{"pull_request":{"number":1,"body":"private"}}`
+	w = httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString(body))
+	ctx.Request.Header.Set(signatureHeader, sign(secret, []byte(body)))
+	ctx.Request.Header.Set(legacySignatureHeader, "sha1=deadbeef")
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	got := <-strippedRequests
+	if expected := `{"pull_request":{"number":1}}`; got.body != expected {
+		t.Errorf("expected stripped body %s, got %s", expected, got.body)
+	}
+	if got.signature != sign(secret, []byte(got.body)) {
+		t.Errorf("expected the stripped body to be signed again, got %q", got.signature)
+	}
+	got = <-intactRequests
+	if got.body != body || got.signature != sign(secret, []byte(body)) {
+		t.Errorf("expected the other backend to receive the original payload, got %+v", got)
+	}
+}
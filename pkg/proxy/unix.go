@@ -0,0 +1,88 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+// unixScheme is the scheme of the backends listening on a Unix domain socket, such as
+// "unix:///var/run/hook.sock". Requests are sent to them over cleartext HTTP.
+const unixScheme = "unix"
+
+// unixSockets maps the placeholder hosts of Unix socket backends to the path of their socket, so the
+// transports dial the socket instead of resolving the host. Hosts only depend on the socket path, so
+// the mapping is shared by all proxies.
+var unixSockets sync.Map
+
+// normalizeUnixSocketURL normalizes the URL of a Unix socket backend, which holds the absolute path of
+// the socket and no host.
+func normalizeUnixSocketURL(u *url.URL) (string, error) {
+	if u.Host != "" || !path.IsAbs(u.Path) {
+		return "", errors.New("invalid unix socket, expected unix:///path/to/socket")
+	}
+	return unixScheme + "://" + path.Clean(u.Path), nil
+}
+
+// unixSocketHost returns the placeholder host of the requests sent to the Unix socket: the name of the
+// socket, as logged and labeling metrics, along with a hash of its path so sockets of the same name in
+// different directories do not share connections.
+func unixSocketHost(socket string) string {
+	h := fnv.New64a()
+	h.Write([]byte(socket))
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' || r == '.' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(path.Base(socket)))
+	return fmt.Sprintf("%s-%016x", strings.Trim(name, "-."), h.Sum64())
+}
+
+// parseBackendURL parses the URL of a backend into the URL its requests are sent to. Unix socket backends
+// are sent requests to a placeholder host, which their socket is dialed for.
+func parseBackendURL(backend string) (*url.URL, error) {
+	u, err := url.Parse(backend)
+	if err != nil || u.Scheme != unixScheme {
+		return u, err
+	}
+	host := unixSocketHost(u.Path)
+	unixSockets.Store(host, u.Path)
+	return &url.URL{Scheme: "http", Host: host}, nil
+}
+
+// unixSocket returns the path of the socket of the placeholder host, if it is the host of a Unix socket backend.
+func unixSocket(host string) (string, bool) {
+	socket, ok := unixSockets.Load(host)
+	if !ok {
+		return "", false
+	}
+	return socket.(string), true
+}
+
+// dialBackend returns the dial function of the transports, dialing the socket of Unix socket backends
+// and the address of the others.
+func dialBackend(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			if socket, ok := unixSocket(host); ok {
+				// the local address of TCP connections does not apply to sockets
+				unixDialer := *dialer
+				unixDialer.LocalAddr = nil
+				return unixDialer.DialContext(ctx, "unix", socket)
+			}
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// newUnixSocketServer starts a test server listening on a Unix socket, and returns the path of the socket.
+func newUnixSocketServer(t *testing.T, handler http.Handler) string {
+	socket := filepath.Join(t.TempDir(), "hook.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", socket, err)
+	}
+	server := &httptest.Server{Listener: listener, Config: &http.Server{Handler: handler}}
+	server.Start()
+	t.Cleanup(server.Close)
+	return socket
+}
+
+func TestHandleProxyUnixSocket(t *testing.T) {
+	type received struct {
+		path string
+		body string
+	}
+	requests := make(chan received, 1)
+	socket := newUnixSocketServer(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/healthz" {
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		requests <- received{path: req.URL.Path, body: string(body)}
+	}))
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), nil, WithHealthChecks(time.Minute, "/healthz", 1))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := callBackendsHandler(proxy.Register, http.MethodPost, url.Values{"server": {"unix://" + socket + "/"}, "pathPrefix": {"/hooks"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("failed to register backend: %d %s", w.Code, w.Body.String())
+	}
+	if got := proxy.Backends(); len(got) != 1 || got[0] != "unix://"+socket {
+		t.Errorf("expected the socket backend to be registered, got %v", got)
+	}
+
+	w = httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080/", bytes.NewBufferString("hello"))
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if got := <-requests; got.path != "/hooks/" || got.body != "hello" {
+		t.Errorf("expected the request to be forwarded over the socket, got %+v", got)
+	}
+
+	proxy.checkBackends(0)
+	if health := proxy.BackendHealth(); !health["unix://"+socket] {
+		t.Errorf("expected the socket backend to pass health checks, got %v", health)
+	}
+	result, err := proxy.TestForward("unix://"+socket, []byte("test"), nil)
+	if err != nil || result.Status != http.StatusOK {
+		t.Errorf("expected the test forward to reach the socket, got %+v, %v", result, err)
+	}
+	<-requests
+}
+
+func TestNormalizeUnixSocketURL(t *testing.T) {
+	for backend, expected := range map[string]string{
+		"unix:///var/run/hook.sock":        "unix:///var/run/hook.sock",
+		"unix:///var/run/../run/hook.sock": "unix:///var/run/hook.sock",
+		"unix://localhost/var/hook.sock":   "",
+		"unix:hook.sock":                   "",
+		"unix://":                          "",
+	} {
+		got, err := normalizeBackendURL(backend)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", backend, got)
+			}
+			continue
+		}
+		if err != nil || got != expected {
+			t.Errorf("%s: expected %q, got %q, %v", backend, expected, got, err)
+		}
+	}
+}
+
+func TestUnixSocketHost(t *testing.T) {
+	host := unixSocketHost("/var/run/Hook.sock")
+	if host != unixSocketHost("/var/run/Hook.sock") {
+		t.Error("expected the host of a socket to be stable")
+	}
+	if host == unixSocketHost("/tmp/Hook.sock") {
+		t.Error("expected sockets of the same name to have their own host")
+	}
+	if backendURL, err := parseBackendURL("unix:///var/run/Hook.sock"); err != nil || backendURL.Scheme != "http" || backendURL.Host != host {
+		t.Errorf("expected an http URL to host %s, got %v, %v", host, backendURL, err)
+	}
+	if socket, ok := unixSocket(host); !ok || socket != "/var/run/Hook.sock" {
+		t.Errorf("expected the socket of host %s, got %q", host, socket)
+	}
+}
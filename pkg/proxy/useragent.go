@@ -0,0 +1,70 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/version"
+)
+
+// UserAgentMode decides the User-Agent of the requests forwarded to the backends.
+type UserAgentMode string
+
+const (
+	// UserAgentKeep forwards the User-Agent of the inbound request unchanged.
+	UserAgentKeep UserAgentMode = "keep"
+	// UserAgentAppend identifies the proxy in the User-Agent, followed by the one of the inbound request,
+	// such as "sprayproxy/v0.1.0 (via GitHub-Hookshot/abc1234)".
+	UserAgentAppend UserAgentMode = "append"
+	// UserAgentReplace replaces the User-Agent of the inbound request with the one of the proxy.
+	UserAgentReplace UserAgentMode = "replace"
+)
+
+// parseUserAgentMode parses the name of a user agent mode, case insensitively.
+func parseUserAgentMode(name string) (UserAgentMode, bool) {
+	switch mode := UserAgentMode(strings.ToLower(strings.TrimSpace(name))); mode {
+	case UserAgentKeep, UserAgentAppend, UserAgentReplace:
+		return mode, true
+	}
+	return "", false
+}
+
+// forwardedUserAgent returns the User-Agent of the requests forwarded for an inbound request with the given
+// one, according to the mode.
+func (mode UserAgentMode) forwardedUserAgent(inbound string) string {
+	proxy := "sprayproxy/" + version.Version
+	switch {
+	case mode == UserAgentReplace || (mode == UserAgentAppend && inbound == ""):
+		return proxy
+	case mode == UserAgentAppend:
+		return proxy + " (via " + inbound + ")"
+	default:
+		return inbound
+	}
+}
+
+// RequireUserAgent is a gin middleware rejecting the requests whose User-Agent does not start with the
+// required prefix of the proxy, if set, with 403 Forbidden. GitHub webhooks are sent with a User-Agent
+// starting with "GitHub-Hookshot/", so the check cheaply filters out scanners before requests are read
+// and forwarded. The User-Agent is set by the client, so this is not a replacement for signatures.
+func (p *SprayProxy) RequireUserAgent(c *gin.Context) {
+	if p.userAgentPrefix == "" {
+		return
+	}
+	userAgent := c.Request.UserAgent()
+	if strings.HasPrefix(userAgent, p.userAgentPrefix) {
+		return
+	}
+	p.logger.Debug("rejecting request with unexpected user agent", zap.String("request-id", c.GetString("requestId")),
+		zap.String("user-agent", userAgent), zap.String("client", c.Request.RemoteAddr))
+	p.respondError(c, http.StatusForbidden, errorCodeInvalidUserAgent, "unexpected user agent")
+	c.Abort()
+}
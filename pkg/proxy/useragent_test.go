@@ -0,0 +1,101 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestRequireUserAgent(t *testing.T) {
+	var calls int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer backend.Close()
+	t.Setenv("SPRAYPROXY_REQUIRE_UA_PREFIX", "GitHub-Hookshot/")
+	proxy, err := NewSprayProxy(false, zap.NewNop(), backend.URL)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	router := gin.New()
+	router.POST("/", proxy.RequireUserAgent, proxy.HandleProxy)
+
+	for userAgent, expected := range map[string]int{
+		"GitHub-Hookshot/044aadd": http.StatusOK,
+		"curl/7.88.1":             http.StatusForbidden,
+		"github-hookshot/044aadd": http.StatusForbidden,
+		"":                        http.StatusForbidden,
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/", bytes.NewBufferString("hello"))
+		req.Header.Set("User-Agent", userAgent)
+		router.ServeHTTP(w, req)
+		if w.Code != expected {
+			t.Errorf("user agent %q: expected status code %d, got %d", userAgent, expected, w.Code)
+		}
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("expected %d forwarded requests, got %d", 1, got)
+	}
+}
+
+func TestRequireUserAgentDisabled(t *testing.T) {
+	proxy, err := NewSprayProxyWithOptions(false, zap.NewNop(), []string{}, WithAllowNoBackends(true),
+		WithRequiredUserAgentPrefix(""))
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	router := gin.New()
+	router.POST("/", proxy.RequireUserAgent, proxy.HandleProxy)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/", bytes.NewBufferString("hello"))
+	req.Header.Set("User-Agent", "curl/7.88.1")
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d without a required prefix, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestForwardedUserAgent(t *testing.T) {
+	userAgents := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents <- r.UserAgent()
+	}))
+	defer backend.Close()
+	for _, tc := range []struct {
+		env       string
+		userAgent string
+		expected  string
+	}{
+		{env: "", userAgent: "GitHub-Hookshot/044aadd", expected: "GitHub-Hookshot/044aadd"},
+		{env: "invalid", userAgent: "GitHub-Hookshot/044aadd", expected: "GitHub-Hookshot/044aadd"},
+		{env: "keep", userAgent: "GitHub-Hookshot/044aadd", expected: "GitHub-Hookshot/044aadd"},
+		{env: "Append", userAgent: "GitHub-Hookshot/044aadd", expected: "sprayproxy/dev (via GitHub-Hookshot/044aadd)"},
+		{env: "append", userAgent: "", expected: "sprayproxy/dev"},
+		{env: "replace", userAgent: "GitHub-Hookshot/044aadd", expected: "sprayproxy/dev"},
+	} {
+		t.Setenv("SPRAYPROXY_FORWARDED_USER_AGENT", tc.env)
+		proxy, err := NewSprayProxy(false, zap.NewNop(), backend.URL)
+		if err != nil {
+			t.Fatalf("failed to set up proxy: %v", err)
+		}
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+		ctx.Request.Header.Set("User-Agent", tc.userAgent)
+		proxy.HandleProxy(ctx)
+		if got := <-userAgents; got != tc.expected {
+			t.Errorf("mode %q and user agent %q: expected %q forwarded, got %q", tc.env, tc.userAgent, tc.expected, got)
+		}
+	}
+}
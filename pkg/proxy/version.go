@@ -0,0 +1,19 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/version"
+)
+
+// Version returns the version, commit and Go version the proxy was built with, as JSON.
+func (p *SprayProxy) Version(c *gin.Context) {
+	c.JSON(http.StatusOK, version.Get())
+}
@@ -6,9 +6,13 @@ SPDX-License-Identifier: Apache-2.0
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	ginzap "github.com/gin-contrib/zap"
 	"github.com/gin-gonic/gin"
@@ -22,10 +26,14 @@ import (
 var zapLogger *zap.Logger
 
 type SprayProxyServer struct {
-	server *gin.Engine
-	proxy  *proxy.SprayProxy
-	host   string
-	port   int
+	server     *gin.Engine
+	httpServer *http.Server
+	proxy      *proxy.SprayProxy
+	host       string
+	port       int
+	// shutdownDone is closed once the first call to Shutdown completes
+	shutdownDone chan struct{}
+	shutdownOnce sync.Once
 }
 
 func init() {
@@ -55,34 +63,79 @@ func NewServer(host string, port int, insecureSkipTLS bool, backends ...string)
 		}),
 	}))
 	r.Use(ginzap.RecoveryWithZap(zapLogger, true))
-	r.GET("/", handleHealthz)
-	r.POST("/", sprayProxy.HandleProxy)
-	r.GET("/healthz", handleHealthz)
+	r.GET("/", sprayProxy.Healthz)
+	r.POST("/", sprayProxy.RequireUserAgent, sprayProxy.RateLimit, sprayProxy.HandleProxy)
+	r.GET("/healthz", sprayProxy.Healthz)
+	r.GET("/readyz", sprayProxy.Readyz)
+	r.GET("/shutdown", sprayProxy.ShutdownStatus)
+	r.GET("/version", sprayProxy.Version)
+	r.POST("/pause", sprayProxy.Pause)
+	r.POST("/resume", sprayProxy.Resume)
+	r.GET("/debug", sprayProxy.Config)
+	r.GET("/backends", sprayProxy.List)
+	r.POST("/backends", sprayProxy.Register)
+	r.DELETE("/backends", sprayProxy.Unregister)
+	r.PUT("/backends", sprayProxy.Set)
+	r.POST("/backends/reload", sprayProxy.Reload)
+	r.POST("/backends/drain", sprayProxy.Drain)
+	r.GET("/backends/deliveries", sprayProxy.ListDeliveries)
+	r.GET("/backends/errors", sprayProxy.ListErrors)
+	r.NoRoute(sprayProxy.NotFoundHandler)
 	return &SprayProxyServer{
 		server: r,
-		proxy:  sprayProxy,
-		host:   host,
-		port:   port,
+		httpServer: &http.Server{
+			Addr:    fmt.Sprintf("%s:%d", host, port),
+			Handler: r,
+			// lets the proxy interrupt the reads of the bodies of slow clients
+			ConnContext: proxy.ConnContext,
+		},
+		proxy:        sprayProxy,
+		host:         host,
+		port:         port,
+		shutdownDone: make(chan struct{}),
 	}, nil
 }
 
 // Run launches the proxy server with the pre-configured hostname and address.
+// If the server is stopped by Shutdown, Run returns once the shutdown completes.
 func (s *SprayProxyServer) Run() error {
-	address := fmt.Sprintf("%s:%d", s.host, s.port)
-	zapLogger.Info(fmt.Sprintf("Running spray proxy on %s", address))
+	zapLogger.Info(fmt.Sprintf("Running spray proxy on %s", s.httpServer.Addr))
 	zapLogger.Info(fmt.Sprintf("Forwarding traffic to %s", strings.Join(s.proxy.Backends(), ",")))
 	if s.proxy.InsecureSkipTLSVerify() {
 		zapLogger.Warn("Skipping TLS verification on backends")
 	}
 	defer zapLogger.Sync()
-	return s.server.Run(address)
+	err := s.httpServer.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		<-s.shutdownDone
+		return nil
+	}
+	return err
+}
+
+// Shutdown gracefully stops the server: new webhooks are rejected while the in-flight
+// forwards complete, then the server stops listening. It gives up when the context expires.
+// It can be called more than once, such as by both a signal and a context cancellation.
+func (s *SprayProxyServer) Shutdown(ctx context.Context) error {
+	defer s.shutdownOnce.Do(func() { close(s.shutdownDone) })
+	proxyErr := s.proxy.Shutdown(ctx)
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		return err
+	}
+	return proxyErr
+}
+
+// RunHealthChecks runs the health checks of the proxy backends until stopCh is closed.
+func (s *SprayProxyServer) RunHealthChecks(stopCh <-chan struct{}) {
+	s.proxy.RunHealthChecks(stopCh)
+}
+
+// OldestForwardAge returns the time since the oldest forward of the proxy in flight started.
+func (s *SprayProxyServer) OldestForwardAge() time.Duration {
+	return s.proxy.OldestForwardAge()
 }
 
 // Handler returns the http.Handler interface for the proxy server.
 func (s *SprayProxyServer) Handler() http.Handler {
 	return s.server
 }
-
-func handleHealthz(c *gin.Context) {
-	c.String(http.StatusOK, "healthy")
-}
@@ -7,6 +7,8 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -14,9 +16,12 @@ import (
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/version"
 )
 
 func TestServerRootPost(t *testing.T) {
+	t.Setenv("SPRAYPROXY_ALLOW_NO_BACKENDS", "true")
 	// override default logger with a nop one
 	zapLogger = zap.NewNop()
 	server, err := NewServer("localhost", 8080, false)
@@ -46,6 +51,40 @@ func TestServerHealthz(t *testing.T) {
 	}
 }
 
+func TestServerReadyz(t *testing.T) {
+	// override default logger with a nop one
+	zapLogger = zap.NewNop()
+	server, err := NewServer("localhost", 8080, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/readyz", nil)
+	server.Handler().ServeHTTP(w, req)
+	// not ready without any backend to forward to
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status code %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+}
+
+func TestServerNotFound(t *testing.T) {
+	// override default logger with a nop one
+	zapLogger = zap.NewNop()
+	server, err := NewServer("localhost", 8080, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/unknown", nil)
+	server.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status code %d, got %d", http.StatusNotFound, w.Code)
+	}
+	if w.Body.String() != "not found" {
+		t.Errorf("expected response %q, got %q", "not found", w.Body.String())
+	}
+}
+
 func TestServerAccessLog(t *testing.T) {
 	var buff bytes.Buffer
 	config := zap.NewProductionConfig()
@@ -86,3 +125,39 @@ func TestServerAccessLog(t *testing.T) {
 		}
 	})
 }
+
+func TestServerVersion(t *testing.T) {
+	// override default logger with a nop one
+	zapLogger = zap.NewNop()
+	server, err := NewServer("localhost", 8080, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/version", nil)
+	server.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	info := version.Info{}
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("failed to parse version %q: %v", w.Body.String(), err)
+	}
+	if info != version.Get() {
+		t.Errorf("expected version %+v, got %+v", version.Get(), info)
+	}
+}
+
+func TestServerShutdownTwice(t *testing.T) {
+	// override default logger with a nop one
+	zapLogger = zap.NewNop()
+	server, err := NewServer("localhost", 8080, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := server.Shutdown(context.Background()); err != nil {
+			t.Errorf("unexpected error shutting down: %v", err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package tracing
+
+import (
+	"context"
+	"os"
+	"strconv"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName  = "github.com/redhat-appstudio/sprayproxy"
+	serviceName = "sprayproxy"
+)
+
+// Enabled returns true if tracing is enabled by the SPRAYPROXY_TRACING env var.
+func Enabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("SPRAYPROXY_TRACING"))
+	return enabled
+}
+
+// Init sets up the global tracer provider, exporting spans over OTLP/HTTP, and the W3C trace context
+// propagator. The exporter is configured by the standard OTEL_EXPORTER_OTLP_* env vars.
+// The returned function flushes and stops the exporter.
+func Init(ctx context.Context) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer of the proxy.
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
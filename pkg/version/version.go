@@ -0,0 +1,32 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package version
+
+import "runtime"
+
+// Version and Commit identify the build. They are set at build time with ldflags, for example:
+//
+//	go build -ldflags "-X github.com/redhat-appstudio/sprayproxy/pkg/version.Version=v0.1.0"
+var (
+	Version = "dev"
+	Commit  = "unknown"
+)
+
+// Info is the build information of the running proxy.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	GoVersion string `json:"goVersion"`
+}
+
+// Get returns the build information of the running proxy.
+func Get() Info {
+	return Info{
+		Version:   Version,
+		Commit:    Commit,
+		GoVersion: runtime.Version(),
+	}
+}